@@ -0,0 +1,296 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package admin serves an optional HTTP admin API for a running processor: health, stats, the stored
+// resume point, pause/resume, seek, browsing quarantined events and the Grafana dashboard.
+// Every endpoint except /healthz requires the configured bearer token.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/mmtracker/mongowatch"
+	"github.com/mmtracker/mongowatch/metrics"
+	"github.com/mmtracker/mongowatch/stream"
+)
+
+// ErrNoToken is returned when the server is configured without a bearer token
+var ErrNoToken = errors.New("admin server requires a bearer token")
+
+// Processor is the processor controlled by the admin server, implemented by stream.DocumentProcessor
+type Processor interface {
+	Stats() stream.ProcessorStats
+	ResumePoint() (*mongowatch.ChangeStreamResumePoint, error)
+	DescribeResumePoint(ctx context.Context) (*mongowatch.ResumePointInfo, error)
+	Pause()
+	Resume()
+	Seek(ctx context.Context, pos mongowatch.StartPosition) error
+	Checkpoint(ctx context.Context) (mongowatch.ResumeToken, error)
+}
+
+var _ Processor = stream.DocumentProcessor{}
+
+// Config configures the admin server
+type Config struct {
+	// Addr is the listen address, e.g. ":8081"
+	Addr string
+	// Token is the bearer token clients must send in the Authorization header
+	Token     string
+	Processor Processor
+	// Quarantine enables /quarantine when set
+	Quarantine stream.QuarantineBrowser
+	// MaxLag fails /healthz once the lag of the stored resume point exceeds it, zero disables the check
+	MaxLag time.Duration
+}
+
+// Server is the admin HTTP server
+type Server struct {
+	cfg Config
+	mux *http.ServeMux
+}
+
+// NewServer creates the admin server
+func NewServer(cfg Config) (*Server, error) {
+	if cfg.Token == "" {
+		return nil, ErrNoToken
+	}
+	s := &Server{cfg: cfg, mux: http.NewServeMux()}
+	s.mux.HandleFunc("/healthz", s.method(http.MethodGet, s.health))
+	s.mux.HandleFunc("/stats", s.authorized(s.method(http.MethodGet, s.stats)))
+	s.mux.HandleFunc("/resume-point", s.authorized(s.method(http.MethodGet, s.resumePoint)))
+	s.mux.HandleFunc("/pause", s.authorized(s.method(http.MethodPost, s.pause)))
+	s.mux.HandleFunc("/resume", s.authorized(s.method(http.MethodPost, s.resume)))
+	s.mux.HandleFunc("/seek", s.authorized(s.method(http.MethodPost, s.seek)))
+	s.mux.HandleFunc("/checkpoint", s.authorized(s.method(http.MethodPost, s.checkpoint)))
+	s.mux.HandleFunc("/quarantine", s.authorized(s.method(http.MethodGet, s.quarantine)))
+	s.mux.HandleFunc("/dashboard", s.authorized(s.method(http.MethodGet, s.dashboard)))
+	return s, nil
+}
+
+// Handler returns the admin API handler, e.g. to mount it on an existing server
+func (s *Server) Handler() http.Handler {
+	return s.mux
+}
+
+// ListenAndServe serves the admin API until ctx is done
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	srv := &http.Server{Addr: s.cfg.Addr, Handler: s.mux, ReadHeaderTimeout: 10 * time.Second}
+
+	errCh := make(chan error, 1)
+	go func() {
+		log.Infof("admin server listening on %s", s.cfg.Addr)
+		errCh <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("admin server failed: %w", err)
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return srv.Shutdown(shutdownCtx)
+	}
+}
+
+func (s *Server) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *Server) method(method string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// health reports 200 while the processor runs and keeps up, for liveness and readiness probes
+func (s *Server) health(w http.ResponseWriter, r *http.Request) {
+	stats := s.cfg.Processor.Stats()
+	status := http.StatusOK
+	if !stats.Running {
+		status = http.StatusServiceUnavailable
+	}
+	body := map[string]interface{}{"running": stats.Running, "paused": stats.Paused}
+
+	if s.cfg.MaxLag > 0 {
+		info, err := s.cfg.Processor.DescribeResumePoint(r.Context())
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			// nothing processed yet
+		case err != nil:
+			status = http.StatusServiceUnavailable
+			body["error"] = err.Error()
+		default:
+			body["lag"] = info.Lag.String()
+			if info.Lag > s.cfg.MaxLag {
+				status = http.StatusServiceUnavailable
+			}
+		}
+	}
+	writeJSON(w, status, body)
+}
+
+func (s *Server) stats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.cfg.Processor.Stats())
+}
+
+func (s *Server) dashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(metrics.Dashboard())
+}
+
+func (s *Server) resumePoint(w http.ResponseWriter, r *http.Request) {
+	point, err := s.cfg.Processor.ResumePoint()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeError(w, http.StatusNotFound, errors.New("no resume point stored"))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if r.URL.Query().Get("describe") != "" {
+		info := point.Describe(time.Now())
+		writeJSON(w, http.StatusOK, info)
+		return
+	}
+	writeJSON(w, http.StatusOK, point)
+}
+
+func (s *Server) pause(w http.ResponseWriter, r *http.Request) {
+	s.cfg.Processor.Pause()
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": true})
+}
+
+func (s *Server) resume(w http.ResponseWriter, r *http.Request) {
+	s.cfg.Processor.Resume()
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": false})
+}
+
+// seekRequest positions the stream at a resume token or a cluster time
+type seekRequest struct {
+	Token     string               `json:"token"`
+	Timestamp *primitive.Timestamp `json:"timestamp"`
+}
+
+func (s *Server) seek(w http.ResponseWriter, r *http.Request) {
+	var req seekRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid seek request: %w", err))
+		return
+	}
+
+	pos := mongowatch.StartPosition{Timestamp: req.Timestamp}
+	if req.Token != "" {
+		pos.Token = &mongowatch.ResumeToken{TokenData: req.Token}
+	}
+	if _, err := pos.ResumePoint(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := s.cfg.Processor.Seek(r.Context(), pos); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, req)
+}
+
+func (s *Server) checkpoint(w http.ResponseWriter, r *http.Request) {
+	token, err := s.cfg.Processor.Checkpoint(r.Context())
+	if errors.Is(err, stream.ErrNoCheckpoint) {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"token": token.TokenData})
+}
+
+func (s *Server) quarantine(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.Quarantine == nil {
+		writeError(w, http.StatusNotFound, errors.New("quarantine is not configured"))
+		return
+	}
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	limit, err := queryInt(r, "limit", 50)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	records, err := s.cfg.Quarantine.ListQuarantined(r.Context(), offset, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+func queryInt(r *http.Request, name string, def int64) (int64, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return def, nil
+	}
+	v, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, raw)
+	}
+	return v, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("admin server failed to write response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,184 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/mmtracker/mongowatch"
+	"github.com/mmtracker/mongowatch/metrics"
+	"github.com/mmtracker/mongowatch/stream"
+)
+
+type fakeProcessor struct {
+	paused bool
+	seeks  []mongowatch.StartPosition
+	point  *mongowatch.ChangeStreamResumePoint
+}
+
+func (p *fakeProcessor) Checkpoint(ctx context.Context) (mongowatch.ResumeToken, error) {
+	if p.point == nil {
+		return mongowatch.ResumeToken{}, stream.ErrNoCheckpoint
+	}
+	return p.point.ID, nil
+}
+
+func (p *fakeProcessor) Stats() stream.ProcessorStats {
+	return stream.ProcessorStats{Stats: stream.Stats{Processed: 7}, Running: true, Paused: p.paused}
+}
+
+func (p *fakeProcessor) ResumePoint() (*mongowatch.ChangeStreamResumePoint, error) {
+	if p.point == nil {
+		return nil, mongo.ErrNoDocuments
+	}
+	return p.point, nil
+}
+
+func (p *fakeProcessor) DescribeResumePoint(ctx context.Context) (*mongowatch.ResumePointInfo, error) {
+	point, err := p.ResumePoint()
+	if err != nil {
+		return nil, err
+	}
+	info := point.Describe(time.Now())
+	return &info, nil
+}
+
+func (p *fakeProcessor) Pause()  { p.paused = true }
+func (p *fakeProcessor) Resume() { p.paused = false }
+
+func (p *fakeProcessor) Seek(ctx context.Context, pos mongowatch.StartPosition) error {
+	p.seeks = append(p.seeks, pos)
+	return nil
+}
+
+type fakeQuarantine []stream.QuarantineRecord
+
+func (q fakeQuarantine) ListQuarantined(ctx context.Context, offset, limit int64) ([]stream.QuarantineRecord, error) {
+	return q[offset:], nil
+}
+
+func newTestServer(t *testing.T, processor *fakeProcessor) http.Handler {
+	srv, err := NewServer(Config{
+		Token:      "secret",
+		Processor:  processor,
+		Quarantine: fakeQuarantine{{Reason: "poison"}, {Reason: "invalid"}},
+	})
+	require.NoError(t, err)
+	return srv.Handler()
+}
+
+func do(h http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestServerRequiresToken(t *testing.T) {
+	_, err := NewServer(Config{})
+	assert.ErrorIs(t, err, ErrNoToken)
+
+	h := newTestServer(t, &fakeProcessor{})
+	assert.Equal(t, http.StatusUnauthorized, do(h, http.MethodGet, "/stats", "", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, do(h, http.MethodGet, "/stats", "wrong", "").Code)
+	assert.Equal(t, http.StatusOK, do(h, http.MethodGet, "/stats", "secret", "").Code)
+	// probes don't carry the token
+	assert.Equal(t, http.StatusOK, do(h, http.MethodGet, "/healthz", "", "").Code)
+}
+
+func TestServerEndpoints(t *testing.T) {
+	processor := &fakeProcessor{}
+	h := newTestServer(t, processor)
+
+	rec := do(h, http.MethodGet, "/stats", "secret", "")
+	var stats stream.ProcessorStats
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &stats))
+	assert.Equal(t, uint64(7), stats.Processed)
+
+	assert.Equal(t, http.StatusNotFound, do(h, http.MethodGet, "/resume-point", "secret", "").Code)
+
+	rec = do(h, http.MethodGet, "/dashboard", "secret", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, string(metrics.Dashboard()), rec.Body.String())
+
+	assert.Equal(t, http.StatusMethodNotAllowed, do(h, http.MethodGet, "/pause", "secret", "").Code)
+	assert.Equal(t, http.StatusOK, do(h, http.MethodPost, "/pause", "secret", "").Code)
+	assert.True(t, processor.paused)
+	assert.Equal(t, http.StatusOK, do(h, http.MethodPost, "/resume", "secret", "").Code)
+	assert.False(t, processor.paused)
+
+	assert.Equal(t, http.StatusBadRequest, do(h, http.MethodPost, "/seek", "secret", `{}`).Code)
+	assert.Equal(t, http.StatusOK, do(h, http.MethodPost, "/seek", "secret", `{"timestamp":{"T":10,"I":2}}`).Code)
+	assert.Equal(t, http.StatusOK, do(h, http.MethodPost, "/seek", "secret", `{"token":"8264"}`).Code)
+	require.Len(t, processor.seeks, 2)
+	assert.Equal(t, &primitive.Timestamp{T: 10, I: 2}, processor.seeks[0].Timestamp)
+	assert.Equal(t, "8264", processor.seeks[1].Token.TokenData)
+
+	assert.Equal(t, http.StatusConflict, do(h, http.MethodPost, "/checkpoint", "secret", "").Code)
+	processor.point = &mongowatch.ChangeStreamResumePoint{ID: mongowatch.ResumeToken{TokenData: "82aa"}}
+	rec = do(h, http.MethodPost, "/checkpoint", "secret", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"token":"82aa"}`, rec.Body.String())
+
+	rec = do(h, http.MethodGet, "/quarantine?offset=1", "secret", "")
+	var records []stream.QuarantineRecord
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &records))
+	require.Len(t, records, 1)
+	assert.Equal(t, "invalid", records[0].Reason)
+	assert.Equal(t, http.StatusBadRequest, do(h, http.MethodGet, "/quarantine?limit=-1", "secret", "").Code)
+}
+
+func TestServerHealthLag(t *testing.T) {
+	happened := time.Now().Add(-time.Hour).Truncate(time.Second)
+	processor := &fakeProcessor{}
+	srv, err := NewServer(Config{Token: "secret", Processor: processor, MaxLag: time.Minute})
+	require.NoError(t, err)
+	h := srv.Handler()
+
+	// nothing stored yet
+	assert.Equal(t, http.StatusOK, do(h, http.MethodGet, "/healthz", "", "").Code)
+
+	processor.point = &mongowatch.ChangeStreamResumePoint{
+		Timestamp: primitive.Timestamp{T: uint32(happened.Unix())},
+		StoredAt:  happened.Add(time.Second),
+	}
+	assert.Equal(t, http.StatusOK, do(h, http.MethodGet, "/healthz", "", "").Code)
+
+	processor.point.StoredAt = happened.Add(2 * time.Minute)
+	assert.Equal(t, http.StatusServiceUnavailable, do(h, http.MethodGet, "/healthz", "", "").Code)
+
+	rec := do(h, http.MethodGet, "/resume-point?describe=1", "secret", "")
+	var info mongowatch.ResumePointInfo
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &info))
+	assert.Equal(t, 2*time.Minute, info.Lag)
+	assert.GreaterOrEqual(t, info.TokenAge, time.Hour)
+}
@@ -0,0 +1,218 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Command mongowatch-gen generates a typed mongowatch.CollectionWatcher for a struct.
+//
+// Usage, next to the struct declaration:
+//
+//	//go:generate go run github.com/mmtracker/mongowatch/cmd/mongowatch-gen -type Device -id Serial
+//
+// The generated <Type>Watcher decodes the JSON payloads with the mapper package and calls the
+// Insert<Type>/Update<Type>/Delete<Type> methods of a <Type>Handler. With -id the mongo "_id"
+// is mapped onto the given field, so the struct itself doesn't need a mongowatch:"_id" tag.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+func main() {
+	typeName := flag.String("type", "", "struct type to generate a watcher for (required)")
+	idField := flag.String("id", "", "struct field the mongo _id is mapped onto")
+	output := flag.String("output", "", "output file, defaults to <type>_watcher_gen.go")
+	dir := flag.String("dir", ".", "package directory")
+	flag.Parse()
+
+	if *typeName == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *output == "" {
+		*output = strings.ToLower(*typeName) + "_watcher_gen.go"
+	}
+
+	src, err := generate(*dir, *typeName, *idField)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mongowatch-gen: %v\n", err)
+		os.Exit(1)
+	}
+	if err = os.WriteFile(filepath.Join(*dir, *output), src, 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "mongowatch-gen: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+type templateData struct {
+	Package string
+	Type    string
+	IDField string
+}
+
+// generate finds the struct in the package at dir and renders the watcher source
+func generate(dir, typeName, idField string) ([]byte, error) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(info os.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse package: %w", err)
+	}
+
+	for name, pkg := range pkgs {
+		st := findStruct(pkg, typeName)
+		if st == nil {
+			continue
+		}
+		if idField != "" && !hasField(st, idField) {
+			return nil, fmt.Errorf("struct %s has no field %s", typeName, idField)
+		}
+		return render(templateData{Package: name, Type: typeName, IDField: idField})
+	}
+
+	return nil, fmt.Errorf("struct %s not found in %s", typeName, dir)
+}
+
+func findStruct(pkg *ast.Package, typeName string) *ast.StructType {
+	for _, file := range pkg.Files {
+		for _, decl := range file.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				ts := spec.(*ast.TypeSpec)
+				if st, ok := ts.Type.(*ast.StructType); ok && ts.Name.Name == typeName {
+					return st
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func hasField(st *ast.StructType, name string) bool {
+	for _, field := range st.Fields.List {
+		for _, ident := range field.Names {
+			if ident.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func render(data templateData) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := watcherTemplate.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to format generated code: %w", err)
+	}
+	return src, nil
+}
+
+var watcherTemplate = template.Must(template.New("watcher").Parse(`// Code generated by mongowatch-gen. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mmtracker/mongowatch"
+	"github.com/mmtracker/mongowatch/mapper"
+)
+
+// {{.Type}}Handler handles decoded {{.Type}} changes
+type {{.Type}}Handler interface {
+	Insert{{.Type}}(ctx context.Context, doc {{.Type}}) error
+	Update{{.Type}}(ctx context.Context, doc {{.Type}}) error
+	Delete{{.Type}}(ctx context.Context, doc {{.Type}}) error
+}
+
+// {{.Type}}Watcher adapts a {{.Type}}Handler to mongowatch.CollectionWatcher
+type {{.Type}}Watcher struct {
+	handler {{.Type}}Handler
+}
+
+var _ mongowatch.CollectionWatcher = (*{{.Type}}Watcher)(nil)
+
+// New{{.Type}}Watcher creates a typed {{.Type}} watcher
+func New{{.Type}}Watcher(handler {{.Type}}Handler) *{{.Type}}Watcher {
+	return &{{.Type}}Watcher{handler: handler}
+}
+
+// Insert decodes the inserted {{.Type}}
+func (w *{{.Type}}Watcher) Insert(ctx context.Context, doc []byte) error {
+	v, err := decode{{.Type}}(doc)
+	if err != nil {
+		return err
+	}
+	return w.handler.Insert{{.Type}}(ctx, v)
+}
+
+// Update decodes the updated {{.Type}}
+func (w *{{.Type}}Watcher) Update(ctx context.Context, doc []byte) error {
+	v, err := decode{{.Type}}(doc)
+	if err != nil {
+		return err
+	}
+	return w.handler.Update{{.Type}}(ctx, v)
+}
+
+// Delete decodes the deleted {{.Type}}
+func (w *{{.Type}}Watcher) Delete(ctx context.Context, doc []byte) error {
+	v, err := decode{{.Type}}(doc)
+	if err != nil {
+		return err
+	}
+	return w.handler.Delete{{.Type}}(ctx, v)
+}
+
+func decode{{.Type}}(doc []byte) ({{.Type}}, error) {
+{{- if .IDField}}
+	// the wrapper maps mongo's "_id" onto {{.Type}}.{{.IDField}}
+	var wrapper struct {
+		{{.Type}}
+		MongoID string ` + "`mongowatch:\"_id\"`" + `
+	}
+	if err := mapper.DecodeJSON(doc, &wrapper); err != nil {
+		return {{.Type}}{}, fmt.Errorf("failed to decode {{.Type}}: %w", err)
+	}
+	wrapper.{{.Type}}.{{.IDField}} = wrapper.MongoID
+	return wrapper.{{.Type}}, nil
+{{- else}}
+	var v {{.Type}}
+	if err := mapper.DecodeJSON(doc, &v); err != nil {
+		return v, fmt.Errorf("failed to decode {{.Type}}: %w", err)
+	}
+	return v, nil
+{{- end}}
+}
+`))
@@ -0,0 +1,55 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// exampleDir holds the Device fixture and its checked in watcher, the golden file of the generator
+const exampleDir = "../../examples/watchers"
+
+func TestGenerate_Golden(t *testing.T) {
+	src, err := generate(exampleDir, "Device", "Serial")
+	require.NoError(t, err)
+
+	golden, err := os.ReadFile(exampleDir + "/device_watcher_gen.go")
+	require.NoError(t, err)
+	assert.Equal(t, string(golden), string(src), "generated watcher changed, run go generate ./examples/watchers")
+}
+
+func TestGenerate_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		typ     string
+		id      string
+		wantErr string
+	}{
+		{name: "unknown type", typ: "Sensor", wantErr: "struct Sensor not found"},
+		{name: "unknown id field", typ: "Device", id: "Code", wantErr: "struct Device has no field Code"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := generate(exampleDir, tt.typ, tt.id)
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mmtracker/mongowatch/db"
+	"github.com/mmtracker/mongowatch/stream"
+)
+
+type consumersFlags struct {
+	uri        string
+	db         string
+	collection string
+	stale      time.Duration
+}
+
+func parseConsumersFlags(args []string) (consumersFlags, error) {
+	var f consumersFlags
+	fs := flag.NewFlagSet("consumers", flag.ContinueOnError)
+	fs.StringVar(&f.uri, "uri", "mongodb://localhost:27017", "local MongoDB connection string")
+	fs.StringVar(&f.db, "db", "", "local database holding the registry")
+	fs.StringVar(&f.collection, "collection", "mongowatch_consumers", "registry collection")
+	fs.DurationVar(&f.stale, "stale", time.Minute, "hide consumers without a heartbeat for this long, 0 shows all")
+	if err := fs.Parse(args); err != nil {
+		return f, err
+	}
+	if f.db == "" {
+		return f, fmt.Errorf("-db is required")
+	}
+	return f, nil
+}
+
+func runConsumers(args []string) error {
+	f, err := parseConsumersFlags(args)
+	if err != nil {
+		return err
+	}
+
+	registry := stream.NewConsumerRegistry(stream.NewCollection(f.collection, db.ConnectToMongo(f.db, f.uri)))
+	consumers, err := registry.ListConsumers(context.Background(), f.stale)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "GROUP\tTARGET\tHOST\tPID\tSTARTED\tHEARTBEAT\tTIMESTAMP")
+	for _, c := range consumers {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s ago\t%d.%d\n",
+			c.Group,
+			c.Target,
+			c.Host,
+			c.PID,
+			c.StartedAt.Format(time.RFC3339),
+			time.Since(c.HeartbeatAt).Round(time.Second),
+			c.Timestamp.T,
+			c.Timestamp.I,
+		)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,43 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mmtracker/mongowatch/metrics"
+)
+
+func runDashboard(args []string) error {
+	fs := flag.NewFlagSet("dashboard", flag.ContinueOnError)
+	out := fs.String("o", "", "write the dashboard to this file instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *out == "" {
+		_, err := os.Stdout.Write(metrics.Dashboard())
+		return err
+	}
+	if err := os.WriteFile(*out, metrics.Dashboard(), 0o644); err != nil {
+		return fmt.Errorf("failed to write dashboard: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Command mongowatch is an operator tool for inspecting mongowatch deployments
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"consumers":         {usage: "list running consumers from the registry", run: runConsumers},
+	"dashboard":         {usage: "print the Grafana dashboard for the pushed metrics", run: runDashboard},
+	"resume-collection": {usage: "print the resume collection name of a processor", run: runResumeCollection},
+	"resume-point":      {usage: "describe the stored resume point of a processor", run: runResumePoint},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	if err := cmd.run(os.Args[2:]); err != nil {
+		// the flag set already printed the usage
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		fmt.Fprintf(os.Stderr, "mongowatch %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: mongowatch <command> [flags]")
+	fmt.Fprintln(os.Stderr, "commands:")
+	for name, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", name, cmd.usage)
+	}
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"flag"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mmtracker/mongowatch/stream"
+)
+
+func TestCommands(t *testing.T) {
+	for _, name := range []string{"consumers", "dashboard", "resume-collection", "resume-point"} {
+		_, ok := commands[name]
+		assert.True(t, ok, name)
+	}
+	_, ok := commands["unknown"]
+	assert.False(t, ok)
+}
+
+func TestParseConsumersFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    consumersFlags
+		wantErr string
+	}{
+		{
+			name: "defaults",
+			args: []string{"-db", "local"},
+			want: consumersFlags{uri: "mongodb://localhost:27017", db: "local", collection: "mongowatch_consumers", stale: time.Minute},
+		},
+		{
+			name: "all flags",
+			args: []string{"-uri", "mongodb://h:1", "-db", "local", "-collection", "registry", "-stale", "0"},
+			want: consumersFlags{uri: "mongodb://h:1", db: "local", collection: "registry"},
+		},
+		{name: "missing db", args: nil, wantErr: "-db is required"},
+		{name: "bad duration", args: []string{"-db", "local", "-stale", "soon"}, wantErr: "invalid value"},
+		{name: "unknown flag", args: []string{"-db", "local", "-verbose"}, wantErr: "flag provided but not defined"},
+	}
+	silenceUsage(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseConsumersFlags(tt.args)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParseResumePointFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    resumePointFlags
+		wantErr string
+	}{
+		{
+			name: "defaults",
+			args: []string{"-db", "local", "-collection", "orders_resume"},
+			want: resumePointFlags{uri: "mongodb://localhost:27017", db: "local", collection: "orders_resume"},
+		},
+		{name: "missing collection", args: []string{"-db", "local"}, wantErr: "-db and -collection are required"},
+		{name: "missing db", args: []string{"-collection", "orders_resume"}, wantErr: "-db and -collection are required"},
+		{name: "help", args: []string{"-h"}, wantErr: flag.ErrHelp.Error()},
+	}
+	silenceUsage(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseResumePointFlags(tt.args)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParseResumeCollectionFlags(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		wantKey    stream.ResumeKey
+		wantPrefix string
+		wantErr    string
+	}{
+		{
+			name:    "suffix naming",
+			args:    []string{"-db", "app", "-collection", "orders", "-suffix", "_resume"},
+			wantKey: stream.ResumeKey{Database: "app", Collection: "orders", Suffix: "_resume"},
+		},
+		{
+			name:       "hashed naming",
+			args:       []string{"-target-uri", "mongodb://h:1", "-db", "app", "-collection", "orders", "-group", "billing", "-prefix", "rp_"},
+			wantKey:    stream.ResumeKey{URI: "mongodb://h:1", Database: "app", Collection: "orders", Group: "billing"},
+			wantPrefix: "rp_",
+		},
+		{name: "missing collection", args: []string{"-db", "app"}, wantErr: "-db and -collection are required"},
+	}
+	silenceUsage(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, prefix, err := parseResumeCollectionFlags(tt.args)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantKey, key)
+			assert.Equal(t, tt.wantPrefix, prefix)
+		})
+	}
+}
+
+// silenceUsage keeps the usage printed by failing flag sets out of the test output
+func silenceUsage(t *testing.T) {
+	stderr := os.Stderr
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stderr = devNull
+	t.Cleanup(func() {
+		os.Stderr = stderr
+		_ = devNull.Close()
+	})
+}
@@ -0,0 +1,59 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/mmtracker/mongowatch/stream"
+)
+
+// parseResumeCollectionFlags returns the key of the processor and the namer it uses
+func parseResumeCollectionFlags(args []string) (stream.ResumeKey, string, error) {
+	var key stream.ResumeKey
+	var prefix string
+	fs := flag.NewFlagSet("resume-collection", flag.ContinueOnError)
+	fs.StringVar(&key.URI, "target-uri", "", "connection string of the watched cluster")
+	fs.StringVar(&key.Database, "db", "", "watched database")
+	fs.StringVar(&key.Collection, "collection", "", "watched collection")
+	fs.StringVar(&key.Group, "group", "", "consumer group")
+	fs.StringVar(&key.Suffix, "suffix", "", "resume suffix passed to the processor")
+	fs.StringVar(&prefix, "prefix", "", "prefix passed to stream.HashedResumeNamer, empty for the default suffix naming")
+	if err := fs.Parse(args); err != nil {
+		return key, prefix, err
+	}
+	if key.Database == "" || key.Collection == "" {
+		return key, prefix, fmt.Errorf("-db and -collection are required")
+	}
+	return key, prefix, nil
+}
+
+func runResumeCollection(args []string) error {
+	key, prefix, err := parseResumeCollectionFlags(args)
+	if err != nil {
+		return err
+	}
+
+	namer := stream.SuffixResumeNamer
+	if prefix != "" {
+		namer = stream.HashedResumeNamer(prefix)
+	}
+	fmt.Println(namer(key))
+	return nil
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mmtracker/mongowatch/db"
+	"github.com/mmtracker/mongowatch/stream"
+)
+
+type resumePointFlags struct {
+	uri        string
+	db         string
+	collection string
+}
+
+func parseResumePointFlags(args []string) (resumePointFlags, error) {
+	var f resumePointFlags
+	fs := flag.NewFlagSet("resume-point", flag.ContinueOnError)
+	fs.StringVar(&f.uri, "uri", "mongodb://localhost:27017", "local MongoDB connection string")
+	fs.StringVar(&f.db, "db", "", "local database holding the resume points")
+	fs.StringVar(&f.collection, "collection", "", "resume point collection, the target collection name plus the resume suffix")
+	if err := fs.Parse(args); err != nil {
+		return f, err
+	}
+	if f.db == "" || f.collection == "" {
+		return f, fmt.Errorf("-db and -collection are required")
+	}
+	return f, nil
+}
+
+func runResumePoint(args []string) error {
+	f, err := parseResumePointFlags(args)
+	if err != nil {
+		return err
+	}
+
+	repo := stream.NewStreamResumeRepository(stream.NewCollection(f.collection, db.ConnectToMongo(f.db, f.uri)))
+	info, err := repo.Describe(context.Background())
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "TOKEN\t%v\n", info.Token.TokenData)
+	fmt.Fprintf(w, "OPERATION\t%s\n", info.OperationType)
+	fmt.Fprintf(w, "CLUSTER TIME\t%d.%d\n", info.ClusterTime.T, info.ClusterTime.I)
+	if !info.StoredAt.IsZero() {
+		fmt.Fprintf(w, "STORED\t%s\n", info.StoredAt.Format(time.RFC3339))
+	}
+	fmt.Fprintf(w, "TOKEN AGE\t%s\n", info.TokenAge.Round(time.Second))
+	fmt.Fprintf(w, "LAG\t%s\n", info.Lag.Round(time.Millisecond))
+	return w.Flush()
+}
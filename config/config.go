@@ -0,0 +1,347 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package config loads processor settings from an optional YAML file and MONGOWATCH_* environment
+// variables, so deployments can be reconfigured without code changes.
+//
+// Precedence is defaults < YAML file < environment.
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/yaml.v3"
+
+	"github.com/mmtracker/mongowatch"
+	"github.com/mmtracker/mongowatch/db"
+	"github.com/mmtracker/mongowatch/stream"
+	"github.com/mmtracker/mongowatch/wasm"
+)
+
+// EnvPrefix prefixes every environment variable read by Load
+const EnvPrefix = "MONGOWATCH_"
+
+// Config describes a single document processor deployment
+type Config struct {
+	Target Mongo `yaml:"target"`
+	Local  Mongo `yaml:"local"`
+
+	// Group and Instance identify the processor in logs and stats, see mongowatch.WatcherID
+	Group    string `yaml:"group"`
+	Instance string `yaml:"instance"`
+
+	// Collection is the target collection to watch
+	Collection string `yaml:"collection"`
+	// ResumeSuffix distinguishes processors watching the same collection
+	ResumeSuffix string `yaml:"resume_suffix"`
+	// Profile names a stream.Profile applied before the other settings, e.g. low-latency, high-throughput or audit
+	Profile string `yaml:"profile"`
+	// FullDocument is one of default, updateLookup, whenAvailable, required, off; the last three set the
+	// pre-image mode of the stream, the others keep pre-images required
+	FullDocument string `yaml:"full_document"`
+	// PartialUpdates dispatches update descriptions instead of looked up documents
+	PartialUpdates bool `yaml:"partial_updates"`
+	// HandlerTimeout bounds each dispatcher call, zero disables it
+	HandlerTimeout time.Duration `yaml:"handler_timeout"`
+	// EventBudget bounds the total processing time of an event, checkpoint included, zero disables it
+	EventBudget time.Duration `yaml:"event_budget"`
+
+	Namespaces Namespaces `yaml:"namespaces"`
+	Backoff    Backoff    `yaml:"backoff"`
+
+	// Plugins are paths of WebAssembly transform plugins run in order, see package wasm
+	Plugins []string `yaml:"plugins"`
+}
+
+// Mongo holds connection settings of a single deployment
+type Mongo struct {
+	URI      string `yaml:"uri"`
+	Database string `yaml:"database"`
+}
+
+// Namespaces maps onto stream.NamespaceFilter
+type Namespaces struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// Backoff configures the exponential backoff used by StartWithRetry
+type Backoff struct {
+	InitialInterval time.Duration `yaml:"initial_interval"`
+	MaxInterval     time.Duration `yaml:"max_interval"`
+	// MaxElapsedTime of zero retries forever
+	MaxElapsedTime time.Duration `yaml:"max_elapsed_time"`
+	Multiplier     float64       `yaml:"multiplier"`
+	// Jitter switches to stream.DefaultRetryPolicy between InitialInterval and MaxInterval: decorrelated jitter
+	// with separate curves for network, election and handler errors; Multiplier is ignored then
+	Jitter bool `yaml:"jitter"`
+}
+
+// Default returns the configuration used for anything not set explicitly
+func Default() Config {
+	return Config{
+		FullDocument: string(options.UpdateLookup),
+		Backoff: Backoff{
+			InitialInterval: backoff.DefaultInitialInterval,
+			MaxInterval:     backoff.DefaultMaxInterval,
+			Multiplier:      backoff.DefaultMultiplier,
+		},
+	}
+}
+
+// Load reads the YAML file at path (skipped when empty) and applies environment overrides on top
+func Load(path string) (Config, error) {
+	return load(path, os.LookupEnv)
+}
+
+func load(path string, lookupEnv func(string) (string, bool)) (Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("failed to read config file: %w", err)
+		}
+		if err = yaml.Unmarshal(raw, &cfg); err != nil {
+			return cfg, fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+	}
+
+	if err := cfg.applyEnv(lookupEnv); err != nil {
+		return cfg, err
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// applyEnv overrides fields with the MONGOWATCH_* variables that are set
+func (c *Config) applyEnv(lookupEnv func(string) (string, bool)) error {
+	strs := map[string]*string{
+		"TARGET_URI":      &c.Target.URI,
+		"TARGET_DATABASE": &c.Target.Database,
+		"LOCAL_URI":       &c.Local.URI,
+		"LOCAL_DATABASE":  &c.Local.Database,
+		"COLLECTION":      &c.Collection,
+		"GROUP":           &c.Group,
+		"INSTANCE":        &c.Instance,
+		"RESUME_SUFFIX":   &c.ResumeSuffix,
+		"FULL_DOCUMENT":   &c.FullDocument,
+		"PROFILE":         &c.Profile,
+	}
+	for name, field := range strs {
+		if v, ok := lookupEnv(EnvPrefix + name); ok {
+			*field = v
+		}
+	}
+
+	lists := map[string]*[]string{
+		"NAMESPACES_ALLOW": &c.Namespaces.Allow,
+		"NAMESPACES_DENY":  &c.Namespaces.Deny,
+		"PLUGINS":          &c.Plugins,
+	}
+	for name, field := range lists {
+		if v, ok := lookupEnv(EnvPrefix + name); ok {
+			*field = splitList(v)
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		"HANDLER_TIMEOUT":          &c.HandlerTimeout,
+		"EVENT_BUDGET":             &c.EventBudget,
+		"BACKOFF_INITIAL_INTERVAL": &c.Backoff.InitialInterval,
+		"BACKOFF_MAX_INTERVAL":     &c.Backoff.MaxInterval,
+		"BACKOFF_MAX_ELAPSED_TIME": &c.Backoff.MaxElapsedTime,
+	}
+	for name, field := range durations {
+		if v, ok := lookupEnv(EnvPrefix + name); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s%s: %w", EnvPrefix, name, err)
+			}
+			*field = d
+		}
+	}
+
+	if v, ok := lookupEnv(EnvPrefix + "BACKOFF_MULTIPLIER"); ok {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("invalid %sBACKOFF_MULTIPLIER: %w", EnvPrefix, err)
+		}
+		c.Backoff.Multiplier = f
+	}
+	if v, ok := lookupEnv(EnvPrefix + "BACKOFF_JITTER"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid %sBACKOFF_JITTER: %w", EnvPrefix, err)
+		}
+		c.Backoff.Jitter = b
+	}
+	if v, ok := lookupEnv(EnvPrefix + "PARTIAL_UPDATES"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid %sPARTIAL_UPDATES: %w", EnvPrefix, err)
+		}
+		c.PartialUpdates = b
+	}
+
+	return nil
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// Validate reports every invalid or missing setting at once
+func (c Config) Validate() error {
+	var errs []error
+	required := map[string]string{
+		"target.uri":      c.Target.URI,
+		"target.database": c.Target.Database,
+		"local.uri":       c.Local.URI,
+		"local.database":  c.Local.Database,
+		"collection":      c.Collection,
+	}
+	for _, name := range []string{"target.uri", "target.database", "local.uri", "local.database", "collection"} {
+		if required[name] == "" {
+			errs = append(errs, fmt.Errorf("%s is required", name))
+		}
+	}
+
+	switch options.FullDocument(c.FullDocument) {
+	case options.Default, options.UpdateLookup, options.WhenAvailable, options.Required, options.Off:
+	default:
+		errs = append(errs, fmt.Errorf("full_document %q is not one of default, updateLookup, whenAvailable, required, off", c.FullDocument))
+	}
+
+	if c.Profile != "" {
+		if _, err := stream.LookupProfile(c.Profile); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.HandlerTimeout < 0 {
+		errs = append(errs, errors.New("handler_timeout must not be negative"))
+	}
+	if c.EventBudget < 0 {
+		errs = append(errs, errors.New("event_budget must not be negative"))
+	}
+	if c.Backoff.InitialInterval <= 0 || c.Backoff.MaxInterval < c.Backoff.InitialInterval {
+		errs = append(errs, errors.New("backoff intervals must be positive with max_interval >= initial_interval"))
+	}
+	if c.Backoff.Multiplier < 1 {
+		errs = append(errs, errors.New("backoff multiplier must be >= 1"))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// FullDocumentMode returns the configured full document mode
+func (c Config) FullDocumentMode() options.FullDocument {
+	return options.FullDocument(c.FullDocument)
+}
+
+// BackOff builds the retry policy for DocumentProcessor.StartWithRetry
+func (c Config) BackOff() backoff.BackOff {
+	if c.Backoff.Jitter {
+		policy := stream.DefaultRetryPolicy(c.Backoff.InitialInterval, c.Backoff.MaxInterval)
+		policy.MaxElapsedTime = c.Backoff.MaxElapsedTime
+		return policy
+	}
+	bo := backoff.NewExponentialBackOff()
+	bo.InitialInterval = c.Backoff.InitialInterval
+	bo.MaxInterval = c.Backoff.MaxInterval
+	bo.MaxElapsedTime = c.Backoff.MaxElapsedTime
+	bo.Multiplier = c.Backoff.Multiplier
+	bo.Reset()
+	return bo
+}
+
+// ProcessorOptions translates the config into options for stream.NewDataProcessor
+func (c Config) ProcessorOptions() []stream.ProcessorOption {
+	var opts []stream.ProcessorOption
+	if profile, err := stream.LookupProfile(c.Profile); err == nil {
+		opts = append(opts, stream.WithProfile(profile))
+	}
+	if c.Group != "" || c.Instance != "" {
+		opts = append(opts, stream.WithProcessorID(mongowatch.NewWatcherID(c.Group, c.Instance)))
+	}
+	if c.PartialUpdates {
+		opts = append(opts, stream.WithPartialUpdates())
+	}
+	filter := stream.NamespaceFilter{Allow: c.Namespaces.Allow, Deny: c.Namespaces.Deny}
+	if !filter.IsEmpty() {
+		opts = append(opts, stream.WithWatcherOptions(stream.WithNamespaceFilter(filter)))
+	}
+	if c.HandlerTimeout > 0 {
+		opts = append(opts, stream.WithManagerOptions(stream.WithHandlerTimeout(c.HandlerTimeout)))
+	}
+	if c.EventBudget > 0 {
+		opts = append(opts, stream.WithManagerOptions(stream.WithEventBudget(c.EventBudget)))
+	}
+	return opts
+}
+
+// LoadPlugins loads the configured transform plugins, register them with stream.WithTransform
+func (c Config) LoadPlugins(ctx context.Context) ([]*wasm.Plugin, error) {
+	plugins := make([]*wasm.Plugin, 0, len(c.Plugins))
+	for _, path := range c.Plugins {
+		plugin, err := wasm.LoadFile(ctx, path, wasm.Config{})
+		if err != nil {
+			for _, loaded := range plugins {
+				_ = loaded.Close(ctx)
+			}
+			return nil, err
+		}
+		plugins = append(plugins, plugin)
+	}
+	return plugins, nil
+}
+
+// NewProcessor connects to both deployments and builds the configured document processor
+func (c Config) NewProcessor(opts ...stream.ProcessorOption) *stream.DocumentProcessor {
+	targetDB := db.ConnectToMongo(c.Target.Database, c.Target.URI)
+	localDB := db.ConnectToMongo(c.Local.Database, c.Local.URI)
+	return stream.NewDataProcessor(targetDB, c.Collection, c.ResumeSuffix, localDB, append(c.ProcessorOptions(), opts...)...)
+}
+
+// ParseNamespaceFilter reads the namespaces section of a config file,
+// suitable as the parse func of stream.FilterReloader.WatchFile
+func ParseNamespaceFilter(raw []byte) (stream.NamespaceFilter, error) {
+	var doc struct {
+		Namespaces Namespaces `yaml:"namespaces"`
+	}
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return stream.NamespaceFilter{}, fmt.Errorf("failed to parse namespaces: %w", err)
+	}
+	return stream.NamespaceFilter{Allow: doc.Namespaces.Allow, Deny: doc.Namespaces.Deny}, nil
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mmtracker/mongowatch/stream"
+)
+
+func envMap(m map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := m[key]
+		return v, ok
+	}
+}
+
+func TestLoadYAMLWithEnvOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mongowatch.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+target:
+  uri: mongodb://target:27017
+  database: app
+local:
+  uri: mongodb://local:27017
+  database: local
+collection: users
+resume_suffix: _a
+full_document: required
+handler_timeout: 5s
+event_budget: 20s
+namespaces:
+  deny: ["app.tmp_*"]
+backoff:
+  max_interval: 30s
+`), 0o600))
+
+	cfg, err := load(path, envMap(map[string]string{
+		"MONGOWATCH_COLLECTION":       "orders",
+		"MONGOWATCH_PARTIAL_UPDATES":  "true",
+		"MONGOWATCH_NAMESPACES_ALLOW": "app.orders, app.users",
+	}))
+	require.NoError(t, err)
+
+	assert.Equal(t, "mongodb://target:27017", cfg.Target.URI)
+	assert.Equal(t, "orders", cfg.Collection)
+	assert.Equal(t, options.Required, cfg.FullDocumentMode())
+	assert.Equal(t, 5*time.Second, cfg.HandlerTimeout)
+	assert.Equal(t, 20*time.Second, cfg.EventBudget)
+	assert.True(t, cfg.PartialUpdates)
+	assert.Equal(t, []string{"app.orders", "app.users"}, cfg.Namespaces.Allow)
+	assert.Equal(t, []string{"app.tmp_*"}, cfg.Namespaces.Deny)
+	// defaults survive a partially specified section
+	assert.Equal(t, 30*time.Second, cfg.Backoff.MaxInterval)
+	assert.Equal(t, Default().Backoff.InitialInterval, cfg.Backoff.InitialInterval)
+	assert.Len(t, cfg.ProcessorOptions(), 4)
+}
+
+func TestLoadValidation(t *testing.T) {
+	_, err := load("", envMap(map[string]string{
+		"MONGOWATCH_TARGET_URI":    "mongodb://target:27017",
+		"MONGOWATCH_FULL_DOCUMENT": "always",
+		"MONGOWATCH_PROFILE":       "fastest",
+	}))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "target.database is required")
+	assert.Contains(t, err.Error(), "collection is required")
+	assert.Contains(t, err.Error(), `full_document "always"`)
+	assert.NotContains(t, err.Error(), "target.uri")
+	assert.Contains(t, err.Error(), `unknown profile "fastest"`)
+
+	_, err = load("", envMap(map[string]string{"MONGOWATCH_HANDLER_TIMEOUT": "soon"}))
+	assert.ErrorContains(t, err, "MONGOWATCH_HANDLER_TIMEOUT")
+}
+
+func TestProfile(t *testing.T) {
+	cfg := Default()
+	assert.Empty(t, cfg.ProcessorOptions())
+	cfg.Profile = stream.ProfileAudit
+	assert.Len(t, cfg.ProcessorOptions(), 1)
+}
+
+func TestBackOffJitter(t *testing.T) {
+	cfg := Default()
+	_, ok := cfg.BackOff().(*backoff.ExponentialBackOff)
+	assert.True(t, ok)
+
+	require.NoError(t, cfg.applyEnv(envMap(map[string]string{"MONGOWATCH_BACKOFF_JITTER": "true"})))
+	policy, ok := cfg.BackOff().(*stream.RetryPolicy)
+	require.True(t, ok)
+	d := policy.NextBackOff()
+	assert.GreaterOrEqual(t, d, cfg.Backoff.InitialInterval)
+	assert.LessOrEqual(t, d, cfg.Backoff.MaxInterval)
+}
+
+func TestParseNamespaceFilter(t *testing.T) {
+	filter, err := ParseNamespaceFilter([]byte("collection: users\nnamespaces:\n  allow: [app.users]\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"app.users"}, filter.Allow)
+	assert.Empty(t, filter.Deny)
+}
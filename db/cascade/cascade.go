@@ -0,0 +1,229 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package cascade removes the local documents depending on a deleted mirror document
+package cascade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/mmtracker/mongowatch"
+	"github.com/mmtracker/mongowatch/db/tx"
+)
+
+// ErrNoDocumentKey is returned when a delete can't be related to a document
+var ErrNoDocumentKey = errors.New("delete event has no document key")
+
+// Relation declares the documents of a child collection referencing their parent by Field
+type Relation struct {
+	// Collection in the local DB holding the child documents
+	Collection string `yaml:"collection" json:"collection"`
+	// Field of the child documents holding the _id of the parent
+	Field string `yaml:"field" json:"field"`
+	// Relations of the child collection, removed before the children themselves
+	Relations []Relation `yaml:"relations" json:"relations"`
+}
+
+// validate checks the relation and its children are complete
+func (r Relation) validate() error {
+	if r.Collection == "" || r.Field == "" {
+		return fmt.Errorf("relation must have a collection and a field: %+v", r)
+	}
+	for _, child := range r.Relations {
+		if err := child.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// store is the part of the local DB cascading deletes need
+type store interface {
+	// ids returns the _id of the documents in collection with field in keys
+	ids(ctx context.Context, collection, field string, keys []interface{}) ([]interface{}, error)
+	// deleteMany removes the documents in collection with field in keys
+	deleteMany(ctx context.Context, collection, field string, keys []interface{}) (int64, error)
+}
+
+type mongoStore struct {
+	db *mongo.Database
+}
+
+func (m mongoStore) ids(ctx context.Context, collection, field string, keys []interface{}) ([]interface{}, error) {
+	return m.db.Collection(collection).Distinct(ctx, "_id", bson.M{field: bson.M{"$in": keys}})
+}
+
+func (m mongoStore) deleteMany(ctx context.Context, collection, field string, keys []interface{}) (int64, error) {
+	res, err := m.db.Collection(collection).DeleteMany(ctx, bson.M{field: bson.M{"$in": keys}})
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+// Option configures a Cascade
+type Option func(*Cascade)
+
+// WithParentKey sets how the documentKey of a delete event maps onto the local _id of the parent,
+// by default a valid ObjectID hex becomes an ObjectID and anything else stays a string
+func WithParentKey(fn func(documentKey string) interface{}) Option {
+	return func(c *Cascade) {
+		c.parentKey = fn
+	}
+}
+
+// WithoutParent leaves the parent document in place and only removes its dependents,
+// e.g. when the mirror watcher removes the parent itself
+func WithoutParent() Option {
+	return func(c *Cascade) {
+		c.keepParent = true
+	}
+}
+
+// Cascade deletes a local mirror document along with the documents referencing it, in one transaction
+type Cascade struct {
+	executor   tx.Executor
+	store      store
+	parent     string
+	relations  []Relation
+	parentKey  func(documentKey string) interface{}
+	keepParent bool
+}
+
+// New creates a Cascade for documents of the parent collection in the local DB and the given relations
+func New(executor tx.Executor, local *mongo.Database, parent string, relations []Relation, opts ...Option) (*Cascade, error) {
+	return newCascade(executor, mongoStore{db: local}, parent, relations, opts...)
+}
+
+func newCascade(executor tx.Executor, s store, parent string, relations []Relation, opts ...Option) (*Cascade, error) {
+	if parent == "" {
+		return nil, errors.New("cascade requires a parent collection")
+	}
+	for _, r := range relations {
+		if err := r.validate(); err != nil {
+			return nil, err
+		}
+	}
+	c := &Cascade{
+		executor:  executor,
+		store:     s,
+		parent:    parent,
+		relations: relations,
+		parentKey: defaultParentKey,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// defaultParentKey reads ObjectIDs back from their hex form, documentKey presents every _id as a string
+func defaultParentKey(documentKey string) interface{} {
+	if oid, err := primitive.ObjectIDFromHex(documentKey); err == nil {
+		return oid
+	}
+	return documentKey
+}
+
+// Delete removes the parent document with the given local _id and everything depending on it in one transaction
+func (c *Cascade) Delete(ctx context.Context, id interface{}) error {
+	return c.run(ctx, id, nil)
+}
+
+// run removes id and its dependents in a transaction, then calls then within it
+func (c *Cascade) run(ctx context.Context, id interface{}, then func(context.Context) error) error {
+	err := tx.Run(ctx, c.executor, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		if err := c.remove(sessCtx, id); err != nil {
+			return nil, err
+		}
+		if then != nil {
+			return nil, then(sessCtx)
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to cascade delete of %s %v: %w", c.parent, id, err)
+	}
+	return nil
+}
+
+// remove deletes the dependents of id depth first and the parent last
+func (c *Cascade) remove(ctx context.Context, id interface{}) error {
+	keys := []interface{}{id}
+	if err := c.removeRelations(ctx, c.relations, keys); err != nil {
+		return err
+	}
+	if c.keepParent {
+		return nil
+	}
+	if _, err := c.store.deleteMany(ctx, c.parent, "_id", keys); err != nil {
+		return fmt.Errorf("failed to delete from %s: %w", c.parent, err)
+	}
+	return nil
+}
+
+func (c *Cascade) removeRelations(ctx context.Context, relations []Relation, keys []interface{}) error {
+	for _, r := range relations {
+		if len(r.Relations) > 0 {
+			ids, err := c.store.ids(ctx, r.Collection, r.Field, keys)
+			if err != nil {
+				return fmt.Errorf("failed to find documents in %s: %w", r.Collection, err)
+			}
+			if len(ids) > 0 {
+				if err := c.removeRelations(ctx, r.Relations, ids); err != nil {
+					return err
+				}
+			}
+		}
+		n, err := c.store.deleteMany(ctx, r.Collection, r.Field, keys)
+		if err != nil {
+			return fmt.Errorf("failed to delete from %s: %w", r.Collection, err)
+		}
+		log.Debugf("cascade deleted %d documents from %s", n, r.Collection)
+	}
+	return nil
+}
+
+// Watcher wraps a mirror watcher so delete events cascade: the dependents of the deleted document are removed
+// and the Delete of the watcher runs in the same transaction, with the session context.
+// The parent is taken from the documentKey of the event, see mongowatch.EventMetaFromContext
+func (c *Cascade) Watcher(watcher mongowatch.CollectionWatcher) mongowatch.CollectionWatcher {
+	return &cascadeWatcher{CollectionWatcher: watcher, cascade: c}
+}
+
+type cascadeWatcher struct {
+	mongowatch.CollectionWatcher
+	cascade *Cascade
+}
+
+// Delete removes the dependents of the deleted document, then calls the wrapped Delete in the same transaction
+func (w *cascadeWatcher) Delete(ctx context.Context, doc []byte) error {
+	meta, ok := mongowatch.EventMetaFromContext(ctx)
+	if !ok || meta.DocumentKey == "" {
+		return ErrNoDocumentKey
+	}
+	return w.cascade.run(ctx, w.cascade.parentKey(meta.DocumentKey), func(sessCtx context.Context) error {
+		return w.CollectionWatcher.Delete(sessCtx, doc)
+	})
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cascade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/mmtracker/mongowatch"
+	"github.com/mmtracker/mongowatch/db/tx"
+)
+
+type fakeExecutor struct {
+	txs int
+}
+
+func (f *fakeExecutor) WithTransaction(callback tx.Callback) error {
+	f.txs++
+	_, err := callback(mongo.NewSessionContext(context.TODO(), nil))
+	return err
+}
+
+// fakeStore keeps documents as collection -> _id -> fields and logs the deletes
+type fakeStore struct {
+	docs    map[string]map[interface{}]map[string]interface{}
+	deletes []string
+	fail    string
+}
+
+func (f *fakeStore) matches(collection, field string, keys []interface{}) []interface{} {
+	var ids []interface{}
+	for id, doc := range f.docs[collection] {
+		v := doc[field]
+		if field == "_id" {
+			v = id
+		}
+		for _, k := range keys {
+			if v == k {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+func (f *fakeStore) ids(_ context.Context, collection, field string, keys []interface{}) ([]interface{}, error) {
+	return f.matches(collection, field, keys), nil
+}
+
+func (f *fakeStore) deleteMany(_ context.Context, collection, field string, keys []interface{}) (int64, error) {
+	if collection == f.fail {
+		return 0, errors.New("write failed")
+	}
+	ids := f.matches(collection, field, keys)
+	for _, id := range ids {
+		delete(f.docs[collection], id)
+	}
+	f.deletes = append(f.deletes, fmt.Sprintf("%s:%d", collection, len(ids)))
+	return int64(len(ids)), nil
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{docs: map[string]map[interface{}]map[string]interface{}{
+		"devices": {"d1": {}, "d2": {}},
+		"reports": {
+			"r1": {"deviceId": "d1"},
+			"r2": {"deviceId": "d1"},
+			"r3": {"deviceId": "d2"},
+		},
+		"attachments": {
+			"a1": {"reportId": "r1"},
+			"a2": {"reportId": "r3"},
+		},
+		"settings": {"s1": {"deviceId": "d1"}},
+	}}
+}
+
+var deviceRelations = []Relation{
+	{Collection: "reports", Field: "deviceId", Relations: []Relation{
+		{Collection: "attachments", Field: "reportId"},
+	}},
+	{Collection: "settings", Field: "deviceId"},
+}
+
+func TestCascade_Delete(t *testing.T) {
+	s := newFakeStore()
+	executor := &fakeExecutor{}
+	c, err := newCascade(executor, s, "devices", deviceRelations)
+	require.NoError(t, err)
+
+	require.NoError(t, c.Delete(context.Background(), "d1"))
+
+	assert.Equal(t, 1, executor.txs)
+	// children go before their parents
+	assert.Equal(t, []string{"attachments:1", "reports:2", "settings:1", "devices:1"}, s.deletes)
+	assert.Len(t, s.docs["reports"], 1)
+	assert.Contains(t, s.docs["attachments"], "a2")
+	assert.Contains(t, s.docs["devices"], "d2")
+}
+
+func TestCascade_WithoutParent(t *testing.T) {
+	s := newFakeStore()
+	c, err := newCascade(&fakeExecutor{}, s, "devices", deviceRelations, WithoutParent())
+	require.NoError(t, err)
+
+	require.NoError(t, c.Delete(context.Background(), "d2"))
+	assert.Equal(t, []string{"attachments:1", "reports:1", "settings:0"}, s.deletes)
+	assert.Contains(t, s.docs["devices"], "d2")
+}
+
+func TestCascade_Failure(t *testing.T) {
+	s := newFakeStore()
+	s.fail = "settings"
+	c, err := newCascade(&fakeExecutor{}, s, "devices", deviceRelations)
+	require.NoError(t, err)
+
+	err = c.Delete(context.Background(), "d1")
+	assert.ErrorContains(t, err, "failed to delete from settings")
+	// the parent is removed last, so it survives a failed cascade to be retried
+	assert.Contains(t, s.docs["devices"], "d1")
+}
+
+func TestCascade_InvalidRelations(t *testing.T) {
+	_, err := newCascade(&fakeExecutor{}, newFakeStore(), "", nil)
+	assert.Error(t, err)
+
+	_, err = newCascade(&fakeExecutor{}, newFakeStore(), "devices", []Relation{
+		{Collection: "reports", Field: "deviceId", Relations: []Relation{{Collection: "attachments"}}},
+	})
+	assert.Error(t, err)
+}
+
+func TestDefaultParentKey(t *testing.T) {
+	oid := primitive.NewObjectID()
+	assert.Equal(t, oid, defaultParentKey(oid.Hex()))
+	assert.Equal(t, "device-1", defaultParentKey("device-1"))
+}
+
+type deleteWatcher struct {
+	mongowatch.CollectionWatcher
+	inSession bool
+	calls     int
+}
+
+func (d *deleteWatcher) Delete(ctx context.Context, _ []byte) error {
+	_, d.inSession = ctx.(mongo.SessionContext)
+	d.calls++
+	return nil
+}
+
+func TestCascade_Watcher(t *testing.T) {
+	s := newFakeStore()
+	executor := &fakeExecutor{}
+	c, err := newCascade(executor, s, "devices", deviceRelations, WithoutParent())
+	require.NoError(t, err)
+
+	inner := &deleteWatcher{}
+	w := c.Watcher(inner)
+
+	ctx := mongowatch.ContextWithEvent(context.Background(), mongowatch.ChangeStreamEvent{OperationType: "delete", DocumentKey: "d1"})
+	require.NoError(t, w.Delete(ctx, []byte("null")))
+
+	assert.Equal(t, 1, executor.txs)
+	assert.Equal(t, 1, inner.calls)
+	assert.True(t, inner.inSession)
+	assert.Empty(t, s.docs["settings"])
+
+	assert.ErrorIs(t, w.Delete(context.Background(), nil), ErrNoDocumentKey)
+}
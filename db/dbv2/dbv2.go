@@ -0,0 +1,132 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package dbv2 offers the helpers of package db on mongo-driver v2 handles, for applications moving to the v2
+// driver. Both packages share their implementation, connection defaults and errors are the same.
+package dbv2
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"go.mongodb.org/mongo-driver/v2/mongo/writeconcern"
+
+	"github.com/mmtracker/mongowatch/internal/driver"
+)
+
+// ConnectToMongo connects to the database and exits on failure, see db.ConnectToMongo
+func ConnectToMongo(dbName string, connectURL string) *mongo.Database {
+	log.Printf("connecting to MongoDB: %s", connectURL)
+
+	database, err := Connect(context.Background(), dbName, connectURL)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	log.Info("mongo connection established")
+	return database
+}
+
+// Connect connects to the MongoDB deployment at connectURL and returns the database
+func Connect(ctx context.Context, dbName string, connectURL string) (*mongo.Database, error) {
+	c, err := driver.Connect(ctx, func(ctx context.Context) (client, error) {
+		// options set by the connection string win over the defaults set before ApplyURI
+		opts := options.Client().SetServerSelectionTimeout(driver.ServerSelectionTimeout).ApplyURI(connectURL)
+		c, err := mongo.Connect(opts)
+		return client{c}, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.Database(dbName), nil
+}
+
+// NewCollection returns the collection with the write concern stream.NewCollection uses
+func NewCollection(col string, mongoInstance *mongo.Database) *mongo.Collection {
+	journal := false
+	return mongoInstance.Collection(col,
+		options.Collection().SetWriteConcern(&writeconcern.WriteConcern{W: 1, Journal: &journal}),
+	)
+}
+
+// Truncate collection records and indexes
+func Truncate(col *mongo.Collection, dropIndexes bool) error {
+	return driver.Truncate(context.Background(), collection{col}, dropIndexes)
+}
+
+// RecordPreImages enables pre/post images for a collection for MongoDB < 6
+func RecordPreImages(mongoInstance *mongo.Database, colName string) error {
+	return driver.RecordPreImages(context.Background(), database{mongoInstance}, colName)
+}
+
+// EnablePrePostImages enables pre/post images for a collection for MongoDB >= 6
+func EnablePrePostImages(mongoInstance *mongo.Database, colName string) error {
+	return driver.EnablePrePostImages(context.Background(), database{mongoInstance}, colName)
+}
+
+// client, database and collection adapt the v2 driver to package driver
+
+type client struct {
+	*mongo.Client
+}
+
+func (c client) Ping(ctx context.Context) error {
+	return c.Client.Ping(ctx, nil)
+}
+
+type database struct {
+	db *mongo.Database
+}
+
+func (d database) RunCommand(ctx context.Context, cmd driver.Command) (map[string]interface{}, error) {
+	result := map[string]interface{}{}
+	err := d.db.RunCommand(ctx, command(cmd)).Decode(&result)
+	return result, err
+}
+
+// command converts the command into a bson.D, nested commands included
+func command(cmd driver.Command) bson.D {
+	doc := make(bson.D, 0, len(cmd))
+	for _, e := range cmd {
+		value := e.Value
+		if nested, ok := value.(driver.Command); ok {
+			value = command(nested)
+		}
+		doc = append(doc, bson.E{Key: e.Key, Value: value})
+	}
+	return doc
+}
+
+type collection struct {
+	col *mongo.Collection
+}
+
+func (c collection) Name() string {
+	return c.col.Name()
+}
+
+func (c collection) DeleteAll(ctx context.Context) error {
+	_, err := c.col.DeleteMany(ctx, bson.M{})
+	return err
+}
+
+func (c collection) DropIndexes(ctx context.Context) error {
+	return c.col.Indexes().DropAll(ctx)
+}
@@ -0,0 +1,45 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package dbv2
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/v2/bson"
+
+	"github.com/mmtracker/mongowatch/internal/driver"
+)
+
+func TestConnect_Unreachable(t *testing.T) {
+	// the connection string overrides the default server selection timeout
+	_, err := Connect(context.Background(), "app", "mongodb://127.0.0.1:1/?serverSelectionTimeoutMS=10")
+	assert.ErrorContains(t, err, "failed to ping MongoDB")
+}
+
+func TestCommand(t *testing.T) {
+	cmd := driver.Command{
+		{Key: "collMod", Value: "orders"},
+		{Key: "changeStreamPreAndPostImages", Value: driver.Command{{Key: "enabled", Value: true}}},
+	}
+	assert.Equal(t, bson.D{
+		{Key: "collMod", Value: "orders"},
+		{Key: "changeStreamPreAndPostImages", Value: bson.D{{Key: "enabled", Value: true}}},
+	}, command(cmd))
+}
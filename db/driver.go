@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package db
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/mmtracker/mongowatch/internal/driver"
+)
+
+// client, database and collection adapt the v1 driver to package driver
+
+type client struct {
+	*mongo.Client
+}
+
+func (c client) Ping(ctx context.Context) error {
+	return c.Client.Ping(ctx, nil)
+}
+
+type database struct {
+	db *mongo.Database
+}
+
+func (d database) RunCommand(ctx context.Context, cmd driver.Command) (map[string]interface{}, error) {
+	result := map[string]interface{}{}
+	err := d.db.RunCommand(ctx, command(cmd)).Decode(&result)
+	return result, err
+}
+
+// command converts the command into a bson.D, nested commands included
+func command(cmd driver.Command) bson.D {
+	doc := make(bson.D, 0, len(cmd))
+	for _, e := range cmd {
+		value := e.Value
+		if nested, ok := value.(driver.Command); ok {
+			value = command(nested)
+		}
+		doc = append(doc, bson.E{Key: e.Key, Value: value})
+	}
+	return doc
+}
+
+type collection struct {
+	col *mongo.Collection
+}
+
+func (c collection) Name() string {
+	return c.col.Name()
+}
+
+func (c collection) DeleteAll(ctx context.Context) error {
+	_, err := c.col.DeleteMany(ctx, bson.M{})
+	return err
+}
+
+func (c collection) DropIndexes(ctx context.Context) error {
+	_, err := c.col.Indexes().DropAll(ctx, nil)
+	return err
+}
@@ -21,57 +21,43 @@ package db
 
 import (
 	"context"
-	"fmt"
-	"time"
 
 	log "github.com/sirupsen/logrus"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mmtracker/mongowatch/internal/driver"
 )
 
 // ConnectToMongo helper to connect and setup  mongo DB
 func ConnectToMongo(dbName string, connectURL string) *mongo.Database {
 	log.Printf("connecting to MongoDB: %s", connectURL)
 
-	// Create MongoDB client
-	opts := options.Client().ApplyURI(connectURL)
-	opts.SetServerSelectionTimeout(10 * time.Second)
-
-	client, err := mongo.NewClient(opts)
+	database, err := Connect(context.Background(), dbName, connectURL)
 	if err != nil {
-		log.Fatalf("failed to create new MongoDB client: %#v", err)
+		log.Fatalf("%v", err)
 	}
 
-	// Connect client
-	if err = client.Connect(context.Background()); err != nil {
-		log.Fatalf("failed to connect to MongoDB: %#v", err)
-	}
+	log.Info("mongo connection established")
+	return database
+}
 
-	err = client.Ping(context.Background(), nil)
+// Connect connects to the MongoDB deployment at connectURL and returns the database,
+// unlike ConnectToMongo it reports failures instead of exiting
+func Connect(ctx context.Context, dbName string, connectURL string) (*mongo.Database, error) {
+	c, err := driver.Connect(ctx, func(ctx context.Context) (client, error) {
+		// options set by the connection string win over the defaults set before ApplyURI
+		opts := options.Client().SetServerSelectionTimeout(driver.ServerSelectionTimeout).ApplyURI(connectURL)
+		c, err := mongo.Connect(ctx, opts)
+		return client{c}, err
+	})
 	if err != nil {
-		log.Fatalf("failed to ping MongoDB: %#v", err)
+		return nil, err
 	}
-
-	log.Info("mongo connection established")
-
-	// Get collection from database
-	return client.Database(dbName)
+	return c.Database(dbName), nil
 }
 
 // Truncate collection records and indexes
 func Truncate(col *mongo.Collection, dropIndexes bool) error {
-	_, err := col.DeleteMany(context.Background(), bson.M{})
-	if err != nil {
-		return fmt.Errorf("truncate failed to delete all docs from %s: %w", col.Name(), err)
-	}
-
-	if dropIndexes {
-		_, err = col.Indexes().DropAll(context.Background(), nil)
-		if err != nil {
-			return fmt.Errorf("truncate failed to drop indexes on %s: %w", col.Name(), err)
-		}
-	}
-
-	return nil
+	return driver.Truncate(context.Background(), collection{col}, dropIndexes)
 }
@@ -36,6 +36,8 @@ type MongoExecutor struct {
 	Client *mongo.Client
 }
 
+var _ ContextExecutor = (*MongoExecutor)(nil)
+
 // NewMongoExecutor creates new MongoExecutor for transaction management
 func NewMongoExecutor(client *mongo.Client) *MongoExecutor {
 	return &MongoExecutor{Client: client}
@@ -46,6 +48,11 @@ type Callback func(sessCtx mongo.SessionContext) (interface{}, error)
 
 // WithTransaction execute callback within transaction
 func (e *MongoExecutor) WithTransaction(callback Callback) error {
+	return e.WithTransactionContext(context.TODO(), callback)
+}
+
+// WithTransactionContext execute callback within transaction derived from ctx
+func (e *MongoExecutor) WithTransactionContext(ctx context.Context, callback Callback) error {
 	// opts := options.Session().SetDefaultReadConcern(readconcern.Majority())
 	session, err := e.Client.StartSession()
 	if err != nil {
@@ -53,7 +60,7 @@ func (e *MongoExecutor) WithTransaction(callback Callback) error {
 	}
 	// TODO: tune according to your needs
 	const duration = 10 * time.Second
-	ctx, cancel := context.WithTimeout(context.TODO(), duration)
+	ctx, cancel := context.WithTimeout(ctx, duration)
 	defer cancel()
 
 	defer session.EndSession(ctx)
@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package tx
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// Operations handled by Transactional
+const (
+	OperationInsert = "insert"
+	OperationUpdate = "update"
+	OperationDelete = "delete"
+)
+
+// ContextExecutor is an Executor that can derive the transaction from a caller context,
+// so the session context keeps its values and cancellation
+type ContextExecutor interface {
+	Executor
+	WithTransactionContext(ctx context.Context, callback Callback) error
+}
+
+// TransactionalOption configures Transactional
+type TransactionalOption func(*transactional)
+
+// Operations limits transactions to the given operations, all of them are wrapped by default
+func Operations(ops ...string) TransactionalOption {
+	return func(t *transactional) {
+		t.ops = make(map[string]bool, len(ops))
+		for _, op := range ops {
+			t.ops[op] = true
+		}
+	}
+}
+
+// Transactional wraps every call of watcher in a local transaction of executor. The watcher receives the
+// session context, so writes made with it join the transaction and a returned error aborts it.
+// The driver may run the call again on transient transaction errors, so watcher calls should stay idempotent
+func Transactional(executor Executor, watcher mongowatch.CollectionWatcher, opts ...TransactionalOption) mongowatch.CollectionWatcher {
+	t := &transactional{
+		executor: executor,
+		watcher:  watcher,
+		ops: map[string]bool{
+			OperationInsert: true,
+			OperationUpdate: true,
+			OperationDelete: true,
+		},
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+type transactional struct {
+	executor Executor
+	watcher  mongowatch.CollectionWatcher
+	ops      map[string]bool
+}
+
+// Insert runs the wrapped Insert, in a transaction if enabled
+func (t *transactional) Insert(ctx context.Context, doc []byte) error {
+	return t.run(ctx, OperationInsert, doc, t.watcher.Insert)
+}
+
+// Update runs the wrapped Update, in a transaction if enabled
+func (t *transactional) Update(ctx context.Context, doc []byte) error {
+	return t.run(ctx, OperationUpdate, doc, t.watcher.Update)
+}
+
+// Delete runs the wrapped Delete, in a transaction if enabled
+func (t *transactional) Delete(ctx context.Context, doc []byte) error {
+	return t.run(ctx, OperationDelete, doc, t.watcher.Delete)
+}
+
+func (t *transactional) run(ctx context.Context, op string, doc []byte, fn func(context.Context, []byte) error) error {
+	if !t.ops[op] {
+		return fn(ctx, doc)
+	}
+
+	callback := func(sessCtx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sessCtx, doc)
+	}
+
+	if err := Run(ctx, t.executor, callback); err != nil {
+		return fmt.Errorf("failed to %s in transaction: %w", op, err)
+	}
+	return nil
+}
+
+// Run executes callback in a transaction of executor, derived from ctx when the executor is a ContextExecutor
+func Run(ctx context.Context, executor Executor, callback Callback) error {
+	if ce, ok := executor.(ContextExecutor); ok {
+		return ce.WithTransactionContext(ctx, callback)
+	}
+	return executor.WithTransaction(callback)
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package tx
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type ctxKey struct{}
+
+// fakeExecutor runs callbacks without a session and records how many transactions were opened
+type fakeExecutor struct {
+	txs int
+}
+
+func (f *fakeExecutor) WithTransaction(callback Callback) error {
+	return f.WithTransactionContext(context.TODO(), callback)
+}
+
+func (f *fakeExecutor) WithTransactionContext(ctx context.Context, callback Callback) error {
+	f.txs++
+	_, err := callback(mongo.NewSessionContext(ctx, nil))
+	return err
+}
+
+// recordingWatcher remembers the operations and whether they ran with a session context
+type recordingWatcher struct {
+	calls   []string
+	session []bool
+	values  []interface{}
+	fail    error
+}
+
+func (r *recordingWatcher) record(ctx context.Context, op string) error {
+	_, ok := ctx.(mongo.SessionContext)
+	r.calls = append(r.calls, op)
+	r.session = append(r.session, ok)
+	r.values = append(r.values, ctx.Value(ctxKey{}))
+	return r.fail
+}
+
+func (r *recordingWatcher) Insert(ctx context.Context, _ []byte) error {
+	return r.record(ctx, OperationInsert)
+}
+
+func (r *recordingWatcher) Update(ctx context.Context, _ []byte) error {
+	return r.record(ctx, OperationUpdate)
+}
+
+func (r *recordingWatcher) Delete(ctx context.Context, _ []byte) error {
+	return r.record(ctx, OperationDelete)
+}
+
+func TestTransactional(t *testing.T) {
+	ctx := context.WithValue(context.Background(), ctxKey{}, "meta")
+
+	t.Run("all operations", func(t *testing.T) {
+		executor := &fakeExecutor{}
+		inner := &recordingWatcher{}
+		w := Transactional(executor, inner)
+
+		require.NoError(t, w.Insert(ctx, nil))
+		require.NoError(t, w.Update(ctx, nil))
+		require.NoError(t, w.Delete(ctx, nil))
+
+		assert.Equal(t, 3, executor.txs)
+		assert.Equal(t, []string{OperationInsert, OperationUpdate, OperationDelete}, inner.calls)
+		assert.Equal(t, []bool{true, true, true}, inner.session)
+		assert.Equal(t, []interface{}{"meta", "meta", "meta"}, inner.values)
+	})
+
+	t.Run("selected operations", func(t *testing.T) {
+		executor := &fakeExecutor{}
+		inner := &recordingWatcher{}
+		w := Transactional(executor, inner, Operations(OperationDelete))
+
+		require.NoError(t, w.Insert(ctx, nil))
+		require.NoError(t, w.Delete(ctx, nil))
+
+		assert.Equal(t, 1, executor.txs)
+		assert.Equal(t, []bool{false, true}, inner.session)
+	})
+
+	t.Run("watcher error aborts", func(t *testing.T) {
+		fail := errors.New("boom")
+		w := Transactional(&fakeExecutor{}, &recordingWatcher{fail: fail})
+
+		err := w.Update(ctx, nil)
+		assert.ErrorIs(t, err, fail)
+	})
+}
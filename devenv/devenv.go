@@ -0,0 +1,177 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package devenv prepares a plain mongo container for change streams: it initiates a single node
+// replica set and waits until the node is PRIMARY, so examples and integration tests don't need
+// external init scripts.
+package devenv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongo server error codes returned by replSetGetStatus / replSetInitiate
+const (
+	codeAlreadyInitialized = 23
+	codeNotYetInitialized  = 94
+)
+
+// ErrPrimaryTimeout is returned when the node didn't become PRIMARY in time
+var ErrPrimaryTimeout = errors.New("timed out waiting for PRIMARY")
+
+// ReplicaSetOption configures the replica set helper
+type ReplicaSetOption func(*replicaSet)
+
+type replicaSet struct {
+	name         string
+	host         string
+	pollInterval time.Duration
+	timeout      time.Duration
+}
+
+// WithReplicaSetName sets the replica set name, it must match the --replSet flag of mongod (default rs0)
+func WithReplicaSetName(name string) ReplicaSetOption {
+	return func(rs *replicaSet) {
+		rs.name = name
+	}
+}
+
+// WithMemberHost sets the host:port the member advertises to clients (default localhost:27017)
+// when running in docker compose this should be the service name, e.g. mongo:27017
+func WithMemberHost(host string) ReplicaSetOption {
+	return func(rs *replicaSet) {
+		rs.host = host
+	}
+}
+
+// WithPrimaryTimeout limits how long to wait for the node to become PRIMARY (default 30s)
+func WithPrimaryTimeout(timeout, pollInterval time.Duration) ReplicaSetOption {
+	return func(rs *replicaSet) {
+		rs.timeout = timeout
+		rs.pollInterval = pollInterval
+	}
+}
+
+func newReplicaSet(opts ...ReplicaSetOption) *replicaSet {
+	rs := &replicaSet{
+		name:         "rs0",
+		host:         "localhost:27017",
+		pollInterval: 250 * time.Millisecond,
+		timeout:      30 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(rs)
+	}
+	return rs
+}
+
+// initiateCommand builds the replSetInitiate command for a single member set
+func (rs *replicaSet) initiateCommand() bson.D {
+	return bson.D{{Key: "replSetInitiate", Value: bson.D{
+		{Key: "_id", Value: rs.name},
+		{Key: "members", Value: bson.A{
+			bson.D{{Key: "_id", Value: 0}, {Key: "host", Value: rs.host}},
+		}},
+	}}}
+}
+
+// ConnectReplicaSet connects directly to a single mongod started with --replSet, initiates the
+// replica set if needed and returns the client once the node is PRIMARY
+func ConnectReplicaSet(ctx context.Context, uri string, opts ...ReplicaSetOption) (*mongo.Client, error) {
+	clientOpts := options.Client().ApplyURI(uri).SetDirect(true)
+	client, err := mongo.Connect(ctx, clientOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", uri, err)
+	}
+
+	if err = InitiateReplicaSet(ctx, client, opts...); err != nil {
+		_ = client.Disconnect(context.Background())
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// InitiateReplicaSet runs rs.initiate() unless the replica set is already initiated and waits for PRIMARY
+func InitiateReplicaSet(ctx context.Context, client *mongo.Client, opts ...ReplicaSetOption) error {
+	rs := newReplicaSet(opts...)
+	admin := client.Database("admin")
+
+	err := admin.RunCommand(ctx, bson.D{{Key: "replSetGetStatus", Value: 1}}).Err()
+	switch {
+	case err == nil:
+		log.Tracef("replica set already initiated")
+	case hasErrorCode(err, codeNotYetInitialized):
+		log.Infof("initiating replica set %s with member %s", rs.name, rs.host)
+		err = admin.RunCommand(ctx, rs.initiateCommand()).Err()
+		if err != nil && !hasErrorCode(err, codeAlreadyInitialized) {
+			return fmt.Errorf("failed to initiate replica set: %w", err)
+		}
+	default:
+		return fmt.Errorf("failed to get replica set status: %w", err)
+	}
+
+	return rs.waitForPrimary(ctx, admin)
+}
+
+// WaitForPrimary polls the node until it reports itself as writable PRIMARY
+func WaitForPrimary(ctx context.Context, client *mongo.Client, opts ...ReplicaSetOption) error {
+	return newReplicaSet(opts...).waitForPrimary(ctx, client.Database("admin"))
+}
+
+func (rs *replicaSet) waitForPrimary(ctx context.Context, admin *mongo.Database) error {
+	ctx, cancel := context.WithTimeout(ctx, rs.timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(rs.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		var hello struct {
+			IsWritablePrimary bool `bson:"isWritablePrimary"`
+			IsMaster          bool `bson:"ismaster"`
+		}
+		// isMaster is understood by all server versions, newer ones report both fields
+		err := admin.RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&hello)
+		if err == nil && (hello.IsWritablePrimary || hello.IsMaster) {
+			log.Infof("replica set %s is PRIMARY", rs.name)
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if err != nil {
+				return fmt.Errorf("%w: %v", ErrPrimaryTimeout, err)
+			}
+			return ErrPrimaryTimeout
+		case <-ticker.C:
+		}
+	}
+}
+
+func hasErrorCode(err error, code int) bool {
+	var se mongo.ServerError
+	return errors.As(err, &se) && se.HasErrorCode(code)
+}
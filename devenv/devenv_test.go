@@ -0,0 +1,48 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package devenv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestInitiateCommand(t *testing.T) {
+	rs := newReplicaSet(WithReplicaSetName("rs1"), WithMemberHost("mongo:27017"))
+
+	expected := bson.D{{Key: "replSetInitiate", Value: bson.D{
+		{Key: "_id", Value: "rs1"},
+		{Key: "members", Value: bson.A{
+			bson.D{{Key: "_id", Value: 0}, {Key: "host", Value: "mongo:27017"}},
+		}},
+	}}}
+	assert.Equal(t, expected, rs.initiateCommand())
+}
+
+func TestReplicaSetDefaults(t *testing.T) {
+	rs := newReplicaSet()
+	assert.Equal(t, "rs0", rs.name)
+	assert.Equal(t, "localhost:27017", rs.host)
+
+	rs = newReplicaSet(WithPrimaryTimeout(time.Second, 10*time.Millisecond))
+	assert.Equal(t, time.Second, rs.timeout)
+	assert.Equal(t, 10*time.Millisecond, rs.pollInterval)
+}
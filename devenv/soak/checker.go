@@ -0,0 +1,219 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package soak
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+	"github.com/mmtracker/mongowatch/devenv"
+)
+
+// Violation is a broken invariant
+type Violation struct {
+	Key    string
+	Reason string
+}
+
+// Report is the outcome of a soak run
+type Report struct {
+	Ops      int
+	Events   int
+	Restarts int
+	Duration time.Duration
+	// Duplicates counts redelivered events, expected after restarts with at-least-once delivery
+	Duplicates int
+	// Unexpected counts events of operations the checker wasn't told about, e.g. writes interrupted at shutdown
+	Unexpected int
+	// Lost are the operations never observed as an event
+	Lost []string
+	// OutOfOrder are events observed after a later event of the same key
+	OutOfOrder []Violation
+	// CheckpointRegressions are saved resume points older than a previously saved one
+	CheckpointRegressions []Violation
+}
+
+// OK reports whether every invariant held
+func (r Report) OK() bool {
+	return len(r.Lost) == 0 && len(r.OutOfOrder) == 0 && len(r.CheckpointRegressions) == 0
+}
+
+// String formats the report for logs and CI output
+func (r Report) String() string {
+	var b strings.Builder
+	status := "PASS"
+	if !r.OK() {
+		status = "FAIL"
+	}
+	fmt.Fprintf(&b, "soak %s after %s: %d ops, %d events, %d duplicates, %d unexpected, %d restarts\n",
+		status, r.Duration.Round(time.Second), r.Ops, r.Events, r.Duplicates, r.Unexpected, r.Restarts)
+	fmt.Fprintf(&b, "lost: %d, out of order: %d, checkpoint regressions: %d\n", len(r.Lost), len(r.OutOfOrder), len(r.CheckpointRegressions))
+	for _, op := range limit(r.Lost, 20) {
+		fmt.Fprintf(&b, "  lost %s\n", op)
+	}
+	for _, v := range limit(r.OutOfOrder, 20) {
+		fmt.Fprintf(&b, "  out of order %s: %s\n", v.Key, v.Reason)
+	}
+	for _, v := range limit(r.CheckpointRegressions, 20) {
+		fmt.Fprintf(&b, "  checkpoint regression %s: %s\n", v.Key, v.Reason)
+	}
+	return b.String()
+}
+
+func limit[T any](items []T, n int) []T {
+	if len(items) > n {
+		return items[:n]
+	}
+	return items
+}
+
+// Checker verifies the events of a devenv workload: every operation is observed, the events of a key are
+// observed in write order, and saved checkpoints never move backwards. It is safe for concurrent use.
+type Checker struct {
+	mu       sync.Mutex
+	expected map[string]bool
+	observed map[string]int
+	// lastSeq is the seq of the latest event observed per key, deleted keys are marked with -1
+	lastSeq map[string]int64
+	report  Report
+
+	lastCheckpoint primitive.Timestamp
+}
+
+// NewChecker creates an empty checker
+func NewChecker() *Checker {
+	return &Checker{expected: map[string]bool{}, observed: map[string]int{}, lastSeq: map[string]int64{}}
+}
+
+// Expect registers an applied operation, pass it as devenv.WorkloadConfig.OnOp
+func (c *Checker) Expect(op devenv.WorkloadOp) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expected[opID(op.Key, op.Op, op.Seq)] = true
+	c.report.Ops++
+}
+
+// Observe registers a processed event
+func (c *Checker) Observe(ce mongowatch.ChangeStreamEvent) {
+	seq, ok := eventSeq(ce)
+	if ce.OperationType != devenv.OpDelete && !ok {
+		return
+	}
+	id := opID(ce.DocumentKey, ce.OperationType, seq)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.report.Events++
+	c.observed[id]++
+	if c.observed[id] > 1 {
+		c.report.Duplicates++
+		return
+	}
+
+	last, seen := c.lastSeq[ce.DocumentKey]
+	switch {
+	case seen && last < 0:
+		c.report.OutOfOrder = append(c.report.OutOfOrder, Violation{Key: ce.DocumentKey, Reason: fmt.Sprintf("%s %d after delete", ce.OperationType, seq)})
+	case ce.OperationType == devenv.OpDelete:
+		c.lastSeq[ce.DocumentKey] = -1
+	case seen && seq < last:
+		c.report.OutOfOrder = append(c.report.OutOfOrder, Violation{Key: ce.DocumentKey, Reason: fmt.Sprintf("%s %d after %d", ce.OperationType, seq, last)})
+	default:
+		c.lastSeq[ce.DocumentKey] = seq
+	}
+}
+
+// Checkpoint registers a saved resume point
+func (c *Checker) Checkpoint(point mongowatch.ChangeStreamResumePoint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if point.Timestamp.Before(c.lastCheckpoint) {
+		c.report.CheckpointRegressions = append(c.report.CheckpointRegressions, Violation{
+			Key:    fmt.Sprint(point.ID.TokenData),
+			Reason: fmt.Sprintf("%d.%d saved after %d.%d", point.Timestamp.T, point.Timestamp.I, c.lastCheckpoint.T, c.lastCheckpoint.I),
+		})
+		return
+	}
+	c.lastCheckpoint = point.Timestamp
+}
+
+// Pending counts the expected operations not observed yet
+func (c *Checker) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var pending int
+	for id := range c.expected {
+		if c.observed[id] == 0 {
+			pending++
+		}
+	}
+	return pending
+}
+
+// Report returns the invariant check results so far
+func (c *Checker) Report() Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	report := c.report
+	report.Lost = nil
+	for id := range c.expected {
+		if c.observed[id] == 0 {
+			report.Lost = append(report.Lost, id)
+		}
+	}
+	sort.Strings(report.Lost)
+	for id := range c.observed {
+		if !c.expected[id] {
+			report.Unexpected++
+		}
+	}
+	return report
+}
+
+// opID identifies an operation, deletes have no seq since keys are deleted once
+func opID(key, op string, seq int64) string {
+	if op == devenv.OpDelete {
+		return key + "/delete"
+	}
+	return fmt.Sprintf("%s/%s/%d", key, op, seq)
+}
+
+// eventSeq reads the seq the workload wrote with the event, updates carry it in the update description
+// since the looked up full document may already be newer
+func eventSeq(ce mongowatch.ChangeStreamEvent) (int64, bool) {
+	var value interface{}
+	switch ce.OperationType {
+	case devenv.OpInsert:
+		value = ce.FullDocument["seq"]
+	case devenv.OpUpdate:
+		value = ce.UpdateDescription.UpdatedFields["seq"]
+	}
+	switch v := value.(type) {
+	case int64:
+		return v, true
+	case int32:
+		return int64(v), true
+	}
+	return 0, false
+}
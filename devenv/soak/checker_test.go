@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package soak
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+	"github.com/mmtracker/mongowatch/devenv"
+)
+
+func insert(key string, seq int64) mongowatch.ChangeStreamEvent {
+	return mongowatch.ChangeStreamEvent{OperationType: devenv.OpInsert, DocumentKey: key, FullDocument: primitive.M{"seq": seq}}
+}
+
+func update(key string, seq int64) mongowatch.ChangeStreamEvent {
+	ce := mongowatch.ChangeStreamEvent{OperationType: devenv.OpUpdate, DocumentKey: key}
+	ce.UpdateDescription.UpdatedFields = map[string]interface{}{"seq": seq}
+	return ce
+}
+
+func TestCheckerInvariants(t *testing.T) {
+	c := NewChecker()
+	for _, op := range []devenv.WorkloadOp{
+		{Seq: 1, Op: devenv.OpInsert, Key: "a"},
+		{Seq: 2, Op: devenv.OpUpdate, Key: "a"},
+		{Seq: 3, Op: devenv.OpInsert, Key: "b"},
+		{Seq: 4, Op: devenv.OpDelete, Key: "a"},
+		{Seq: 5, Op: devenv.OpUpdate, Key: "b"},
+	} {
+		c.Expect(op)
+	}
+
+	c.Observe(insert("a", 1))
+	c.Observe(update("a", 2))
+	// redelivered after a restart
+	c.Observe(insert("a", 1))
+	c.Observe(mongowatch.ChangeStreamEvent{OperationType: devenv.OpDelete, DocumentKey: "a"})
+	c.Observe(update("b", 5))
+	c.Observe(insert("b", 3))
+	assert.Zero(t, c.Pending())
+
+	report := c.Report()
+	assert.Equal(t, 5, report.Ops)
+	assert.Equal(t, 6, report.Events)
+	assert.Equal(t, 1, report.Duplicates)
+	assert.Empty(t, report.Lost)
+	assert.Equal(t, []Violation{{Key: "b", Reason: "insert 3 after 5"}}, report.OutOfOrder)
+	assert.False(t, report.OK())
+}
+
+func TestCheckerLossAndCheckpoints(t *testing.T) {
+	c := NewChecker()
+	c.Expect(devenv.WorkloadOp{Seq: 1, Op: devenv.OpInsert, Key: "a"})
+	c.Expect(devenv.WorkloadOp{Seq: 2, Op: devenv.OpDelete, Key: "a"})
+	c.Observe(insert("a", 1))
+	c.Observe(insert("z", 9))
+
+	c.Checkpoint(mongowatch.ChangeStreamResumePoint{Timestamp: primitive.Timestamp{T: 2}})
+	c.Checkpoint(mongowatch.ChangeStreamResumePoint{Timestamp: primitive.Timestamp{T: 1}})
+
+	report := c.Report()
+	assert.Equal(t, []string{"a/delete"}, report.Lost)
+	assert.Equal(t, 1, report.Unexpected)
+	assert.Len(t, report.CheckpointRegressions, 1)
+	assert.Contains(t, report.String(), "soak FAIL")
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package soak runs a processor against generated traffic for extended periods while checking the delivery
+// invariants of the stream: no event loss, write order per key and monotonic checkpoints.
+package soak
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mmtracker/mongowatch"
+	"github.com/mmtracker/mongowatch/devenv"
+	"github.com/mmtracker/mongowatch/stream"
+)
+
+// Config configures a soak run
+type Config struct {
+	// Workload is the generated traffic, Workload.Ops caps the operations of a run bounded by Duration
+	Workload devenv.WorkloadConfig
+	// Duration bounds the traffic generation, 0 runs Workload.Ops operations
+	Duration time.Duration
+	// RestartEvery stops and restarts the processor periodically to exercise resuming, 0 never restarts
+	RestartEvery time.Duration
+	// Settle is how long the processor may take to catch up once traffic stops, 1m by default
+	Settle time.Duration
+	// ProcessorOptions are passed to the processor under test
+	ProcessorOptions []stream.ProcessorOption
+}
+
+// Run drops target and its resume collection in localDB, then runs the workload against target while a processor
+// watches it, and reports the invariants checked on the processed events
+func Run(ctx context.Context, target *mongo.Collection, localDB *mongo.Database, cfg Config) (Report, error) {
+	if cfg.Settle <= 0 {
+		cfg.Settle = time.Minute
+	}
+	const resumeSuffix = "_soak_resume"
+	if err := target.Drop(ctx); err != nil {
+		return Report{}, fmt.Errorf("failed to drop soak target: %w", err)
+	}
+	resumeCol := stream.NewCollection(target.Name()+resumeSuffix, localDB)
+	if err := resumeCol.Drop(ctx); err != nil {
+		return Report{}, fmt.Errorf("failed to drop soak resume collection: %w", err)
+	}
+
+	checker := NewChecker()
+	resume := checkedResume{StreamResume: stream.NewStreamResumeRepository(resumeCol), checker: checker}
+	opts := append([]stream.ProcessorOption{
+		stream.WithStreamResume(resume),
+		stream.WithManagerOptions(stream.WithMiddleware(observe(checker))),
+	}, cfg.ProcessorOptions...)
+	dp := stream.NewDataProcessor(target.Database(), target.Name(), resumeSuffix, localDB, opts...)
+
+	started := time.Now()
+	stop := supervise(dp, cfg.RestartEvery)
+
+	workload := cfg.Workload
+	workload.OnOp = checker.Expect
+	genCtx := ctx
+	if cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		genCtx, cancel = context.WithTimeout(ctx, cfg.Duration)
+		defer cancel()
+		if workload.Ops <= 0 {
+			workload.Ops = math.MaxInt
+		}
+	}
+	_, err := devenv.GenerateWorkload(genCtx, target, workload)
+	if err != nil && !(cfg.Duration > 0 && errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil) {
+		stop()
+		return Report{}, fmt.Errorf("failed to generate soak traffic: %w", err)
+	}
+
+	// let the processor catch up
+	deadline := time.Now().Add(cfg.Settle)
+	for checker.Pending() > 0 && time.Now().Before(deadline) && ctx.Err() == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	report := checker.Report()
+	report.Restarts = stop()
+	report.Duration = time.Since(started)
+	return report, nil
+}
+
+// supervise keeps the processor running, restarting it every interval; stop ends it and returns the restart count
+func supervise(dp *stream.DocumentProcessor, every time.Duration) func() int {
+	done := make(chan struct{})
+	restarts := make(chan int, 1)
+	go func() {
+		var n int
+		defer func() { restarts <- n }()
+		for {
+			exited := make(chan error, 1)
+			go func() { exited <- dp.Start(noopWatcher{}, options.UpdateLookup) }()
+
+			var restart <-chan time.Time
+			if every > 0 {
+				restart = time.After(every)
+			}
+			select {
+			case <-done:
+				dp.Stop()
+				<-exited
+				return
+			case err := <-exited:
+				log.Errorf("soak processor exited: %v", err)
+				time.Sleep(time.Second)
+			case <-restart:
+				dp.Stop()
+				<-exited
+			}
+			n++
+		}
+	}()
+	return func() int {
+		close(done)
+		return <-restarts
+	}
+}
+
+// observe records the events the rest of the chain processed successfully
+func observe(checker *Checker) mongowatch.ChangeEventMiddleware {
+	return func(next mongowatch.ChangeEventDispatcherFunc) mongowatch.ChangeEventDispatcherFunc {
+		return func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+			if err = next(ctx, ce, err); err != nil {
+				return err
+			}
+			checker.Observe(ce)
+			return nil
+		}
+	}
+}
+
+// checkedResume reports every saved resume point to the checker
+type checkedResume struct {
+	mongowatch.StreamResume
+	checker *Checker
+}
+
+func (r checkedResume) SaveResumePoint(ctx context.Context, ce mongowatch.ChangeStreamResumePoint) error {
+	if err := r.StreamResume.SaveResumePoint(ctx, ce); err != nil {
+		return err
+	}
+	r.checker.Checkpoint(ce)
+	return nil
+}
+
+// noopWatcher accepts every document, the checker observes the events before it
+type noopWatcher struct{}
+
+func (noopWatcher) Insert(ctx context.Context, doc []byte) error { return nil }
+func (noopWatcher) Update(ctx context.Context, doc []byte) error { return nil }
+func (noopWatcher) Delete(ctx context.Context, doc []byte) error { return nil }
@@ -0,0 +1,181 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package devenv
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Workload operation types
+const (
+	OpInsert = "insert"
+	OpUpdate = "update"
+	OpDelete = "delete"
+)
+
+// WorkloadConfig describes generated traffic against a collection
+type WorkloadConfig struct {
+	// Ops is the number of operations to run
+	Ops int
+	// Inserts, Updates and Deletes weigh the operation mix, 70/25/5 by default
+	Inserts, Updates, Deletes int
+	// DocBytes is the approximate size of the payload field of a document, 256 by default
+	DocBytes int
+	// Skew concentrates updates and deletes on few hot keys following a Zipf distribution with s = Skew,
+	// values <= 1 pick keys uniformly
+	Skew float64
+	// Burst runs that many operations back to back before pausing BurstPause, 0 runs without pauses
+	Burst      int
+	BurstPause time.Duration
+	// Seed makes the workload reproducible
+	Seed int64
+	// OnOp is called after every applied operation, e.g. to record the expected events
+	OnOp func(op WorkloadOp)
+}
+
+// WorkloadOp is one generated operation. Documents carry their key as _id and the Seq of the last write,
+// Seq increases with every operation, so consumers can check ordering per key.
+type WorkloadOp struct {
+	Seq int64
+	Op  string
+	Key string
+}
+
+// WorkloadReport summarizes an executed workload
+type WorkloadReport struct {
+	Inserts, Updates, Deletes int
+	Duration                  time.Duration
+}
+
+// workload plans the operations of a config
+type workload struct {
+	cfg  WorkloadConfig
+	rnd  *rand.Rand
+	zipf *rand.Zipf
+	// live are the keys inserted and not deleted yet, in insertion order, so the Zipf head is the oldest keys
+	live    []string
+	nextKey int
+	seq     int64
+}
+
+func newWorkload(cfg WorkloadConfig) *workload {
+	if cfg.Inserts == 0 && cfg.Updates == 0 && cfg.Deletes == 0 {
+		cfg.Inserts, cfg.Updates, cfg.Deletes = 70, 25, 5
+	}
+	if cfg.DocBytes <= 0 {
+		cfg.DocBytes = 256
+	}
+	return &workload{cfg: cfg, rnd: rand.New(rand.NewSource(cfg.Seed))}
+}
+
+// next plans the next operation, updates and deletes fall back to inserts while no document is live
+func (w *workload) next() WorkloadOp {
+	w.seq++
+	op := OpInsert
+	if len(w.live) > 0 {
+		n := w.rnd.Intn(w.cfg.Inserts + w.cfg.Updates + w.cfg.Deletes)
+		switch {
+		case n >= w.cfg.Inserts+w.cfg.Updates:
+			op = OpDelete
+		case n >= w.cfg.Inserts:
+			op = OpUpdate
+		}
+	}
+
+	if op == OpInsert {
+		key := fmt.Sprintf("key-%d", w.nextKey)
+		w.nextKey++
+		w.live = append(w.live, key)
+		return WorkloadOp{Seq: w.seq, Op: op, Key: key}
+	}
+
+	i := w.pick()
+	key := w.live[i]
+	if op == OpDelete {
+		w.live = append(w.live[:i], w.live[i+1:]...)
+	}
+	return WorkloadOp{Seq: w.seq, Op: op, Key: key}
+}
+
+// pick returns the index of a live key, skewed towards the oldest ones with a Skew above 1
+func (w *workload) pick() int {
+	if w.cfg.Skew <= 1 {
+		return w.rnd.Intn(len(w.live))
+	}
+	// the distribution is rebuilt as the key space changes
+	zipf := rand.NewZipf(w.rnd, w.cfg.Skew, 1, uint64(len(w.live)-1))
+	return int(zipf.Uint64())
+}
+
+// document builds the document written by an insert or update
+func (w *workload) document(op WorkloadOp) bson.M {
+	payload := make([]byte, w.cfg.DocBytes)
+	const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
+	for i := range payload {
+		payload[i] = letters[w.rnd.Intn(len(letters))]
+	}
+	return bson.M{"_id": op.Key, "seq": op.Seq, "payload": string(payload), "updatedAt": time.Now()}
+}
+
+// GenerateWorkload runs the configured operation mix against col, e.g. to load test a consumer watching it
+func GenerateWorkload(ctx context.Context, col *mongo.Collection, cfg WorkloadConfig) (WorkloadReport, error) {
+	w := newWorkload(cfg)
+	var report WorkloadReport
+	started := time.Now()
+
+	for i := 0; i < cfg.Ops; i++ {
+		if cfg.Burst > 0 && i > 0 && i%cfg.Burst == 0 && cfg.BurstPause > 0 {
+			select {
+			case <-ctx.Done():
+				return report, ctx.Err()
+			case <-time.After(cfg.BurstPause):
+			}
+		}
+
+		op := w.next()
+		var err error
+		switch op.Op {
+		case OpInsert:
+			_, err = col.InsertOne(ctx, w.document(op))
+			report.Inserts++
+		case OpUpdate:
+			doc := w.document(op)
+			delete(doc, "_id")
+			_, err = col.UpdateByID(ctx, op.Key, bson.M{"$set": doc})
+			report.Updates++
+		case OpDelete:
+			_, err = col.DeleteOne(ctx, bson.M{"_id": op.Key})
+			report.Deletes++
+		}
+		if err != nil {
+			return report, fmt.Errorf("failed to run %s of %s: %w", op.Op, op.Key, err)
+		}
+		if cfg.OnOp != nil {
+			cfg.OnOp(op)
+		}
+	}
+
+	report.Duration = time.Since(started)
+	return report, nil
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package devenv
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkloadMix(t *testing.T) {
+	w := newWorkload(WorkloadConfig{Seed: 1})
+	live := map[string]bool{}
+	counts := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		op := w.next()
+		assert.Equal(t, int64(i+1), op.Seq)
+		counts[op.Op]++
+		switch op.Op {
+		case OpInsert:
+			assert.False(t, live[op.Key], "keys are never reused")
+			live[op.Key] = true
+		case OpUpdate:
+			assert.True(t, live[op.Key])
+		case OpDelete:
+			assert.True(t, live[op.Key])
+			delete(live, op.Key)
+		}
+	}
+	assert.InDelta(t, 7000, counts[OpInsert], 300)
+	assert.InDelta(t, 2500, counts[OpUpdate], 300)
+	assert.InDelta(t, 500, counts[OpDelete], 150)
+
+	doc := w.document(WorkloadOp{Seq: 1, Op: OpInsert, Key: "key-0"})
+	assert.Len(t, doc["payload"], 256)
+}
+
+func TestWorkloadSkew(t *testing.T) {
+	hits := func(skew float64) int {
+		w := newWorkload(WorkloadConfig{Inserts: 1, Updates: 1, Skew: skew, Seed: 1})
+		var hot int
+		for i := 0; i < 10000; i++ {
+			if op := w.next(); op.Op == OpUpdate && op.Key == "key-0" {
+				hot++
+			}
+		}
+		return hot
+	}
+	assert.Greater(t, hits(2), 10*hits(0))
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mongowatch
+
+import (
+	"reflect"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ChangeKind tells how a field differs between the pre- and post-image
+type ChangeKind string
+
+const (
+	FieldAdded   ChangeKind = "added"
+	FieldChanged ChangeKind = "changed"
+	FieldRemoved ChangeKind = "removed"
+)
+
+// FieldChange is a single difference between two document versions
+type FieldChange struct {
+	// Path is the dotted path of the field, nested documents are descended into, arrays are compared as a whole
+	Path string      `bson:"path" json:"path"`
+	Kind ChangeKind  `bson:"kind" json:"kind"`
+	Old  interface{} `bson:"old,omitempty" json:"old,omitempty"`
+	New  interface{} `bson:"new,omitempty" json:"new,omitempty"`
+}
+
+// Diff compares the pre-image with the post-image of the event, see Diff
+func (ce ChangeStreamEvent) Diff() []FieldChange {
+	return Diff(ce.FullDocumentBeforeChange, ce.FullDocument)
+}
+
+// Diff returns the changes turning before into after ordered by path
+func Diff(before, after primitive.M) []FieldChange {
+	var changes []FieldChange
+	diffDocuments("", before, after, &changes)
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes
+}
+
+func diffDocuments(prefix string, before, after map[string]interface{}, changes *[]FieldChange) {
+	for key, oldValue := range before {
+		path := joinFieldPath(prefix, key)
+		newValue, ok := after[key]
+		if !ok {
+			*changes = append(*changes, FieldChange{Path: path, Kind: FieldRemoved, Old: oldValue})
+			continue
+		}
+
+		oldDoc, oldIsDoc := AsDocument(oldValue)
+		newDoc, newIsDoc := AsDocument(newValue)
+		if oldIsDoc && newIsDoc {
+			diffDocuments(path, oldDoc, newDoc, changes)
+			continue
+		}
+		if !reflect.DeepEqual(oldValue, newValue) {
+			*changes = append(*changes, FieldChange{Path: path, Kind: FieldChanged, Old: oldValue, New: newValue})
+		}
+	}
+
+	for key, newValue := range after {
+		if _, ok := before[key]; !ok {
+			*changes = append(*changes, FieldChange{Path: joinFieldPath(prefix, key), Kind: FieldAdded, New: newValue})
+		}
+	}
+}
+
+func joinFieldPath(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mongowatch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func Test_ChangeStreamEvent_Diff(t *testing.T) {
+	ce := ChangeStreamEvent{
+		FullDocumentBeforeChange: primitive.M{
+			"status":    "trial",
+			"paidUntil": "2023-01-01",
+			"owner":     primitive.M{"name": "John", "phone": "+370"},
+			"tags":      primitive.A{"a"},
+		},
+		FullDocument: primitive.M{
+			"status":    "trial",
+			"paidUntil": "2024-01-01",
+			"owner":     primitive.M{"name": "John", "email": "john@example.com"},
+			"tags":      primitive.A{"a", "b"},
+		},
+	}
+
+	assert.Equal(t, []FieldChange{
+		{Path: "owner.email", Kind: FieldAdded, New: "john@example.com"},
+		{Path: "owner.phone", Kind: FieldRemoved, Old: "+370"},
+		{Path: "paidUntil", Kind: FieldChanged, Old: "2023-01-01", New: "2024-01-01"},
+		{Path: "tags", Kind: FieldChanged, Old: primitive.A{"a"}, New: primitive.A{"a", "b"}},
+	}, ce.Diff())
+
+	assert.Empty(t, Diff(primitive.M{"a": int32(1)}, primitive.M{"a": int32(1)}))
+	assert.Equal(t, []FieldChange{{Path: "a", Kind: FieldAdded, New: int32(1)}}, Diff(nil, primitive.M{"a": int32(1)}))
+}
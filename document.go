@@ -0,0 +1,53 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mongowatch
+
+import (
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// AsDocument returns value as a map if it holds a document, decoded change events carry nested documents
+// as primitive.M, primitive.D or plain maps depending on the decoder
+func AsDocument(value interface{}) (map[string]interface{}, bool) {
+	switch v := value.(type) {
+	case primitive.M:
+		return v, true
+	case map[string]interface{}:
+		return v, true
+	case primitive.D:
+		return v.Map(), true
+	}
+	return nil, false
+}
+
+// LookupField resolves a dotted path (e.g. "owner.tenantId") in a document
+func LookupField(doc map[string]interface{}, path string) (interface{}, bool) {
+	var current interface{} = doc
+	for _, key := range strings.Split(path, ".") {
+		m, ok := AsDocument(current)
+		if !ok {
+			return nil, false
+		}
+		if current, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
@@ -0,0 +1,44 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mongowatch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestLookupField(t *testing.T) {
+	doc := primitive.M{
+		"owner": primitive.D{{Key: "tenant", Value: map[string]interface{}{"id": "t1"}}},
+		"name":  "a",
+	}
+
+	value, ok := LookupField(doc, "owner.tenant.id")
+	assert.True(t, ok)
+	assert.Equal(t, "t1", value)
+	value, ok = LookupField(doc, "name")
+	assert.True(t, ok)
+	assert.Equal(t, "a", value)
+
+	_, ok = LookupField(doc, "name.first")
+	assert.False(t, ok)
+	_, ok = LookupField(doc, "owner.missing")
+	assert.False(t, ok)
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mongowatch
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ProcessingError wraps a handler error with the context of the change stream event that failed,
+// use errors.As to extract it from the error returned by the watcher
+type ProcessingError struct {
+	Token         ResumeToken
+	Timestamp     primitive.Timestamp
+	OperationType string
+	Database      string
+	Collection    string
+	DocumentKey   string
+	// Attempt counts how many times in a row processing of this event failed, starting at 1
+	Attempt int
+	Err     error
+}
+
+// NewProcessingError builds a ProcessingError for the event
+func NewProcessingError(ce ChangeStreamEvent, attempt int, err error) *ProcessingError {
+	return &ProcessingError{
+		Token:         ce.ID,
+		Timestamp:     ce.Timestamp,
+		OperationType: ce.OperationType,
+		Database:      ce.Database,
+		Collection:    ce.Collection,
+		DocumentKey:   ce.DocumentKey,
+		Attempt:       attempt,
+		Err:           err,
+	}
+}
+
+func (e *ProcessingError) Error() string {
+	return fmt.Sprintf(
+		"failed to process %s event %v at %d.%d on %s.%s (documentKey: %s, attempt: %d): %v",
+		e.OperationType,
+		e.Token.TokenData,
+		e.Timestamp.T,
+		e.Timestamp.I,
+		e.Database,
+		e.Collection,
+		e.DocumentKey,
+		e.Attempt,
+		e.Err,
+	)
+}
+
+// Unwrap returns the underlying handler error
+func (e *ProcessingError) Unwrap() error {
+	return e.Err
+}
@@ -18,6 +18,11 @@
 package mongowatch
 
 import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -31,10 +36,91 @@ type ChangeStreamResumePoint struct {
 	// OperationType == 'invalidate' means that the resume point is no longer valid,
 	// and we need to use startAfter to resume the stream
 	OperationType string `bson:"operationType" json:"operationType"`
+	// Epoch is the fencing token of the writer, points from stale epochs never override newer ones
+	Epoch int64 `bson:"epoch,omitempty" json:"epoch,omitempty"`
+	// Namespace and Cluster identify the stream the point was written for, see stream.ResumeTarget
+	Namespace string `bson:"namespace,omitempty" json:"namespace,omitempty"`
+	Cluster   string `bson:"cluster,omitempty" json:"cluster,omitempty"`
+	// SchemaVersion is the document version, stores migrate older points when reading them
+	SchemaVersion int `bson:"schemaVersion" json:"schemaVersion"`
+	// StoredAt is when the point was written, zero for points written by older releases
+	StoredAt time.Time `bson:"storedAt,omitempty" json:"storedAt,omitempty"`
+	// SinkOffset is the offset a CommitWatcher returned when confirming the events up to the point
+	SinkOffset string `bson:"sinkOffset,omitempty" json:"sinkOffset,omitempty"`
+}
+
+// ResumePointInfo describes a stored resume point for health checks, tooling and metrics
+type ResumePointInfo struct {
+	Token         ResumeToken         `json:"token"`
+	OperationType string              `json:"operationType"`
+	ClusterTime   primitive.Timestamp `json:"clusterTime"`
+	StoredAt      time.Time           `json:"storedAt,omitempty"`
+	SinkOffset    string              `json:"sinkOffset,omitempty"`
+	// TokenAge is the time since the event of the token happened, it keeps growing while the collection is idle
+	TokenAge time.Duration `json:"tokenAge"`
+	// Lag estimates how far behind the stream was: the time between the event and storing its resume point
+	Lag time.Duration `json:"lag"`
+}
+
+// Describe summarizes the resume point as of now, durations are zero when the point lacks the times to compute them
+func (rp ChangeStreamResumePoint) Describe(now time.Time) ResumePointInfo {
+	info := ResumePointInfo{
+		Token:         rp.ID,
+		OperationType: rp.OperationType,
+		ClusterTime:   rp.Timestamp,
+		StoredAt:      rp.StoredAt,
+		SinkOffset:    rp.SinkOffset,
+	}
+	if rp.Timestamp.T == 0 {
+		return info
+	}
+	happened := time.Unix(int64(rp.Timestamp.T), 0)
+	info.TokenAge = now.Sub(happened)
+	if !rp.StoredAt.IsZero() {
+		info.Lag = rp.StoredAt.Sub(happened)
+	}
+	return info
 }
 
 const OperationTypeInvalidate = "invalidate"
 
+// StartPosition tells where a change stream starts from, set either Token or Timestamp
+type StartPosition struct {
+	// Token resumes right after the event the token belongs to
+	Token *ResumeToken
+	// Timestamp starts at the first event at or after the cluster time
+	Timestamp *primitive.Timestamp
+}
+
+// ResumePoint converts the position into a resume point to be stored in a StreamResume
+func (p StartPosition) ResumePoint() (ChangeStreamResumePoint, error) {
+	switch {
+	case p.Token != nil && p.Timestamp != nil:
+		return ChangeStreamResumePoint{}, errors.New("start position must have either a token or a timestamp, not both")
+	case p.Token != nil:
+		return ChangeStreamResumePoint{ID: *p.Token}, nil
+	case p.Timestamp != nil:
+		// resume points are keyed by token, the timestamp based point gets a synthetic one
+		return ChangeStreamResumePoint{
+			ID:        ResumeToken{TokenData: fmt.Sprintf("%s%d-%d", seekTokenPrefix, p.Timestamp.T, p.Timestamp.I)},
+			Timestamp: *p.Timestamp,
+		}, nil
+	}
+	return ChangeStreamResumePoint{}, errors.New("start position must have a token or a timestamp")
+}
+
+// seekTokenPrefix marks the synthetic tokens of timestamp based start positions
+const seekTokenPrefix = "seek-"
+
+// IsSeek tells whether the point was set by seeking rather than by checkpointing an event,
+// such points have a synthetic token or no timestamp
+func (rp ChangeStreamResumePoint) IsSeek() bool {
+	if token, ok := rp.ID.TokenData.(string); ok && strings.HasPrefix(token, seekTokenPrefix) {
+		return true
+	}
+	return rp.Timestamp.IsZero()
+}
+
 // ChangeStreamEvent is the customized representation of a MongoDB change stream event that is captured and processed by
 // this application.
 type ChangeStreamEvent struct {
@@ -50,11 +136,35 @@ type ChangeStreamEvent struct {
 	DocumentKey              string      `bson:"documentKey" json:"documentKey"`
 	FullDocument             primitive.M `bson:"fullDocument" json:"fullDocument"`
 	FullDocumentBeforeChange primitive.M `bson:"fullDocumentBeforeChange" json:"fullDocumentBeforeChange"`
-	// TODO: get previous field values e.g. paidUntil
+	// HasPreImage tells whether the server sent a pre-image, with options.WhenAvailable it may be missing
+	HasPreImage bool `bson:"hasPreImage,omitempty" json:"hasPreImage,omitempty"`
+	// SuspectedOrphan flags events on documents of a chunk the shard doesn't own, see stream.OrphanFilter
+	SuspectedOrphan bool `bson:"suspectedOrphan,omitempty" json:"suspectedOrphan,omitempty"`
+	// updates can be narrowed down to the fields of interest, e.g. paidUntil, with stream.WatchOnlyFieldChanges
 	UpdateDescription struct {
 		UpdatedFields map[string]interface{} `bson:"updatedFields" json:"updatedFields"`
 		RemovedFields interface{}            `bson:"removedFields" json:"removedFields"`
 	} `bson:"updateDescription" json:"updateDescription"`
+	// OldValues holds the previous values of the fields selected with stream.WithOldValues, keyed by dotted path
+	OldValues map[string]interface{} `bson:"oldValues,omitempty" json:"oldValues,omitempty"`
+	// Key is the logical key derived by stream.WithKeyExtractor, empty when the documentKey is the logical key
+	Key string `bson:"key,omitempty" json:"key,omitempty"`
+	// To is the new namespace of rename events
+	To *Namespace `bson:"to,omitempty" json:"to,omitempty"`
+}
+
+// Namespace is a database and collection pair as sent in change events
+type Namespace struct {
+	Database   string `bson:"db" json:"db"`
+	Collection string `bson:"coll" json:"coll"`
+}
+
+// LogicalKey returns the key used for ordering and partitioning, Key when set and DocumentKey otherwise
+func (ce ChangeStreamEvent) LogicalKey() string {
+	if ce.Key != "" {
+		return ce.Key
+	}
+	return ce.DocumentKey
 }
 
 // ResumeToken denotes the token associated with a MongoDB change stream event, which may be used to resume receiving change stream events from
@@ -0,0 +1,90 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mongowatch
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// EventMeta describes the event a handler context belongs to, for code deep in handler call stacks
+// (loggers, tracers) that doesn't get the event itself. It is taken from the event as received, before transforms.
+type EventMeta struct {
+	// EventID is the resume token data of the event, unique within the stream
+	EventID       string              `json:"eventId"`
+	Token         ResumeToken         `json:"token"`
+	ClusterTime   primitive.Timestamp `json:"clusterTime"`
+	OperationType string              `json:"operationType"`
+	Database      string              `json:"database"`
+	Collection    string              `json:"collection"`
+	DocumentKey   string              `json:"documentKey"`
+	// Key is the logical key derived by stream.WithKeyExtractor, empty when the documentKey is the logical key
+	Key string `json:"key,omitempty"`
+	// HasPreImage tells whether the event carried a pre-image, see ChangeStreamEvent.HasPreImage
+	HasPreImage bool `json:"hasPreImage"`
+	// UUID is the deterministic UUID of the event, see ChangeStreamEvent.UUID
+	UUID string `json:"uuid"`
+}
+
+// MetaOf returns the metadata of the event
+func MetaOf(ce ChangeStreamEvent) EventMeta {
+	var id string
+	if ce.ID.TokenData != nil {
+		id = fmt.Sprint(ce.ID.TokenData)
+	}
+	return EventMeta{
+		EventID:       id,
+		UUID:          ce.UUID(),
+		Token:         ce.ID,
+		ClusterTime:   ce.Timestamp,
+		OperationType: ce.OperationType,
+		Database:      ce.Database,
+		Collection:    ce.Collection,
+		DocumentKey:   ce.DocumentKey,
+		Key:           ce.Key,
+		HasPreImage:   ce.HasPreImage,
+	}
+}
+
+type eventMetaKey struct{}
+
+// ContextWithEvent returns a context carrying the metadata of the event
+func ContextWithEvent(ctx context.Context, ce ChangeStreamEvent) context.Context {
+	return context.WithValue(ctx, eventMetaKey{}, MetaOf(ce))
+}
+
+// EventMetaFromContext returns the metadata of the event being dispatched with the context
+func EventMetaFromContext(ctx context.Context) (EventMeta, bool) {
+	meta, ok := ctx.Value(eventMetaKey{}).(EventMeta)
+	return meta, ok
+}
+
+// EventIDFromContext returns the ID of the event being dispatched with the context, empty without one
+func EventIDFromContext(ctx context.Context) string {
+	meta, _ := EventMetaFromContext(ctx)
+	return meta.EventID
+}
+
+// ResumeTokenFromContext returns the resume token of the event being dispatched with the context,
+// consumers committing offsets to their own store resume from it with StartPosition.Token
+func ResumeTokenFromContext(ctx context.Context) (ResumeToken, bool) {
+	meta, ok := EventMetaFromContext(ctx)
+	return meta.Token, ok
+}
@@ -0,0 +1,56 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mongowatch
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestEventMetaFromContext(t *testing.T) {
+	ce := ChangeStreamEvent{
+		ID:            ResumeToken{TokenData: "8264A1"},
+		Timestamp:     primitive.Timestamp{T: 10, I: 2},
+		OperationType: "update",
+		Database:      "app",
+		Collection:    "users",
+		DocumentKey:   "u1",
+	}
+
+	_, ok := EventMetaFromContext(context.Background())
+	assert.False(t, ok)
+	assert.Empty(t, EventIDFromContext(context.Background()))
+
+	ctx := ContextWithEvent(context.Background(), ce)
+	meta, ok := EventMetaFromContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, EventMeta{
+		EventID:       "8264A1",
+		UUID:          ce.UUID(),
+		Token:         ce.ID,
+		ClusterTime:   ce.Timestamp,
+		OperationType: "update",
+		Database:      "app",
+		Collection:    "users",
+		DocumentKey:   "u1",
+	}, meta)
+	assert.Equal(t, "8264A1", EventIDFromContext(ctx))
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mongowatch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func Test_StartPosition_ResumePoint(t *testing.T) {
+	token := ResumeToken{TokenData: "8264"}
+	ts := primitive.Timestamp{T: 1686830000, I: 2}
+
+	point, err := StartPosition{Token: &token}.ResumePoint()
+	assert.NoError(t, err)
+	assert.Equal(t, token, point.ID)
+	assert.True(t, point.Timestamp.IsZero())
+
+	point, err = StartPosition{Timestamp: &ts}.ResumePoint()
+	assert.NoError(t, err)
+	assert.Equal(t, ts, point.Timestamp)
+
+	_, err = StartPosition{}.ResumePoint()
+	assert.Error(t, err)
+	_, err = StartPosition{Token: &token, Timestamp: &ts}.ResumePoint()
+	assert.Error(t, err)
+}
+
+func Test_ChangeStreamResumePoint_IsSeek(t *testing.T) {
+	token := ResumeToken{TokenData: "8264"}
+	ts := primitive.Timestamp{T: 1686830000, I: 2}
+
+	point, _ := StartPosition{Token: &token}.ResumePoint()
+	assert.True(t, point.IsSeek())
+	point, _ = StartPosition{Timestamp: &ts}.ResumePoint()
+	assert.True(t, point.IsSeek())
+	assert.False(t, ChangeStreamResumePoint{ID: token, Timestamp: ts}.IsSeek())
+}
+
+func Test_ChangeStreamResumePoint_Describe(t *testing.T) {
+	now := time.Unix(1686830600, 0)
+	point := ChangeStreamResumePoint{
+		ID:            ResumeToken{TokenData: "8264"},
+		Timestamp:     primitive.Timestamp{T: 1686830000, I: 2},
+		OperationType: "update",
+		StoredAt:      time.Unix(1686830003, 0),
+	}
+
+	info := point.Describe(now)
+	assert.Equal(t, "update", info.OperationType)
+	assert.Equal(t, 10*time.Minute, info.TokenAge)
+	assert.Equal(t, 3*time.Second, info.Lag)
+
+	// token only seek positions have no time to compare against
+	info = ChangeStreamResumePoint{ID: point.ID}.Describe(now)
+	assert.Zero(t, info.TokenAge)
+	assert.Zero(t, info.Lag)
+}
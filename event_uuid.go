@@ -0,0 +1,63 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mongowatch
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+)
+
+// eventUUIDNamespace is the UUIDv5 namespace of event UUIDs, changing it changes every UUID ever handed out
+var eventUUIDNamespace = [16]byte{
+	0x6d, 0x6f, 0x6e, 0x67, 0x6f, 0x77, 0x61, 0x74, 0x63, 0x68, 0x2d, 0x65, 0x76, 0x65, 0x6e, 0x74,
+}
+
+// UUID returns a deterministic name based UUID (version 5) derived from the resume token, empty for events
+// without one. Every delivery of the same event gets the same UUID, across retries, restarts and failovers,
+// so consumers can deduplicate on it without parsing Mongo tokens.
+func (ce ChangeStreamEvent) UUID() string {
+	if ce.ID.TokenData == nil {
+		return ""
+	}
+	return tokenUUID(fmt.Sprint(ce.ID.TokenData))
+}
+
+func tokenUUID(token string) string {
+	h := sha1.New()
+	h.Write(eventUUIDNamespace[:])
+	h.Write([]byte(token))
+	sum := h.Sum(nil)
+
+	var u [16]byte
+	copy(u[:], sum)
+	u[6] = (u[6] & 0x0f) | 0x50 // version 5
+	u[8] = (u[8] & 0x3f) | 0x80 // RFC 4122 variant
+
+	buf := make([]byte, 36)
+	hex.Encode(buf[0:8], u[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], u[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], u[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], u[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], u[10:])
+	return string(buf)
+}
@@ -0,0 +1,35 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mongowatch
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChangeStreamEvent_UUID(t *testing.T) {
+	a := ChangeStreamEvent{ID: ResumeToken{TokenData: "8265A1B2C3000000012B022C0100296E5A1004"}}
+	b := ChangeStreamEvent{ID: ResumeToken{TokenData: "8265A1B2C3000000022B022C0100296E5A1004"}}
+
+	assert.Regexp(t, regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-5[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`), a.UUID())
+	assert.Equal(t, a.UUID(), ChangeStreamEvent{ID: a.ID, OperationType: "update"}.UUID(), "UUID depends on the token only")
+	assert.NotEqual(t, a.UUID(), b.UUID())
+	assert.Empty(t, ChangeStreamEvent{}.UUID())
+}
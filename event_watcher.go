@@ -0,0 +1,162 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mongowatch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// EventWatcher is a CollectionWatcher variant receiving the whole change event, with the operation metadata
+// (cluster time, documentKey, updateDescription, pre-image) next to the document. Processors dispatch to it
+// instead of the byte-slice methods when the watcher implements it, see EventCollectionWatcher.
+type EventWatcher interface {
+	InsertEvent(ctx context.Context, ce ChangeStreamEvent) error
+	UpdateEvent(ctx context.Context, ce ChangeStreamEvent) error
+	DeleteEvent(ctx context.Context, ce ChangeStreamEvent) error
+}
+
+// EventCollectionWatcher adapts an EventWatcher to CollectionWatcher, so it can be passed where CollectionWatchers
+// are expected. Processors hand it whole events; callers of the byte-slice methods, e.g. routers, get an event
+// rebuilt from EventMetaFromContext with the JSON payload as its document.
+func EventCollectionWatcher(w EventWatcher) CollectionWatcher {
+	return eventCollectionWatcher{EventWatcher: w}
+}
+
+type eventCollectionWatcher struct {
+	EventWatcher
+}
+
+// Insert rebuilds the event and calls InsertEvent
+func (w eventCollectionWatcher) Insert(ctx context.Context, doc []byte) error {
+	ce, err := eventFromPayload(ctx, doc, false)
+	if err != nil {
+		return err
+	}
+	return w.InsertEvent(ctx, ce)
+}
+
+// Update rebuilds the event and calls UpdateEvent
+func (w eventCollectionWatcher) Update(ctx context.Context, doc []byte) error {
+	ce, err := eventFromPayload(ctx, doc, false)
+	if err != nil {
+		return err
+	}
+	return w.UpdateEvent(ctx, ce)
+}
+
+// Delete rebuilds the event and calls DeleteEvent, the payload becomes the pre-image
+func (w eventCollectionWatcher) Delete(ctx context.Context, doc []byte) error {
+	ce, err := eventFromPayload(ctx, doc, true)
+	if err != nil {
+		return err
+	}
+	return w.DeleteEvent(ctx, ce)
+}
+
+// eventFromPayload rebuilds an event from the metadata of the context and a JSON document
+func eventFromPayload(ctx context.Context, doc []byte, preImage bool) (ChangeStreamEvent, error) {
+	meta, _ := EventMetaFromContext(ctx)
+	ce := ChangeStreamEvent{
+		ID:            meta.Token,
+		Timestamp:     meta.ClusterTime,
+		OperationType: meta.OperationType,
+		Database:      meta.Database,
+		Collection:    meta.Collection,
+		DocumentKey:   meta.DocumentKey,
+		HasPreImage:   meta.HasPreImage,
+	}
+	if len(doc) == 0 || string(doc) == "null" {
+		return ce, nil
+	}
+	var d primitive.M
+	if err := bson.UnmarshalExtJSON(doc, false, &d); err != nil {
+		return ce, fmt.Errorf("failed to decode event document: %w", err)
+	}
+	if preImage {
+		ce.FullDocumentBeforeChange = d
+	} else {
+		ce.FullDocument = d
+	}
+	return ce, nil
+}
+
+// LegacyEventWatcher adapts a byte-slice CollectionWatcher to EventWatcher, passing it the document of each event
+// serialized the way processors do: the pre-image for deletes if there is one, plain JSON when serializer is nil
+func LegacyEventWatcher(w CollectionWatcher, serializer Serializer) EventWatcher {
+	return legacyEventWatcher{watcher: w, serializer: serializer}
+}
+
+type legacyEventWatcher struct {
+	watcher    CollectionWatcher
+	serializer Serializer
+}
+
+// InsertEvent serializes the inserted document and calls Insert
+func (w legacyEventWatcher) InsertEvent(ctx context.Context, ce ChangeStreamEvent) error {
+	doc, err := w.serialize(ce.FullDocument)
+	if err != nil {
+		return err
+	}
+	return w.watcher.Insert(ctx, doc)
+}
+
+// UpdateEvent serializes the updated document and calls Update
+func (w legacyEventWatcher) UpdateEvent(ctx context.Context, ce ChangeStreamEvent) error {
+	doc, err := w.serialize(ce.FullDocument)
+	if err != nil {
+		return err
+	}
+	return w.watcher.Update(ctx, doc)
+}
+
+// DeleteEvent serializes the deleted document and calls Delete
+func (w legacyEventWatcher) DeleteEvent(ctx context.Context, ce ChangeStreamEvent) error {
+	d := ce.FullDocument
+	if ce.FullDocumentBeforeChange != nil {
+		d = ce.FullDocumentBeforeChange
+	}
+	doc, err := w.serialize(d)
+	if err != nil {
+		return err
+	}
+	return w.watcher.Delete(ctx, doc)
+}
+
+func (w legacyEventWatcher) serialize(doc primitive.M) ([]byte, error) {
+	var payload []byte
+	var err error
+	if w.serializer != nil {
+		payload, err = w.serializer.Serialize(doc)
+	} else {
+		payload, err = json.Marshal(doc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal event stream document: %w", err)
+	}
+	return payload, nil
+}
+
+var (
+	_ CollectionWatcher = eventCollectionWatcher{}
+	_ EventWatcher      = legacyEventWatcher{}
+)
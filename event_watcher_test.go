@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mongowatch
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type recordedEvents struct {
+	events []ChangeStreamEvent
+}
+
+func (r *recordedEvents) InsertEvent(ctx context.Context, ce ChangeStreamEvent) error {
+	return r.add(ce)
+}
+func (r *recordedEvents) UpdateEvent(ctx context.Context, ce ChangeStreamEvent) error {
+	return r.add(ce)
+}
+func (r *recordedEvents) DeleteEvent(ctx context.Context, ce ChangeStreamEvent) error {
+	return r.add(ce)
+}
+
+func (r *recordedEvents) add(ce ChangeStreamEvent) error {
+	r.events = append(r.events, ce)
+	return nil
+}
+
+type recordedPayloads struct {
+	payloads []string
+}
+
+func (r *recordedPayloads) Insert(ctx context.Context, doc []byte) error { return r.add("insert", doc) }
+func (r *recordedPayloads) Update(ctx context.Context, doc []byte) error { return r.add("update", doc) }
+func (r *recordedPayloads) Delete(ctx context.Context, doc []byte) error { return r.add("delete", doc) }
+
+func (r *recordedPayloads) add(op string, doc []byte) error {
+	r.payloads = append(r.payloads, op+" "+string(doc))
+	return nil
+}
+
+func TestEventCollectionWatcher(t *testing.T) {
+	events := &recordedEvents{}
+	w := EventCollectionWatcher(events)
+	_, ok := w.(EventWatcher)
+	assert.True(t, ok, "processors must see the EventWatcher")
+
+	update := ChangeStreamEvent{
+		ID:            ResumeToken{TokenData: "82aa"},
+		Timestamp:     primitive.Timestamp{T: 10, I: 1},
+		OperationType: "update",
+		Database:      "app",
+		Collection:    "devices",
+		DocumentKey:   "d1",
+	}
+	ctx := ContextWithEvent(context.Background(), update)
+	require.NoError(t, w.Update(ctx, []byte(`{"name":"tracker","n":2}`)))
+	require.NoError(t, w.Delete(ctx, []byte(`null`)))
+	assert.Error(t, w.Insert(ctx, []byte(`not json`)))
+
+	require.Len(t, events.events, 2)
+	got := events.events[0]
+	assert.Equal(t, update.ID, got.ID)
+	assert.Equal(t, update.Timestamp, got.Timestamp)
+	assert.Equal(t, "app", got.Database)
+	assert.Equal(t, "d1", got.DocumentKey)
+	assert.Equal(t, primitive.M{"name": "tracker", "n": int32(2)}, got.FullDocument)
+	assert.Nil(t, events.events[1].FullDocumentBeforeChange)
+}
+
+func TestLegacyEventWatcher(t *testing.T) {
+	legacy := &recordedPayloads{}
+	w := LegacyEventWatcher(legacy, nil)
+	ctx := context.Background()
+
+	require.NoError(t, w.InsertEvent(ctx, ChangeStreamEvent{FullDocument: primitive.M{"name": "a"}}))
+	require.NoError(t, w.UpdateEvent(ctx, ChangeStreamEvent{FullDocument: primitive.M{"name": "b"}}))
+	require.NoError(t, w.DeleteEvent(ctx, ChangeStreamEvent{FullDocumentBeforeChange: primitive.M{"name": "b"}}))
+	require.NoError(t, w.DeleteEvent(ctx, ChangeStreamEvent{}))
+
+	assert.Equal(t, []string{
+		`insert {"name":"a"}`,
+		`update {"name":"b"}`,
+		`delete {"name":"b"}`,
+		`delete null`,
+	}, legacy.payloads)
+}
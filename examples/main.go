@@ -40,7 +40,8 @@ func main() {
 	processor := stream.NewDataProcessor(targetDB, "target_collection_to_watch", "_resume_suffix_1", localDB)
 
 	txExecutor := tx.NewMongoExecutor(localDB.Client())
-	collectionWatcher := watchers.NewSomeCollectionWatcher(txExecutor)
+	// every Delete runs in a local transaction, Insert and Update stay plain calls
+	collectionWatcher := tx.Transactional(txExecutor, watchers.NewSomeCollectionWatcher(), tx.Operations(tx.OperationDelete))
 
 	err := processor.Start(collectionWatcher, options.Required)
 	if err != nil {
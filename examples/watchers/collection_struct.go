@@ -19,39 +19,31 @@ package watchers
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 
 	log "github.com/sirupsen/logrus"
-	mongoDriver "go.mongodb.org/mongo-driver/mongo"
 
 	"github.com/mmtracker/mongowatch"
-	"github.com/mmtracker/mongowatch/db/tx"
+	"github.com/mmtracker/mongowatch/mapper"
 )
 
 // CollectionStruct refers to structure stored in target collection
+// the mongowatch tag maps mongo's "_id" column onto SomePrimaryKey, while the json tag stays free for local use
 type CollectionStruct struct {
-	SomePrimaryKey string `json:"some_primary_key,omitempty"`
+	SomePrimaryKey string `json:"some_primary_key,omitempty" mongowatch:"_id"`
 }
 
 // NewSomeCollectionWatcher creates a new any Collection watcher
-func NewSomeCollectionWatcher(executor tx.Executor) *SomeCollectionWatcher {
-	return &SomeCollectionWatcher{executor: executor}
+func NewSomeCollectionWatcher() *SomeCollectionWatcher {
+	return &SomeCollectionWatcher{}
 }
 
-// SomeCollectionWatcher is a watcher for SomeCollectionWatcher changes
-type SomeCollectionWatcher struct {
-	executor tx.Executor
-}
+// SomeCollectionWatcher is a watcher for SomeCollectionWatcher changes,
+// wrap it with tx.Transactional to run its calls in local transactions
+type SomeCollectionWatcher struct{}
 
 var _ mongowatch.CollectionWatcher = (*SomeCollectionWatcher)(nil)
 
-// CollectionStructWrapper is a wrapper for SomeCollectionWatcher on watcher side since mongo primary key is in "_id" column
-type CollectionStructWrapper struct {
-	CollectionStruct `json:",inline"`
-	SomePrimaryKey   string `json:"_id"` // override SomePrimaryKey with _id json identifier to unmarshall mongo data properly
-}
-
 // Insert is called when a new document is inserted
 func (s SomeCollectionWatcher) Insert(ctx context.Context, doc []byte) error {
 	return s.Update(ctx, doc)
@@ -61,8 +53,8 @@ func (s SomeCollectionWatcher) Insert(ctx context.Context, doc []byte) error {
 func (s SomeCollectionWatcher) Update(ctx context.Context, doc []byte) error {
 	log.Tracef("processing collection change: %s", string(doc))
 
-	collection := CollectionStructWrapper{}
-	err := json.Unmarshal(doc, &collection)
+	collection := CollectionStruct{}
+	err := mapper.DecodeJSON(doc, &collection)
 	if err != nil {
 		return fmt.Errorf("collection watcher update: failed to unmarshal collection: %w", err)
 	}
@@ -78,19 +70,12 @@ func (s SomeCollectionWatcher) Delete(ctx context.Context, doc []byte) error {
 	log.Tracef("processing collection delete: %s", string(doc))
 
 	collection := CollectionStruct{}
-	err := json.Unmarshal(doc, &collection)
+	err := mapper.DecodeJSON(doc, &collection)
 	if err != nil {
 		return fmt.Errorf("collection watcher delete: failed to unmarshal collection: %w", err)
 	}
 
-	err = s.executor.WithTransaction(func(sessCtx mongoDriver.SessionContext) (interface{}, error) {
-		// TODO: delete some state using sessCtx from local DB
-		return nil, nil
-	})
-	if err != nil {
-		return fmt.Errorf("collection watcher delete: failed to delete device and reports: %w", err)
-	}
-
+	// TODO: delete some state from local DB using ctx, it is the session context of the wrapping transaction
 	log.Infof("collection watcher deleted entity %s", collection.SomePrimaryKey)
 
 	return nil
@@ -0,0 +1,55 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package watchers
+
+//go:generate go run ../../cmd/mongowatch-gen -type Device -id Serial
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Device is decoded by the generated DeviceWatcher, the mongo "_id" lands in Serial
+type Device struct {
+	Serial string
+	Name   string `json:"name"`
+}
+
+// LoggingDeviceHandler logs typed device changes, wrap it with NewDeviceWatcher
+type LoggingDeviceHandler struct{}
+
+var _ DeviceHandler = LoggingDeviceHandler{}
+
+// InsertDevice is called with the inserted device
+func (LoggingDeviceHandler) InsertDevice(ctx context.Context, doc Device) error {
+	log.Infof("device inserted: %s", doc.Serial)
+	return nil
+}
+
+// UpdateDevice is called with the updated device
+func (LoggingDeviceHandler) UpdateDevice(ctx context.Context, doc Device) error {
+	log.Infof("device updated: %s", doc.Serial)
+	return nil
+}
+
+// DeleteDevice is called with the deleted device
+func (LoggingDeviceHandler) DeleteDevice(ctx context.Context, doc Device) error {
+	log.Infof("device deleted: %s", doc.Serial)
+	return nil
+}
@@ -0,0 +1,70 @@
+// Code generated by mongowatch-gen. DO NOT EDIT.
+
+package watchers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mmtracker/mongowatch"
+	"github.com/mmtracker/mongowatch/mapper"
+)
+
+// DeviceHandler handles decoded Device changes
+type DeviceHandler interface {
+	InsertDevice(ctx context.Context, doc Device) error
+	UpdateDevice(ctx context.Context, doc Device) error
+	DeleteDevice(ctx context.Context, doc Device) error
+}
+
+// DeviceWatcher adapts a DeviceHandler to mongowatch.CollectionWatcher
+type DeviceWatcher struct {
+	handler DeviceHandler
+}
+
+var _ mongowatch.CollectionWatcher = (*DeviceWatcher)(nil)
+
+// NewDeviceWatcher creates a typed Device watcher
+func NewDeviceWatcher(handler DeviceHandler) *DeviceWatcher {
+	return &DeviceWatcher{handler: handler}
+}
+
+// Insert decodes the inserted Device
+func (w *DeviceWatcher) Insert(ctx context.Context, doc []byte) error {
+	v, err := decodeDevice(doc)
+	if err != nil {
+		return err
+	}
+	return w.handler.InsertDevice(ctx, v)
+}
+
+// Update decodes the updated Device
+func (w *DeviceWatcher) Update(ctx context.Context, doc []byte) error {
+	v, err := decodeDevice(doc)
+	if err != nil {
+		return err
+	}
+	return w.handler.UpdateDevice(ctx, v)
+}
+
+// Delete decodes the deleted Device
+func (w *DeviceWatcher) Delete(ctx context.Context, doc []byte) error {
+	v, err := decodeDevice(doc)
+	if err != nil {
+		return err
+	}
+	return w.handler.DeleteDevice(ctx, v)
+}
+
+func decodeDevice(doc []byte) (Device, error) {
+	// the wrapper maps mongo's "_id" onto Device.Serial
+	var wrapper struct {
+		Device
+		MongoID string `mongowatch:"_id"`
+	}
+	if err := mapper.DecodeJSON(doc, &wrapper); err != nil {
+		return Device{}, fmt.Errorf("failed to decode Device: %w", err)
+	}
+	wrapper.Device.Serial = wrapper.MongoID
+	return wrapper.Device, nil
+}
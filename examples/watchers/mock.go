@@ -27,6 +27,9 @@ import (
 )
 
 // Mock is a mock implementation of SomeCollectionWatcher
+//
+// Deprecated: Mock isn't safe for concurrent use and needs the WaitGroup counted up front,
+// use mongowatchtest.Mock instead.
 type Mock struct {
 	Wg    *sync.WaitGroup
 	Limit int
@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mongowatch
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// WatcherID identifies a processor in logs, stats and hooks of deployments running several of them
+type WatcherID struct {
+	// Group is the consumer group, processors of the same group share the stream
+	Group string `json:"group"`
+	// Instance distinguishes members of a group, e.g. pod name
+	Instance string `json:"instance"`
+}
+
+// NewWatcherID creates an ID for the group, an empty instance defaults to hostname-pid
+func NewWatcherID(group, instance string) WatcherID {
+	if instance == "" {
+		host, _ := os.Hostname()
+		instance = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+	return WatcherID{Group: group, Instance: instance}
+}
+
+// IsZero reports whether the ID is unset
+func (id WatcherID) IsZero() bool {
+	return id.Group == "" && id.Instance == ""
+}
+
+// String formats the ID as group/instance
+func (id WatcherID) String() string {
+	return id.Group + "/" + id.Instance
+}
+
+type watcherIDKey struct{}
+
+// ContextWithWatcherID returns a context carrying the watcher ID
+func ContextWithWatcherID(ctx context.Context, id WatcherID) context.Context {
+	return context.WithValue(ctx, watcherIDKey{}, id)
+}
+
+// WatcherIDFromContext returns the ID of the watcher dispatching the event the context belongs to
+func WatcherIDFromContext(ctx context.Context) (WatcherID, bool) {
+	id, ok := ctx.Value(watcherIDKey{}).(WatcherID)
+	return id, ok
+}
@@ -0,0 +1,41 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mongowatch
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatcherID(t *testing.T) {
+	id := NewWatcherID("billing", "")
+	assert.Equal(t, "billing", id.Group)
+	assert.NotEmpty(t, id.Instance)
+	assert.False(t, id.IsZero())
+	assert.True(t, WatcherID{}.IsZero())
+	assert.Equal(t, "billing/pod-1", NewWatcherID("billing", "pod-1").String())
+
+	_, ok := WatcherIDFromContext(context.Background())
+	assert.False(t, ok)
+
+	got, ok := WatcherIDFromContext(ContextWithWatcherID(context.Background(), id))
+	assert.True(t, ok)
+	assert.Equal(t, id, got)
+}
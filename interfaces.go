@@ -37,12 +37,28 @@ type StreamResume interface {
 	DeleteResumePoint(ctx context.Context, token ResumeToken) error
 	// SaveResumePoint stores ChangeStreamResumePoint
 	SaveResumePoint(ctx context.Context, ce ChangeStreamResumePoint) error
+	// ReplaceResumePoints removes all stored resume points and stores the given one instead
+	ReplaceResumePoints(ctx context.Context, ce ChangeStreamResumePoint) error
+	// Describe summarizes the last stored resume point, see ResumePointInfo
+	Describe(ctx context.Context) (*ResumePointInfo, error)
 }
 
 // ChangeEventDispatcherFunc change event callback function
-// returning err will stop further ChangeEventDispatcherFunc processing and the change stream watcher
+// returning err will stop further ChangeEventDispatcherFunc processing and the change stream watcher.
+// Chained dispatch funcs stop at the first error, so err is nil unless the func is wrapped by a middleware
+// or transform forwarding an upstream error; handlers that must see failures are ErrorAwareDispatchers.
 type ChangeEventDispatcherFunc func(ctx context.Context, ce ChangeStreamEvent, err error) error
 
+// ErrorAwareDispatcher is a cleanup handler running after the dispatch funcs of a chain, also when one of them failed.
+// err is the chain error, nil on success; the returned error replaces it, so returning nil marks the failure handled.
+type ErrorAwareDispatcher func(ctx context.Context, ce ChangeStreamEvent, err error) error
+
+// TransformFunc enriches or rewrites an event before it is dispatched, returning keep == false drops the event
+type TransformFunc func(ctx context.Context, ce *ChangeStreamEvent) (keep bool, err error)
+
+// ChangeEventMiddleware wraps a ChangeEventDispatcherFunc to add behaviour around event dispatching
+type ChangeEventMiddleware func(next ChangeEventDispatcherFunc) ChangeEventDispatcherFunc
+
 // ChangeStreamWatcher watches a change stream and dispatches received changed events
 type ChangeStreamWatcher interface {
 	// Start resumes watching change events and
@@ -57,9 +73,55 @@ type CollectionWatcher interface {
 	Delete(ctx context.Context, doc []byte) error
 }
 
+// DocumentWatcher is an optional CollectionWatcher extension receiving the decoded documents of events directly
+// instead of serialized payloads: no marshal and unmarshal per event, and BSON types such as ObjectID and dates
+// stay intact. Deletes get the pre-image if the event has one, nil otherwise. The document belongs to the event,
+// handlers must not modify it or keep it after returning.
+type DocumentWatcher interface {
+	InsertDocument(ctx context.Context, doc primitive.M) error
+	UpdateDocument(ctx context.Context, doc primitive.M) error
+	DeleteDocument(ctx context.Context, doc primitive.M) error
+}
+
+// PartialUpdateWatcher is an optional CollectionWatcher extension receiving targeted field changes of update events
+// delivered without a full document, e.g. to issue column updates on SQL mirrors instead of full row rewrites
+type PartialUpdateWatcher interface {
+	UpdateFields(ctx context.Context, documentKey string, updated map[string]interface{}, removed []string) error
+}
+
+// OperationRouter is an optional CollectionWatcher extension handling events by operation type instead of
+// through Insert, Update and Delete; operation types without a handler are skipped
+type OperationRouter interface {
+	Handler(operationType string) (handler func(ctx context.Context, doc []byte) error, ok bool)
+}
+
+// NamespaceWatcher is an optional CollectionWatcher extension notified of drop, rename and dropDatabase events,
+// e.g. to clean up local state when the source collection disappears. The watcher only passes these events
+// with stream.WithNamespaceEvents; the invalidate event following a drop or rename of the watched collection still ends the stream.
+type NamespaceWatcher interface {
+	OnDrop(ctx context.Context, ns Namespace) error
+	OnRename(ctx context.Context, from, to Namespace) error
+	OnDropDatabase(ctx context.Context, database string) error
+}
+
+// CommitWatcher is an optional CollectionWatcher extension for sinks with their own durability, e.g. Kafka
+// transactions or SQL transactions, see stream.WithTwoPhaseCommit. Handlers stage the events, Commit makes
+// everything staged since the last commit durable and returns the sink's own offset, which is stored with the
+// resume point; Abort drops the staged events when the batch fails and is going to be replayed.
+type CommitWatcher interface {
+	Commit(ctx context.Context) (offset string, err error)
+	Abort(ctx context.Context) error
+}
+
+// Serializer encodes change stream documents into the payload passed to a CollectionWatcher
+type Serializer interface {
+	Serialize(doc primitive.M) ([]byte, error)
+}
+
 // DocumentProcessor is an interface for processing document data from a change stream
 type DocumentProcessor interface {
 	StartWithRetry(bo backoff.BackOff, actions CollectionWatcher, fullDocumentMode options.FullDocument) error
 	Start(actions CollectionWatcher, fullDocumentMode options.FullDocument) error
+	Seek(ctx context.Context, pos StartPosition) error
 	Stop()
 }
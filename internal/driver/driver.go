@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package driver implements the helpers of package db once for both mongo-driver major versions. Package db adapts
+// the v1 driver and package db/dbv2 the v2 driver to the interfaces here, so applications migrating to v2 get the
+// same connection defaults and collection helpers from either while they run both drivers side by side.
+package driver
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ServerSelectionTimeout is used when the connection string doesn't set serverSelectionTimeoutMS
+const ServerSelectionTimeout = 10 * time.Second
+
+// Client is a connected driver client
+type Client interface {
+	Ping(ctx context.Context) error
+	Disconnect(ctx context.Context) error
+}
+
+// Database runs database commands, the result document is decoded into a map
+type Database interface {
+	RunCommand(ctx context.Context, cmd Command) (map[string]interface{}, error)
+}
+
+// Collection is the part of a collection the helpers need
+type Collection interface {
+	Name() string
+	DeleteAll(ctx context.Context) error
+	DropIndexes(ctx context.Context) error
+}
+
+// Command is an ordered command document, values of type Command are nested documents
+type Command []Element
+
+// Element is a field of a Command
+type Element struct {
+	Key   string
+	Value interface{}
+}
+
+// Connect dials with dial and pings the deployment, a client failing the ping is disconnected
+func Connect[C Client](ctx context.Context, dial func(ctx context.Context) (C, error)) (C, error) {
+	client, err := dial(ctx)
+	if err != nil {
+		return client, fmt.Errorf("failed to connect to MongoDB: %w", err)
+	}
+
+	if err = client.Ping(ctx); err != nil {
+		_ = client.Disconnect(ctx)
+		return client, fmt.Errorf("failed to ping MongoDB: %w", err)
+	}
+	return client, nil
+}
+
+// Truncate deletes all documents of the collection and, with dropIndexes, its indexes
+func Truncate(ctx context.Context, col Collection, dropIndexes bool) error {
+	if err := col.DeleteAll(ctx); err != nil {
+		return fmt.Errorf("truncate failed to delete all docs from %s: %w", col.Name(), err)
+	}
+
+	if dropIndexes {
+		if err := col.DropIndexes(ctx); err != nil {
+			return fmt.Errorf("truncate failed to drop indexes on %s: %w", col.Name(), err)
+		}
+	}
+	return nil
+}
+
+// RecordPreImages enables recording of pre-images for a collection for MongoDB < 6
+func RecordPreImages(ctx context.Context, database Database, colName string) error {
+	cmd := Command{
+		{Key: "collMod", Value: colName},
+		{Key: "recordPreImages", Value: true},
+	}
+	result, err := database.RunCommand(ctx, cmd)
+	if err != nil {
+		return fmt.Errorf("failed to enable recording of pre and post images: %w", err)
+	}
+
+	log.Printf("recording of pre and post images enabled: %+v", result)
+	return nil
+}
+
+// EnablePrePostImages enables pre/post images for a collection for MongoDB >= 6
+func EnablePrePostImages(ctx context.Context, database Database, colName string) error {
+	cmd := Command{
+		{Key: "collMod", Value: colName},
+		{Key: "changeStreamPreAndPostImages", Value: Command{{Key: "enabled", Value: true}}},
+	}
+	result, err := database.RunCommand(ctx, cmd)
+	if err != nil {
+		return fmt.Errorf("failed to enable change stream pre and post images: %w", err)
+	}
+
+	log.Printf("change stream pre and post images enabled: %+v", result)
+	return nil
+}
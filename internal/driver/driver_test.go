@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClient struct {
+	pingErr      error
+	disconnected bool
+}
+
+func (c *fakeClient) Ping(ctx context.Context) error { return c.pingErr }
+
+func (c *fakeClient) Disconnect(ctx context.Context) error {
+	c.disconnected = true
+	return nil
+}
+
+type fakeCollection struct {
+	deleteErr error
+	calls     []string
+}
+
+func (c *fakeCollection) Name() string { return "orders" }
+
+func (c *fakeCollection) DeleteAll(ctx context.Context) error {
+	c.calls = append(c.calls, "delete")
+	return c.deleteErr
+}
+
+func (c *fakeCollection) DropIndexes(ctx context.Context) error {
+	c.calls = append(c.calls, "dropIndexes")
+	return nil
+}
+
+type fakeDatabase struct {
+	cmd Command
+}
+
+func (d *fakeDatabase) RunCommand(ctx context.Context, cmd Command) (map[string]interface{}, error) {
+	d.cmd = cmd
+	return map[string]interface{}{"ok": 1}, nil
+}
+
+func TestConnect(t *testing.T) {
+	ctx := context.Background()
+	ok := &fakeClient{}
+	c, err := Connect(ctx, func(ctx context.Context) (*fakeClient, error) { return ok, nil })
+	assert.NoError(t, err)
+	assert.Same(t, ok, c)
+	assert.False(t, ok.disconnected)
+
+	unreachable := &fakeClient{pingErr: errors.New("no servers")}
+	_, err = Connect(ctx, func(ctx context.Context) (*fakeClient, error) { return unreachable, nil })
+	assert.ErrorContains(t, err, "failed to ping MongoDB")
+	assert.True(t, unreachable.disconnected, "client failing the ping stays connected")
+
+	_, err = Connect(ctx, func(ctx context.Context) (*fakeClient, error) { return nil, errors.New("bad uri") })
+	assert.ErrorContains(t, err, "failed to connect to MongoDB: bad uri")
+}
+
+func TestTruncate(t *testing.T) {
+	ctx := context.Background()
+	col := &fakeCollection{}
+	assert.NoError(t, Truncate(ctx, col, false))
+	assert.NoError(t, Truncate(ctx, col, true))
+	assert.Equal(t, []string{"delete", "delete", "dropIndexes"}, col.calls)
+
+	failing := &fakeCollection{deleteErr: errors.New("not primary")}
+	assert.ErrorContains(t, Truncate(ctx, failing, true), "truncate failed to delete all docs from orders")
+	assert.Equal(t, []string{"delete"}, failing.calls)
+}
+
+func TestEnablePrePostImages(t *testing.T) {
+	database := &fakeDatabase{}
+	assert.NoError(t, EnablePrePostImages(context.Background(), database, "orders"))
+	assert.Equal(t, Command{
+		{Key: "collMod", Value: "orders"},
+		{Key: "changeStreamPreAndPostImages", Value: Command{{Key: "enabled", Value: true}}},
+	}, database.cmd)
+}
@@ -0,0 +1,348 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package mapper converts change stream documents into user structs.
+//
+// Struct fields are matched with the `mongowatch:"field"` tag, which may contain a dotted path into nested documents
+// (e.g. `mongowatch:"address.city"`). Fields without the tag fall back to their bson tag and then to the lower-cased
+// field name, same as the bson codec. Common mongo types are coerced on the way:
+// ObjectID to string, DateTime and Timestamp to time.Time, and numbers between numeric kinds.
+package mapper
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// TagName is the struct tag used for field mapping
+const TagName = "mongowatch"
+
+// ErrInvalidTarget is returned when the decode target is not a non-nil pointer to a struct
+var ErrInvalidTarget = errors.New("mapper: target must be a non-nil pointer to a struct")
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	objectIDType = reflect.TypeOf(primitive.ObjectID{})
+)
+
+// Decode maps doc (usually ChangeStreamEvent.FullDocument) into the struct pointed to by out
+func Decode(doc primitive.M, out interface{}) error {
+	rv := reflect.ValueOf(out)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return ErrInvalidTarget
+	}
+
+	return decodeStruct(map[string]interface{}(doc), rv.Elem())
+}
+
+// DecodeJSON maps a JSON payload as passed to a mongowatch.CollectionWatcher into the struct pointed to by out
+func DecodeJSON(payload []byte, out interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+
+	var doc map[string]interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return fmt.Errorf("mapper: failed to unmarshal payload: %w", err)
+	}
+
+	return Decode(doc, out)
+}
+
+func decodeStruct(doc map[string]interface{}, sv reflect.Value) error {
+	st := sv.Type()
+	for i := 0; i < st.NumField(); i++ {
+		field := st.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		tag, hasTag := fieldTag(field)
+		if tag == "-" {
+			continue
+		}
+		// embedded structs without a tag are inlined
+		if field.Anonymous && !hasTag && field.Type.Kind() == reflect.Struct {
+			if err := decodeStruct(doc, sv.Field(i)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := mongowatch.LookupField(doc, tag)
+		if !ok || value == nil {
+			continue
+		}
+		if err := assign(value, sv.Field(i)); err != nil {
+			return fmt.Errorf("mapper: field %s (%s): %w", field.Name, tag, err)
+		}
+	}
+
+	return nil
+}
+
+// fieldTag returns the document path for a struct field and whether it was explicitly tagged
+func fieldTag(field reflect.StructField) (string, bool) {
+	if tag, ok := field.Tag.Lookup(TagName); ok {
+		return strings.Split(tag, ",")[0], true
+	}
+	if tag, ok := field.Tag.Lookup("bson"); ok {
+		if name := strings.Split(tag, ",")[0]; name != "" {
+			return name, true
+		}
+	}
+	return strings.ToLower(field.Name), false
+}
+
+func asSlice(v interface{}) ([]interface{}, bool) {
+	switch s := v.(type) {
+	case []interface{}:
+		return s, true
+	case primitive.A:
+		return s, true
+	}
+	return nil, false
+}
+
+func assign(value interface{}, fv reflect.Value) error {
+	if value == nil {
+		return nil
+	}
+
+	switch fv.Kind() {
+	case reflect.Pointer:
+		ptr := reflect.New(fv.Type().Elem())
+		if err := assign(value, ptr.Elem()); err != nil {
+			return err
+		}
+		fv.Set(ptr)
+		return nil
+	case reflect.Interface:
+		v := reflect.ValueOf(value)
+		if !v.Type().AssignableTo(fv.Type()) {
+			return fmt.Errorf("cannot convert %T to %s", value, fv.Type())
+		}
+		fv.Set(v)
+		return nil
+	}
+
+	switch fv.Type() {
+	case timeType:
+		t, err := toTime(value)
+		if err != nil {
+			return err
+		}
+		fv.Set(reflect.ValueOf(t))
+		return nil
+	case objectIDType:
+		id, err := toObjectID(value)
+		if err != nil {
+			return err
+		}
+		fv.Set(reflect.ValueOf(id))
+		return nil
+	}
+
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(toString(value))
+		return nil
+	case reflect.Bool:
+		b, ok := value.(bool)
+		if !ok {
+			return fmt.Errorf("cannot convert %T to bool", value)
+		}
+		fv.SetBool(b)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := toInt(value)
+		if err != nil {
+			return err
+		}
+		if fv.OverflowInt(n) {
+			return fmt.Errorf("%d overflows %s", n, fv.Type())
+		}
+		fv.SetInt(n)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := toInt(value)
+		if err != nil {
+			return err
+		}
+		if n < 0 || fv.OverflowUint(uint64(n)) {
+			return fmt.Errorf("%d overflows %s", n, fv.Type())
+		}
+		fv.SetUint(uint64(n))
+		return nil
+	case reflect.Float32, reflect.Float64:
+		n, err := toFloat(value)
+		if err != nil {
+			return err
+		}
+		fv.SetFloat(n)
+		return nil
+	case reflect.Struct:
+		m, ok := mongowatch.AsDocument(value)
+		if !ok {
+			return fmt.Errorf("cannot convert %T to %s", value, fv.Type())
+		}
+		return decodeStruct(m, fv)
+	case reflect.Slice:
+		items, ok := asSlice(value)
+		if !ok {
+			break
+		}
+		slice := reflect.MakeSlice(fv.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := assign(item, slice.Index(i)); err != nil {
+				return fmt.Errorf("index %d: %w", i, err)
+			}
+		}
+		fv.Set(slice)
+		return nil
+	case reflect.Map:
+		m, ok := mongowatch.AsDocument(value)
+		if !ok || fv.Type().Key().Kind() != reflect.String {
+			break
+		}
+		out := reflect.MakeMapWithSize(fv.Type(), len(m))
+		for k, item := range m {
+			elem := reflect.New(fv.Type().Elem()).Elem()
+			if err := assign(item, elem); err != nil {
+				return fmt.Errorf("key %s: %w", k, err)
+			}
+			out.SetMapIndex(reflect.ValueOf(k).Convert(fv.Type().Key()), elem)
+		}
+		fv.Set(out)
+		return nil
+	}
+
+	rv := reflect.ValueOf(value)
+	if rv.Type().ConvertibleTo(fv.Type()) {
+		fv.Set(rv.Convert(fv.Type()))
+		return nil
+	}
+
+	return fmt.Errorf("cannot convert %T to %s", value, fv.Type())
+}
+
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case primitive.ObjectID:
+		return v.Hex()
+	case primitive.DateTime:
+		return v.Time().UTC().Format(time.RFC3339Nano)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fmt.Sprint(value)
+}
+
+func toTime(value interface{}) (time.Time, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, nil
+	case primitive.DateTime:
+		return v.Time(), nil
+	case primitive.Timestamp:
+		return time.Unix(int64(v.T), 0), nil
+	case string:
+		return time.Parse(time.RFC3339Nano, v)
+	case int64:
+		return time.UnixMilli(v), nil
+	case json.Number:
+		ms, err := v.Int64()
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.UnixMilli(ms), nil
+	}
+	// extended JSON dates e.g. {"$date": "..."}
+	if m, ok := mongowatch.AsDocument(value); ok {
+		if date, ok := m["$date"]; ok {
+			return toTime(date)
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot convert %T to time.Time", value)
+}
+
+func toObjectID(value interface{}) (primitive.ObjectID, error) {
+	switch v := value.(type) {
+	case primitive.ObjectID:
+		return v, nil
+	case string:
+		return primitive.ObjectIDFromHex(v)
+	}
+	return primitive.NilObjectID, fmt.Errorf("cannot convert %T to ObjectID", value)
+}
+
+// toInt converts integers without a float round trip so large int64 values keep their precision
+func toInt(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n, nil
+		}
+	case string:
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return n, nil
+		}
+	}
+	n, err := toFloat(value)
+	return int64(n), err
+}
+
+func toFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), nil
+	case int32:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case float32:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case json.Number:
+		return v.Float64()
+	case primitive.Decimal128:
+		return strconv.ParseFloat(v.String(), 64)
+	case string:
+		return strconv.ParseFloat(v, 64)
+	}
+	return 0, fmt.Errorf("cannot convert %T to a number", value)
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mapper
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch/stream"
+)
+
+type address struct {
+	City string `mongowatch:"city"`
+}
+
+type device struct {
+	ID        string     `mongowatch:"_id"`
+	PaidUntil time.Time  `mongowatch:"paidUntil"`
+	City      string     `mongowatch:"owner.address.city"`
+	Count     int        `mongowatch:"count"`
+	Address   *address   `mongowatch:"owner.address"`
+	Tags      []string   `mongowatch:"tags"`
+	Skipped   string     `mongowatch:"-"`
+	Missing   *time.Time `mongowatch:"missing"`
+	Name      string
+}
+
+func Test_Decode(t *testing.T) {
+	id := primitive.NewObjectID()
+	paidUntil := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	doc := primitive.M{
+		"_id":       id,
+		"paidUntil": primitive.NewDateTimeFromTime(paidUntil),
+		"owner":     primitive.M{"address": primitive.M{"city": "Vilnius"}},
+		"count":     int32(3),
+		"tags":      primitive.A{"a", "b"},
+		"Skipped":   "nope",
+		"name":      "tracker",
+	}
+
+	want := device{
+		ID:        id.Hex(),
+		PaidUntil: paidUntil,
+		City:      "Vilnius",
+		Count:     3,
+		Address:   &address{City: "Vilnius"},
+		Tags:      []string{"a", "b"},
+		Name:      "tracker",
+	}
+
+	var got device
+	assert.NoError(t, Decode(doc, &got))
+	got.PaidUntil = got.PaidUntil.UTC()
+	assert.Equal(t, want, got)
+
+	// the same document passed through the default JSON serializer maps to the same struct
+	payload, err := stream.JSONSerializer{}.Serialize(doc)
+	assert.NoError(t, err)
+	var fromJSON device
+	assert.NoError(t, DecodeJSON(payload, &fromJSON))
+	fromJSON.PaidUntil = fromJSON.PaidUntil.UTC()
+	assert.Equal(t, want, fromJSON)
+}
+
+func Test_Decode_InvalidTarget(t *testing.T) {
+	var d device
+	assert.ErrorIs(t, Decode(primitive.M{}, d), ErrInvalidTarget)
+	assert.ErrorIs(t, Decode(primitive.M{}, (*device)(nil)), ErrInvalidTarget)
+}
+
+func Test_Decode_ConversionError(t *testing.T) {
+	var d device
+	assert.Error(t, Decode(primitive.M{"count": "many"}, &d))
+}
+
+func Test_Decode_Interface(t *testing.T) {
+	var target struct {
+		Any      interface{}  `mongowatch:"any"`
+		Stringer fmt.Stringer `mongowatch:"stringer"`
+	}
+	assert.NoError(t, Decode(primitive.M{"any": "a"}, &target))
+	assert.Equal(t, "a", target.Any)
+
+	id := primitive.NewObjectID()
+	assert.NoError(t, Decode(primitive.M{"stringer": id}, &target))
+	assert.Equal(t, id, target.Stringer)
+	// a string doesn't implement fmt.Stringer
+	assert.ErrorContains(t, Decode(primitive.M{"stringer": "a"}, &target), "cannot convert string to fmt.Stringer")
+}
+
+func Test_Decode_IntegerRange(t *testing.T) {
+	type counters struct {
+		Small  int8   `mongowatch:"small"`
+		Medium int32  `mongowatch:"medium"`
+		Count  uint16 `mongowatch:"count"`
+		Total  uint64 `mongowatch:"total"`
+	}
+	tests := []struct {
+		name    string
+		doc     primitive.M
+		want    counters
+		wantErr string
+	}{
+		{name: "in range", doc: primitive.M{"small": int32(-128), "medium": int64(1 << 30), "count": int32(65535), "total": int64(1 << 40)},
+			want: counters{Small: -128, Medium: 1 << 30, Count: 65535, Total: 1 << 40}},
+		{name: "int8 overflow", doc: primitive.M{"small": int32(200)}, wantErr: "200 overflows int8"},
+		{name: "int32 overflow", doc: primitive.M{"medium": int64(1 << 40)}, wantErr: "1099511627776 overflows int32"},
+		{name: "uint16 overflow", doc: primitive.M{"count": int32(70000)}, wantErr: "70000 overflows uint16"},
+		{name: "negative uint", doc: primitive.M{"total": int32(-1)}, wantErr: "-1 overflows uint64"},
+		{name: "negative uint from JSON", doc: primitive.M{"count": "-5"}, wantErr: "-5 overflows uint16"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got counters
+			err := Decode(tt.doc, &got)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
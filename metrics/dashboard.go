@@ -0,0 +1,32 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package metrics
+
+import (
+	_ "embed"
+)
+
+//go:embed dashboard.json
+var dashboard []byte
+
+// Dashboard returns a Grafana dashboard for the metrics in names.go: lag, throughput, restarts, DLQ depth,
+// oplog headroom and the processor state. It expects a Prometheus compatible data source, e.g. VictoriaMetrics,
+// and can be imported as is.
+func Dashboard() []byte {
+	return append([]byte(nil), dashboard...)
+}
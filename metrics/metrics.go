@@ -0,0 +1,228 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package metrics pushes processor statistics to metric backends on an interval, for deployments without a
+// scrape infrastructure: VictoriaMetrics (Prometheus text import), Graphite (plaintext protocol) and StatsD.
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mmtracker/mongowatch/stream"
+)
+
+// DefaultInterval is the push interval used unless WithInterval is given
+const DefaultInterval = 15 * time.Second
+
+// Source provides the statistics pushed by a Reporter, implemented by stream.DocumentProcessor
+type Source interface {
+	Stats() stream.ProcessorStats
+}
+
+var _ Source = stream.DocumentProcessor{}
+
+var _ QuarantineCounter = (*stream.MongoQuarantine)(nil)
+
+// Sample is a single metric value
+type Sample struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+}
+
+// Pusher delivers samples taken at the given time to a metric backend
+type Pusher interface {
+	Push(ctx context.Context, samples []Sample, at time.Time) error
+}
+
+// Collect converts processor statistics into samples named as documented in names.go
+func Collect(stats stream.ProcessorStats, now time.Time) []Sample {
+	labels := map[string]string{}
+	if stats.ID.Group != "" {
+		labels["group"] = stats.ID.Group
+	}
+	if stats.ID.Instance != "" {
+		labels["instance"] = stats.ID.Instance
+	}
+	sample := func(name string, value float64) Sample {
+		return Sample{Name: name, Labels: labels, Value: value}
+	}
+	flag := func(b bool) float64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+
+	samples := []Sample{
+		sample(EventsProcessed, float64(stats.Processed)),
+		sample(EventsFailed, float64(stats.Failed)),
+		sample(EventsQuarantined, float64(stats.Quarantined)),
+		sample(EventsSampledKept, float64(stats.Sampled.Kept)),
+		sample(EventsSampledDropped, float64(stats.Sampled.Dropped)),
+		sample(Gaps, float64(stats.Gaps)),
+		sample(Restarts, float64(stats.Restarts)),
+		sample(Running, flag(stats.Running)),
+		sample(Paused, flag(stats.Paused)),
+		sample(Degraded, flag(stats.Degraded)),
+		sample(CursorGetMores, float64(stats.Cursor.GetMores)),
+		sample(CursorEvents, float64(stats.Cursor.Events)),
+		sample(CursorGetMoreSeconds, stats.Cursor.GetMoreLatency.Seconds()),
+	}
+	if stats.LastClusterTime.T != 0 {
+		lag := now.Sub(time.Unix(int64(stats.LastClusterTime.T), 0))
+		samples = append(samples, sample(Lag, lag.Seconds()))
+	}
+	return samples
+}
+
+// ReporterOption configures a Reporter
+type ReporterOption func(*Reporter)
+
+// WithInterval sets how often samples are pushed, DefaultInterval by default
+func WithInterval(d time.Duration) ReporterOption {
+	return func(r *Reporter) {
+		r.interval = d
+	}
+}
+
+// QuarantineCounter counts the events in a quarantine, implemented by stream.MongoQuarantine
+type QuarantineCounter interface {
+	CountQuarantined(ctx context.Context) (int64, error)
+}
+
+// WithQuarantine reports the number of quarantined events as QuarantineDepth
+func WithQuarantine(counter QuarantineCounter) ReporterOption {
+	return func(r *Reporter) {
+		r.quarantine = counter
+	}
+}
+
+// WithOplogMonitor reports the last oplog window check of the monitor, run it alongside the reporter
+func WithOplogMonitor(monitor *stream.OplogMonitor) ReporterOption {
+	return func(r *Reporter) {
+		r.oplog = monitor
+	}
+}
+
+// WithLabels adds constant labels to every sample, e.g. the deployment or host
+func WithLabels(labels map[string]string) ReporterOption {
+	return func(r *Reporter) {
+		r.labels = labels
+	}
+}
+
+// Reporter periodically pushes the statistics of a processor
+type Reporter struct {
+	source   Source
+	pusher   Pusher
+	interval time.Duration
+	labels   map[string]string
+
+	quarantine QuarantineCounter
+	oplog      *stream.OplogMonitor
+}
+
+// NewReporter creates a reporter pushing the statistics of source to pusher
+func NewReporter(source Source, pusher Pusher, opts ...ReporterOption) *Reporter {
+	r := &Reporter{source: source, pusher: pusher, interval: DefaultInterval}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Report pushes the current statistics once
+func (r *Reporter) Report(ctx context.Context) error {
+	now := time.Now()
+	samples := r.Collect(ctx, now)
+	if err := r.pusher.Push(ctx, samples, now); err != nil {
+		return fmt.Errorf("failed to push metrics: %w", err)
+	}
+	return nil
+}
+
+// Collect returns the samples Report pushes, a failing quarantine count is logged and left out
+func (r *Reporter) Collect(ctx context.Context, now time.Time) []Sample {
+	stats := r.source.Stats()
+	samples := Collect(stats, now)
+	if r.quarantine != nil {
+		depth, err := r.quarantine.CountQuarantined(ctx)
+		if err != nil {
+			log.Warnf("metrics: %v", err)
+		} else {
+			samples = append(samples, Sample{Name: QuarantineDepth, Labels: samples[0].Labels, Value: float64(depth)})
+		}
+	}
+	if r.oplog != nil {
+		if status, ok := r.oplog.Status(); ok {
+			samples = append(samples,
+				Sample{Name: OplogWindow, Labels: samples[0].Labels, Value: status.Window.Duration().Seconds()},
+				Sample{Name: OplogHeadroom, Labels: samples[0].Labels, Value: status.Headroom.Seconds()},
+				Sample{Name: OplogWindowUsed, Labels: samples[0].Labels, Value: status.Used},
+			)
+		}
+	}
+	if len(r.labels) > 0 {
+		for i := range samples {
+			samples[i].Labels = merge(samples[i].Labels, r.labels)
+		}
+	}
+	return samples
+}
+
+// Run pushes the statistics every interval until ctx is done, failed pushes are logged and retried on the next tick
+func (r *Reporter) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := r.Report(ctx); err != nil {
+				log.Warnf("metrics: %v", err)
+			}
+		}
+	}
+}
+
+func merge(a, b map[string]string) map[string]string {
+	out := make(map[string]string, len(a)+len(b))
+	for k, v := range a {
+		out[k] = v
+	}
+	for k, v := range b {
+		out[k] = v
+	}
+	return out
+}
+
+// sortedLabels returns the label names in a stable order
+func sortedLabels(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
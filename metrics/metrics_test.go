@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+	"github.com/mmtracker/mongowatch/stream"
+)
+
+type staticSource struct{ stats stream.ProcessorStats }
+
+func (s staticSource) Stats() stream.ProcessorStats { return s.stats }
+
+var testStats = staticSource{stream.ProcessorStats{
+	Stats: stream.Stats{
+		ID:              mongowatch.WatcherID{Group: "orders", Instance: "pod-1"},
+		Processed:       42,
+		Sampled:         stream.SamplingStats{Kept: 42, Dropped: 8},
+		LastClusterTime: primitive.Timestamp{T: 1000},
+	},
+	Running: true,
+}}
+
+func Test_Collect(t *testing.T) {
+	samples := Collect(testStats.stats, time.Unix(1010, 0))
+	values := map[string]float64{}
+	for _, s := range samples {
+		assert.Equal(t, map[string]string{"group": "orders", "instance": "pod-1"}, s.Labels)
+		values[s.Name] = s.Value
+	}
+	assert.Equal(t, float64(42), values["mongowatch_events_processed_total"])
+	assert.Equal(t, float64(42), values["mongowatch_events_sampled_kept_total"])
+	assert.Equal(t, float64(8), values["mongowatch_events_sampled_dropped_total"])
+	assert.Equal(t, float64(1), values["mongowatch_running"])
+	assert.Equal(t, float64(0), values["mongowatch_paused"])
+	assert.Equal(t, float64(10), values["mongowatch_lag_seconds"])
+	for name := range values {
+		assert.Contains(t, Names, name)
+	}
+}
+
+func Test_Reporter_OplogMonitor(t *testing.T) {
+	monitor := stream.NewOplogMonitor(stream.OplogWindowConfig{
+		Window: func(ctx context.Context) (stream.OplogWindow, error) {
+			return stream.OplogWindow{First: primitive.Timestamp{T: 1000}, Last: primitive.Timestamp{T: 2000}}, nil
+		},
+		Checkpoint: func() (*mongowatch.ChangeStreamResumePoint, error) {
+			return &mongowatch.ChangeStreamResumePoint{Timestamp: primitive.Timestamp{T: 1500}}, nil
+		},
+	})
+	r := NewReporter(testStats, nil, WithOplogMonitor(monitor))
+	for _, s := range r.Collect(context.Background(), time.Now()) {
+		assert.NotEqual(t, OplogWindow, s.Name, "reported before the first check")
+	}
+
+	_, _, err := monitor.Check(context.Background())
+	require.NoError(t, err)
+	values := map[string]float64{}
+	for _, s := range r.Collect(context.Background(), time.Now()) {
+		values[s.Name] = s.Value
+	}
+	assert.Equal(t, float64(1000), values[OplogWindow])
+	assert.Equal(t, float64(500), values[OplogHeadroom])
+	assert.Equal(t, 0.5, values[OplogWindowUsed])
+}
+
+func Test_VictoriaMetrics(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+	}))
+	defer server.Close()
+
+	r := NewReporter(testStats, VictoriaMetrics{URL: server.URL}, WithLabels(map[string]string{"env": "prod"}))
+	require.NoError(t, r.Report(context.Background()))
+	assert.Contains(t, body, `mongowatch_events_processed_total{env="prod",group="orders",instance="pod-1"} 42 `)
+}
+
+func Test_Graphite(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	lines := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		lines <- line
+	}()
+
+	g := Graphite{Addr: ln.Addr().String(), Prefix: "prod"}
+	require.NoError(t, g.Push(context.Background(), []Sample{{Name: "mongowatch_running", Labels: map[string]string{"group": "orders"}, Value: 1}}, time.Unix(1000, 0)))
+	assert.Equal(t, "prod.mongowatch_running;group=orders 1 1000\n", <-lines)
+}
+
+func Test_StatsD(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	s := StatsD{Addr: conn.LocalAddr().String(), Prefix: "mongowatch"}
+	require.NoError(t, s.Push(context.Background(), []Sample{{Name: "mongowatch_lag_seconds", Labels: map[string]string{"group": "orders"}, Value: 1.5}}, time.Now()))
+
+	buf := make([]byte, 512)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "mongowatch.orders.mongowatch_lag_seconds:1.5|g", strings.TrimSpace(string(buf[:n])))
+}
+
+func Test_Dashboard(t *testing.T) {
+	var dashboard struct {
+		Panels []struct {
+			Targets []struct {
+				Expr string `json:"expr"`
+			} `json:"targets"`
+		} `json:"panels"`
+	}
+	require.NoError(t, json.Unmarshal(Dashboard(), &dashboard))
+	require.NotEmpty(t, dashboard.Panels)
+
+	known := regexp.MustCompile(`mongowatch_[a-z_]+`)
+	for _, panel := range dashboard.Panels {
+		for _, target := range panel.Targets {
+			for _, name := range known.FindAllString(target.Expr, -1) {
+				assert.Contains(t, Names, name, "dashboard queries an undocumented metric")
+			}
+		}
+	}
+}
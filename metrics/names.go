@@ -0,0 +1,63 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package metrics
+
+// Metric names are stable: they are only ever added, never renamed, so dashboards and alerts keep working across
+// releases. Counters end in _total and only grow until the process restarts, durations are in seconds. Every sample
+// carries the "group" and "instance" labels of the watcher ID plus the labels given with WithLabels.
+const (
+	// EventsProcessed counts successfully dispatched events, rate() of it is the throughput
+	EventsProcessed = "mongowatch_events_processed_total"
+	// EventsFailed counts failed dispatch attempts
+	EventsFailed = "mongowatch_events_failed_total"
+	// EventsQuarantined counts poison events set aside by stream.WithPoisonPolicy
+	EventsQuarantined = "mongowatch_events_quarantined_total"
+	// EventsSampledKept and EventsSampledDropped count the sampling decisions of stream.WithSampling
+	EventsSampledKept    = "mongowatch_events_sampled_kept_total"
+	EventsSampledDropped = "mongowatch_events_sampled_dropped_total"
+	// QuarantineDepth is the number of events currently in the quarantine (dead letter) collection, see WithQuarantine
+	QuarantineDepth = "mongowatch_quarantine_depth"
+	// Gaps counts suspicious gaps found by stream.WithGapDetection
+	Gaps = "mongowatch_gaps_total"
+	// Restarts counts failed starts retried by StartWithRetry
+	Restarts = "mongowatch_restarts_total"
+	// Running, Paused and Degraded are 1 while the processor is in that state, 0 otherwise
+	Running  = "mongowatch_running"
+	Paused   = "mongowatch_paused"
+	Degraded = "mongowatch_degraded"
+	// Lag is the age of the cluster time of the last processed event, missing until an event was processed
+	Lag = "mongowatch_lag_seconds"
+	// CursorGetMores counts server round trips, CursorEvents the events received in them
+	CursorGetMores = "mongowatch_cursor_getmores_total"
+	CursorEvents   = "mongowatch_cursor_events_total"
+	// CursorGetMoreSeconds is the total time spent waiting on round trips
+	CursorGetMoreSeconds = "mongowatch_cursor_getmore_seconds_total"
+	// OplogWindow is the time covered by the oplog of the source, see WithOplogMonitor
+	OplogWindow = "mongowatch_oplog_window_seconds"
+	// OplogHeadroom is how far the checkpoint is ahead of the oplog start
+	OplogHeadroom = "mongowatch_oplog_headroom_seconds"
+	// OplogWindowUsed is the share of the oplog window the consumer is behind, 1 once the checkpoint is lost
+	OplogWindowUsed = "mongowatch_oplog_window_used_ratio"
+)
+
+// Names lists every metric name
+var Names = []string{
+	EventsProcessed, EventsFailed, EventsQuarantined, QuarantineDepth, Gaps, Restarts,
+	Running, Paused, Degraded, Lag, CursorGetMores, CursorEvents, CursorGetMoreSeconds,
+	OplogWindow, OplogHeadroom, OplogWindowUsed, EventsSampledKept, EventsSampledDropped,
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VictoriaMetrics pushes samples in the Prometheus text format, e.g. to /api/v1/import/prometheus of VictoriaMetrics
+// or any endpoint accepting that format
+type VictoriaMetrics struct {
+	URL string
+	// Client defaults to http.DefaultClient
+	Client *http.Client
+	// Header is added to every request, e.g. for authorization
+	Header http.Header
+}
+
+// Push implements Pusher
+func (v VictoriaMetrics) Push(ctx context.Context, samples []Sample, at time.Time) error {
+	var body bytes.Buffer
+	for _, s := range samples {
+		body.WriteString(s.Name)
+		if len(s.Labels) > 0 {
+			body.WriteByte('{')
+			for i, k := range sortedLabels(s.Labels) {
+				if i > 0 {
+					body.WriteByte(',')
+				}
+				fmt.Fprintf(&body, "%s=%s", k, strconv.Quote(s.Labels[k]))
+			}
+			body.WriteByte('}')
+		}
+		fmt.Fprintf(&body, " %s %d\n", formatValue(s.Value), at.UnixMilli())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.URL, &body)
+	if err != nil {
+		return fmt.Errorf("failed to build request: %w", err)
+	}
+	for key, values := range v.Header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	client := v.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send samples: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// Graphite pushes samples with the plaintext protocol over TCP, labels become Graphite tags
+type Graphite struct {
+	// Addr is the host:port of the carbon receiver, usually port 2003
+	Addr string
+	// Prefix is prepended to every metric path, e.g. "prod.mongowatch"
+	Prefix string
+	// Timeout bounds connecting and writing, 5 seconds by default
+	Timeout time.Duration
+}
+
+// Push implements Pusher
+func (g Graphite) Push(ctx context.Context, samples []Sample, at time.Time) error {
+	var body bytes.Buffer
+	for _, s := range samples {
+		body.WriteString(join(g.Prefix, s.Name))
+		for _, k := range sortedLabels(s.Labels) {
+			fmt.Fprintf(&body, ";%s=%s", k, s.Labels[k])
+		}
+		fmt.Fprintf(&body, " %s %d\n", formatValue(s.Value), at.Unix())
+	}
+	return send(ctx, "tcp", g.Addr, g.Timeout, body.Bytes())
+}
+
+// StatsD pushes samples as gauges over UDP. StatsD has no labels, the sample name is prefixed with the label values
+// instead, e.g. "mongowatch.orders.pod-1.mongowatch_events_processed_total"
+type StatsD struct {
+	// Addr is the host:port of the StatsD daemon, usually port 8125
+	Addr string
+	// Prefix is prepended to every metric name
+	Prefix string
+	// Timeout bounds connecting and writing, 5 seconds by default
+	Timeout time.Duration
+}
+
+// Push implements Pusher, counters are sent as gauges of their current value so restarts of the daemon lose nothing
+func (s StatsD) Push(ctx context.Context, samples []Sample, _ time.Time) error {
+	var body bytes.Buffer
+	for _, sample := range samples {
+		name := s.Prefix
+		for _, k := range sortedLabels(sample.Labels) {
+			name = join(name, sample.Labels[k])
+		}
+		fmt.Fprintf(&body, "%s:%s|g\n", join(name, sample.Name), formatValue(sample.Value))
+	}
+	return send(ctx, "udp", s.Addr, s.Timeout, body.Bytes())
+}
+
+func send(ctx context.Context, network, addr string, timeout time.Duration, payload []byte) error {
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	defer conn.Close()
+	_ = conn.SetWriteDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(payload); err != nil {
+		return fmt.Errorf("failed to write samples to %s: %w", addr, err)
+	}
+	return nil
+}
+
+func join(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return strings.TrimSuffix(prefix, ".") + "." + name
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
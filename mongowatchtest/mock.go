@@ -0,0 +1,168 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package mongowatchtest provides test doubles for code built on mongowatch
+package mongowatchtest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// Operations of a CollectionWatcher
+const (
+	OpInsert = "insert"
+	OpUpdate = "update"
+	OpDelete = "delete"
+)
+
+// Mock is a CollectionWatcher recording the documents it is called with, safe for concurrent use.
+// Calls fail with the errors scheduled by FailNext first, then with the one set by FailAlways.
+type Mock struct {
+	mu       sync.Mutex
+	handled  map[string]int
+	attempts map[string]int
+	payloads map[string][][]byte
+	next     map[string][]error
+	always   map[string]error
+	// changed is closed and replaced on every call, waking up AwaitCount
+	changed chan struct{}
+}
+
+var _ mongowatch.CollectionWatcher = (*Mock)(nil)
+
+// NewMock creates a mock succeeding on every call
+func NewMock() *Mock {
+	return &Mock{
+		handled:  map[string]int{},
+		attempts: map[string]int{},
+		payloads: map[string][][]byte{},
+		next:     map[string][]error{},
+		always:   map[string]error{},
+		changed:  make(chan struct{}),
+	}
+}
+
+// Insert records an insert
+func (m *Mock) Insert(ctx context.Context, doc []byte) error {
+	return m.call(OpInsert, doc)
+}
+
+// Update records an update
+func (m *Mock) Update(ctx context.Context, doc []byte) error {
+	return m.call(OpUpdate, doc)
+}
+
+// Delete records a delete
+func (m *Mock) Delete(ctx context.Context, doc []byte) error {
+	return m.call(OpDelete, doc)
+}
+
+func (m *Mock) call(op string, doc []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	defer m.notify()
+
+	m.attempts[op]++
+	err := m.always[op]
+	if scheduled := m.next[op]; len(scheduled) > 0 {
+		err, m.next[op] = scheduled[0], scheduled[1:]
+	}
+	if err != nil {
+		return err
+	}
+
+	m.handled[op]++
+	m.payloads[op] = append(m.payloads[op], append([]byte(nil), doc...))
+	return nil
+}
+
+// notify wakes up waiters, m.mu must be held
+func (m *Mock) notify() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// FailNext makes the next calls of op fail with errs in order, a nil entry lets its call succeed
+func (m *Mock) FailNext(op string, errs ...error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.next[op] = append(m.next[op], errs...)
+}
+
+// FailAlways makes every call of op without a scheduled error fail with err, nil lets them succeed again
+func (m *Mock) FailAlways(op string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.always[op] = err
+}
+
+// Count returns the successful calls of op
+func (m *Mock) Count(op string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.handled[op]
+}
+
+// Attempts returns all calls of op, failed ones included
+func (m *Mock) Attempts(op string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.attempts[op]
+}
+
+// Payloads returns the documents of the successful calls of op in call order
+func (m *Mock) Payloads(op string) [][]byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([][]byte(nil), m.payloads[op]...)
+}
+
+// AwaitCount waits until op succeeded at least n times, it fails after timeout
+func (m *Mock) AwaitCount(op string, n int, timeout time.Duration) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		m.mu.Lock()
+		count, changed := m.handled[op], m.changed
+		m.mu.Unlock()
+		if count >= n {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return fmt.Errorf("timed out after %s waiting for %d %s calls, got %d", timeout, n, op, count)
+		}
+	}
+}
+
+// Reset forgets the recorded calls and scheduled errors
+func (m *Mock) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handled = map[string]int{}
+	m.attempts = map[string]int{}
+	m.payloads = map[string][][]byte{}
+	m.next = map[string][]error{}
+	m.always = map[string]error{}
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mongowatchtest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMockConcurrentCalls(t *testing.T) {
+	m := NewMock()
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = m.Insert(ctx, []byte(`{}`))
+		}()
+	}
+
+	assert.NoError(t, m.AwaitCount(OpInsert, 50, time.Second))
+	wg.Wait()
+	assert.Equal(t, 50, m.Count(OpInsert))
+	assert.Len(t, m.Payloads(OpInsert), 50)
+	assert.Error(t, m.AwaitCount(OpUpdate, 1, 10*time.Millisecond))
+}
+
+func TestMockErrorSchedule(t *testing.T) {
+	m := NewMock()
+	ctx := context.Background()
+	down := errors.New("downstream down")
+
+	m.FailNext(OpUpdate, down, nil, down)
+	assert.ErrorIs(t, m.Update(ctx, []byte(`1`)), down)
+	assert.NoError(t, m.Update(ctx, []byte(`2`)))
+	assert.ErrorIs(t, m.Update(ctx, []byte(`3`)), down)
+	assert.NoError(t, m.Update(ctx, []byte(`4`)))
+
+	m.FailAlways(OpDelete, down)
+	assert.ErrorIs(t, m.Delete(ctx, nil), down)
+	m.FailAlways(OpDelete, nil)
+	assert.NoError(t, m.Delete(ctx, nil))
+
+	assert.Equal(t, 2, m.Count(OpUpdate))
+	assert.Equal(t, 4, m.Attempts(OpUpdate))
+	assert.Equal(t, [][]byte{[]byte(`2`), []byte(`4`)}, m.Payloads(OpUpdate))
+
+	m.Reset()
+	assert.Zero(t, m.Attempts(OpUpdate))
+}
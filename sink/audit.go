@@ -0,0 +1,311 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sink
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// ErrAuditChainBroken is returned by VerifyAuditChain when a record was altered, removed or reordered
+var ErrAuditChainBroken = errors.New("audit chain broken")
+
+// AuditRecord is an append-only entry describing who changed what and when
+type AuditRecord struct {
+	// ID equals Seq, a unique key stops concurrent writers from forking the chain
+	ID            int64                  `bson:"_id" json:"-"`
+	Seq           int64                  `bson:"seq" json:"seq"`
+	RecordedAt    time.Time              `bson:"recordedAt" json:"recordedAt"`
+	ClusterTime   primitive.Timestamp    `bson:"clusterTime" json:"clusterTime"`
+	User          string                 `bson:"user,omitempty" json:"user,omitempty"`
+	OperationType string                 `bson:"operationType" json:"operationType"`
+	Database      string                 `bson:"database" json:"database"`
+	Collection    string                 `bson:"collection" json:"collection"`
+	DocumentKey   string                 `bson:"documentKey" json:"documentKey"`
+	Before        map[string]interface{} `bson:"before,omitempty" json:"before,omitempty"`
+	After         map[string]interface{} `bson:"after,omitempty" json:"after,omitempty"`
+	UpdatedFields map[string]interface{} `bson:"updatedFields,omitempty" json:"updatedFields,omitempty"`
+	// EventID is the mongowatch.ChangeStreamEvent UUID, the same for every delivery of the event
+	EventID string `bson:"eventId,omitempty" json:"eventId,omitempty"`
+	// PrevHash is the Hash of the previous record, chaining records together for tamper evidence
+	PrevHash string `bson:"prevHash" json:"prevHash"`
+	Hash     string `bson:"hash" json:"hash"`
+}
+
+// computeHash hashes the record content together with the previous hash
+func (r AuditRecord) computeHash() (string, error) {
+	r.Hash = ""
+	// documents read back from mongo decode nested documents as primitive.D,
+	// normalize them so the hash doesn't depend on the store the record went through
+	r.Before = normalize(r.Before).(map[string]interface{})
+	r.After = normalize(r.After).(map[string]interface{})
+	r.UpdatedFields = normalize(r.UpdatedFields).(map[string]interface{})
+	content, err := json.Marshal(r)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal audit record: %w", err)
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if v == nil {
+			return v
+		}
+		out := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			out[k] = normalize(item)
+		}
+		return out
+	case primitive.M:
+		return normalize(map[string]interface{}(v))
+	case primitive.D:
+		return normalize(v.Map())
+	case primitive.A:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = normalize(item)
+		}
+		return out
+	case []interface{}:
+		return normalize(primitive.A(v))
+	}
+	return value
+}
+
+// AuditStore persists audit records append-only
+type AuditStore interface {
+	// Append stores a new record
+	Append(ctx context.Context, record AuditRecord) error
+	// Last returns the most recent record or nil if the log is empty
+	Last(ctx context.Context) (*AuditRecord, error)
+}
+
+// AuditLog records every dispatched change into a hash chained audit store
+type AuditLog struct {
+	store AuditStore
+
+	mu   sync.Mutex
+	last *AuditRecord
+	init bool
+}
+
+// NewAuditLog creates an audit log appending to store
+func NewAuditLog(store AuditStore) *AuditLog {
+	return &AuditLog{store: store}
+}
+
+// Dispatch is a mongowatch.ChangeEventDispatcherFunc appending the event to the audit log
+func (a *AuditLog) Dispatch(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.init {
+		last, err := a.store.Last(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to fetch last audit record: %w", err)
+		}
+		a.last, a.init = last, true
+	}
+	// the last event is dispatched again when the stream resumes after a failed checkpoint
+	eventID := ce.UUID()
+	if eventID != "" && a.last != nil && a.last.EventID == eventID {
+		return nil
+	}
+
+	record := AuditRecord{
+		ID:            1,
+		Seq:           1,
+		RecordedAt:    time.Now().UTC().Truncate(time.Millisecond),
+		ClusterTime:   ce.Timestamp,
+		EventID:       eventID,
+		User:          ce.User,
+		OperationType: ce.OperationType,
+		Database:      ce.Database,
+		Collection:    ce.Collection,
+		DocumentKey:   ce.DocumentKey,
+		Before:        ce.FullDocumentBeforeChange,
+		After:         ce.FullDocument,
+		UpdatedFields: ce.UpdateDescription.UpdatedFields,
+	}
+	if a.last != nil {
+		record.Seq = a.last.Seq + 1
+		record.ID = record.Seq
+		record.PrevHash = a.last.Hash
+	}
+	if record.Hash, err = record.computeHash(); err != nil {
+		return err
+	}
+
+	if err = a.store.Append(ctx, record); err != nil {
+		return fmt.Errorf("failed to append audit record: %w", err)
+	}
+	a.last = &record
+
+	return nil
+}
+
+// VerifyAuditChain checks that records, ordered by Seq, form an unbroken hash chain
+func VerifyAuditChain(records []AuditRecord) error {
+	prevHash := ""
+	for i, record := range records {
+		if i > 0 && record.Seq != records[i-1].Seq+1 {
+			return fmt.Errorf("%w: sequence gap at %d", ErrAuditChainBroken, record.Seq)
+		}
+		if i > 0 && record.PrevHash != prevHash {
+			return fmt.Errorf("%w: record %d does not follow its predecessor", ErrAuditChainBroken, record.Seq)
+		}
+		hash, err := record.computeHash()
+		if err != nil {
+			return err
+		}
+		if hash != record.Hash {
+			return fmt.Errorf("%w: record %d was altered", ErrAuditChainBroken, record.Seq)
+		}
+		prevHash = record.Hash
+	}
+	return nil
+}
+
+// MongoAuditStore stores audit records in a collection
+type MongoAuditStore struct {
+	col *mongo.Collection
+}
+
+var _ AuditStore = (*MongoAuditStore)(nil)
+
+// NewMongoAuditStore creates an audit store in col, call EnsureIndexes once to reject duplicate records
+func NewMongoAuditStore(col *mongo.Collection) *MongoAuditStore {
+	return &MongoAuditStore{col: col}
+}
+
+// EnsureIndexes creates the unique index on the event ID, rejecting a second record of the same event
+func (s *MongoAuditStore) EnsureIndexes(ctx context.Context) error {
+	_, err := s.col.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "eventId", Value: 1}},
+		// events without a resume token have no ID
+		Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.D{{Key: "eventId", Value: bson.D{{Key: "$type", Value: "string"}}}}),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create audit indexes: %w", err)
+	}
+	return nil
+}
+
+// Append inserts the record
+func (s *MongoAuditStore) Append(ctx context.Context, record AuditRecord) error {
+	_, err := s.col.InsertOne(ctx, record)
+	return err
+}
+
+// Last returns the record with the highest seq
+func (s *MongoAuditStore) Last(ctx context.Context) (*AuditRecord, error) {
+	var record AuditRecord
+	err := s.col.FindOne(ctx, bson.D{}, options.FindOne().SetSort(bson.D{{Key: "seq", Value: -1}})).Decode(&record)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// FileAuditStore appends audit records to a file as JSON lines
+type FileAuditStore struct {
+	path string
+}
+
+var _ AuditStore = (*FileAuditStore)(nil)
+
+// NewFileAuditStore creates an audit store appending to the file at path
+func NewFileAuditStore(path string) *FileAuditStore {
+	return &FileAuditStore{path: path}
+}
+
+// Append writes the record as a JSON line and syncs the file
+func (s *FileAuditStore) Append(_ context.Context, record AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Last reads the last line of the file
+func (s *FileAuditStore) Last(_ context.Context) (*AuditRecord, error) {
+	records, err := s.ReadAll()
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	return &records[len(records)-1], nil
+}
+
+// ReadAll reads every record, e.g. to pass them to VerifyAuditChain
+func (s *FileAuditStore) ReadAll() ([]AuditRecord, error) {
+	f, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []AuditRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record AuditRecord
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("failed to parse audit record: %w", err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sink
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+func Test_AuditLog_HashChain(t *testing.T) {
+	store := NewFileAuditStore(filepath.Join(t.TempDir(), "audit.jsonl"))
+	ctx := context.Background()
+
+	events := []mongowatch.ChangeStreamEvent{
+		{OperationType: "insert", DocumentKey: "1", FullDocument: primitive.M{"status": "new", "meta": primitive.M{"n": int32(1)}}},
+		{OperationType: "update", DocumentKey: "1", FullDocument: primitive.M{"status": "paid"}, FullDocumentBeforeChange: primitive.M{"status": "new"}},
+		{OperationType: "delete", DocumentKey: "1", FullDocumentBeforeChange: primitive.M{"status": "paid"}},
+	}
+
+	// a restarted process continues the chain from the store
+	assert.NoError(t, NewAuditLog(store).Dispatch(ctx, events[0], nil))
+	auditLog := NewAuditLog(store)
+	for _, ce := range events[1:] {
+		assert.NoError(t, auditLog.Dispatch(ctx, ce, nil))
+	}
+
+	records, err := store.ReadAll()
+	assert.NoError(t, err)
+	assert.Len(t, records, 3)
+	assert.Equal(t, int64(3), records[2].Seq)
+	assert.Equal(t, records[1].Hash, records[2].PrevHash)
+	assert.NoError(t, VerifyAuditChain(records))
+
+	records[1].After["status"] = "refunded"
+	assert.ErrorIs(t, VerifyAuditChain(records), ErrAuditChainBroken)
+	assert.ErrorIs(t, VerifyAuditChain([]AuditRecord{records[0], records[2]}), ErrAuditChainBroken)
+}
+
+func Test_AuditLog_SkipsRedispatchedEvent(t *testing.T) {
+	store := NewFileAuditStore(filepath.Join(t.TempDir(), "audit.jsonl"))
+	ctx := context.Background()
+	first := mongowatch.ChangeStreamEvent{ID: mongowatch.ResumeToken{TokenData: "82aa"}, OperationType: "insert", DocumentKey: "1"}
+	second := mongowatch.ChangeStreamEvent{ID: mongowatch.ResumeToken{TokenData: "82bb"}, OperationType: "delete", DocumentKey: "1"}
+
+	assert.NoError(t, NewAuditLog(store).Dispatch(ctx, first, nil))
+	// the restarted process resumes before the last event and receives it again
+	auditLog := NewAuditLog(store)
+	assert.NoError(t, auditLog.Dispatch(ctx, first, nil))
+	assert.NoError(t, auditLog.Dispatch(ctx, second, nil))
+	assert.NoError(t, auditLog.Dispatch(ctx, second, nil))
+
+	records, err := store.ReadAll()
+	assert.NoError(t, err)
+	assert.Len(t, records, 2)
+	assert.Equal(t, first.UUID(), records[0].EventID)
+	assert.Equal(t, second.UUID(), records[1].EventID)
+	assert.NoError(t, VerifyAuditChain(records))
+}
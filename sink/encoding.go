@@ -0,0 +1,90 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package sink delivers change stream events to external systems
+package sink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Encoding is an HTTP content encoding applied to sink payloads
+type Encoding string
+
+const (
+	// EncodingIdentity sends payloads uncompressed
+	EncodingIdentity Encoding = "identity"
+	// EncodingGzip compresses payloads with gzip
+	EncodingGzip Encoding = "gzip"
+	// EncodingZstd compresses payloads with zstd
+	EncodingZstd Encoding = "zstd"
+	// EncodingAuto starts uncompressed and switches to the best encoding the endpoint advertises in Accept-Encoding
+	EncodingAuto Encoding = "auto"
+)
+
+// preferredEncodings lists supported encodings from the best to the worst compression
+var preferredEncodings = []Encoding{EncodingZstd, EncodingGzip, EncodingIdentity}
+
+// Encode compresses payload with the given encoding
+func Encode(enc Encoding, payload []byte) ([]byte, error) {
+	switch enc {
+	case EncodingIdentity, EncodingAuto, "":
+		return payload, nil
+	case EncodingGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(payload); err != nil {
+			return nil, fmt.Errorf("failed to gzip payload: %w", err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, fmt.Errorf("failed to gzip payload: %w", err)
+		}
+		return buf.Bytes(), nil
+	case EncodingZstd:
+		w, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd encoder: %w", err)
+		}
+		defer w.Close()
+		return w.EncodeAll(payload, nil), nil
+	}
+	return nil, fmt.Errorf("unsupported content encoding: %s", enc)
+}
+
+// NegotiateEncoding picks the best supported encoding listed in an Accept-Encoding header value
+func NegotiateEncoding(acceptEncoding string) Encoding {
+	accepted := map[Encoding]bool{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.ReplaceAll(strings.TrimSpace(params), " ", "") == "q=0" {
+			continue
+		}
+		accepted[Encoding(strings.ToLower(strings.TrimSpace(name)))] = true
+	}
+
+	for _, enc := range preferredEncodings {
+		if accepted[enc] || accepted["*"] {
+			return enc
+		}
+	}
+	return EncodingIdentity
+}
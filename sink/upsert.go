@@ -0,0 +1,170 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sink
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/mmtracker/mongowatch"
+	"github.com/mmtracker/mongowatch/stream"
+)
+
+// ErrNoFullDocument is returned for updates without a full document, upserts need the whole document
+var ErrNoFullDocument = errors.New("update event has no full document, watch with updateLookup")
+
+// UpsertStore writes the latest state of documents keyed by documentKey and versioned by cluster time,
+// see mongowatch.VersionOf. Writes carrying an older version than the stored one are skipped, equal ones are applied.
+type UpsertStore interface {
+	// Upsert writes doc under key unless a newer version is stored, it reports whether doc was written
+	Upsert(ctx context.Context, key string, doc primitive.M, version uint64) (bool, error)
+	// Tombstone marks key deleted unless a newer version is stored, it reports whether the tombstone was written
+	Tombstone(ctx context.Context, key string, version uint64) (bool, error)
+}
+
+// Upsert applies change events to an UpsertStore. Change streams deliver at least once and retries may reorder
+// writes; with every write conditional on the version and deletes kept as versioned tombstones, redelivered and
+// stale events leave the store unchanged, so the downstream state is effectively exactly once.
+type Upsert struct {
+	store UpsertStore
+}
+
+// NewUpsert creates an upsert sink writing to store
+func NewUpsert(store UpsertStore) *Upsert {
+	return &Upsert{store: store}
+}
+
+// Dispatch is a mongowatch.ChangeEventDispatcherFunc applying the event to the store
+func (u *Upsert) Dispatch(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+	if err != nil {
+		return err
+	}
+
+	var applied bool
+	switch ce.OperationType {
+	case "insert", "replace", "update":
+		if ce.FullDocument == nil {
+			return fmt.Errorf("failed to upsert %s: %w", ce.DocumentKey, ErrNoFullDocument)
+		}
+		applied, err = u.store.Upsert(ctx, ce.DocumentKey, ce.FullDocument, ce.Version())
+	case "delete":
+		applied, err = u.store.Tombstone(ctx, ce.DocumentKey, ce.Version())
+	default:
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to apply %s of %s: %w", ce.OperationType, ce.DocumentKey, err)
+	}
+	if !applied {
+		log.Tracef("upsert: skipping stale %s of %s, a newer version is stored", ce.OperationType, ce.DocumentKey)
+	}
+	return nil
+}
+
+// MongoUpsertStore keeps the documents in a Mongo collection under their documentKey, see stream.ReplaceVersioned
+type MongoUpsertStore struct {
+	col *mongo.Collection
+}
+
+var _ UpsertStore = (*MongoUpsertStore)(nil)
+
+// NewMongoUpsertStore creates an upsert store writing to col
+func NewMongoUpsertStore(col *mongo.Collection) *MongoUpsertStore {
+	return &MongoUpsertStore{col: col}
+}
+
+// Upsert replaces the document unless a newer version is stored
+func (s *MongoUpsertStore) Upsert(ctx context.Context, key string, doc primitive.M, version uint64) (bool, error) {
+	return stream.ReplaceVersioned(ctx, s.col, key, doc, version)
+}
+
+// Tombstone replaces the document by a tombstone unless a newer version is stored
+func (s *MongoUpsertStore) Tombstone(ctx context.Context, key string, version uint64) (bool, error) {
+	return stream.DeleteVersioned(ctx, s.col, key, version)
+}
+
+// Execer runs SQL statements, *sql.DB, *sql.Conn and *sql.Tx all implement it
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// SQLUpsertStore keeps the documents as JSON in a table with a key, document, version and deleted column.
+// Statements use INSERT ... ON CONFLICT with $n placeholders, as understood by PostgreSQL and SQLite.
+type SQLUpsertStore struct {
+	db    Execer
+	table string
+}
+
+var _ UpsertStore = (*SQLUpsertStore)(nil)
+
+// NewSQLUpsertStore creates an upsert store writing to table, see SQLUpsertStore.Schema for its layout
+func NewSQLUpsertStore(db Execer, table string) *SQLUpsertStore {
+	return &SQLUpsertStore{db: db, table: table}
+}
+
+// Schema returns the statement creating the table of the store
+func (s *SQLUpsertStore) Schema() string {
+	return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	key TEXT PRIMARY KEY,
+	doc TEXT,
+	version BIGINT NOT NULL,
+	deleted BOOLEAN NOT NULL DEFAULT FALSE
+)`, s.table)
+}
+
+// upsertSQL writes a row unless the stored one has a newer version, the WHERE of the conflict clause
+// turns stale writes into no-ops affecting no rows
+func (s *SQLUpsertStore) upsertSQL() string {
+	return fmt.Sprintf(`INSERT INTO %[1]s (key, doc, version, deleted) VALUES ($1, $2, $3, $4)
+ON CONFLICT (key) DO UPDATE SET doc = EXCLUDED.doc, version = EXCLUDED.version, deleted = EXCLUDED.deleted
+WHERE %[1]s.version <= EXCLUDED.version`, s.table)
+}
+
+// Upsert writes the document as relaxed extended JSON unless a newer version is stored
+func (s *SQLUpsertStore) Upsert(ctx context.Context, key string, doc primitive.M, version uint64) (bool, error) {
+	data, err := bson.MarshalExtJSON(doc, false, false)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal document: %w", err)
+	}
+	return s.exec(ctx, key, string(data), version, false)
+}
+
+// Tombstone clears the document and marks the row deleted unless a newer version is stored
+func (s *SQLUpsertStore) Tombstone(ctx context.Context, key string, version uint64) (bool, error) {
+	return s.exec(ctx, key, nil, version, true)
+}
+
+func (s *SQLUpsertStore) exec(ctx context.Context, key string, doc interface{}, version uint64, deleted bool) (bool, error) {
+	// BIGINT is signed, cluster times fit until 2038
+	res, err := s.db.ExecContext(ctx, s.upsertSQL(), key, doc, int64(version), deleted)
+	if err != nil {
+		return false, fmt.Errorf("failed to upsert into %s: %w", s.table, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to read affected rows: %w", err)
+	}
+	return n > 0, nil
+}
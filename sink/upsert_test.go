@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sink
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+type sqlRow struct {
+	doc     interface{}
+	version int64
+	deleted bool
+}
+
+// fakeSQL executes the upsert statement of SQLUpsertStore against a map, honoring its version condition
+type fakeSQL struct {
+	queries []string
+	rows    map[string]sqlRow
+}
+
+func (f *fakeSQL) ExecContext(_ context.Context, query string, args ...interface{}) (sql.Result, error) {
+	f.queries = append(f.queries, query)
+	key, version := args[0].(string), args[2].(int64)
+	if row, ok := f.rows[key]; ok && row.version > version {
+		return driverResult(0), nil
+	}
+	f.rows[key] = sqlRow{doc: args[1], version: version, deleted: args[3].(bool)}
+	return driverResult(1), nil
+}
+
+type driverResult int64
+
+func (r driverResult) LastInsertId() (int64, error) { return 0, nil }
+func (r driverResult) RowsAffected() (int64, error) { return int64(r), nil }
+
+func event(op string, t uint32, doc primitive.M) mongowatch.ChangeStreamEvent {
+	return mongowatch.ChangeStreamEvent{OperationType: op, DocumentKey: "d1", Timestamp: primitive.Timestamp{T: t}, FullDocument: doc}
+}
+
+func Test_Upsert_SQL(t *testing.T) {
+	ctx := context.Background()
+	db := &fakeSQL{rows: map[string]sqlRow{}}
+	store := NewSQLUpsertStore(db, "devices")
+	upsert := NewUpsert(store)
+
+	insert := event("insert", 10, primitive.M{"status": "new"})
+	update := event("update", 11, primitive.M{"status": "paid"})
+	del := event("delete", 12, nil)
+
+	require.NoError(t, upsert.Dispatch(ctx, insert, nil))
+	require.NoError(t, upsert.Dispatch(ctx, update, nil))
+	// the insert is redelivered after the update, it must not roll the row back
+	require.NoError(t, upsert.Dispatch(ctx, insert, nil))
+	assert.Equal(t, `{"status":"paid"}`, db.rows["d1"].doc)
+
+	require.NoError(t, upsert.Dispatch(ctx, update, nil))
+	require.NoError(t, upsert.Dispatch(ctx, del, nil))
+	// a late update can't revive a deleted document
+	require.NoError(t, upsert.Dispatch(ctx, update, nil))
+	assert.Equal(t, sqlRow{doc: nil, version: int64(del.Version()), deleted: true}, db.rows["d1"])
+
+	assert.Contains(t, db.queries[0], "WHERE devices.version <= EXCLUDED.version")
+	assert.Contains(t, store.Schema(), "CREATE TABLE IF NOT EXISTS devices")
+}
+
+func Test_Upsert_Errors(t *testing.T) {
+	upsert := NewUpsert(NewSQLUpsertStore(&fakeSQL{rows: map[string]sqlRow{}}, "devices"))
+
+	err := upsert.Dispatch(context.Background(), event("update", 10, nil), nil)
+	assert.ErrorIs(t, err, ErrNoFullDocument)
+
+	// other operations are skipped
+	assert.NoError(t, upsert.Dispatch(context.Background(), event("drop", 10, nil), nil))
+	assert.ErrorIs(t, upsert.Dispatch(context.Background(), event("insert", 10, nil), assert.AnError), assert.AnError)
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sink
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+	"github.com/mmtracker/mongowatch/stream"
+)
+
+// WebhookConfig configures delivery of events to an HTTP endpoint
+type WebhookConfig struct {
+	URL string
+	// Client defaults to http.DefaultClient
+	Client *http.Client
+	// Serializer selects the payload format, JSON by default
+	Serializer mongowatch.Serializer
+	// ContentType is sent with every request, defaults to application/json
+	ContentType string
+	// Encoding compresses payloads, EncodingAuto negotiates it with the endpoint
+	Encoding Encoding
+	// Header is added to every request, e.g. for authorization
+	Header http.Header
+}
+
+// Webhook posts every dispatched event to an HTTP endpoint
+type Webhook struct {
+	cfg WebhookConfig
+
+	mu       sync.Mutex
+	encoding Encoding
+}
+
+// NewWebhook creates a webhook sink
+func NewWebhook(cfg WebhookConfig) *Webhook {
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	if cfg.Serializer == nil {
+		cfg.Serializer = stream.JSONSerializer{}
+	}
+	if cfg.ContentType == "" {
+		cfg.ContentType = "application/json"
+	}
+	encoding := cfg.Encoding
+	if encoding == "" || encoding == EncodingAuto {
+		encoding = EncodingIdentity
+	}
+	return &Webhook{cfg: cfg, encoding: encoding}
+}
+
+// Dispatch is a mongowatch.ChangeEventDispatcherFunc delivering the event, non 2xx responses are errors
+func (w *Webhook) Dispatch(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+	if err != nil {
+		return err
+	}
+
+	payload, err := w.cfg.Serializer.Serialize(Envelope(ce))
+	if err != nil {
+		return fmt.Errorf("webhook: failed to serialize event: %w", err)
+	}
+
+	w.mu.Lock()
+	encoding := w.encoding
+	w.mu.Unlock()
+
+	body, err := Encode(encoding, payload)
+	if err != nil {
+		return fmt.Errorf("webhook: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("webhook: failed to build request: %w", err)
+	}
+	for key, values := range w.cfg.Header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", w.cfg.ContentType)
+	if encoding != EncodingIdentity {
+		req.Header.Set("Content-Encoding", string(encoding))
+	}
+
+	resp, err := w.cfg.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook: failed to deliver event: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if w.cfg.Encoding == EncodingAuto {
+		if negotiated := NegotiateEncoding(resp.Header.Get("Accept-Encoding")); negotiated != encoding {
+			log.Tracef("webhook: switching content encoding to %s", negotiated)
+			w.mu.Lock()
+			w.encoding = negotiated
+			w.mu.Unlock()
+		}
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook: endpoint responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// Envelope converts an event into the document delivered by sinks
+func Envelope(ce mongowatch.ChangeStreamEvent) primitive.M {
+	return primitive.M{
+		"id":                       ce.UUID(),
+		"operationType":            ce.OperationType,
+		"database":                 ce.Database,
+		"collection":               ce.Collection,
+		"documentKey":              ce.DocumentKey,
+		"key":                      ce.LogicalKey(),
+		"timestamp":                ce.Timestamp,
+		"version":                  ce.Version(),
+		"resumeToken":              ce.ID.TokenData,
+		"fullDocument":             ce.FullDocument,
+		"fullDocumentBeforeChange": ce.FullDocumentBeforeChange,
+		"updateDescription":        ce.UpdateDescription,
+	}
+}
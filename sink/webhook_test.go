@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+func Test_NegotiateEncoding(t *testing.T) {
+	assert.Equal(t, EncodingZstd, NegotiateEncoding("gzip, zstd"))
+	assert.Equal(t, EncodingGzip, NegotiateEncoding("gzip;q=0.5, br"))
+	assert.Equal(t, EncodingIdentity, NegotiateEncoding("gzip;q=0"))
+	assert.Equal(t, EncodingIdentity, NegotiateEncoding(""))
+}
+
+func Test_Webhook_NegotiatesEncoding(t *testing.T) {
+	var encodings []string
+	var docs []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodings = append(encodings, r.Header.Get("Content-Encoding"))
+
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		if r.Header.Get("Content-Encoding") == string(EncodingZstd) {
+			dec, err := zstd.NewReader(nil)
+			assert.NoError(t, err)
+			body, err = dec.DecodeAll(body, nil)
+			assert.NoError(t, err)
+		}
+
+		var envelope map[string]interface{}
+		assert.NoError(t, json.Unmarshal(body, &envelope))
+		docs = append(docs, envelope["documentKey"].(string))
+
+		w.Header().Set("Accept-Encoding", "gzip, zstd")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	webhook := NewWebhook(WebhookConfig{URL: server.URL, Encoding: EncodingAuto})
+	for _, key := range []string{"a", "b"} {
+		ce := mongowatch.ChangeStreamEvent{OperationType: "insert", DocumentKey: key, FullDocument: primitive.M{"_id": key}}
+		assert.NoError(t, webhook.Dispatch(context.Background(), ce, nil))
+	}
+
+	assert.Equal(t, []string{"", "zstd"}, encodings)
+	assert.Equal(t, []string{"a", "b"}, docs)
+}
+
+func Test_Webhook_FailsOnErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	webhook := NewWebhook(WebhookConfig{URL: server.URL})
+	assert.Error(t, webhook.Dispatch(context.Background(), mongowatch.ChangeStreamEvent{}, nil))
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// watcherSettings is implemented by watchers reporting their effective configuration for the startup banner
+type watcherSettings interface {
+	settings() log.Fields
+}
+
+func (csw *ChangeStreamWatcher) settings() log.Fields {
+	filter := csw.nsFilter
+	if csw.reloader != nil {
+		filter = csw.reloader.Filter()
+	}
+	checkpoint := "per event"
+	if csw.batchCheckpoint {
+		checkpoint = "per batch"
+		if csw.batchMaxEvents > 0 {
+			checkpoint = fmt.Sprintf("per batch of at most %d events", csw.batchMaxEvents)
+		}
+	}
+
+	fields := log.Fields{
+		"mode":         "change stream",
+		"namespace":    csw.namespace,
+		"fullDocument": csw.fullDocument,
+		"checkpoint":   checkpoint,
+	}
+	if !filter.IsEmpty() {
+		fields["allow"] = filter.Allow
+		fields["deny"] = filter.Deny
+	}
+	if len(csw.watchFields) > 0 {
+		fields["watchFields"] = csw.watchFields
+	}
+	if len(csw.operationTypes) > 0 {
+		fields["operationTypes"] = csw.operationTypes
+	}
+	if csw.batchSize > 0 {
+		fields["batchSize"] = csw.batchSize
+	}
+	if csw.maxAwaitTime > 0 {
+		fields["maxAwaitTime"] = csw.maxAwaitTime
+	}
+	return fields
+}
+
+func (w *PollingWatcher) settings() log.Fields {
+	return log.Fields{
+		"mode":       "polling",
+		"namespace":  w.database + "." + w.collection,
+		"timeField":  w.cfg.TimeField,
+		"interval":   w.cfg.Interval,
+		"batchSize":  w.cfg.BatchSize,
+		"checkpoint": "per event",
+	}
+}
+
+// logBanner logs the effective configuration of the processor at info level, once per processor
+func (dp DocumentProcessor) logBanner(ctx context.Context, fullDocumentMode options.FullDocument) {
+	dp.control.banner.Do(func() {
+		fields := log.Fields{"mode": "custom watcher"}
+		if s, ok := dp.watcher.(watcherSettings); ok {
+			fields = s.settings()
+		}
+		fields["fullDocumentBeforeChange"] = fullDocumentMode
+		if w, ok := dp.watcher.(interface{ PreImageMode() options.FullDocument }); ok && !isPreImageMode(fullDocumentMode) {
+			// the mode passed to Start only picks the pre-image mode when it is one
+			fields["fullDocumentBeforeChange"] = w.PreImageMode()
+		}
+		// events are dispatched one at a time in stream order
+		fields["workers"] = 1
+		if dp.resumeCollection.Name != "" {
+			fields["resumeCollection"] = dp.resumeCollection.Name
+		}
+		info, err := dp.resumeRepo.Describe(ctx)
+		switch {
+		case err == nil:
+			fields["resumeFrom"] = fmt.Sprintf("%d.%d (%s)", info.ClusterTime.T, info.ClusterTime.I, info.OperationType)
+		case errors.Is(err, mongo.ErrNoDocuments):
+			fields["resumeFrom"] = "now, no resume point stored"
+		default:
+			fields["resumeFrom"] = fmt.Sprintf("unknown: %v", err)
+		}
+		if dp.manager.handlerTimeout > 0 {
+			fields["handlerTimeout"] = dp.manager.handlerTimeout
+		}
+		if dp.manager.budget != nil {
+			fields["eventBudget"] = dp.manager.budget.budget
+		}
+		if dp.manager.poisonAttempts > 0 {
+			fields["poisonAttempts"] = dp.manager.poisonAttempts
+		}
+		logger(ctx).WithFields(fields).Info("starting data processor")
+	})
+}
@@ -0,0 +1,288 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// SnapshotSource reads a collection page by page for BootstrapWatcher
+type SnapshotSource interface {
+	// ClusterTime returns the current cluster time, the live stream starts there
+	ClusterTime(ctx context.Context) (primitive.Timestamp, error)
+	// Page returns up to limit documents with an _id greater than after in _id order, nil after starts from the
+	// first one, together with the cluster time the page was read at
+	Page(ctx context.Context, after interface{}, limit int64) ([]primitive.M, primitive.Timestamp, error)
+}
+
+// MongoSnapshot reads a collection in causally consistent sessions, so every page knows its read time
+type MongoSnapshot struct {
+	col *mongo.Collection
+}
+
+var _ SnapshotSource = MongoSnapshot{}
+
+// NewMongoSnapshot creates a snapshot source of col
+func NewMongoSnapshot(col *mongo.Collection) MongoSnapshot {
+	return MongoSnapshot{col: col}
+}
+
+// ClusterTime implements SnapshotSource
+func (s MongoSnapshot) ClusterTime(ctx context.Context) (primitive.Timestamp, error) {
+	var at primitive.Timestamp
+	err := s.session(ctx, func(sc mongo.SessionContext) error {
+		return s.col.Database().RunCommand(sc, bson.D{{Key: "ping", Value: 1}}).Err()
+	}, &at)
+	if err != nil {
+		return at, fmt.Errorf("failed to read cluster time: %w", err)
+	}
+	return at, nil
+}
+
+// Page implements SnapshotSource
+func (s MongoSnapshot) Page(ctx context.Context, after interface{}, limit int64) ([]primitive.M, primitive.Timestamp, error) {
+	var page []primitive.M
+	var at primitive.Timestamp
+	err := s.session(ctx, func(sc mongo.SessionContext) error {
+		var err error
+		page, err = fetchPage[primitive.M](sc, s.col, after, limit)
+		return err
+	}, &at)
+	return page, at, err
+}
+
+func (s MongoSnapshot) session(ctx context.Context, fn func(mongo.SessionContext) error, at *primitive.Timestamp) error {
+	sess, err := s.col.Database().Client().StartSession(options.Session().SetCausalConsistency(true))
+	if err != nil {
+		return fmt.Errorf("failed to start session: %w", err)
+	}
+	defer sess.EndSession(ctx)
+
+	if err = fn(mongo.NewSessionContext(ctx, sess)); err != nil {
+		return err
+	}
+	if ts := sess.OperationTime(); ts != nil {
+		*at = *ts
+	}
+	return nil
+}
+
+// BootstrapWatcher starts a fresh processor with a snapshot of the collection before streaming changes.
+// Without a stored resume point it opens the live stream at the current cluster time and reads the collection in
+// _id order meanwhile, every document is dispatched as an insert event stamped with the cluster time it was read at,
+// so handlers should upsert. Live events and snapshot copies are merged per document key, a snapshot copy is never
+// applied over a newer streamed change:
+//   - events of documents already read are dropped when the snapshot copy includes them, dispatched otherwise
+//   - events of documents not read yet are held back until the snapshot reaches the document, then the ones newer
+//     than the snapshot copy are dispatched after it
+//   - events of documents the snapshot never saw, e.g. deleted meanwhile, are dispatched when the snapshot completes
+//
+// No resume point is stored before the snapshot completes, a processor interrupted meanwhile bootstraps again.
+// Keys of the read documents are kept in memory until the live stream passed the read time of the last page.
+// With a stored resume point the live watcher is started as is.
+type BootstrapWatcher struct {
+	source   SnapshotSource
+	live     mongowatch.ChangeStreamWatcher
+	pageSize int64
+}
+
+var _ mongowatch.ChangeStreamWatcher = (*BootstrapWatcher)(nil)
+
+// NewBootstrapWatcher creates a watcher bootstrapping from source before streaming from live
+func NewBootstrapWatcher(source SnapshotSource, live mongowatch.ChangeStreamWatcher) *BootstrapWatcher {
+	return &BootstrapWatcher{source: source, live: live, pageSize: pageBatchSize}
+}
+
+// Start implements mongowatch.ChangeStreamWatcher
+func (b *BootstrapWatcher) Start(ctx context.Context, fullDocumentMode options.FullDocument, resumePoint *mongowatch.ChangeStreamResumePoint, saveFunc, deleteFunc mongowatch.ChangeEventDispatcherFunc, dispatchFuncs ...mongowatch.ChangeEventDispatcherFunc) error {
+	if resumePoint != nil {
+		return b.live.Start(ctx, fullDocumentMode, resumePoint, saveFunc, deleteFunc, dispatchFuncs...)
+	}
+
+	startAt, err := b.source.ClusterTime(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to bootstrap: %w", err)
+	}
+	start, err := mongowatch.StartPosition{Timestamp: &startAt}.ResumePoint()
+	if err != nil {
+		return err
+	}
+	logger(ctx).Infof("bootstrapping from a snapshot, streaming changes from cluster time %d", startAt.T)
+
+	merge := newSnapshotMerge(dispatchFuncs)
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	liveErr := make(chan error, 1)
+	go func() {
+		err := b.live.Start(ctx, fullDocumentMode, &start, merge.save(saveFunc), deleteFunc, merge.live)
+		cancel(err)
+		liveErr <- err
+	}()
+
+	if err = b.snapshot(ctx, merge); err != nil {
+		cancel(err)
+		<-liveErr
+		return fmt.Errorf("failed to bootstrap: %w", context.Cause(ctx))
+	}
+	return <-liveErr
+}
+
+func (b *BootstrapWatcher) snapshot(ctx context.Context, merge *snapshotMerge) error {
+	var after interface{}
+	var read int
+	for {
+		page, at, err := b.source.Page(ctx, after, b.pageSize)
+		if err != nil {
+			return err
+		}
+		if len(page) == 0 {
+			break
+		}
+		if err = merge.snapshot(ctx, page, at); err != nil {
+			return err
+		}
+		read += len(page)
+		after = page[len(page)-1]["_id"]
+	}
+	if err := merge.complete(ctx); err != nil {
+		return err
+	}
+	logger(ctx).Infof("bootstrap snapshot completed with %d documents", read)
+	return nil
+}
+
+// snapshotMerge serializes snapshot documents and live events, ordering them per document key
+type snapshotMerge struct {
+	dispatchFuncs []mongowatch.ChangeEventDispatcherFunc
+
+	mu sync.Mutex
+	// read maps the keys of dispatched snapshot documents to the cluster time they were read at
+	read map[string]primitive.Timestamp
+	// pending holds live events of documents the snapshot didn't reach yet
+	pending map[string][]mongowatch.ChangeStreamEvent
+	// readUntil is the read time of the last page
+	readUntil primitive.Timestamp
+	completed bool
+}
+
+func newSnapshotMerge(dispatchFuncs []mongowatch.ChangeEventDispatcherFunc) *snapshotMerge {
+	return &snapshotMerge{
+		dispatchFuncs: dispatchFuncs,
+		read:          map[string]primitive.Timestamp{},
+		pending:       map[string][]mongowatch.ChangeStreamEvent{},
+	}
+}
+
+func (m *snapshotMerge) live(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.completed && m.read != nil && ce.Timestamp.After(m.readUntil) {
+		// the stream caught up with the snapshot, no event can be older than a snapshot copy anymore
+		m.read = nil
+	}
+	if ce.DocumentKey == "" {
+		return dispatchChain(ctx, ce, m.dispatchFuncs)
+	}
+	if at, ok := m.read[ce.DocumentKey]; ok {
+		if !ce.Timestamp.After(at) {
+			eventLogf(ctx, "dropping %s event already included in the snapshot of %s", ce.OperationType, ce.DocumentKey)
+			return nil
+		}
+		return dispatchChain(ctx, ce, m.dispatchFuncs)
+	}
+	if !m.completed {
+		m.pending[ce.DocumentKey] = append(m.pending[ce.DocumentKey], ce)
+		return nil
+	}
+	return dispatchChain(ctx, ce, m.dispatchFuncs)
+}
+
+func (m *snapshotMerge) snapshot(ctx context.Context, page []primitive.M, at primitive.Timestamp) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, doc := range page {
+		key := documentKeyString(doc["_id"])
+		m.read[key] = at
+		ce := mongowatch.ChangeStreamEvent{OperationType: "insert", DocumentKey: key, FullDocument: doc, Timestamp: at}
+		if err := dispatchChain(ctx, ce, m.dispatchFuncs); err != nil {
+			return err
+		}
+		for _, pending := range m.pending[key] {
+			if !pending.Timestamp.After(at) {
+				continue
+			}
+			if err := dispatchChain(ctx, pending, m.dispatchFuncs); err != nil {
+				return err
+			}
+		}
+		delete(m.pending, key)
+	}
+	m.readUntil = at
+	return nil
+}
+
+// complete dispatches the events of documents the snapshot never saw, in cluster time order
+func (m *snapshotMerge) complete(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var rest []mongowatch.ChangeStreamEvent
+	for _, events := range m.pending {
+		rest = append(rest, events...)
+	}
+	sort.SliceStable(rest, func(i, j int) bool {
+		return rest[j].Timestamp.After(rest[i].Timestamp)
+	})
+	for _, ce := range rest {
+		if err := dispatchChain(ctx, ce, m.dispatchFuncs); err != nil {
+			return err
+		}
+	}
+	m.pending = nil
+	m.completed = true
+	return nil
+}
+
+// save drops checkpoints until the snapshot completed, so an interrupted bootstrap starts over
+func (m *snapshotMerge) save(saveFunc mongowatch.ChangeEventDispatcherFunc) mongowatch.ChangeEventDispatcherFunc {
+	return func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		m.mu.Lock()
+		completed := m.completed
+		m.mu.Unlock()
+		if !completed {
+			return nil
+		}
+		return saveFunc(ctx, ce, err)
+	}
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// pagedSnapshot serves pages once live events were dispatched
+type pagedSnapshot struct {
+	ready chan struct{}
+	pages [][]primitive.M
+	at    primitive.Timestamp
+}
+
+func (s *pagedSnapshot) ClusterTime(ctx context.Context) (primitive.Timestamp, error) {
+	return primitive.Timestamp{T: 1}, nil
+}
+
+func (s *pagedSnapshot) Page(ctx context.Context, after interface{}, limit int64) ([]primitive.M, primitive.Timestamp, error) {
+	<-s.ready
+	if len(s.pages) == 0 {
+		return nil, s.at, nil
+	}
+	page := s.pages[0]
+	s.pages = s.pages[1:]
+	return page, s.at, nil
+}
+
+// scriptedLive dispatches its events, then streams nothing until stopped
+type scriptedLive struct {
+	events  []mongowatch.ChangeStreamEvent
+	dumped  chan struct{}
+	startAt *mongowatch.ChangeStreamResumePoint
+}
+
+func (w *scriptedLive) Start(ctx context.Context, _ options.FullDocument, resumePoint *mongowatch.ChangeStreamResumePoint, saveFunc, _ mongowatch.ChangeEventDispatcherFunc, dispatchFuncs ...mongowatch.ChangeEventDispatcherFunc) error {
+	w.startAt = resumePoint
+	for _, ce := range w.events {
+		if err := dispatchChain(ctx, ce, dispatchFuncs); err != nil {
+			return err
+		}
+		if err := saveFunc(ctx, ce, nil); err != nil {
+			return err
+		}
+	}
+	close(w.dumped)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func Test_BootstrapWatcher(t *testing.T) {
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t} }
+	live := &scriptedLive{
+		dumped: make(chan struct{}),
+		events: []mongowatch.ChangeStreamEvent{
+			{OperationType: "update", DocumentKey: "a", Timestamp: ts(5)},
+			{OperationType: "update", DocumentKey: "b", Timestamp: ts(12)},
+			{OperationType: "insert", DocumentKey: "z", Timestamp: ts(11)},
+		},
+	}
+	source := &pagedSnapshot{
+		ready: live.dumped,
+		pages: [][]primitive.M{{{"_id": "a"}}, {{"_id": "b"}}},
+		at:    ts(10),
+	}
+
+	var mu sync.Mutex
+	var got []string
+	dispatch := func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, ce.OperationType+" "+ce.DocumentKey)
+		return nil
+	}
+	saved := 0
+	save := func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		saved++
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- NewBootstrapWatcher(source, live).Start(ctx, options.UpdateLookup, nil, save, nil, dispatch)
+	}()
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(got) == 4
+	}, time.Second, time.Millisecond)
+	cancel()
+	assert.True(t, errors.Is(<-done, context.Canceled))
+
+	// a is dropped as the snapshot copy includes it, b is newer than its copy, z was never in the snapshot
+	assert.Equal(t, []string{"insert a", "insert b", "update b", "insert z"}, got)
+	assert.Zero(t, saved, "checkpoints before the snapshot completed")
+	if assert.NotNil(t, live.startAt) {
+		assert.Equal(t, ts(1), live.startAt.Timestamp)
+	}
+}
+
+func Test_BootstrapWatcher_Resume(t *testing.T) {
+	live := &scriptedLive{dumped: make(chan struct{})}
+	point := &mongowatch.ChangeStreamResumePoint{ID: mongowatch.ResumeToken{TokenData: "82aa"}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := NewBootstrapWatcher(&pagedSnapshot{}, live).Start(ctx, options.Off, point, nil, nil)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, point, live.startAt)
+}
+
+func Test_snapshotMerge_AfterCompletion(t *testing.T) {
+	var got []primitive.Timestamp
+	merge := newSnapshotMerge([]mongowatch.ChangeEventDispatcherFunc{func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		got = append(got, ce.Timestamp)
+		return nil
+	}})
+	ctx := context.Background()
+	assert.NoError(t, merge.snapshot(ctx, []primitive.M{{"_id": "a"}}, primitive.Timestamp{T: 10}))
+	assert.NoError(t, merge.complete(ctx))
+
+	// a lagging stream still delivers changes the snapshot copy includes
+	assert.NoError(t, merge.live(ctx, mongowatch.ChangeStreamEvent{DocumentKey: "a", Timestamp: primitive.Timestamp{T: 9}}, nil))
+	assert.NoError(t, merge.live(ctx, mongowatch.ChangeStreamEvent{DocumentKey: "a", Timestamp: primitive.Timestamp{T: 11}}, nil))
+	assert.Nil(t, merge.read, "keys kept after the stream caught up")
+	assert.Equal(t, []primitive.Timestamp{{T: 10}, {T: 11}}, got)
+}
@@ -19,7 +19,10 @@ package stream
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync/atomic"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -32,15 +35,39 @@ import (
 // ResumeRepository stores metadata of mongo change events for resumption
 type ResumeRepository struct {
 	col *mongo.Collection
+	// epoch is the fencing token attached to writes, zero disables fencing
+	epoch atomic.Int64
+	// target is stamped on writes and checked on reads, the zero value disables the check
+	target ResumeTarget
+	// migrated is set once the stored points were upgraded to the current schema version
+	migrated atomic.Bool
 }
 
+// ErrStaleEpoch is returned when a resume point write is rejected because a newer writer took over
+var ErrStaleEpoch = errors.New("resume point write rejected: stale epoch")
+
 var _ mongowatch.StreamResume = (*ResumeRepository)(nil)
 
+// epochFenceID identifies the document holding the newest epoch that wrote a resume point
+const epochFenceID = "epoch"
+
 // NewStreamResumeRepository builds a new change stream repo instance
 func NewStreamResumeRepository(col *mongo.Collection) *ResumeRepository {
 	return &ResumeRepository{col: col}
 }
 
+// SetEpoch enables fencing, writes are tagged with epoch and rejected once a newer epoch wrote a point.
+// Fenced writes run in a transaction and need a replica set, which change streams require anyway.
+func (csr *ResumeRepository) SetEpoch(epoch int64) {
+	csr.epoch.Store(epoch)
+}
+
+// SetTarget stamps written resume points with the target and makes GetResumePoint fail with ErrResumePointMismatch
+// when the stored point was written for another one
+func (csr *ResumeRepository) SetTarget(target ResumeTarget) {
+	csr.target = target
+}
+
 // GetResumeTime returns the mongo stream timestamp for the last change stream event that was recorded
 func (csr *ResumeRepository) GetResumeTime() (*primitive.Timestamp, error) {
 	e, err := csr.GetLastResumePoint()
@@ -58,10 +85,24 @@ func (csr *ResumeRepository) GetResumePoint() (*mongowatch.ChangeStreamResumePoi
 	if err != nil {
 		return nil, err
 	}
+	if err = csr.target.check(e); err != nil {
+		return nil, err
+	}
 
 	return e, nil
 }
 
+// Describe summarizes the last stored resume point
+func (csr *ResumeRepository) Describe(ctx context.Context) (*mongowatch.ResumePointInfo, error) {
+	e, err := csr.GetLastResumePoint()
+	if err != nil {
+		return nil, err
+	}
+
+	info := e.Describe(time.Now())
+	return &info, nil
+}
+
 // Count returns the total doc count
 func (csr *ResumeRepository) Count() (int64, error) {
 	cnt, err := csr.col.CountDocuments(context.Background(), bson.D{}, nil)
@@ -72,8 +113,11 @@ func (csr *ResumeRepository) Count() (int64, error) {
 	return cnt, nil
 }
 
-// FetchAll returns all resume points
+// FetchAll returns all resume points, use FetchPage or Each on collections that may be large
 func (csr *ResumeRepository) FetchAll() ([]*mongowatch.ChangeStreamResumePoint, error) {
+	if err := csr.migrate(context.Background()); err != nil {
+		return nil, err
+	}
 	cursor, err := csr.col.Find(context.Background(), bson.D{}, nil)
 	if err != nil {
 		return nil, err
@@ -90,8 +134,12 @@ func (csr *ResumeRepository) FetchAll() ([]*mongowatch.ChangeStreamResumePoint,
 // GetLastResumePoint returns the last resumption point
 func (csr *ResumeRepository) GetLastResumePoint() (*mongowatch.ChangeStreamResumePoint, error) {
 	var opts options.FindOneOptions
-	opts.Sort = map[string]int{"timestamp": -1}
+	// points written by a newer epoch always win, so a stale writer can't clobber the current checkpoint
+	opts.Sort = bson.D{{Key: "epoch", Value: -1}, {Key: "timestamp", Value: -1}}
 	ctx := context.Background()
+	if err := csr.migrate(ctx); err != nil {
+		return nil, err
+	}
 	result := csr.col.FindOne(ctx, bson.D{}, &opts)
 
 	var event *mongowatch.ChangeStreamResumePoint
@@ -104,7 +152,7 @@ func (csr *ResumeRepository) GetLastResumePoint() (*mongowatch.ChangeStreamResum
 
 // DeleteResumePoint deletes a resumption point
 func (csr *ResumeRepository) DeleteResumePoint(ctx context.Context, token mongowatch.ResumeToken) error {
-	filter := bson.D{{Key: "_id", Value: token}}
+	filter := csr.fence(bson.D{{Key: "_id", Value: token}})
 	_, err := csr.col.DeleteOne(ctx, filter)
 	if err != nil {
 		return fmt.Errorf("failed to delete resume point: %w", err)
@@ -114,11 +162,106 @@ func (csr *ResumeRepository) DeleteResumePoint(ctx context.Context, token mongow
 
 // SaveResumePoint saves a resumption point
 func (csr *ResumeRepository) SaveResumePoint(ctx context.Context, ce mongowatch.ChangeStreamResumePoint) error {
-	filter := bson.D{{Key: "_id", Value: ce.ID}}
-	update := bson.M{"$set": ce}
-	_, err := csr.col.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	csr.target.stamp(&ce)
+	ce.SchemaVersion = ResumePointSchemaVersion
+	ce.StoredAt = time.Now()
+	epoch := csr.epoch.Load()
+	if epoch > 0 {
+		ce.Epoch = epoch
+		return csr.saveFenced(ctx, ce, epoch)
+	}
+
+	_, err := csr.col.UpdateOne(ctx, bson.D{{Key: "_id", Value: ce.ID}}, bson.M{"$set": ce}, options.Update().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("failed to save resume point: %w", err)
+	}
+	return nil
+}
+
+// saveFenced claims the epoch on the fence document and writes the point in one transaction. A newer epoch claiming
+// the fence concurrently makes the transaction conflict, and the retry then finds the newer epoch and gives up.
+func (csr *ResumeRepository) saveFenced(ctx context.Context, ce mongowatch.ChangeStreamResumePoint, epoch int64) error {
+	session, err := csr.col.Database().Client().StartSession()
 	if err != nil {
+		return fmt.Errorf("failed to start resume point session: %w", err)
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		if err := csr.claimEpoch(sc, epoch); err != nil {
+			return nil, err
+		}
+		// points written by a newer epoch before the fence document existed
+		if err := csr.checkEpoch(sc, epoch); err != nil {
+			return nil, err
+		}
+		filter := csr.fence(bson.D{{Key: "_id", Value: ce.ID}})
+		_, err := csr.col.UpdateOne(sc, filter, bson.M{"$set": ce}, options.Update().SetUpsert(true))
+		// the upsert collides with the same point already written by a newer epoch
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, fmt.Errorf("%w: %d", ErrStaleEpoch, epoch)
+		}
+		return nil, err
+	})
+	if err != nil {
+		if errors.Is(err, ErrStaleEpoch) {
+			return err
+		}
 		return fmt.Errorf("failed to save resume point: %w", err)
 	}
 	return nil
 }
+
+// claimEpoch raises the fence document to epoch, the guarded upsert collides with the existing document
+// when a newer epoch already holds it
+func (csr *ResumeRepository) claimEpoch(ctx context.Context, epoch int64) error {
+	filter := bson.D{{Key: "_id", Value: epochFenceID}, {Key: "epoch", Value: bson.D{{Key: "$lte", Value: epoch}}}}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "epoch", Value: epoch}}}}
+	_, err := csr.fenceCollection().UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("%w: %d", ErrStaleEpoch, epoch)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to claim resume point epoch: %w", err)
+	}
+	return nil
+}
+
+// fenceCollection holds the fence document next to the resume points, so it never shows up as a point
+func (csr *ResumeRepository) fenceCollection() *mongo.Collection {
+	return csr.col.Database().Collection(csr.col.Name() + "_epoch")
+}
+
+// ReplaceResumePoints deletes all resume points and saves ce as the only one
+func (csr *ResumeRepository) ReplaceResumePoints(ctx context.Context, ce mongowatch.ChangeStreamResumePoint) error {
+	_, err := csr.col.DeleteMany(ctx, csr.fence(bson.D{}))
+	if err != nil {
+		return fmt.Errorf("failed to delete resume points: %w", err)
+	}
+	return csr.SaveResumePoint(ctx, ce)
+}
+
+// fence restricts a filter to points written by the current or older epochs
+func (csr *ResumeRepository) fence(filter bson.D) bson.D {
+	epoch := csr.epoch.Load()
+	if epoch == 0 {
+		return filter
+	}
+	return append(filter, bson.E{Key: "$or", Value: bson.A{
+		bson.D{{Key: "epoch", Value: bson.D{{Key: "$lte", Value: epoch}}}},
+		bson.D{{Key: "epoch", Value: bson.D{{Key: "$exists", Value: false}}}},
+	}})
+}
+
+// checkEpoch fails if any point was written by a newer epoch
+func (csr *ResumeRepository) checkEpoch(ctx context.Context, epoch int64) error {
+	filter := bson.D{{Key: "epoch", Value: bson.D{{Key: "$gt", Value: epoch}}}}
+	cnt, err := csr.col.CountDocuments(ctx, filter, options.Count().SetLimit(1))
+	if err != nil {
+		return fmt.Errorf("failed to check resume point epoch: %w", err)
+	}
+	if cnt > 0 {
+		return fmt.Errorf("%w: %d", ErrStaleEpoch, epoch)
+	}
+	return nil
+}
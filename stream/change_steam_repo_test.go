@@ -0,0 +1,203 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+	"github.com/mmtracker/mongowatch/db"
+)
+
+func Test_ResumeRepository_RejectsStaleEpoch(t *testing.T) {
+	requireMongo(t)
+	col := NewCollection("resume_points_fencing", mongoTestsDB)
+	_ = db.Truncate(col, false)
+	_ = db.Truncate(NewCollection("resume_points_fencing_epoch", mongoTestsDB), false)
+
+	oldLeader := NewStreamResumeRepository(col)
+	oldLeader.SetEpoch(1)
+	newLeader := NewStreamResumeRepository(col)
+	newLeader.SetEpoch(2)
+
+	ctx := context.Background()
+	point := func(token string, t uint32) mongowatch.ChangeStreamResumePoint {
+		return mongowatch.ChangeStreamResumePoint{ID: mongowatch.ResumeToken{TokenData: token}, Timestamp: primitive.Timestamp{T: t}}
+	}
+
+	assert.NoError(t, oldLeader.SaveResumePoint(ctx, point("a", 1)))
+	assert.NoError(t, newLeader.SaveResumePoint(ctx, point("b", 2)))
+
+	// the paused old leader wakes up
+	assert.ErrorIs(t, oldLeader.SaveResumePoint(ctx, point("c", 3)), ErrStaleEpoch)
+	assert.NoError(t, oldLeader.DeleteResumePoint(ctx, mongowatch.ResumeToken{TokenData: "b"}))
+
+	last, err := newLeader.GetLastResumePoint()
+	assert.NoError(t, err)
+	assert.Equal(t, "b", last.ID.TokenData)
+	assert.Equal(t, int64(2), last.Epoch)
+}
+
+func Test_ResumeRepository_FencesConcurrentEpochs(t *testing.T) {
+	requireMongo(t)
+	col := NewCollection("resume_points_fencing_race", mongoTestsDB)
+	_ = db.Truncate(col, false)
+	_ = db.Truncate(NewCollection("resume_points_fencing_race_epoch", mongoTestsDB), false)
+
+	oldLeader := NewStreamResumeRepository(col)
+	oldLeader.SetEpoch(1)
+	newLeader := NewStreamResumeRepository(col)
+	newLeader.SetEpoch(2)
+
+	ctx := context.Background()
+	point := func(prefix string, i int) mongowatch.ChangeStreamResumePoint {
+		return mongowatch.ChangeStreamResumePoint{
+			ID:        mongowatch.ResumeToken{TokenData: fmt.Sprintf("%s-%d", prefix, i)},
+			Timestamp: primitive.Timestamp{T: uint32(i + 1)},
+		}
+	}
+
+	// both leaders write fresh points at once, once the new leader wrote nothing from the old one may land
+	const writes = 50
+	var wg sync.WaitGroup
+	wg.Add(2)
+	newLeaderWrote := make(chan struct{})
+	go func() {
+		defer wg.Done()
+		for i := 0; i < writes; i++ {
+			assert.NoError(t, newLeader.SaveResumePoint(ctx, point("new", i)))
+			if i == 0 {
+				close(newLeaderWrote)
+			}
+		}
+	}()
+	var lateOldWrites int
+	go func() {
+		defer wg.Done()
+		for i := 0; i < writes; i++ {
+			select {
+			case <-newLeaderWrote:
+				lateOldWrites++
+				assert.ErrorIs(t, oldLeader.SaveResumePoint(ctx, point("late", i)), ErrStaleEpoch)
+			default:
+				err := oldLeader.SaveResumePoint(ctx, point("old", i))
+				if err != nil {
+					assert.ErrorIs(t, err, ErrStaleEpoch)
+				}
+			}
+		}
+	}()
+	wg.Wait()
+
+	cnt, err := col.CountDocuments(ctx, bson.D{{Key: "_id._data", Value: bson.D{{Key: "$regex", Value: "^late-"}}}})
+	assert.NoError(t, err)
+	assert.Zero(t, cnt, "%d writes of the stale epoch after the takeover", lateOldWrites)
+	cnt, err = col.CountDocuments(ctx, bson.D{{Key: "epoch", Value: int64(2)}})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(writes), cnt)
+}
+
+func Test_ResumeRepository_RejectsOtherTarget(t *testing.T) {
+	requireMongo(t)
+	col := NewCollection("resume_points_target", mongoTestsDB)
+	_ = db.Truncate(col, false)
+
+	ctx := context.Background()
+	orders := NewStreamResumeRepository(col)
+	orders.SetTarget(ResumeTarget{Namespace: "shop.orders", Cluster: "rs0"})
+	assert.NoError(t, orders.SaveResumePoint(ctx, mongowatch.ChangeStreamResumePoint{ID: mongowatch.ResumeToken{TokenData: "a"}}))
+
+	point, err := orders.GetResumePoint()
+	assert.NoError(t, err)
+	assert.Equal(t, "shop.orders", point.Namespace)
+	assert.Equal(t, "rs0", point.Cluster)
+
+	// the same resume collection reused for another collection
+	invoices := NewStreamResumeRepository(col)
+	invoices.SetTarget(ResumeTarget{Namespace: "shop.invoices", Cluster: "rs0"})
+	_, err = invoices.GetResumePoint()
+	assert.ErrorIs(t, err, ErrResumePointMismatch)
+}
+
+func Test_ResumeRepository_MigratesLegacyPoints(t *testing.T) {
+	requireMongo(t)
+	col := NewCollection("resume_points_legacy", mongoTestsDB)
+	_ = db.Truncate(col, false)
+
+	ctx := context.Background()
+	// written by a release without a schema version
+	_, err := col.InsertOne(ctx, bson.M{"_id": bson.M{"_data": "a"}, "timestamp": primitive.Timestamp{T: 1}, "operationType": "insert"})
+	assert.NoError(t, err)
+
+	repo := NewStreamResumeRepository(col)
+	repo.SetTarget(ResumeTarget{Namespace: "shop.orders"})
+	point, err := repo.GetResumePoint()
+	assert.NoError(t, err)
+	assert.Equal(t, ResumePointSchemaVersion, point.SchemaVersion)
+	assert.Equal(t, "shop.orders", point.Namespace)
+
+	// the stored document was upgraded in place
+	var stored bson.M
+	assert.NoError(t, col.FindOne(ctx, bson.M{}).Decode(&stored))
+	assert.EqualValues(t, ResumePointSchemaVersion, stored["schemaVersion"])
+	assert.Equal(t, "shop.orders", stored["namespace"])
+}
+
+func Test_ResumeRepository_FetchPage(t *testing.T) {
+	requireMongo(t)
+	col := NewCollection("resume_points_pages", mongoTestsDB)
+	_ = db.Truncate(col, false)
+
+	ctx := context.Background()
+	repo := NewStreamResumeRepository(col)
+	for i := 0; i < 5; i++ {
+		point := mongowatch.ChangeStreamResumePoint{ID: mongowatch.ResumeToken{TokenData: fmt.Sprintf("token_%d", i)}}
+		assert.NoError(t, repo.SaveResumePoint(ctx, point))
+	}
+
+	var paged []interface{}
+	var after *mongowatch.ResumeToken
+	for {
+		page, err := repo.FetchPage(ctx, after, 2)
+		assert.NoError(t, err)
+		if len(page) == 0 {
+			break
+		}
+		assert.LessOrEqual(t, len(page), 2)
+		for _, point := range page {
+			paged = append(paged, point.ID.TokenData)
+		}
+		after = &page[len(page)-1].ID
+	}
+	assert.Equal(t, []interface{}{"token_0", "token_1", "token_2", "token_3", "token_4"}, paged)
+
+	var streamed []interface{}
+	err := repo.Each(ctx, func(point *mongowatch.ChangeStreamResumePoint) error {
+		streamed = append(streamed, point.ID.TokenData)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, paged, streamed)
+}
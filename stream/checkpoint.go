@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// ErrNoCheckpoint is returned by Checkpoint before the manager saved or processed any event
+var ErrNoCheckpoint = errors.New("no event to checkpoint yet")
+
+// checkpointBarrier tracks the last saved and the last processed event, saves and checkpoints are serialized
+// so a checkpoint never overwrites a newer point saved by the watcher
+type checkpointBarrier struct {
+	mu        sync.Mutex
+	saved     *mongowatch.ChangeStreamEvent
+	processed *mongowatch.ChangeStreamEvent
+	// manual is the point saved by Checkpoint, the watcher doesn't know it and never deletes it
+	manual *mongowatch.ChangeStreamEvent
+}
+
+// trackSave records the events save stores as resume points, a point left by Checkpoint is deleted with deleteFn
+// once the watcher saved a newer one
+func (b *checkpointBarrier) trackSave(save, deleteFn mongowatch.ChangeEventDispatcherFunc) mongowatch.ChangeEventDispatcherFunc {
+	return func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if err = save(ctx, ce, err); err != nil {
+			return err
+		}
+		b.saved = &ce
+
+		manual := b.manual
+		if manual == nil || deleteFn == nil || equalTokens(manual.ID, ce.ID) {
+			return nil
+		}
+		if err = deleteFn(ctx, *manual, nil); err != nil {
+			return fmt.Errorf("failed to delete checkpoint: %w", err)
+		}
+		b.manual = nil
+		return nil
+	}
+}
+
+// equalTokens compares resume tokens by their data
+func equalTokens(a, b mongowatch.ResumeToken) bool {
+	return reflect.DeepEqual(a.TokenData, b.TokenData)
+}
+
+// done records an event whose processing finished, successfully or by quarantining it
+func (b *checkpointBarrier) done(ce mongowatch.ChangeStreamEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.processed = &ce
+}
+
+// Checkpoint persists the position of the last processed event right away, e.g. before planned maintenance or
+// scaling, and returns the token stored as the resume point. If the watcher already stored a point at or after
+// that event, e.g. when it checkpoints every event, nothing is written and its token is returned.
+// With batch checkpoints this is the way to persist a partially processed batch. The previously saved point is
+// deleted afterwards, and the point saved here once the watcher saves a newer one.
+func (m *Manager) Checkpoint(ctx context.Context) (mongowatch.ResumeToken, error) {
+	b := &m.barrier
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	pending := b.processed
+	if pending == nil || (b.saved != nil && !pending.Timestamp.After(b.saved.Timestamp)) {
+		if b.saved == nil {
+			return mongowatch.ResumeToken{}, ErrNoCheckpoint
+		}
+		return b.saved.ID, nil
+	}
+
+	ctx = m.withID(ctx)
+	if err := m.changeEventSaveFunc(ctx, *pending, nil); err != nil {
+		return mongowatch.ResumeToken{}, fmt.Errorf("failed to save checkpoint: %w", err)
+	}
+	previous := b.saved
+	b.saved, b.manual = pending, pending
+	logger(ctx).Infof("checkpoint stored at %v", pending.ID.TokenData)
+
+	// like the watcher's own checkpoints, the new point replaces the previous one
+	if previous != nil && m.changeEventDeleteFunc != nil && !equalTokens(previous.ID, pending.ID) {
+		if err := m.changeEventDeleteFunc(ctx, *previous, nil); err != nil {
+			return pending.ID, fmt.Errorf("failed to delete previous checkpoint: %w", err)
+		}
+	}
+	return pending.ID, nil
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+func Test_Manager_Checkpoint(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryResume(nil)
+	var writes int
+	save := GetSaveResumePointFunc(repo)
+	counted := func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		writes++
+		return save(ctx, ce, err)
+	}
+	var deleted []string
+	del := GetDeleteResumePointFunc(repo)
+	recorded := func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		deleted = append(deleted, ce.ID.TokenData.(string))
+		return del(ctx, ce, err)
+	}
+	m := NewManager(repo, nil, counted, recorded)
+	// what the watcher gets from Watch
+	watcherSave := m.barrier.trackSave(m.changeEventSaveFunc, m.changeEventDeleteFunc)
+	dispatch := m.buildDispatcher([]mongowatch.ChangeEventDispatcherFunc{
+		func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error { return nil },
+	})
+	event := func(token string, t uint32) mongowatch.ChangeStreamEvent {
+		return mongowatch.ChangeStreamEvent{ID: mongowatch.ResumeToken{TokenData: token}, Timestamp: primitive.Timestamp{T: t}}
+	}
+
+	_, err := m.Checkpoint(ctx)
+	assert.ErrorIs(t, err, ErrNoCheckpoint)
+
+	// the watcher stores every event before dispatching it, the checkpoint is already there
+	e1 := event("82a1", 1)
+	require.NoError(t, watcherSave(ctx, e1, nil))
+	require.NoError(t, dispatch(ctx, e1, nil))
+	token, err := m.Checkpoint(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, e1.ID, token)
+	assert.Equal(t, 1, writes)
+
+	// batch checkpoints: processed events past the stored point are persisted on demand
+	require.NoError(t, dispatch(ctx, event("82a2", 2), nil))
+	require.NoError(t, dispatch(ctx, event("82a3", 3), nil))
+	token, err = m.Checkpoint(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "82a3", token.TokenData)
+	assert.Equal(t, 2, writes)
+	point, err := repo.GetResumePoint()
+	require.NoError(t, err)
+	assert.Equal(t, "82a3", point.ID.TokenData)
+	// the point saved by the watcher is replaced
+	assert.Equal(t, []string{"82a1"}, deleted)
+
+	// a repeated checkpoint doesn't write again
+	token, err = m.Checkpoint(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "82a3", token.TokenData)
+	assert.Equal(t, 2, writes)
+
+	// the watcher saving the same event keeps the point, a newer one replaces it
+	require.NoError(t, watcherSave(ctx, event("82a3", 3), nil))
+	assert.Equal(t, []string{"82a1"}, deleted)
+	require.NoError(t, dispatch(ctx, event("82a4", 4), nil))
+	_, err = m.Checkpoint(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"82a1", "82a3"}, deleted)
+	require.NoError(t, watcherSave(ctx, event("82a5", 5), nil))
+	assert.Equal(t, []string{"82a1", "82a3", "82a4"}, deleted)
+}
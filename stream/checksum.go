@@ -0,0 +1,247 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// Hasher computes the checksum of a document
+type Hasher func(doc primitive.M) (string, error)
+
+// SHA256Hasher hashes the BSON encoding of the document with sorted field names,
+// so the checksum doesn't depend on field order
+func SHA256Hasher(doc primitive.M) (string, error) {
+	raw, err := bson.Marshal(canonical(doc))
+	if err != nil {
+		return "", fmt.Errorf("failed to encode document for hashing: %w", err)
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// canonical converts maps into documents with sorted keys, recursively
+func canonical(v interface{}) interface{} {
+	switch v := v.(type) {
+	case primitive.M:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		d := make(bson.D, 0, len(v))
+		for _, k := range keys {
+			d = append(d, bson.E{Key: k, Value: canonical(v[k])})
+		}
+		return d
+	case map[string]interface{}:
+		return canonical(primitive.M(v))
+	case primitive.D:
+		d := make(bson.D, 0, len(v))
+		for _, e := range v {
+			d = append(d, bson.E{Key: e.Key, Value: canonical(e.Value)})
+		}
+		return d
+	case primitive.A:
+		a := make(bson.A, len(v))
+		for i, e := range v {
+			a[i] = canonical(e)
+		}
+		return a
+	default:
+		return v
+	}
+}
+
+// ChecksumStore keeps the checksum of the last processed version of each document
+type ChecksumStore interface {
+	// Checksum returns the stored checksum of the key, ok is false for unknown keys
+	Checksum(ctx context.Context, documentKey string) (sum string, ok bool, err error)
+	SaveChecksum(ctx context.Context, documentKey string, sum string) error
+	DeleteChecksum(ctx context.Context, documentKey string) error
+}
+
+// Checksums returns a middleware storing the checksum of the full document of every successfully processed
+// insert and update, and removing it on delete, for a DriftVerifier to compare with the source later.
+// Updates without a full document, e.g. WithPartialUpdates, leave the stored checksum as is.
+func Checksums(store ChecksumStore, hasher Hasher) mongowatch.ChangeEventMiddleware {
+	if hasher == nil {
+		hasher = SHA256Hasher
+	}
+	return func(next mongowatch.ChangeEventDispatcherFunc) mongowatch.ChangeEventDispatcherFunc {
+		return func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+			if err = next(ctx, ce, err); err != nil || ce.DocumentKey == "" {
+				return err
+			}
+			if ce.OperationType == "delete" {
+				if dErr := store.DeleteChecksum(ctx, ce.DocumentKey); dErr != nil {
+					return fmt.Errorf("failed to delete checksum of %s: %w", ce.DocumentKey, dErr)
+				}
+				return nil
+			}
+			if ce.FullDocument == nil {
+				return nil
+			}
+			sum, hErr := hasher(ce.FullDocument)
+			if hErr != nil {
+				return hErr
+			}
+			if sErr := store.SaveChecksum(ctx, ce.DocumentKey, sum); sErr != nil {
+				return fmt.Errorf("failed to save checksum of %s: %w", ce.DocumentKey, sErr)
+			}
+			return nil
+		}
+	}
+}
+
+// documentChecksum is the stored checksum of a single documentKey
+type documentChecksum struct {
+	DocumentKey string    `bson:"_id"`
+	Sum         string    `bson:"sum"`
+	UpdatedAt   time.Time `bson:"updatedAt"`
+}
+
+// MongoChecksumStore stores checksums in a collection, one document per documentKey
+type MongoChecksumStore struct {
+	col *mongo.Collection
+}
+
+var _ ChecksumStore = (*MongoChecksumStore)(nil)
+
+// NewMongoChecksumStore creates a checksum store in col
+func NewMongoChecksumStore(col *mongo.Collection) *MongoChecksumStore {
+	return &MongoChecksumStore{col: col}
+}
+
+// Checksum fetches the checksum of the key
+func (s *MongoChecksumStore) Checksum(ctx context.Context, documentKey string) (string, bool, error) {
+	var stored documentChecksum
+	err := s.col.FindOne(ctx, bson.M{"_id": documentKey}).Decode(&stored)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to fetch checksum: %w", err)
+	}
+	return stored.Sum, true, nil
+}
+
+// SaveChecksum upserts the checksum of the key
+func (s *MongoChecksumStore) SaveChecksum(ctx context.Context, documentKey string, sum string) error {
+	_, err := s.col.UpdateOne(ctx,
+		bson.M{"_id": documentKey},
+		bson.M{"$set": bson.M{"sum": sum, "updatedAt": time.Now()}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save checksum: %w", err)
+	}
+	return nil
+}
+
+// DeleteChecksum removes the checksum of the key
+func (s *MongoChecksumStore) DeleteChecksum(ctx context.Context, documentKey string) error {
+	if _, err := s.col.DeleteOne(ctx, bson.M{"_id": documentKey}); err != nil {
+		return fmt.Errorf("failed to delete checksum: %w", err)
+	}
+	return nil
+}
+
+// DriftReport lists the sampled documents whose checksum differs from the consumer's
+type DriftReport struct {
+	Sampled int `json:"sampled"`
+	Matched int `json:"matched"`
+	// Missing keys have no checksum stored, Mismatched ones a different checksum
+	Missing    []string `json:"missing,omitempty"`
+	Mismatched []string `json:"mismatched,omitempty"`
+}
+
+// OK tells whether every sampled document matched
+func (r DriftReport) OK() bool {
+	return len(r.Missing) == 0 && len(r.Mismatched) == 0
+}
+
+// DriftVerifier samples documents of the source collection and compares their checksums with those stored
+// by the Checksums middleware, detecting drift of the consumer's mirror without scanning either side.
+// Documents changed since the consumer processed them show up as drift until it caught up,
+// so differences are worth rechecking before alerting.
+type DriftVerifier struct {
+	source *mongo.Collection
+	store  ChecksumStore
+	hasher Hasher
+}
+
+// NewDriftVerifier creates a verifier, hasher must match the one given to Checksums, nil is SHA256Hasher
+func NewDriftVerifier(source *mongo.Collection, store ChecksumStore, hasher Hasher) *DriftVerifier {
+	if hasher == nil {
+		hasher = SHA256Hasher
+	}
+	return &DriftVerifier{source: source, store: store, hasher: hasher}
+}
+
+// Verify compares a random sample of size documents
+func (v *DriftVerifier) Verify(ctx context.Context, size int) (DriftReport, error) {
+	cursor, err := v.source.Aggregate(ctx, mongo.Pipeline{{{Key: "$sample", Value: bson.D{{Key: "size", Value: size}}}}})
+	if err != nil {
+		return DriftReport{}, fmt.Errorf("failed to sample source documents: %w", err)
+	}
+	var docs []primitive.M
+	if err = cursor.All(ctx, &docs); err != nil {
+		return DriftReport{}, fmt.Errorf("failed cursor iteration for sampled documents: %w", err)
+	}
+	return v.compare(ctx, docs)
+}
+
+// compare checks the documents against the stored checksums
+func (v *DriftVerifier) compare(ctx context.Context, docs []primitive.M) (DriftReport, error) {
+	report := DriftReport{Sampled: len(docs)}
+	for _, doc := range docs {
+		key := documentKeyString(doc["_id"])
+		stored, ok, err := v.store.Checksum(ctx, key)
+		if err != nil {
+			return report, err
+		}
+		if !ok {
+			report.Missing = append(report.Missing, key)
+			continue
+		}
+		sum, err := v.hasher(doc)
+		if err != nil {
+			return report, err
+		}
+		if sum != stored {
+			report.Mismatched = append(report.Mismatched, key)
+			continue
+		}
+		report.Matched++
+	}
+	return report, nil
+}
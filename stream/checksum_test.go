@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+type memoryChecksums struct {
+	mu   sync.Mutex
+	sums map[string]string
+}
+
+func (m *memoryChecksums) Checksum(ctx context.Context, key string) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sum, ok := m.sums[key]
+	return sum, ok, nil
+}
+
+func (m *memoryChecksums) SaveChecksum(ctx context.Context, key string, sum string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sums[key] = sum
+	return nil
+}
+
+func (m *memoryChecksums) DeleteChecksum(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sums, key)
+	return nil
+}
+
+func Test_SHA256Hasher(t *testing.T) {
+	a, err := SHA256Hasher(primitive.M{"a": 1, "b": primitive.M{"x": "1", "y": primitive.A{primitive.M{"p": 1, "q": 2}}}})
+	assert.NoError(t, err)
+	b, err := SHA256Hasher(primitive.M{"b": primitive.M{"y": primitive.A{primitive.M{"q": 2, "p": 1}}, "x": "1"}, "a": 1})
+	assert.NoError(t, err)
+	assert.Equal(t, a, b)
+
+	c, err := SHA256Hasher(primitive.M{"a": 2, "b": primitive.M{"x": "1", "y": primitive.A{primitive.M{"p": 1, "q": 2}}}})
+	assert.NoError(t, err)
+	assert.NotEqual(t, a, c)
+}
+
+func Test_Checksums(t *testing.T) {
+	store := &memoryChecksums{sums: map[string]string{}}
+	dispatch := Checksums(store, nil)(func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error { return err })
+	ctx := context.Background()
+
+	docs := map[string]primitive.M{
+		"a": {"_id": "a", "n": 1},
+		"b": {"_id": "b", "n": 2},
+		"c": {"_id": "c", "n": 3},
+	}
+	for key, doc := range docs {
+		assert.NoError(t, dispatch(ctx, mongowatch.ChangeStreamEvent{OperationType: "insert", DocumentKey: key, FullDocument: doc}, nil))
+	}
+	assert.NoError(t, dispatch(ctx, mongowatch.ChangeStreamEvent{OperationType: "delete", DocumentKey: "c"}, nil))
+	// partial updates keep the previous checksum
+	assert.NoError(t, dispatch(ctx, mongowatch.ChangeStreamEvent{OperationType: "update", DocumentKey: "a"}, nil))
+	assert.Len(t, store.sums, 2)
+
+	verifier := NewDriftVerifier(nil, store, nil)
+	report, err := verifier.compare(ctx, []primitive.M{
+		{"_id": "a", "n": 1},
+		{"_id": "b", "n": 20},
+		{"_id": "c", "n": 3},
+	})
+	assert.NoError(t, err)
+	assert.False(t, report.OK())
+	assert.Equal(t, DriftReport{Sampled: 3, Matched: 1, Missing: []string{"c"}, Mismatched: []string{"b"}}, report)
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// CircuitState is the state of a CircuitBreaker
+type CircuitState int
+
+const (
+	// CircuitClosed lets events through and records their outcome
+	CircuitClosed CircuitState = iota
+	// CircuitOpen holds dispatching until OpenDuration passes
+	CircuitOpen
+	// CircuitHalfOpen lets a single probe event through to test the downstream
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// CircuitBreakerConfig configures when the breaker trips and how long it stays open
+type CircuitBreakerConfig struct {
+	// Window is the number of most recent dispatches the error rate is computed on
+	Window int
+	// MinCalls is the number of dispatches needed in the window before the breaker may trip
+	MinCalls int
+	// MaxErrorRate trips the breaker when the failure ratio in the window reaches it (0..1)
+	MaxErrorRate float64
+	// MaxLatency counts dispatches slower than this as failures, zero disables latency tracking
+	MaxLatency time.Duration
+	// OpenDuration is how long the breaker stays open before probing the downstream again
+	OpenDuration time.Duration
+}
+
+// CircuitBreaker guards downstream handlers. Once tripped it holds the failing event and re-dispatches it
+// as a half-open probe every OpenDuration until the downstream recovers. Since the watcher blocks meanwhile,
+// neither dispatching nor checkpoint advancement happens while the breaker is open.
+type CircuitBreaker struct {
+	cfg CircuitBreakerConfig
+
+	mu       sync.Mutex
+	state    CircuitState
+	outcomes []bool
+	next     int
+	failures int
+}
+
+// NewCircuitBreaker creates a closed circuit breaker
+func NewCircuitBreaker(cfg CircuitBreakerConfig) *CircuitBreaker {
+	if cfg.Window <= 0 {
+		cfg.Window = 20
+	}
+	if cfg.MinCalls <= 0 {
+		cfg.MinCalls = cfg.Window / 2
+	}
+	if cfg.MaxErrorRate <= 0 {
+		cfg.MaxErrorRate = 0.5
+	}
+	if cfg.OpenDuration <= 0 {
+		cfg.OpenDuration = 30 * time.Second
+	}
+	return &CircuitBreaker{cfg: cfg, outcomes: make([]bool, 0, cfg.Window)}
+}
+
+// State returns the current breaker state
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// Middleware returns the middleware to register with WithMiddleware
+func (cb *CircuitBreaker) Middleware() mongowatch.ChangeEventMiddleware {
+	return func(next mongowatch.ChangeEventDispatcherFunc) mongowatch.ChangeEventDispatcherFunc {
+		return func(ctx context.Context, ce mongowatch.ChangeStreamEvent, prevErr error) error {
+			for {
+				started := time.Now()
+				err := next(ctx, ce, prevErr)
+				failed := err != nil || (cb.cfg.MaxLatency > 0 && time.Since(started) > cb.cfg.MaxLatency)
+
+				if !cb.record(failed) {
+					return err
+				}
+
+				logger(ctx).Errorf("circuit breaker open, pausing dispatch for %s: %v", cb.cfg.OpenDuration, err)
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(cb.cfg.OpenDuration):
+				}
+				cb.halfOpen()
+				if err == nil {
+					// tripped by a slow but successful dispatch, the next event becomes the probe
+					return nil
+				}
+				eventLogf(ctx, "circuit breaker half-open, probing with event: %v", ce.ID.TokenData)
+			}
+		}
+	}
+}
+
+// record stores a dispatch outcome and reports whether the breaker is open after it
+func (cb *CircuitBreaker) record(failed bool) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == CircuitHalfOpen {
+		if failed {
+			cb.state = CircuitOpen
+			return true
+		}
+		log.Trace("circuit breaker closed, downstream recovered")
+		cb.reset()
+		return false
+	}
+
+	if len(cb.outcomes) < cb.cfg.Window {
+		cb.outcomes = append(cb.outcomes, failed)
+	} else {
+		if cb.outcomes[cb.next] {
+			cb.failures--
+		}
+		cb.outcomes[cb.next] = failed
+		cb.next = (cb.next + 1) % cb.cfg.Window
+	}
+	if failed {
+		cb.failures++
+	}
+
+	// only a failing dispatch can trip the breaker, so the event being held is the one that failed
+	if failed && len(cb.outcomes) >= cb.cfg.MinCalls &&
+		float64(cb.failures)/float64(len(cb.outcomes)) >= cb.cfg.MaxErrorRate {
+		cb.state = CircuitOpen
+		return true
+	}
+	return false
+}
+
+func (cb *CircuitBreaker) halfOpen() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.state = CircuitHalfOpen
+}
+
+func (cb *CircuitBreaker) reset() {
+	cb.state = CircuitClosed
+	cb.outcomes = cb.outcomes[:0]
+	cb.next = 0
+	cb.failures = 0
+}
@@ -0,0 +1,59 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+func Test_CircuitBreaker_HoldsEventUntilDownstreamRecovers(t *testing.T) {
+	cb := NewCircuitBreaker(CircuitBreakerConfig{Window: 4, MinCalls: 1, MaxErrorRate: 0.5, OpenDuration: 5 * time.Millisecond})
+
+	calls := 0
+	dispatch := cb.Middleware()(func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		calls++
+		if calls <= 2 {
+			return errors.New("downstream unavailable")
+		}
+		return nil
+	})
+
+	assert.NoError(t, dispatch(context.Background(), mongowatch.ChangeStreamEvent{}, nil))
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, CircuitClosed, cb.State())
+}
+
+func Test_CircuitBreaker_StopsWaitingOnCancel(t *testing.T) {
+	cb := NewCircuitBreaker(CircuitBreakerConfig{Window: 1, MinCalls: 1, OpenDuration: time.Hour})
+	dispatch := cb.Middleware()(func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		return errors.New("downstream unavailable")
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	assert.ErrorIs(t, dispatch(ctx, mongowatch.ChangeStreamEvent{}, nil), context.DeadlineExceeded)
+	assert.Equal(t, CircuitOpen, cb.State())
+}
@@ -0,0 +1,181 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// CursorStats describes the server round trips of a watcher's change stream cursor,
+// use them to size batches and tune WithMaxAwaitTime
+type CursorStats struct {
+	// GetMores counts server round trips for the next batch
+	GetMores uint64
+	// EmptyAwaits counts round trips that waited maxAwaitTime without receiving events
+	EmptyAwaits uint64
+	// Batches counts round trips that returned events
+	Batches uint64
+	// Events counts the events received in those batches
+	Events uint64
+	// MaxBatchSize is the largest batch received
+	MaxBatchSize uint64
+	// GetMoreLatency is the total round trip time, MaxGetMoreLatency the slowest round trip
+	GetMoreLatency    time.Duration
+	MaxGetMoreLatency time.Duration
+	// ThrottleWait is the total time round trips were held back by WithGetMoreRate
+	ThrottleWait time.Duration
+}
+
+// AvgBatchSize returns the average number of events per non empty batch
+func (s CursorStats) AvgBatchSize() float64 {
+	if s.Batches == 0 {
+		return 0
+	}
+	return float64(s.Events) / float64(s.Batches)
+}
+
+// AvgGetMoreLatency returns the average round trip time
+func (s CursorStats) AvgGetMoreLatency() time.Duration {
+	if s.GetMores == 0 {
+		return 0
+	}
+	return s.GetMoreLatency / time.Duration(s.GetMores)
+}
+
+// cursorStats is the concurrency safe accumulator behind CursorStats
+type cursorStats struct {
+	getMores     atomic.Uint64
+	emptyAwaits  atomic.Uint64
+	batches      atomic.Uint64
+	events       atomic.Uint64
+	maxBatchSize atomic.Uint64
+	latency      atomic.Int64
+	maxLatency   atomic.Int64
+	throttleWait atomic.Int64
+}
+
+func (s *cursorStats) recordFetch(latency time.Duration, batchSize uint64) {
+	s.getMores.Add(1)
+	s.latency.Add(int64(latency))
+	storeMax(&s.maxLatency, int64(latency))
+
+	if batchSize == 0 {
+		s.emptyAwaits.Add(1)
+		return
+	}
+	s.batches.Add(1)
+	s.events.Add(batchSize)
+	for {
+		current := s.maxBatchSize.Load()
+		if batchSize <= current || s.maxBatchSize.CompareAndSwap(current, batchSize) {
+			break
+		}
+	}
+}
+
+func (s *cursorStats) snapshot() CursorStats {
+	return CursorStats{
+		GetMores:          s.getMores.Load(),
+		EmptyAwaits:       s.emptyAwaits.Load(),
+		Batches:           s.batches.Load(),
+		Events:            s.events.Load(),
+		MaxBatchSize:      s.maxBatchSize.Load(),
+		GetMoreLatency:    time.Duration(s.latency.Load()),
+		MaxGetMoreLatency: time.Duration(s.maxLatency.Load()),
+		ThrottleWait:      time.Duration(s.throttleWait.Load()),
+	}
+}
+
+func storeMax(v *atomic.Int64, n int64) {
+	for {
+		current := v.Load()
+		if n <= current || v.CompareAndSwap(current, n) {
+			return
+		}
+	}
+}
+
+// CursorStats returns the cursor statistics collected since the watcher was created
+func (csw *ChangeStreamWatcher) CursorStats() CursorStats {
+	return csw.stats.snapshot()
+}
+
+// next blocks like mongo.ChangeStream.Next but fetches one batch per call to the server,
+// so every round trip including the empty ones can be measured
+func (csw *ChangeStreamWatcher) next(ctx context.Context, cursor *mongo.ChangeStream) bool {
+	for {
+		fetch := cursor.RemainingBatchLength() == 0
+		if fetch && !csw.awaitGetMore(ctx) {
+			return false
+		}
+		started := time.Now()
+		ok := cursor.TryNext(ctx)
+		if fetch && cursor.Err() == nil {
+			var batchSize uint64
+			if ok {
+				batchSize = uint64(cursor.RemainingBatchLength()) + 1
+			}
+			csw.stats.recordFetch(time.Since(started), batchSize)
+		}
+		if ok {
+			return true
+		}
+		// a closed cursor (id 0) won't return more events, same as Next
+		if cursor.Err() != nil || ctx.Err() != nil || cursor.ID() == 0 {
+			return false
+		}
+	}
+}
+
+// CursorStats returns the statistics of the manager's watcher cursor,
+// ok is false when the watcher doesn't collect them
+func (m *Manager) CursorStats() (stats CursorStats, ok bool) {
+	w, ok := m.watcher.(interface{ CursorStats() CursorStats })
+	if !ok {
+		return CursorStats{}, false
+	}
+	return w.CursorStats(), true
+}
+
+// CursorStats returns the statistics of the processor's change stream cursor
+func (dp DocumentProcessor) CursorStats() CursorStats {
+	stats, _ := dp.manager.CursorStats()
+	return stats
+}
+
+// awaitGetMore holds back the next round trip until the getMore rate allows it, false if ctx is done meanwhile
+func (csw *ChangeStreamWatcher) awaitGetMore(ctx context.Context) bool {
+	if csw.getMoreLimit == nil {
+		return true
+	}
+	delay := csw.getMoreLimit.reserve(time.Now())
+	if delay <= 0 {
+		return true
+	}
+	csw.stats.throttleWait.Add(int64(delay))
+	select {
+	case <-time.After(delay):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
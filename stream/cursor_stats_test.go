@@ -0,0 +1,82 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCursorStats(t *testing.T) {
+	var stats cursorStats
+	stats.recordFetch(10*time.Millisecond, 3)
+	stats.recordFetch(30*time.Millisecond, 0)
+	stats.recordFetch(20*time.Millisecond, 5)
+
+	s := stats.snapshot()
+	assert.Equal(t, uint64(3), s.GetMores)
+	assert.Equal(t, uint64(1), s.EmptyAwaits)
+	assert.Equal(t, uint64(2), s.Batches)
+	assert.Equal(t, uint64(8), s.Events)
+	assert.Equal(t, uint64(5), s.MaxBatchSize)
+	assert.Equal(t, 4.0, s.AvgBatchSize())
+	assert.Equal(t, 20*time.Millisecond, s.AvgGetMoreLatency())
+	assert.Equal(t, 30*time.Millisecond, s.MaxGetMoreLatency)
+
+	assert.Zero(t, CursorStats{}.AvgBatchSize())
+	assert.Zero(t, CursorStats{}.AvgGetMoreLatency())
+}
+
+func TestCursorStatsConcurrentMax(t *testing.T) {
+	var stats cursorStats
+	wg := sync.WaitGroup{}
+	for i := 1; i <= 50; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			stats.recordFetch(time.Duration(n), uint64(n))
+		}(i)
+	}
+	wg.Wait()
+
+	s := stats.snapshot()
+	assert.Equal(t, uint64(50), s.MaxBatchSize)
+	assert.Equal(t, time.Duration(50), s.MaxGetMoreLatency)
+}
+
+func TestGetMoreRate(t *testing.T) {
+	csw := NewChangeStreamWatcher(nil, WithGetMoreRate(20, 1))
+	ctx := context.Background()
+
+	started := time.Now()
+	assert.True(t, csw.awaitGetMore(ctx))
+	assert.True(t, csw.awaitGetMore(ctx))
+	assert.GreaterOrEqual(t, time.Since(started), 40*time.Millisecond)
+	assert.Positive(t, csw.CursorStats().ThrottleWait)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.False(t, csw.awaitGetMore(cancelled))
+
+	// without a rate round trips are never held back
+	assert.True(t, NewChangeStreamWatcher(nil).awaitGetMore(cancelled))
+}
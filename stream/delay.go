@@ -0,0 +1,176 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// DelayConfig configures a DelayQueue
+type DelayConfig struct {
+	// Due returns when the event is due, events without a due time or due already are dispatched right away
+	Due func(ce mongowatch.ChangeStreamEvent) (time.Time, bool)
+	// Interval between checks for due events, 1s by default
+	Interval time.Duration
+	// BatchSize bounds the due events dispatched by a single check, 100 by default
+	BatchSize int64
+}
+
+// DueAtField returns a Due func reading the due time from a date field of the full document, e.g. sendAt
+func DueAtField(field string) func(ce mongowatch.ChangeStreamEvent) (time.Time, bool) {
+	return func(ce mongowatch.ChangeStreamEvent) (time.Time, bool) {
+		value, ok := mongowatch.LookupField(ce.FullDocument, field)
+		if !ok {
+			return time.Time{}, false
+		}
+		switch v := value.(type) {
+		case primitive.DateTime:
+			return v.Time(), true
+		case time.Time:
+			return v, true
+		}
+		return time.Time{}, false
+	}
+}
+
+// DelayedEvent is an event parked in the delay queue until it is due
+type DelayedEvent struct {
+	// ID is the resume token of the event, parking a redelivered event again is a no-op
+	ID        string                       `bson:"_id" json:"id"`
+	DueAt     time.Time                    `bson:"dueAt" json:"dueAt"`
+	Event     mongowatch.ChangeStreamEvent `bson:"event" json:"event"`
+	ParkedAt  time.Time                    `bson:"parkedAt" json:"parkedAt"`
+	Attempts  int                          `bson:"attempts" json:"attempts"`
+	LastError string                       `bson:"lastError,omitempty" json:"lastError,omitempty"`
+}
+
+// DelayQueue defers events to a scheduled time. Dispatch parks events due later in a local collection and
+// returns, so the stream checkpoint only advances once the event is stored durably; Run dispatches parked
+// events to the handler when due and removes them only after the handler succeeded, so both sides keep the
+// at-least-once guarantee of the stream. Run a single scheduler per queue, e.g. next to the primary processor.
+type DelayQueue struct {
+	col     *mongo.Collection
+	cfg     DelayConfig
+	handler mongowatch.ChangeEventDispatcherFunc
+}
+
+// NewDelayQueue creates a delay queue stored in col in front of handler
+func NewDelayQueue(col *mongo.Collection, cfg DelayConfig, handler mongowatch.ChangeEventDispatcherFunc) *DelayQueue {
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Second
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	return &DelayQueue{col: col, cfg: cfg, handler: handler}
+}
+
+// EnsureIndexes creates the index the scheduler queries due events with
+func (q *DelayQueue) EnsureIndexes(ctx context.Context) error {
+	_, err := q.col.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "dueAt", Value: 1}}})
+	if err != nil {
+		return fmt.Errorf("failed to create delay queue index: %w", err)
+	}
+	return nil
+}
+
+// Dispatch parks the event if it is due later, otherwise it passes it to the handler
+func (q *DelayQueue) Dispatch(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+	due, ok := q.cfg.Due(ce)
+	if !ok || !due.After(time.Now()) {
+		return q.handler(ctx, ce, err)
+	}
+
+	delayed := DelayedEvent{ID: tokenKey(ce.ID), DueAt: due, Event: ce, ParkedAt: time.Now()}
+	_, err = q.col.UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: delayed.ID}},
+		bson.D{{Key: "$setOnInsert", Value: delayed}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to park delayed event: %w", err)
+	}
+	eventLogf(ctx, "parked event until %s: %s", due.Format(time.RFC3339), ce.ID)
+	return nil
+}
+
+// Run dispatches due events until ctx is done
+func (q *DelayQueue) Run(ctx context.Context) error {
+	ticker := time.NewTicker(q.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		if err := q.dispatchDue(ctx); err != nil && ctx.Err() == nil {
+			logger(ctx).Errorf("failed to dispatch delayed events: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// dispatchDue passes the due events to the handler in due order, stopping at the first failure
+func (q *DelayQueue) dispatchDue(ctx context.Context) error {
+	opts := options.Find().SetSort(bson.D{{Key: "dueAt", Value: 1}}).SetLimit(q.cfg.BatchSize)
+	cursor, err := q.col.Find(ctx, bson.D{{Key: "dueAt", Value: bson.D{{Key: "$lte", Value: time.Now()}}}}, opts)
+	if err != nil {
+		return fmt.Errorf("failed to find due events: %w", err)
+	}
+	var due []DelayedEvent
+	if err = cursor.All(ctx, &due); err != nil {
+		return fmt.Errorf("failed cursor iteration for due events: %w", err)
+	}
+
+	for _, delayed := range due {
+		evCtx := mongowatch.ContextWithEvent(ctx, delayed.Event)
+		if hErr := q.handler(evCtx, delayed.Event, nil); hErr != nil {
+			update := bson.D{
+				{Key: "$inc", Value: bson.D{{Key: "attempts", Value: 1}}},
+				{Key: "$set", Value: bson.D{{Key: "lastError", Value: hErr.Error()}}},
+			}
+			if _, err = q.col.UpdateByID(ctx, delayed.ID, update); err != nil {
+				return fmt.Errorf("failed to record delayed event failure: %w", err)
+			}
+			return fmt.Errorf("failed to dispatch delayed event %s: %w", delayed.ID, hErr)
+		}
+		if _, err = q.col.DeleteOne(ctx, bson.D{{Key: "_id", Value: delayed.ID}}); err != nil {
+			return fmt.Errorf("failed to remove dispatched delayed event: %w", err)
+		}
+		eventLogf(evCtx, "dispatched delayed event: %s", delayed.ID)
+	}
+	return nil
+}
+
+// Pending counts the parked events
+func (q *DelayQueue) Pending(ctx context.Context) (int64, error) {
+	cnt, err := q.col.CountDocuments(ctx, bson.D{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count delayed events: %w", err)
+	}
+	return cnt, nil
+}
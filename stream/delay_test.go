@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+	"github.com/mmtracker/mongowatch/db"
+)
+
+func Test_DueAtField(t *testing.T) {
+	sendAt := time.Date(2023, 6, 15, 12, 0, 0, 0, time.UTC)
+	due := DueAtField("notification.sendAt")
+
+	at, ok := due(mongowatch.ChangeStreamEvent{FullDocument: primitive.M{"notification": primitive.M{"sendAt": primitive.NewDateTimeFromTime(sendAt)}}})
+	assert.True(t, ok)
+	assert.True(t, sendAt.Equal(at))
+
+	_, ok = due(mongowatch.ChangeStreamEvent{FullDocument: primitive.M{"notification": primitive.M{"sendAt": "tomorrow"}}})
+	assert.False(t, ok)
+	_, ok = due(mongowatch.ChangeStreamEvent{})
+	assert.False(t, ok)
+}
+
+func Test_DelayQueue(t *testing.T) {
+	requireMongo(t)
+	col := NewCollection("delayed_events", mongoTestsDB)
+	_ = db.Truncate(col, false)
+
+	var dispatched []string
+	failing := true
+	handler := func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		if ce.DocumentKey == "later" && failing {
+			return errors.New("smtp down")
+		}
+		dispatched = append(dispatched, ce.DocumentKey)
+		return nil
+	}
+	q := NewDelayQueue(col, DelayConfig{Due: DueAtField("sendAt")}, handler)
+
+	ctx := context.Background()
+	event := func(key string, sendAt time.Time) mongowatch.ChangeStreamEvent {
+		return mongowatch.ChangeStreamEvent{
+			ID:           mongowatch.ResumeToken{TokenData: key},
+			DocumentKey:  key,
+			FullDocument: primitive.M{"sendAt": primitive.NewDateTimeFromTime(sendAt)},
+		}
+	}
+	assert.NoError(t, q.Dispatch(ctx, event("now", time.Now().Add(-time.Minute)), nil))
+	assert.NoError(t, q.Dispatch(ctx, event("later", time.Now().Add(time.Second)), nil))
+	// a redelivered event is parked once
+	assert.NoError(t, q.Dispatch(ctx, event("later", time.Now().Add(time.Second)), nil))
+	assert.Equal(t, []string{"now"}, dispatched)
+
+	pending, err := q.Pending(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), pending)
+
+	// not due yet
+	assert.NoError(t, q.dispatchDue(ctx))
+	assert.Equal(t, []string{"now"}, dispatched)
+
+	time.Sleep(1100 * time.Millisecond)
+	assert.Error(t, q.dispatchDue(ctx))
+	pending, _ = q.Pending(ctx)
+	assert.Equal(t, int64(1), pending)
+
+	failing = false
+	assert.NoError(t, q.dispatchDue(ctx))
+	assert.Equal(t, []string{"now", "later"}, dispatched)
+	pending, _ = q.Pending(ctx)
+	assert.Zero(t, pending)
+}
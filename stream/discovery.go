@@ -0,0 +1,209 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// CollectionStarter runs the processor of a discovered collection until ctx is done
+type CollectionStarter func(ctx context.Context, collection string) error
+
+// DiscoveryConfig configures a Discovery
+type DiscoveryConfig struct {
+	// Pattern selects the collections to watch, e.g. ^orders_
+	Pattern *regexp.Regexp
+	// Interval between rescans picking up created and dropped collections, 0 only scans at startup
+	Interval time.Duration
+}
+
+// Discovery runs a processor per collection matching a name pattern, e.g. for per-tenant collections.
+// Processors are started for new matching collections and stopped for dropped ones on every scan,
+// a processor returning on its own (e.g. on the invalidate event of a dropped collection) is restarted
+// by the next scan if its collection still exists.
+type Discovery struct {
+	db    *mongo.Database
+	cfg   DiscoveryConfig
+	start CollectionStarter
+
+	mu      sync.Mutex
+	running map[string]*discovered
+	wg      sync.WaitGroup
+}
+
+// discovered is a running processor of a collection
+type discovered struct {
+	cancel context.CancelFunc
+}
+
+// NewDiscovery creates a discovery of the collections of db
+func NewDiscovery(db *mongo.Database, cfg DiscoveryConfig, start CollectionStarter) *Discovery {
+	return &Discovery{db: db, cfg: cfg, start: start, running: map[string]*discovered{}}
+}
+
+// Run scans the collections and keeps their processors running until ctx is done, then stops them all
+func (d *Discovery) Run(ctx context.Context) error {
+	defer d.wg.Wait()
+	defer d.stopAll()
+
+	for {
+		names, err := d.scan(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if d.cfg.Interval <= 0 {
+				return err
+			}
+			logger(ctx).Errorf("collection discovery failed: %v", err)
+		} else {
+			d.sync(ctx, names)
+		}
+
+		if d.cfg.Interval <= 0 {
+			<-ctx.Done()
+			return nil
+		}
+		select {
+		case <-time.After(d.cfg.Interval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Collections returns the collections with a running processor
+func (d *Discovery) Collections() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	names := make([]string, 0, len(d.running))
+	for name := range d.running {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// scan lists the matching collections, views and time series collections have no change stream to watch
+func (d *Discovery) scan(ctx context.Context) ([]string, error) {
+	filter := bson.M{"type": "collection"}
+	if d.cfg.Pattern != nil {
+		filter["name"] = primitive.Regex{Pattern: d.cfg.Pattern.String()}
+	}
+	names, err := d.db.ListCollectionNames(ctx, filter, options.ListCollections().SetNameOnly(true))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list collections: %w", err)
+	}
+	return names, nil
+}
+
+// sync starts processors for new collections and stops the ones of collections gone
+func (d *Discovery) sync(ctx context.Context, names []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	present := make(map[string]bool, len(names))
+	for _, name := range names {
+		present[name] = true
+		if _, ok := d.running[name]; ok {
+			continue
+		}
+		d.launch(ctx, name)
+	}
+	for name, p := range d.running {
+		if !present[name] {
+			logger(ctx).Infof("collection %s is gone, stopping its processor", name)
+			p.cancel()
+			delete(d.running, name)
+		}
+	}
+}
+
+// launch starts the processor of a collection, d.mu must be held
+func (d *Discovery) launch(ctx context.Context, name string) {
+	pctx, cancel := context.WithCancel(ctx)
+	p := &discovered{cancel: cancel}
+	d.running[name] = p
+	logger(ctx).Infof("discovered collection %s, starting its processor", name)
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		defer cancel()
+		err := d.start(pctx, name)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			logger(ctx).Errorf("processor of collection %s stopped: %v", name, err)
+		}
+
+		// forget the processor unless it was replaced in the meantime, the next scan restarts it
+		d.mu.Lock()
+		if d.running[name] == p {
+			delete(d.running, name)
+		}
+		d.mu.Unlock()
+	}()
+}
+
+func (d *Discovery) stopAll() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for name, p := range d.running {
+		p.cancel()
+		delete(d.running, name)
+	}
+}
+
+// DataProcessorStarter starts a DocumentProcessor per discovered collection, resume points of each
+// collection are kept in localDB under the collection name plus resumeSuffix
+func DataProcessorStarter(
+	targetDB *mongo.Database,
+	resumeSuffix string,
+	localDB *mongo.Database,
+	actions func(collection string) mongowatch.CollectionWatcher,
+	fullDocumentMode options.FullDocument,
+	opts ...ProcessorOption,
+) CollectionStarter {
+	return func(ctx context.Context, collection string) error {
+		dp := NewDataProcessor(targetDB, collection, resumeSuffix, localDB, opts...)
+
+		stopped := make(chan struct{})
+		defer close(stopped)
+		go func() {
+			select {
+			case <-ctx.Done():
+				dp.Stop()
+			case <-stopped:
+			}
+		}()
+
+		return dp.Start(actions(collection), fullDocumentMode)
+	}
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiscoverySync(t *testing.T) {
+	var mu sync.Mutex
+	starts := map[string]int{}
+	failing := map[string]bool{"orders_b": true}
+	d := NewDiscovery(nil, DiscoveryConfig{}, func(ctx context.Context, collection string) error {
+		mu.Lock()
+		starts[collection]++
+		fail := failing[collection]
+		mu.Unlock()
+		if fail {
+			return errors.New("processor failed")
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d.sync(ctx, []string{"orders_a", "orders_b"})
+	// a failed processor is forgotten and restarted by the next scan
+	assert.Eventually(t, func() bool { return len(d.Collections()) == 1 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, []string{"orders_a"}, d.Collections())
+
+	mu.Lock()
+	failing["orders_b"] = false
+	mu.Unlock()
+	d.sync(ctx, []string{"orders_a", "orders_b", "orders_c"})
+	assert.Equal(t, []string{"orders_a", "orders_b", "orders_c"}, d.Collections())
+
+	// dropped collections stop their processor
+	d.sync(ctx, []string{"orders_c"})
+	assert.Equal(t, []string{"orders_c"}, d.Collections())
+
+	d.stopAll()
+	d.wg.Wait()
+	assert.Empty(t, d.Collections())
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, map[string]int{"orders_a": 1, "orders_b": 2, "orders_c": 1}, starts)
+}
@@ -22,9 +22,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 
 	"github.com/cenkalti/backoff/v4"
-	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
@@ -38,42 +40,239 @@ import (
 type DocumentProcessor struct {
 	manager    *Manager
 	resumeRepo mongowatch.StreamResume
+	serializer mongowatch.Serializer
+
+	// strict fails on operation types the processor can't dispatch instead of skipping them
+	strict bool
+	// envelope wraps documents with the operation type and key before serializing them
+	envelope bool
+	// externalOffsets adds the resume token to the envelope, the consumer stores it instead of the resume repository
+	externalOffsets bool
+	// clusterHint is stored with resume points next to the namespace, see ResumeTarget
+	clusterHint string
+	// resumeNamer names the resume collection described by resumeCollection
+	resumeNamer      ResumeNamer
+	resumeCollection ResumeCollectionInfo
+	// latencyGuard pauses dispatching while resume point writes are slow
+	latencyGuard *LatencyGuard
+	// twoPhase commits the sink before every checkpoint, see WithTwoPhaseCommit
+	twoPhase *twoPhaseCommit
+
+	managerOpts []ManagerOption
+	watcherOpts []WatcherOption
+	watcher     mongowatch.ChangeStreamWatcher
+
+	// control is shared between copies of the processor, its methods have value receivers
+	control *processorControl
+}
+
+// processorControl coordinates a running Start with Seek
+type processorControl struct {
+	mu      sync.Mutex
+	running bool
+	seek    *seekRequest
+	gate    *PauseGate
+	// banner logs the effective configuration on the first Start
+	banner sync.Once
+	// restarts counts failed starts retried by StartWithRetry
+	restarts atomic.Uint64
+}
+
+type seekRequest struct {
+	pos  mongowatch.StartPosition
+	done chan error
 }
 
 var _ mongowatch.DocumentProcessor = (*DocumentProcessor)(nil)
 
+// ProcessorOption configures optional DocumentProcessor behaviour
+type ProcessorOption func(*DocumentProcessor)
+
+// WithSerializer sets the wire format of the documents passed to the CollectionWatcher, JSON by default
+func WithSerializer(serializer mongowatch.Serializer) ProcessorOption {
+	return func(dp *DocumentProcessor) {
+		dp.serializer = serializer
+	}
+}
+
+// WithEnvelope wraps the document passed to the CollectionWatcher as {"id": ..., "version": ..., "op": ..., "key": ..., "doc": ...},
+// so handlers can tell inserts from updates or deletes when they share an implementation.
+// JSON payloads decode into JSONEnvelope. The key is the logical key of the event, see WithKeyExtractor.
+func WithEnvelope() ProcessorOption {
+	return func(dp *DocumentProcessor) {
+		dp.envelope = true
+	}
+}
+
+// ErrUnhandledOperation is returned by strict processors for events of an operation type they can't dispatch
+var ErrUnhandledOperation = errors.New("unhandled operation type")
+
+// WithStrictOperations fails on events of operation types the processor can't dispatch, instead of skipping them,
+// so new event types showing up after a server upgrade go through retries and the poison policy and get noticed.
+// With OperationHandlers, known operation types without a handler are still skipped, only unknown ones fail.
+func WithStrictOperations() ProcessorOption {
+	return func(dp *DocumentProcessor) {
+		dp.strict = true
+	}
+}
+
+// JSONEnvelope is the JSON payload of processors created WithEnvelope
+type JSONEnvelope struct {
+	// ID is the deterministic UUID of the event, see ChangeStreamEvent.UUID
+	ID string `json:"id,omitempty"`
+	// Version orders the events of a document, see mongowatch.VersionOf
+	Version uint64          `json:"version,omitempty"`
+	Op      string          `json:"op"`
+	Key     string          `json:"key"`
+	Doc     json.RawMessage `json:"doc"`
+	// Token is the resume token of the event, only set WithExternalOffsets
+	Token *mongowatch.ResumeToken `json:"token,omitempty"`
+}
+
+// WithManagerOptions passes options down to the underlying stream Manager
+func WithManagerOptions(opts ...ManagerOption) ProcessorOption {
+	return func(dp *DocumentProcessor) {
+		dp.managerOpts = append(dp.managerOpts, opts...)
+	}
+}
+
+// WithWatcherOptions passes options down to the underlying ChangeStreamWatcher
+func WithWatcherOptions(opts ...WatcherOption) ProcessorOption {
+	return func(dp *DocumentProcessor) {
+		dp.watcherOpts = append(dp.watcherOpts, opts...)
+	}
+}
+
+// WithWatcher replaces the ChangeStreamWatcher of the target collection, e.g. with the TimeSeriesWatcher
+// returned by NewWatcher; watcher options are ignored then
+func WithWatcher(watcher mongowatch.ChangeStreamWatcher) ProcessorOption {
+	return func(dp *DocumentProcessor) {
+		dp.watcher = watcher
+	}
+}
+
+// WithStreamResume stores the resume points in resume instead of a ResumeRepository in the local database,
+// the resume namer and cluster hint don't apply then
+func WithStreamResume(resume mongowatch.StreamResume) ProcessorOption {
+	return func(dp *DocumentProcessor) {
+		dp.resumeRepo = resume
+	}
+}
+
+// WithClusterHint stores hint, e.g. the replica set name returned by ClusterHint, with every resume point,
+// starting against a cluster with a different hint fails with ErrResumePointMismatch
+func WithClusterHint(hint string) ProcessorOption {
+	return func(dp *DocumentProcessor) {
+		dp.clusterHint = hint
+	}
+}
+
+// WithProcessorID identifies the processor in log lines, stats and the context passed to handlers
+func WithProcessorID(id mongowatch.WatcherID) ProcessorOption {
+	return WithManagerOptions(WithManagerID(id))
+}
+
+// WithPartialUpdates turns off the full document lookup of update events, they are passed to the
+// UpdateFields method of CollectionWatchers implementing mongowatch.PartialUpdateWatcher instead
+func WithPartialUpdates() ProcessorOption {
+	return WithWatcherOptions(WithFullDocument(options.Default))
+}
+
+// WithFullDocumentBeforeChange sets the pre-image mode of the change stream, see WithPreImage.
+// A pre-image mode passed to Start takes precedence, other modes such as options.UpdateLookup keep this one.
+func WithFullDocumentBeforeChange(mode options.FullDocument) ProcessorOption {
+	return WithWatcherOptions(WithPreImage(mode))
+}
+
 // NewDataProcessor creates a new DocumentProcessor
-func NewDataProcessor(targetDB *mongo.Database, targetCollectionName string, resumeSuffix string, localDB *mongo.Database) *DocumentProcessor {
-	resumeRepo := NewStreamResumeRepository(NewCollection(
-		targetCollectionName+resumeSuffix,
-		localDB,
-	))
+func NewDataProcessor(targetDB *mongo.Database, targetCollectionName string, resumeSuffix string, localDB *mongo.Database, opts ...ProcessorOption) *DocumentProcessor {
+	dp := &DocumentProcessor{
+		serializer:  JSONSerializer{},
+		control:     &processorControl{gate: NewPauseGate()},
+		resumeNamer: SuffixResumeNamer,
+	}
+	for _, opt := range opts {
+		opt(dp)
+	}
+
+	if dp.resumeRepo == nil {
+		dp.resumeCollection.Key.Database = targetDB.Name()
+		dp.resumeCollection.Key.Collection = targetCollectionName
+		dp.resumeCollection.Key.Suffix = resumeSuffix
+		dp.resumeCollection.Name = dp.resumeNamer(dp.resumeCollection.Key)
+		resumeRepo := NewStreamResumeRepository(NewCollection(dp.resumeCollection.Name, localDB))
+		resumeRepo.SetTarget(ResumeTarget{Namespace: targetDB.Name() + "." + targetCollectionName, Cluster: dp.clusterHint})
+		dp.resumeRepo = resumeRepo
+	}
 
-	return &DocumentProcessor{
-		resumeRepo: resumeRepo,
-		manager: NewManager(
-			resumeRepo,
-			NewChangeStreamWatcher(NewCollection(targetCollectionName, targetDB)),
-			GetSaveResumePointFunc(resumeRepo),
-			GetDeleteResumePointFunc(resumeRepo),
-		),
+	// the pause gate wraps every other middleware so a paused processor doesn't touch the event at all
+	managerOpts := append([]ManagerOption{WithMiddleware(dp.control.gate.Middleware())}, dp.managerOpts...)
+	if dp.latencyGuard != nil {
+		repo := dp.resumeRepo
+		probe := func(ctx context.Context) error {
+			_, err := repo.GetResumePoint()
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				return nil
+			}
+			return err
+		}
+		dp.resumeRepo = dp.latencyGuard.wrap(repo)
+		managerOpts = append(managerOpts, WithMiddleware(dp.latencyGuard.Middleware(probe)))
+	}
+	if dp.twoPhase != nil {
+		dp.twoPhase.StreamResume = dp.resumeRepo
+		dp.resumeRepo = dp.twoPhase
+	}
+
+	if dp.watcher == nil {
+		dp.watcher = NewChangeStreamWatcher(NewCollection(targetCollectionName, targetDB), dp.watcherOpts...)
 	}
+	dp.manager = NewManager(
+		dp.resumeRepo,
+		dp.watcher,
+		GetSaveResumePointFunc(dp.resumeRepo),
+		GetDeleteResumePointFunc(dp.resumeRepo),
+		managerOpts...,
+	)
+
+	return dp
 }
 
-// StartWithRetry starts the doc processor with a retry mechanism
+// StartWithRetry starts the doc processor with a retry mechanism.
+// Stop ends it with a nil error even while backing off, errors caused by context cancellation aren't retried.
+// A RetryPolicy as bo picks the wait by the class of the error.
 func (dp DocumentProcessor) StartWithRetry(bo backoff.BackOff, actions mongowatch.CollectionWatcher, fullDocumentMode options.FullDocument) error {
+	ctx := dp.manager.withID(context.Background())
 	op := func() error {
 		err := dp.Start(actions, fullDocumentMode)
 		if err != nil {
 			if errors.Is(err, ErrInvalidate) {
-				// gracefully stop the stream manager
-				log.Tracef("stopping data processor due to invalidate event: %v", err)
-				log.Trace("restarting...")
-				dp.Stop()
+				// the watcher already returned, the next attempt resumes after the invalidate event
+				logger(ctx).Tracef("restarting data processor due to invalidate event: %v", err)
+			}
+			if errors.Is(err, ErrResumePointMismatch) {
+				// resuming would process the wrong stream, the checkpoint has to be fixed by hand
+				logger(ctx).Errorf("refusing to start data processor: %v", err)
+				return backoff.Permanent(err)
+			}
+			if errors.Is(err, ErrPipelineParity) {
+				// the stages won't change until the next deploy
+				logger(ctx).Errorf("refusing to start data processor: %v", err)
+				return backoff.Permanent(err)
+			}
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				// whoever canceled the context wants the processor gone, restarting would race with them
+				logger(ctx).Infof("data processor stopped by context cancellation: %v", err)
+				return backoff.Permanent(err)
+			}
+			logger(ctx).Errorf("error while starting data processor: %v", err)
+		}
+		if err != nil {
+			dp.control.restarts.Add(1)
+			if observer, ok := bo.(errorObserver); ok {
+				observer.Observe(err)
 			}
-			log.Errorf("error while starting data processor: %v", err)
 		}
-		// TODO: increase error metrics to trigger notification to slack from victoria metrics via grafana
 		return err
 	}
 
@@ -83,45 +282,112 @@ func (dp DocumentProcessor) StartWithRetry(bo backoff.BackOff, actions mongowatc
 
 // Start starts the doc processor
 func (dp DocumentProcessor) Start(actions mongowatch.CollectionWatcher, fullDocumentMode options.FullDocument) error {
-	resumePoint, err := dp.resumeRepo.GetResumePoint()
-	if err != nil {
-		if !errors.Is(err, mongo.ErrNoDocuments) {
-			return fmt.Errorf("failed to fetch mongo watcher resume token: %w", err)
+	// the manager fetches the stored resume point itself, after checking that Stop wasn't called meanwhile
+	var resumePoint *mongowatch.ChangeStreamResumePoint
+	var err error
+
+	changeEventDispatcherFunc := dp.dispatcher(actions)
+
+	dp.control.mu.Lock()
+	dp.control.running = true
+	dp.control.mu.Unlock()
+	defer func() {
+		dp.control.mu.Lock()
+		dp.control.running = false
+		dp.control.mu.Unlock()
+	}()
+
+	ctx := dp.manager.withID(context.Background())
+	dp.logBanner(ctx, fullDocumentMode)
+	if dp.twoPhase != nil {
+		dp.twoPhase.use(actions)
+	}
+	for {
+		// start watching the change stream
+		err = dp.manager.Watch(ctx, fullDocumentMode, resumePoint, changeEventDispatcherFunc)
+		if dp.twoPhase != nil {
+			// events dispatched after the last checkpoint are replayed, the sink must not keep them
+			dp.twoPhase.abort(ctx)
 		}
+
+		dp.control.mu.Lock()
+		req := dp.control.seek
+		dp.control.seek = nil
+		dp.control.mu.Unlock()
+		if req == nil {
+			return err
+		}
+
+		// the stream was stopped by Seek, restart it from the new position
+		resumePoint, err = dp.applySeek(ctx, req.pos)
+		req.done <- err
+		if err != nil {
+			return err
+		}
+		logger(ctx).Infof("restarting data processor from seek position: %v", resumePoint.ID.TokenData)
 	}
+}
 
+// dispatcher maps change events onto the CollectionWatcher methods
+func (dp DocumentProcessor) dispatcher(actions mongowatch.CollectionWatcher) mongowatch.ChangeEventDispatcherFunc {
 	// skip initial error
 	// stream manager supports running multiple callbacks which can share errors
 	// we don't need it here because 1 op = 1 callback
-	var changeEventDispatcherFunc mongowatch.ChangeEventDispatcherFunc = func(ctx context.Context, ce mongowatch.ChangeStreamEvent, _ error) error {
-		log.Tracef("processing event: %d: %s", ce.Timestamp.T, ce.OperationType)
+	return func(ctx context.Context, ce mongowatch.ChangeStreamEvent, _ error) error {
+		eventLogf(ctx, "processing event: %d: %s", ce.Timestamp.T, ce.OperationType)
+		if router, ok := actions.(mongowatch.OperationRouter); ok {
+			return dp.route(ctx, router, ce)
+		}
+		if namespaces, ok := actions.(mongowatch.NamespaceWatcher); ok {
+			if handled, err := dispatchNamespace(ctx, namespaces, ce); handled {
+				return err
+			}
+		}
+		if events, ok := actions.(mongowatch.EventWatcher); ok {
+			return dp.dispatchEvent(ctx, events, ce)
+		}
+
+		// document watchers get the decoded document as is, unless they asked for envelopes
+		docs, direct := actions.(mongowatch.DocumentWatcher)
+		direct = direct && !dp.envelope
 
-		// TODO: maybe ce.FullDocument can be serialized into a struct directly
-		// easiest way to remap the document to a struct is with JSON marshalling
+		// the serializer remaps the document into the wire format handlers expect, JSON by default
 		var docBytes []byte
 		var err error
 		if ce.OperationType == "insert" {
-			docBytes, err = json.Marshal(ce.FullDocument)
+			if direct {
+				return docs.InsertDocument(ctx, ce.FullDocument)
+			}
+			docBytes, err = dp.serialize(ce, ce.FullDocument)
 			if err != nil {
 				return fmt.Errorf("failed to marshal event stream document: %w", err)
 			}
 			return actions.Insert(ctx, docBytes)
 		}
 		if ce.OperationType == "update" {
-			docBytes, err = json.Marshal(ce.FullDocument)
+			if partial, ok := actions.(mongowatch.PartialUpdateWatcher); ok && ce.FullDocument == nil {
+				return partial.UpdateFields(ctx, ce.DocumentKey, ce.UpdateDescription.UpdatedFields, removedFields(ce))
+			}
+			if direct {
+				return docs.UpdateDocument(ctx, ce.FullDocument)
+			}
+			docBytes, err = dp.serialize(ce, ce.FullDocument)
 			if err != nil {
 				return fmt.Errorf("failed to marshal event stream document: %w", err)
 			}
 			return actions.Update(ctx, docBytes)
 		}
 		if ce.OperationType == "delete" {
+			if direct {
+				return docs.DeleteDocument(ctx, eventDocument(ce))
+			}
 			if ce.FullDocumentBeforeChange != nil {
-				docBytes, err = json.Marshal(ce.FullDocumentBeforeChange)
+				docBytes, err = dp.serialize(ce, ce.FullDocumentBeforeChange)
 				if err != nil {
 					return fmt.Errorf("failed to marshal event stream document before change: %w", err)
 				}
 			} else {
-				docBytes, err = json.Marshal(ce.FullDocument)
+				docBytes, err = dp.serialize(ce, ce.FullDocument)
 				if err != nil {
 					return fmt.Errorf("failed to marshal event stream document: %w", err)
 				}
@@ -129,13 +395,193 @@ func (dp DocumentProcessor) Start(actions mongowatch.CollectionWatcher, fullDocu
 			return actions.Delete(ctx, docBytes)
 		}
 
-		log.Tracef("skipping event: %d: %s", ce.Timestamp.T, ce.OperationType)
+		return dp.skip(ctx, ce)
+	}
+}
+
+// dispatchEvent passes the whole event to an EventWatcher
+func (dp DocumentProcessor) dispatchEvent(ctx context.Context, events mongowatch.EventWatcher, ce mongowatch.ChangeStreamEvent) error {
+	switch ce.OperationType {
+	case "insert":
+		return events.InsertEvent(ctx, ce)
+	case "update":
+		return events.UpdateEvent(ctx, ce)
+	case "delete":
+		return events.DeleteEvent(ctx, ce)
+	}
+	return dp.skip(ctx, ce)
+}
+
+// skip handles events of operation types without a CollectionWatcher method, strict processors fail on them
+func (dp DocumentProcessor) skip(ctx context.Context, ce mongowatch.ChangeStreamEvent) error {
+	if dp.strict && ce.OperationType != mongowatch.OperationTypeInvalidate {
+		return fmt.Errorf("%w: %s", ErrUnhandledOperation, ce.OperationType)
+	}
+	eventLogf(ctx, "skipping event: %d: %s", ce.Timestamp.T, ce.OperationType)
+
+	return nil
+}
+
+// serialize converts the document of the event into the payload passed to the CollectionWatcher
+func (dp DocumentProcessor) serialize(ce mongowatch.ChangeStreamEvent, doc primitive.M) ([]byte, error) {
+	if dp.envelope {
+		envelope := primitive.M{"op": ce.OperationType, "key": ce.LogicalKey(), "doc": doc}
+		if id := ce.UUID(); id != "" {
+			envelope["id"] = id
+		}
+		if !ce.Timestamp.IsZero() {
+			envelope["version"] = ce.Version()
+		}
+		if dp.externalOffsets {
+			envelope["token"] = ce.ID
+		}
+		doc = envelope
+	}
+	return dp.serializer.Serialize(doc)
+}
+
+// Seek moves the stored resume position, e.g. to skip a poison event or to rewind for reprocessing.
+// A running stream is stopped, restarted from the new position and Start keeps blocking meanwhile.
+func (dp DocumentProcessor) Seek(ctx context.Context, pos mongowatch.StartPosition) error {
+	if _, err := pos.ResumePoint(); err != nil {
+		return err
+	}
+
+	dp.control.mu.Lock()
+	if !dp.control.running {
+		dp.control.mu.Unlock()
+		_, err := dp.applySeek(ctx, pos)
+		return err
+	}
+	req := &seekRequest{pos: pos, done: make(chan error, 1)}
+	dp.control.seek = req
+	dp.control.mu.Unlock()
+
+	dp.manager.Stop()
+
+	select {
+	case err := <-req.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// applySeek overwrites the stored resume points with the seek position
+func (dp DocumentProcessor) applySeek(ctx context.Context, pos mongowatch.StartPosition) (*mongowatch.ChangeStreamResumePoint, error) {
+	point, err := pos.ResumePoint()
+	if err != nil {
+		return nil, err
+	}
+	if err = dp.resumeRepo.ReplaceResumePoints(ctx, point); err != nil {
+		return nil, fmt.Errorf("failed to seek: %w", err)
+	}
+	return &point, nil
+}
 
+// removedFields lists the field names removed by an update event
+func removedFields(ce mongowatch.ChangeStreamEvent) []string {
+	removed, ok := ce.UpdateDescription.RemovedFields.(primitive.A)
+	if !ok {
 		return nil
 	}
+	fields := make([]string, 0, len(removed))
+	for _, field := range removed {
+		if name, ok := field.(string); ok {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
+
+// StartWithFailover runs the doc processor in active-passive mode, it only starts once the coordinator
+// grants this instance the lease and stops as soon as the lease is lost. When a successor requests a handover,
+// the event in flight is finished before stopping and ErrHandedOver is returned.
+func (dp DocumentProcessor) StartWithFailover(ctx context.Context, coordinator *FailoverCoordinator, actions mongowatch.CollectionWatcher, fullDocumentMode options.FullDocument) error {
+	return coordinator.Run(ctx, func(ctx context.Context, epoch int64) error {
+		// fence off checkpoint writes of the previous primary
+		if fenced, ok := dp.resumeRepo.(interface{ SetEpoch(epoch int64) }); ok {
+			fenced.SetEpoch(epoch)
+		}
+
+		stopped := make(chan struct{})
+		defer close(stopped)
+		go func() {
+			select {
+			case <-ctx.Done():
+				if errors.Is(context.Cause(ctx), ErrHandedOver) {
+					// the successor resumes right after the last checkpoint, let the event in flight reach it
+					drainCtx, cancel := context.WithTimeout(context.Background(), coordinator.cfg.TTL)
+					if err := dp.Drain(drainCtx); err != nil {
+						logger(ctx).Warnf("failed to drain before handing over: %v", err)
+					}
+					cancel()
+				}
+				dp.Stop()
+			case <-stopped:
+			}
+		}()
+
+		err := dp.Start(actions, fullDocumentMode)
+		if errors.Is(context.Cause(ctx), ErrHandedOver) {
+			// draining paused the gate, a later start of this processor shouldn't be held back
+			dp.Resume()
+		}
+		return err
+	})
+}
+
+// StartWithHandover takes over the stream from the running primary with minimal processing gap, e.g. during a
+// deploy: it opens a cursor at the stored checkpoint to warm up connections and check the position, signals
+// readiness with RequestHandover and then runs StartWithFailover, which picks up the lease as soon as the
+// primary finished its event in flight and stepped down. Without a primary it starts like StartWithFailover.
+func (dp DocumentProcessor) StartWithHandover(ctx context.Context, coordinator *FailoverCoordinator, actions mongowatch.CollectionWatcher, fullDocumentMode options.FullDocument) error {
+	if v, ok := dp.watcher.(positionValidator); ok {
+		point, err := dp.resumeRepo.GetResumePoint()
+		switch {
+		case err == nil:
+			if err = v.ValidatePosition(ctx, *point); err != nil {
+				return fmt.Errorf("failed to warm up cursor for handover: %w", err)
+			}
+		case !errors.Is(err, mongo.ErrNoDocuments):
+			return fmt.Errorf("failed to fetch checkpoint for handover: %w", err)
+		}
+	}
+	if err := coordinator.RequestHandover(ctx); err != nil {
+		return err
+	}
+	return dp.StartWithFailover(ctx, coordinator, actions, fullDocumentMode)
+}
+
+// Pause holds back event dispatching without closing the change stream
+func (dp DocumentProcessor) Pause() {
+	dp.control.gate.Pause()
+}
+
+// Resume continues a paused processor
+func (dp DocumentProcessor) Resume() {
+	dp.control.gate.Resume()
+}
+
+// Drain stops dispatching new events and waits for the event in flight, call Stop afterwards
+func (dp DocumentProcessor) Drain(ctx context.Context) error {
+	return dp.control.gate.Drain(ctx)
+}
+
+// Checkpoint stores the position of the last processed event right away and returns its token,
+// e.g. after Drain before planned maintenance, see Manager.Checkpoint
+func (dp DocumentProcessor) Checkpoint(ctx context.Context) (mongowatch.ResumeToken, error) {
+	return dp.manager.Checkpoint(ctx)
+}
+
+// ResumePoint returns the stored resume point the processor would restart from
+func (dp DocumentProcessor) ResumePoint() (*mongowatch.ChangeStreamResumePoint, error) {
+	return dp.resumeRepo.GetResumePoint()
+}
 
-	// start watching the change stream
-	return dp.manager.Watch(context.Background(), fullDocumentMode, resumePoint, changeEventDispatcherFunc)
+// DescribeResumePoint summarizes the stored resume point, e.g. for health checks
+func (dp DocumentProcessor) DescribeResumePoint(ctx context.Context) (*mongowatch.ResumePointInfo, error) {
+	return dp.resumeRepo.Describe(ctx)
 }
 
 // Stop stops the doc processor
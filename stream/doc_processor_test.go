@@ -19,6 +19,9 @@ package stream
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -26,12 +29,17 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 
+	"github.com/mmtracker/mongowatch"
 	"github.com/mmtracker/mongowatch/db"
 	"github.com/mmtracker/mongowatch/examples/watchers"
 )
 
 func Test_DocumentProcessor_Start(t *testing.T) {
+	requireMongo(t)
 	tests := []struct {
 		name    string
 		want    interface{}
@@ -98,3 +106,191 @@ func Test_DocumentProcessor_Start(t *testing.T) {
 		})
 	}
 }
+
+type partialWatcher struct {
+	watchers.Mock
+	documentKey string
+	updated     map[string]interface{}
+	removed     []string
+}
+
+func (p *partialWatcher) UpdateFields(ctx context.Context, documentKey string, updated map[string]interface{}, removed []string) error {
+	p.documentKey, p.updated, p.removed = documentKey, updated, removed
+	return nil
+}
+
+func Test_DocumentProcessor_PartialUpdates(t *testing.T) {
+	dp := DocumentProcessor{serializer: JSONSerializer{}}
+	actions := &partialWatcher{}
+
+	ce := mongowatch.ChangeStreamEvent{OperationType: "update", DocumentKey: "device_1"}
+	ce.UpdateDescription.UpdatedFields = map[string]interface{}{"paidUntil": "2024-01-01"}
+	ce.UpdateDescription.RemovedFields = primitive.A{"trial"}
+
+	assert.NoError(t, dp.dispatcher(actions)(context.Background(), ce, nil))
+	assert.Equal(t, "device_1", actions.documentKey)
+	assert.Equal(t, ce.UpdateDescription.UpdatedFields, actions.updated)
+	assert.Equal(t, []string{"trial"}, actions.removed)
+	assert.Equal(t, 0, actions.Updated)
+}
+
+// payloadWatcher records the payloads it receives
+type payloadWatcher struct {
+	payloads []string
+}
+
+func (p *payloadWatcher) Insert(ctx context.Context, doc []byte) error { return p.record(doc) }
+func (p *payloadWatcher) Update(ctx context.Context, doc []byte) error { return p.record(doc) }
+func (p *payloadWatcher) Delete(ctx context.Context, doc []byte) error { return p.record(doc) }
+
+func (p *payloadWatcher) record(doc []byte) error {
+	p.payloads = append(p.payloads, string(doc))
+	return nil
+}
+
+// eventRecorder is an EventWatcher, payloadWatcher collects what reaches the byte-slice methods
+type eventRecorder struct {
+	payloadWatcher
+	events []mongowatch.ChangeStreamEvent
+}
+
+func (e *eventRecorder) InsertEvent(ctx context.Context, ce mongowatch.ChangeStreamEvent) error {
+	return e.add(ce)
+}
+
+func (e *eventRecorder) UpdateEvent(ctx context.Context, ce mongowatch.ChangeStreamEvent) error {
+	return e.add(ce)
+}
+
+func (e *eventRecorder) DeleteEvent(ctx context.Context, ce mongowatch.ChangeStreamEvent) error {
+	return e.add(ce)
+}
+
+func (e *eventRecorder) add(ce mongowatch.ChangeStreamEvent) error {
+	e.events = append(e.events, ce)
+	return nil
+}
+
+func Test_DocumentProcessor_EventWatcher(t *testing.T) {
+	dp := DocumentProcessor{serializer: JSONSerializer{}, strict: true}
+	actions := &eventRecorder{}
+	dispatch := dp.dispatcher(actions)
+
+	update := mongowatch.ChangeStreamEvent{OperationType: "update", DocumentKey: "d1", Timestamp: primitive.Timestamp{T: 10}}
+	update.UpdateDescription.UpdatedFields = map[string]interface{}{"status": "paid"}
+	assert.NoError(t, dispatch(context.Background(), update, nil))
+	assert.NoError(t, dispatch(context.Background(), mongowatch.ChangeStreamEvent{OperationType: "delete", DocumentKey: "d1"}, nil))
+	assert.ErrorIs(t, dispatch(context.Background(), mongowatch.ChangeStreamEvent{OperationType: "drop"}, nil), ErrUnhandledOperation)
+
+	assert.Empty(t, actions.payloads)
+	if assert.Len(t, actions.events, 2) {
+		// updates without a full document still carry their update description
+		assert.Equal(t, update, actions.events[0])
+		assert.Equal(t, "delete", actions.events[1].OperationType)
+	}
+}
+
+// namespaceRecorder is a NamespaceWatcher, payloadWatcher collects what reaches the byte-slice methods
+type namespaceRecorder struct {
+	payloadWatcher
+	calls []string
+}
+
+func (n *namespaceRecorder) OnDrop(ctx context.Context, ns mongowatch.Namespace) error {
+	n.calls = append(n.calls, "drop "+ns.Database+"."+ns.Collection)
+	return nil
+}
+
+func (n *namespaceRecorder) OnRename(ctx context.Context, from, to mongowatch.Namespace) error {
+	n.calls = append(n.calls, "rename "+from.Database+"."+from.Collection+" "+to.Database+"."+to.Collection)
+	return nil
+}
+
+func (n *namespaceRecorder) OnDropDatabase(ctx context.Context, database string) error {
+	n.calls = append(n.calls, "dropDatabase "+database)
+	return nil
+}
+
+func Test_DocumentProcessor_NamespaceWatcher(t *testing.T) {
+	dp := DocumentProcessor{serializer: JSONSerializer{}, strict: true}
+	actions := &namespaceRecorder{}
+	dispatch := dp.dispatcher(actions)
+
+	ctx := context.Background()
+	assert.NoError(t, dispatch(ctx, mongowatch.ChangeStreamEvent{OperationType: "insert", FullDocument: primitive.M{"name": "a"}}, nil))
+	assert.NoError(t, dispatch(ctx, mongowatch.ChangeStreamEvent{OperationType: "drop", Database: "app", Collection: "users"}, nil))
+	assert.NoError(t, dispatch(ctx, mongowatch.ChangeStreamEvent{
+		OperationType: "rename", Database: "app", Collection: "users",
+		To: &mongowatch.Namespace{Database: "app", Collection: "members"},
+	}, nil))
+	assert.Error(t, dispatch(ctx, mongowatch.ChangeStreamEvent{OperationType: "rename", Database: "app", Collection: "users"}, nil))
+	assert.NoError(t, dispatch(ctx, mongowatch.ChangeStreamEvent{OperationType: "dropDatabase", Database: "app"}, nil))
+
+	assert.Equal(t, []string{`{"name":"a"}`}, actions.payloads)
+	assert.Equal(t, []string{"drop app.users", "rename app.users app.members", "dropDatabase app"}, actions.calls)
+}
+
+func Test_DocumentProcessor_Envelope(t *testing.T) {
+	dp := DocumentProcessor{serializer: JSONSerializer{}}
+	WithEnvelope()(&dp)
+	actions := &payloadWatcher{}
+	dispatch := dp.dispatcher(actions)
+
+	insert := mongowatch.ChangeStreamEvent{OperationType: "insert", DocumentKey: "d1", FullDocument: primitive.M{"name": "a"}}
+	assert.NoError(t, dispatch(context.Background(), insert, nil))
+	del := mongowatch.ChangeStreamEvent{OperationType: "delete", DocumentKey: "d1", FullDocumentBeforeChange: primitive.M{"name": "a"}}
+	assert.NoError(t, dispatch(context.Background(), del, nil))
+
+	assert.Equal(t, []string{
+		`{"doc":{"name":"a"},"key":"d1","op":"insert"}`,
+		`{"doc":{"name":"a"},"key":"d1","op":"delete"}`,
+	}, actions.payloads)
+
+	var envelope JSONEnvelope
+	assert.NoError(t, json.Unmarshal([]byte(actions.payloads[1]), &envelope))
+	assert.Equal(t, "delete", envelope.Op)
+	assert.JSONEq(t, `{"name":"a"}`, string(envelope.Doc))
+}
+
+func Test_DocumentProcessor_StartupBanner(t *testing.T) {
+	out := captureLog(t)
+	w := &stopWatcher{fail: errors.New("connection reset")}
+	dp := testProcessor(w)
+
+	for i := 0; i < 2; i++ {
+		assert.Error(t, dp.Start(&payloadWatcher{}, options.WhenAvailable))
+	}
+
+	assert.Equal(t, 1, strings.Count(out.String(), "starting data processor"))
+	assert.Contains(t, out.String(), "fullDocumentBeforeChange=whenAvailable")
+	assert.Contains(t, out.String(), `resumeFrom="now, no resume point stored"`)
+	assert.Contains(t, out.String(), "workers=1")
+}
+
+func Test_DocumentProcessor_ExternalOffsets(t *testing.T) {
+	dp := DocumentProcessor{serializer: JSONSerializer{}}
+	WithEnvelope()(&dp)
+	WithExternalOffsets()(&dp)
+	actions := &payloadWatcher{}
+	dispatch := dp.dispatcher(actions)
+
+	insert := mongowatch.ChangeStreamEvent{ID: mongowatch.ResumeToken{TokenData: "82aa"}, Timestamp: primitive.Timestamp{T: 10, I: 1}, OperationType: "insert", DocumentKey: "d1", FullDocument: primitive.M{"name": "a"}}
+	assert.NoError(t, dispatch(context.Background(), insert, nil))
+
+	var envelope JSONEnvelope
+	assert.NoError(t, json.Unmarshal([]byte(actions.payloads[0]), &envelope))
+	assert.Equal(t, insert.UUID(), envelope.ID)
+	assert.Equal(t, insert.Version(), envelope.Version)
+	if assert.NotNil(t, envelope.Token) {
+		assert.Equal(t, "82aa", envelope.Token.TokenData)
+	}
+
+	_, err := dp.resumeRepo.GetResumePoint()
+	assert.ErrorIs(t, err, mongo.ErrNoDocuments)
+	_, err = dp.applySeek(context.Background(), mongowatch.StartPosition{Token: envelope.Token})
+	assert.NoError(t, err)
+	point, err := dp.resumeRepo.GetResumePoint()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "82aa", point.ID.TokenData)
+	}
+}
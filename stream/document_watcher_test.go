@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// documentWatcher records the documents it gets directly, payloadWatcher collects serialized ones otherwise
+type documentWatcher struct {
+	payloadWatcher
+	docs []primitive.M
+}
+
+func (d *documentWatcher) InsertDocument(ctx context.Context, doc primitive.M) error {
+	return d.add(doc)
+}
+func (d *documentWatcher) UpdateDocument(ctx context.Context, doc primitive.M) error {
+	return d.add(doc)
+}
+func (d *documentWatcher) DeleteDocument(ctx context.Context, doc primitive.M) error {
+	return d.add(doc)
+}
+
+func (d *documentWatcher) add(doc primitive.M) error {
+	d.docs = append(d.docs, doc)
+	return nil
+}
+
+func Test_DocumentProcessor_DocumentWatcher(t *testing.T) {
+	dp := DocumentProcessor{serializer: JSONSerializer{}}
+	actions := &documentWatcher{}
+	dispatch := dp.dispatcher(actions)
+
+	id := primitive.NewObjectID()
+	insert := mongowatch.ChangeStreamEvent{OperationType: "insert", FullDocument: primitive.M{"_id": id}}
+	update := mongowatch.ChangeStreamEvent{OperationType: "update", FullDocument: primitive.M{"_id": id, "n": int32(2)}}
+	del := mongowatch.ChangeStreamEvent{OperationType: "delete", FullDocumentBeforeChange: primitive.M{"_id": id, "n": int32(2)}}
+	for _, ce := range []mongowatch.ChangeStreamEvent{insert, update, del, {OperationType: "delete"}} {
+		assert.NoError(t, dispatch(context.Background(), ce, nil))
+	}
+
+	assert.Empty(t, actions.payloads, "documents went through the serializer")
+	assert.Equal(t, []primitive.M{insert.FullDocument, update.FullDocument, del.FullDocumentBeforeChange, nil}, actions.docs)
+	// the ObjectID survives, a JSON round trip would turn it into a string
+	assert.IsType(t, primitive.ObjectID{}, actions.docs[0]["_id"])
+
+	// envelopes need a payload, the document watcher falls back to the CollectionWatcher methods
+	WithEnvelope()(&dp)
+	assert.NoError(t, dp.dispatcher(actions)(context.Background(), insert, nil))
+	assert.Len(t, actions.payloads, 1)
+}
+
+// largeDocument builds a document of roughly 100KB with nested documents, arrays and BSON typed values
+func largeDocument() primitive.M {
+	readings := make(primitive.A, 500)
+	for i := range readings {
+		readings[i] = primitive.M{
+			"at":    primitive.NewDateTimeFromTime(time.Unix(int64(1700000000+i), 0)),
+			"value": float64(i) * 0.25,
+			"tags":  primitive.A{"gps", "battery", fmt.Sprintf("seq-%d", i)},
+		}
+	}
+	doc := primitive.M{"_id": primitive.NewObjectID(), "readings": readings}
+	for i := 0; i < 100; i++ {
+		doc[fmt.Sprintf("field%d", i)] = fmt.Sprintf("value of field %d", i)
+	}
+	return doc
+}
+
+type benchReading struct {
+	Value float64 `bson:"value" json:"value"`
+}
+
+type benchDevice struct {
+	Readings []benchReading `bson:"readings" json:"readings"`
+}
+
+func benchmarkDispatch(b *testing.B, dp DocumentProcessor, actions mongowatch.CollectionWatcher) {
+	dispatch := dp.dispatcher(actions)
+	ce := mongowatch.ChangeStreamEvent{OperationType: "update", FullDocument: largeDocument()}
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := dispatch(ctx, ce, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// jsonWatcher decodes payloads the way handlers of the default JSON serializer do
+type jsonWatcher struct {
+	payloadWatcher
+}
+
+func (j *jsonWatcher) Update(ctx context.Context, doc []byte) error {
+	var d benchDevice
+	return json.Unmarshal(doc, &d)
+}
+
+// Benchmark_Dispatch_JSON is the default: the document is marshalled to JSON and decoded by the handler
+func Benchmark_Dispatch_JSON(b *testing.B) {
+	benchmarkDispatch(b, DocumentProcessor{serializer: JSONSerializer{}}, &jsonWatcher{})
+}
+
+// Benchmark_Dispatch_TypedBSON passes the document to a TypedCollectionWatcher, decoding it with the BSON codec
+func Benchmark_Dispatch_TypedBSON(b *testing.B) {
+	w := mongowatch.NewTypedCollectionWatcher(mongowatch.TypedCallbacks[benchDevice]{
+		Update: func(ctx context.Context, d benchDevice) error { return nil },
+	})
+	benchmarkDispatch(b, DocumentProcessor{serializer: JSONSerializer{}}, w)
+}
+
+// Benchmark_Dispatch_Document hands the decoded document to a DocumentWatcher as is
+func Benchmark_Dispatch_Document(b *testing.B) {
+	benchmarkDispatch(b, DocumentProcessor{serializer: JSONSerializer{}}, &documentWatcher{})
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// ErrEventBudgetExceeded is returned when an event runs out of its processing budget, see WithEventBudget
+var ErrEventBudgetExceeded = errors.New("event processing budget exceeded")
+
+// WithEventBudget bounds the total time spent on one event: saving its resume point, deleting the previous one and
+// the whole dispatch chain share the budget. Past it the current step fails with ErrEventBudgetExceeded, which
+// dispatch failures hand to the failure policy (retries, WithPoisonPolicy), so a slow event can't block the stream
+// for longer than the budget per attempt. Like WithHandlerTimeout, a step ignoring its context keeps running
+// in the background once WithHandlerCancelGrace is over.
+func WithEventBudget(budget time.Duration) ManagerOption {
+	return func(m *Manager) {
+		m.budget = &eventBudget{budget: budget}
+	}
+}
+
+// eventBudget tracks the deadline of the event being processed, the watcher handles one event at a time
+type eventBudget struct {
+	budget time.Duration
+
+	mu       sync.Mutex
+	event    string
+	deadline time.Time
+}
+
+// deadlineFor returns the deadline of the event the context belongs to, starting its budget on the first step.
+// Steps are matched by the event of the context: the previous resume point is deleted with the context of the
+// event replacing it.
+func (b *eventBudget) deadlineFor(ctx context.Context) time.Time {
+	id := mongowatch.EventIDFromContext(ctx)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if id == "" || id != b.event {
+		b.event = id
+		b.deadline = time.Now().Add(b.budget)
+	}
+	return b.deadline
+}
+
+// wrap runs fn within the budget of the event, a step past it is given grace to return, see WithHandlerCancelGrace
+func (b *eventBudget) wrap(fn mongowatch.ChangeEventDispatcherFunc, grace time.Duration) mongowatch.ChangeEventDispatcherFunc {
+	if fn == nil {
+		return nil
+	}
+	return func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		ctx, cancel := context.WithDeadline(ctx, b.deadlineFor(ctx))
+		defer cancel()
+
+		err = callBounded(ctx, fn, ce, err, grace)
+		if err == nil {
+			return nil
+		}
+		// the event will be retried or skipped, either way the next attempt starts with a full budget
+		b.reset()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("%w after %s: %w", ErrEventBudgetExceeded, b.budget, err)
+		}
+		return err
+	}
+}
+
+func (b *eventBudget) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.event = ""
+}
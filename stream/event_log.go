@@ -0,0 +1,179 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// maxBufferedEventLines bounds the lines kept for an event until it is known whether it is logged
+const maxBufferedEventLines = 64
+
+// EventLogConfig controls the per-event log lines (received, saved, processed...) of a watcher.
+// Per-event lines are written at Level regardless of the level of the standard logger, so they can be
+// enabled or silenced on their own. An event is logged if it is one of every EveryN events,
+// took at least Slow to handle, or failed while Failed is set.
+type EventLogConfig struct {
+	// Level the per-event lines are written at, log.TraceLevel if zero
+	Level log.Level
+	// EveryN logs one of every n events, 0 logs none unless slow or failed
+	EveryN uint64
+	// Slow logs events taking at least this long, 0 disables it
+	Slow time.Duration
+	// Failed logs events failing to be processed
+	Failed bool
+}
+
+// WithEventLogging samples the per-event log lines instead of writing them all at trace level
+func WithEventLogging(cfg EventLogConfig) WatcherOption {
+	return func(csw *ChangeStreamWatcher) {
+		if cfg.Level == log.PanicLevel {
+			cfg.Level = log.TraceLevel
+		}
+		csw.eventLog = &eventLog{cfg: cfg}
+	}
+}
+
+// eventLog decides which events of a watcher are logged
+type eventLog struct {
+	cfg  EventLogConfig
+	seen atomic.Uint64
+}
+
+type eventTraceKey struct{}
+
+// eventTrace collects the log lines of a single event until it is finished
+type eventTrace struct {
+	cfg     *EventLogConfig
+	entry   *log.Entry
+	id      interface{}
+	start   time.Time
+	sampled bool
+
+	mu      sync.Mutex
+	lines   []string
+	dropped int
+	done    bool
+}
+
+// traceEvent starts the trace of ce, it returns ctx unchanged when event logging isn't configured
+func (csw *ChangeStreamWatcher) traceEvent(ctx context.Context, ce mongowatch.ChangeStreamEvent) (context.Context, *eventTrace) {
+	if csw.eventLog == nil {
+		return ctx, nil
+	}
+	cfg := &csw.eventLog.cfg
+	n := csw.eventLog.seen.Add(1)
+	t := &eventTrace{
+		cfg:     cfg,
+		entry:   logger(ctx),
+		id:      ce.ID.TokenData,
+		start:   time.Now(),
+		sampled: cfg.EveryN > 0 && (n-1)%cfg.EveryN == 0,
+	}
+	return context.WithValue(ctx, eventTraceKey{}, t), t
+}
+
+// eventLogf writes a per-event log line through the trace of ctx, or at trace level without one
+func eventLogf(ctx context.Context, format string, args ...interface{}) {
+	t, ok := ctx.Value(eventTraceKey{}).(*eventTrace)
+	if !ok {
+		logger(ctx).Tracef(format, args...)
+		return
+	}
+	t.logf(format, args...)
+}
+
+func (t *eventTrace) logf(format string, args ...interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case t.sampled:
+		// sampled events are known to be logged, nothing to hold back
+		t.write(fmt.Sprintf(format, args...))
+	case t.done || (!t.cfg.Failed && t.cfg.Slow <= 0):
+		// the event can't turn out slow or failed anymore
+	case len(t.lines) < maxBufferedEventLines:
+		t.lines = append(t.lines, fmt.Sprintf(format, args...))
+	default:
+		t.dropped++
+	}
+}
+
+// finish ends the trace, flushing the held back lines if the event turned out slow or failed.
+// Only the first call counts, it is a no-op on a nil trace.
+func (t *eventTrace) finish(err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return
+	}
+	t.done = true
+	took := time.Since(t.start)
+	failed := err != nil && !errors.Is(err, ErrInvalidate)
+	slow := t.cfg.Slow > 0 && took >= t.cfg.Slow
+	switch {
+	case failed && t.cfg.Failed:
+		t.flush()
+		t.write(fmt.Sprintf("event %v failed after %s: %v", t.id, took, err))
+	case slow:
+		t.flush()
+		t.write(fmt.Sprintf("event %v was slow, took %s", t.id, took))
+	}
+	t.lines = nil
+}
+
+func (t *eventTrace) flush() {
+	for _, line := range t.lines {
+		t.write(line)
+	}
+	if t.dropped > 0 {
+		t.write(fmt.Sprintf("%d more lines of event %v dropped", t.dropped, t.id))
+	}
+}
+
+// write logs at the configured level, bypassing the level of the standard logger
+func (t *eventTrace) write(line string) {
+	std := t.entry.Logger
+	if std.IsLevelEnabled(t.cfg.Level) {
+		t.entry.Log(t.cfg.Level, line)
+		return
+	}
+	// a copy of the logger sharing its output and hooks, with the level lifted for this line
+	lifted := &log.Logger{
+		Out:          std.Out,
+		Hooks:        std.Hooks,
+		Formatter:    std.Formatter,
+		ReportCaller: std.ReportCaller,
+		Level:        t.cfg.Level,
+		ExitFunc:     std.ExitFunc,
+	}
+	entry := log.NewEntry(lifted).WithFields(t.entry.Data)
+	entry.Log(t.cfg.Level, line)
+}
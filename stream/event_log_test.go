@@ -0,0 +1,121 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// captureLog redirects the standard logger at info level into a buffer for the duration of the test
+func captureLog(t *testing.T) *bytes.Buffer {
+	std := log.StandardLogger()
+	out, level := std.Out, std.GetLevel()
+	buf := &bytes.Buffer{}
+	std.SetOutput(buf)
+	std.SetLevel(log.InfoLevel)
+	t.Cleanup(func() {
+		std.SetOutput(out)
+		std.SetLevel(level)
+	})
+	return buf
+}
+
+func tracedEvent(csw *ChangeStreamWatcher, line string) (context.Context, *eventTrace) {
+	ctx, trace := csw.traceEvent(context.Background(), mongowatch.ChangeStreamEvent{})
+	eventLogf(ctx, "%s", line)
+	return ctx, trace
+}
+
+func TestEventLog_EveryN(t *testing.T) {
+	buf := captureLog(t)
+	csw := NewChangeStreamWatcher(nil, WithEventLogging(EventLogConfig{Level: log.DebugLevel, EveryN: 3}))
+
+	for _, line := range []string{"one", "two", "three", "four"} {
+		_, trace := tracedEvent(csw, line)
+		trace.finish(nil)
+	}
+
+	out := buf.String()
+	assert.Contains(t, out, "one")
+	assert.NotContains(t, out, "two")
+	assert.NotContains(t, out, "three")
+	assert.Contains(t, out, "four")
+	assert.Contains(t, out, "level=debug")
+}
+
+func TestEventLog_FailedAndSlow(t *testing.T) {
+	buf := captureLog(t)
+	csw := NewChangeStreamWatcher(nil, WithEventLogging(EventLogConfig{Failed: true, Slow: 20 * time.Millisecond}))
+
+	_, trace := tracedEvent(csw, "fine")
+	trace.finish(nil)
+	_, trace = tracedEvent(csw, "invalidated")
+	trace.finish(ErrInvalidate)
+	assert.Empty(t, buf.String())
+
+	_, trace = tracedEvent(csw, "broken")
+	trace.finish(errors.New("boom"))
+	assert.Contains(t, buf.String(), "broken")
+	assert.Contains(t, buf.String(), "boom")
+
+	ctx, trace := tracedEvent(csw, "sluggish")
+	time.Sleep(25 * time.Millisecond)
+	trace.finish(nil)
+	assert.Contains(t, buf.String(), "sluggish")
+	assert.Contains(t, buf.String(), "was slow")
+
+	// lines after the event finished are dropped, so is a second finish
+	before := buf.Len()
+	eventLogf(ctx, "late")
+	trace.finish(errors.New("again"))
+	assert.Equal(t, before, buf.Len())
+}
+
+func TestEventLog_BufferBounded(t *testing.T) {
+	buf := captureLog(t)
+	csw := NewChangeStreamWatcher(nil, WithEventLogging(EventLogConfig{Failed: true}))
+
+	ctx, trace := csw.traceEvent(context.Background(), mongowatch.ChangeStreamEvent{})
+	for i := 0; i < maxBufferedEventLines+5; i++ {
+		eventLogf(ctx, "line")
+	}
+	trace.finish(errors.New("boom"))
+
+	assert.Equal(t, maxBufferedEventLines, strings.Count(buf.String(), "msg=line"))
+	assert.Contains(t, buf.String(), "5 more lines")
+}
+
+func TestEventLog_Disabled(t *testing.T) {
+	csw := NewChangeStreamWatcher(nil)
+	ctx := context.Background()
+	evCtx, trace := csw.traceEvent(ctx, mongowatch.ChangeStreamEvent{})
+	assert.Nil(t, trace)
+	assert.Equal(t, ctx, evCtx)
+	// finishing a nil trace is a no-op
+	trace.finish(errors.New("boom"))
+}
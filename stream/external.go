@@ -0,0 +1,29 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+// WithExternalOffsets disables the resume repository for consumers committing resume tokens to a store of their own,
+// e.g. Kafka offsets. Handlers get the token of every event with mongowatch.ResumeTokenFromContext, and in the
+// "token" field of the envelope WithEnvelope. The processor only remembers the last event in memory, so StartWithRetry
+// restarts continue from it; after a process restart, pass the committed token with Seek before starting.
+func WithExternalOffsets() ProcessorOption {
+	return func(dp *DocumentProcessor) {
+		dp.resumeRepo = NewMemoryResume(nil)
+		dp.externalOffsets = true
+	}
+}
@@ -0,0 +1,286 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrLeaseLost is returned when the active consumer could not renew its lease in time
+var ErrLeaseLost = errors.New("failover lease lost")
+
+// ErrHandedOver is returned by Run when the primary stepped down for a successor that requested a handover
+var ErrHandedOver = errors.New("failover lease handed over")
+
+// handoverPollInterval is how often a successor polls the lease while waiting for the primary to step down
+const handoverPollInterval = 50 * time.Millisecond
+
+// LeaseConfig configures the failover lease
+type LeaseConfig struct {
+	// Name identifies the stream the lease is for, consumers of the same stream must use the same name
+	Name string
+	// Owner uniquely identifies this consumer, e.g. region + host
+	Owner string
+	// TTL is how long the primary may stay silent before a standby takes over,
+	// it must comfortably exceed the clock skew between regions
+	TTL time.Duration
+	// HeartbeatInterval is how often the primary renews the lease and how often standbys poll it
+	HeartbeatInterval time.Duration
+}
+
+// Lease is the heartbeat document shared by the consumers of a stream
+type Lease struct {
+	Name        string    `bson:"_id" json:"name"`
+	Owner       string    `bson:"owner" json:"owner"`
+	Epoch       int64     `bson:"epoch" json:"epoch"`
+	HeartbeatAt time.Time `bson:"heartbeatAt" json:"heartbeatAt"`
+	ExpiresAt   time.Time `bson:"expiresAt" json:"expiresAt"`
+	// Handover is set by a successor ready to take over, see RequestHandover
+	Handover *Handover `bson:"handover,omitempty" json:"handover,omitempty"`
+}
+
+// Handover is the request of a successor whose cursor is warm, asking the primary to step down
+type Handover struct {
+	Owner       string    `bson:"owner" json:"owner"`
+	RequestedAt time.Time `bson:"requestedAt" json:"requestedAt"`
+}
+
+// FailoverCoordinator runs a consumer in active-passive mode. Every instance competes for a lease,
+// the holder (primary) heartbeats it while processing, the others (standbys) poll it and take over
+// from the last stored checkpoint once the primary stays silent for longer than the TTL.
+// Each takeover increments the lease epoch, which acts as a fencing token.
+type FailoverCoordinator struct {
+	col *mongo.Collection
+	cfg LeaseConfig
+
+	// handover makes awaitLease poll quickly after RequestHandover
+	handover atomic.Bool
+}
+
+// NewFailoverCoordinator creates a coordinator storing leases in col
+func NewFailoverCoordinator(col *mongo.Collection, cfg LeaseConfig) *FailoverCoordinator {
+	if cfg.TTL <= 0 {
+		cfg.TTL = 30 * time.Second
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = cfg.TTL / 3
+	}
+	return &FailoverCoordinator{col: col, cfg: cfg}
+}
+
+// Run waits until this instance holds the lease and runs fn with the lease epoch.
+// The context passed to fn is canceled as soon as the lease can't be renewed, so a partitioned primary
+// stops before a standby may take over. Run returns ErrLeaseLost in that case, or the error returned by fn.
+// When a successor requested a handover, the context is canceled with the cause ErrHandedOver, the lease is
+// released once fn returned and Run returns ErrHandedOver.
+func (fc *FailoverCoordinator) Run(ctx context.Context, fn func(ctx context.Context, epoch int64) error) error {
+	lease, err := fc.awaitLease(ctx)
+	if err != nil {
+		return err
+	}
+	fc.handover.Store(false)
+	log.Infof("failover: %s became primary for %s with epoch %d", fc.cfg.Owner, fc.cfg.Name, lease.Epoch)
+
+	runCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	ended := make(chan leaseEnd, 1)
+	go func() {
+		end := fc.heartbeat(runCtx, lease)
+		ended <- end
+		if end == leaseHandedOver {
+			cancel(ErrHandedOver)
+			return
+		}
+		cancel(nil)
+	}()
+
+	err = fn(runCtx, lease.Epoch)
+	cancel(nil)
+	switch <-ended {
+	case leaseLost:
+		return fmt.Errorf("%w: %s epoch %d", ErrLeaseLost, fc.cfg.Owner, lease.Epoch)
+	case leaseHandedOver:
+		if rErr := fc.Release(context.Background()); rErr != nil {
+			return rErr
+		}
+		log.Infof("failover: %s handed %s over with epoch %d", fc.cfg.Owner, fc.cfg.Name, lease.Epoch)
+		return ErrHandedOver
+	default:
+		return err
+	}
+}
+
+// RequestHandover asks the current primary to step down for this instance, signaling that it is ready to
+// take over, e.g. after warming up its cursor during a deploy. The primary notices on its next heartbeat,
+// finishes the event in flight and releases the lease, which Run of this instance then picks up right away.
+// It does nothing when this instance holds the lease or nobody does.
+func (fc *FailoverCoordinator) RequestHandover(ctx context.Context) error {
+	filter := bson.D{
+		{Key: "_id", Value: fc.cfg.Name},
+		{Key: "owner", Value: bson.D{{Key: "$ne", Value: fc.cfg.Owner}}},
+		{Key: "expiresAt", Value: bson.D{{Key: "$gte", Value: time.Now()}}},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "handover", Value: Handover{Owner: fc.cfg.Owner, RequestedAt: time.Now()}}}}}
+	res, err := fc.col.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return fmt.Errorf("failed to request failover handover: %w", err)
+	}
+	if res.MatchedCount == 1 {
+		fc.handover.Store(true)
+		log.Infof("failover: %s requested a handover of %s", fc.cfg.Owner, fc.cfg.Name)
+	}
+	return nil
+}
+
+// Release gives up the lease so a standby can take over without waiting for the TTL, used on graceful shutdown
+func (fc *FailoverCoordinator) Release(ctx context.Context) error {
+	filter := bson.D{{Key: "_id", Value: fc.cfg.Name}, {Key: "owner", Value: fc.cfg.Owner}}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "expiresAt", Value: time.Time{}}}}}
+	if _, err := fc.col.UpdateOne(ctx, filter, update); err != nil {
+		return fmt.Errorf("failed to release failover lease: %w", err)
+	}
+	return nil
+}
+
+// CurrentLease returns the lease as last written by the primary
+func (fc *FailoverCoordinator) CurrentLease(ctx context.Context) (*Lease, error) {
+	var lease Lease
+	err := fc.col.FindOne(ctx, bson.D{{Key: "_id", Value: fc.cfg.Name}}).Decode(&lease)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch failover lease: %w", err)
+	}
+	return &lease, nil
+}
+
+func (fc *FailoverCoordinator) awaitLease(ctx context.Context) (*Lease, error) {
+	for {
+		lease, err := fc.acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if lease != nil {
+			return lease, nil
+		}
+
+		log.Tracef("failover: %s is standby for %s", fc.cfg.Owner, fc.cfg.Name)
+		poll := fc.cfg.HeartbeatInterval
+		if fc.handover.Load() && handoverPollInterval < poll {
+			poll = handoverPollInterval
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(poll):
+		}
+	}
+}
+
+// acquire takes over an expired (or own) lease bumping its epoch, it returns nil if another instance holds it
+func (fc *FailoverCoordinator) acquire(ctx context.Context) (*Lease, error) {
+	now := time.Now()
+	filter := bson.D{
+		{Key: "_id", Value: fc.cfg.Name},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "expiresAt", Value: bson.D{{Key: "$lt", Value: now}}}},
+			bson.D{{Key: "owner", Value: fc.cfg.Owner}},
+		}},
+	}
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "owner", Value: fc.cfg.Owner},
+			{Key: "heartbeatAt", Value: now},
+			{Key: "expiresAt", Value: now.Add(fc.cfg.TTL)},
+		}},
+		{Key: "$inc", Value: bson.D{{Key: "epoch", Value: int64(1)}}},
+		{Key: "$unset", Value: bson.D{{Key: "handover", Value: ""}}},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var lease Lease
+	err := fc.col.FindOneAndUpdate(ctx, filter, update, opts).Decode(&lease)
+	if err != nil {
+		// the upsert collides with the lease held by another instance
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to acquire failover lease: %w", err)
+	}
+	return &lease, nil
+}
+
+// leaseEnd tells why a primary stopped heartbeating
+type leaseEnd int
+
+const (
+	leaseReleased leaseEnd = iota
+	leaseLost
+	leaseHandedOver
+)
+
+// heartbeat renews the lease until ctx is done, the lease is lost or a successor requested a handover
+func (fc *FailoverCoordinator) heartbeat(ctx context.Context, lease *Lease) leaseEnd {
+	ticker := time.NewTicker(fc.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+
+	renewedAt := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return leaseReleased
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		filter := bson.D{{Key: "_id", Value: fc.cfg.Name}, {Key: "owner", Value: fc.cfg.Owner}, {Key: "epoch", Value: lease.Epoch}}
+		update := bson.D{{Key: "$set", Value: bson.D{
+			{Key: "heartbeatAt", Value: now},
+			{Key: "expiresAt", Value: now.Add(fc.cfg.TTL)},
+		}}}
+		var renewed Lease
+		err := fc.col.FindOneAndUpdate(ctx, filter, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&renewed)
+		switch {
+		case err == nil && renewed.Handover != nil && renewed.Handover.Owner != fc.cfg.Owner:
+			log.Infof("failover: %s steps down for %s", fc.cfg.Owner, renewed.Handover.Owner)
+			return leaseHandedOver
+		case err == nil:
+			renewedAt = now
+			continue
+		case errors.Is(err, mongo.ErrNoDocuments):
+			log.Errorf("failover: %s was fenced off, lease epoch %d taken over", fc.cfg.Owner, lease.Epoch)
+			return leaseLost
+		case ctx.Err() != nil:
+			return leaseReleased
+		}
+
+		// stop before the lease can expire, leaving a heartbeat interval of margin
+		log.Errorf("failover: failed to renew lease: %v", err)
+		if now.Sub(renewedAt) >= fc.cfg.TTL-fc.cfg.HeartbeatInterval {
+			return leaseLost
+		}
+	}
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mmtracker/mongowatch/db"
+)
+
+func Test_FailoverCoordinator_StandbyTakesOver(t *testing.T) {
+	requireMongo(t)
+	col := NewCollection("failover_leases", mongoTestsDB)
+	_ = db.Truncate(col, false)
+
+	cfg := LeaseConfig{Name: "stream", TTL: 300 * time.Millisecond, HeartbeatInterval: 50 * time.Millisecond}
+	primaryCfg, standbyCfg := cfg, cfg
+	primaryCfg.Owner, standbyCfg.Owner = "eu", "us"
+	primary := NewFailoverCoordinator(col, primaryCfg)
+	standby := NewFailoverCoordinator(col, standbyCfg)
+
+	primaryStarted := make(chan struct{})
+	primaryCtx, stopPrimary := context.WithCancel(context.Background())
+	go func() {
+		_ = primary.Run(primaryCtx, func(ctx context.Context, epoch int64) error {
+			assert.Equal(t, int64(1), epoch)
+			close(primaryStarted)
+			<-ctx.Done()
+			return nil
+		})
+	}()
+	<-primaryStarted
+
+	standbyEpoch := make(chan int64, 1)
+	go func() {
+		_ = standby.Run(context.Background(), func(ctx context.Context, epoch int64) error {
+			standbyEpoch <- epoch
+			return nil
+		})
+	}()
+
+	select {
+	case <-standbyEpoch:
+		t.Fatal("standby took over while the primary was alive")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// primary goes silent
+	stopPrimary()
+	select {
+	case epoch := <-standbyEpoch:
+		assert.Equal(t, int64(2), epoch)
+	case <-time.After(2 * time.Second):
+		t.Fatal("standby did not take over")
+	}
+}
+
+func Test_FailoverCoordinator_Handover(t *testing.T) {
+	requireMongo(t)
+	col := NewCollection("failover_leases", mongoTestsDB)
+	_ = db.Truncate(col, false)
+
+	cfg := LeaseConfig{Name: "stream", TTL: 10 * time.Second, HeartbeatInterval: 50 * time.Millisecond}
+	oldCfg, newCfg := cfg, cfg
+	oldCfg.Owner, newCfg.Owner = "v1", "v2"
+	previous := NewFailoverCoordinator(col, oldCfg)
+	successor := NewFailoverCoordinator(col, newCfg)
+
+	started := make(chan struct{})
+	previousDone := make(chan error, 1)
+	go func() {
+		previousDone <- previous.Run(context.Background(), func(ctx context.Context, epoch int64) error {
+			close(started)
+			<-ctx.Done()
+			assert.ErrorIs(t, context.Cause(ctx), ErrHandedOver)
+			return nil
+		})
+	}()
+	<-started
+
+	assert.NoError(t, successor.RequestHandover(context.Background()))
+	requested := time.Now()
+	successorEpoch := make(chan int64, 1)
+	go func() {
+		_ = successor.Run(context.Background(), func(ctx context.Context, epoch int64) error {
+			successorEpoch <- epoch
+			<-ctx.Done()
+			return nil
+		})
+	}()
+
+	select {
+	case epoch := <-successorEpoch:
+		assert.Equal(t, int64(2), epoch)
+		// taken over well before the TTL expired
+		assert.Less(t, time.Since(requested), time.Second)
+	case <-time.After(2 * time.Second):
+		t.Fatal("successor did not take over")
+	}
+	assert.ErrorIs(t, <-previousDone, ErrHandedOver)
+
+	lease, err := successor.CurrentLease(context.Background())
+	assert.NoError(t, err)
+	assert.Nil(t, lease.Handover)
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// FailureDump captures a failed event together with the events dispatched right before it,
+// so a handler failure can be reproduced offline with the exact payloads
+type FailureDump struct {
+	FailedAt time.Time                      `bson:"failedAt" json:"failedAt"`
+	Error    string                         `bson:"error" json:"error"`
+	Event    mongowatch.ChangeStreamEvent   `bson:"event" json:"event"`
+	Previous []mongowatch.ChangeStreamEvent `bson:"previous" json:"previous"`
+}
+
+// FailureDumpSink persists failure dumps
+type FailureDumpSink interface {
+	SaveFailureDump(ctx context.Context, dump FailureDump) error
+}
+
+// RecordFailures returns a middleware which remembers the last size dispatched events in a ring buffer
+// and writes them to the sink along with the failing event whenever dispatching fails.
+// Sink errors are logged, the original dispatch error is always returned.
+func RecordFailures(size int, sink FailureDumpSink) mongowatch.ChangeEventMiddleware {
+	ring := &eventRing{events: make([]mongowatch.ChangeStreamEvent, 0, size), size: size}
+
+	return func(next mongowatch.ChangeEventDispatcherFunc) mongowatch.ChangeEventDispatcherFunc {
+		return func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+			err = next(ctx, ce, err)
+			if err == nil {
+				ring.push(ce)
+				return nil
+			}
+
+			dump := FailureDump{
+				FailedAt: time.Now(),
+				Error:    err.Error(),
+				Event:    ce,
+				Previous: ring.snapshot(),
+			}
+			if dumpErr := sink.SaveFailureDump(ctx, dump); dumpErr != nil {
+				logger(ctx).Errorf("failed to save failure dump for event %v: %v", ce.ID.TokenData, dumpErr)
+			}
+
+			return err
+		}
+	}
+}
+
+// eventRing keeps the last size events, oldest first
+type eventRing struct {
+	mu     sync.Mutex
+	events []mongowatch.ChangeStreamEvent
+	size   int
+	next   int
+}
+
+func (r *eventRing) push(ce mongowatch.ChangeStreamEvent) {
+	if r.size <= 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.events) < r.size {
+		r.events = append(r.events, ce)
+		return
+	}
+	r.events[r.next] = ce
+	r.next = (r.next + 1) % r.size
+}
+
+func (r *eventRing) snapshot() []mongowatch.ChangeStreamEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := make([]mongowatch.ChangeStreamEvent, 0, len(r.events))
+	out = append(out, r.events[r.next:]...)
+	return append(out, r.events[:r.next]...)
+}
+
+// MongoFailureDumpSink stores failure dumps in a debug collection
+type MongoFailureDumpSink struct {
+	col *mongo.Collection
+}
+
+var _ FailureDumpSink = (*MongoFailureDumpSink)(nil)
+
+// NewMongoFailureDumpSink creates a sink writing to col
+func NewMongoFailureDumpSink(col *mongo.Collection) *MongoFailureDumpSink {
+	return &MongoFailureDumpSink{col: col}
+}
+
+// SaveFailureDump inserts the dump as a new document
+func (s *MongoFailureDumpSink) SaveFailureDump(ctx context.Context, dump FailureDump) error {
+	_, err := s.col.InsertOne(ctx, dump)
+	if err != nil {
+		return fmt.Errorf("failed to insert failure dump: %w", err)
+	}
+	return nil
+}
+
+// FileFailureDumpSink appends failure dumps to a file as JSON lines
+type FileFailureDumpSink struct {
+	mu   sync.Mutex
+	path string
+}
+
+var _ FailureDumpSink = (*FileFailureDumpSink)(nil)
+
+// NewFileFailureDumpSink creates a sink appending to the file at path
+func NewFileFailureDumpSink(path string) *FileFailureDumpSink {
+	return &FileFailureDumpSink{path: path}
+}
+
+// SaveFailureDump appends the dump as a single JSON line
+func (s *FileFailureDumpSink) SaveFailureDump(_ context.Context, dump FailureDump) error {
+	line, err := json.Marshal(dump)
+	if err != nil {
+		return fmt.Errorf("failed to marshal failure dump: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open failure dump file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write failure dump: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+func Test_RecordFailures_DumpsPreviousEvents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.jsonl")
+	errHandler := errors.New("handler failed")
+
+	dispatch := RecordFailures(2, NewFileFailureDumpSink(path))(func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		if ce.DocumentKey == "fail" {
+			return errHandler
+		}
+		return nil
+	})
+
+	for _, key := range []string{"1", "2", "3", "fail"} {
+		err := dispatch(context.Background(), mongowatch.ChangeStreamEvent{DocumentKey: key, FullDocument: primitive.M{"key": key}}, nil)
+		if key == "fail" {
+			assert.ErrorIs(t, err, errHandler)
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	assert.True(t, scanner.Scan())
+	var dump FailureDump
+	assert.NoError(t, json.Unmarshal(scanner.Bytes(), &dump))
+	assert.Equal(t, "fail", dump.Event.DocumentKey)
+	assert.Equal(t, errHandler.Error(), dump.Error)
+	assert.Len(t, dump.Previous, 2)
+	assert.Equal(t, "2", dump.Previous[0].DocumentKey)
+	assert.Equal(t, "3", dump.Previous[1].DocumentKey)
+	assert.False(t, scanner.Scan())
+}
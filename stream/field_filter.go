@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// WatchOnlyFieldChanges drops update events, on the server side, that don't touch any of the fields.
+// Fields are dotted paths, "billing.paidUntil" matches updates setting or removing billing.paidUntil,
+// any field nested under it, or its parent billing as a whole. Other operation types are not affected.
+func WatchOnlyFieldChanges(fields ...string) WatcherOption {
+	return func(csw *ChangeStreamWatcher) {
+		csw.watchFields = append(csw.watchFields, fields...)
+	}
+}
+
+// fieldChangeStage builds the $match stage letting through non update events and updates touching fields.
+// updatedFields keys are dotted paths themselves, so they are matched as strings via $objectToArray
+// rather than as nested field paths.
+func fieldChangeStage(fields []string) bson.D {
+	regex := fieldPathRegex(fields)
+	touches := func(input interface{}, key string) bson.D {
+		return bson.D{{Key: "$gt", Value: bson.A{
+			bson.D{{Key: "$size", Value: bson.D{{Key: "$filter", Value: bson.D{
+				{Key: "input", Value: bson.D{{Key: "$ifNull", Value: bson.A{input, bson.A{}}}}},
+				{Key: "cond", Value: bson.D{{Key: "$regexMatch", Value: bson.D{
+					{Key: "input", Value: key},
+					{Key: "regex", Value: regex},
+				}}}},
+			}}}}},
+			0,
+		}}}
+	}
+
+	return bson.D{{Key: "$match", Value: bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "operationType", Value: bson.D{{Key: "$ne", Value: "update"}}}},
+		bson.D{{Key: "$expr", Value: bson.D{{Key: "$or", Value: bson.A{
+			touches(bson.D{{Key: "$objectToArray", Value: "$updateDescription.updatedFields"}}, "$$this.k"),
+			touches("$updateDescription.removedFields", "$$this"),
+			touches("$updateDescription.truncatedArrays", "$$this.field"),
+		}}}}},
+	}}}}}
+}
+
+// fieldPathRegex matches the update description paths touching any of the fields:
+// the field itself, one of its parents or anything nested under it
+func fieldPathRegex(fields []string) string {
+	var exact, nested []string
+	for _, field := range fields {
+		parts := strings.Split(field, ".")
+		for i := range parts {
+			exact = append(exact, regexp.QuoteMeta(strings.Join(parts[:i+1], ".")))
+		}
+		nested = append(nested, regexp.QuoteMeta(field)+`\.`)
+	}
+	return "^(?:" + strings.Join(exact, "|") + ")$|^(?:" + strings.Join(nested, "|") + ")"
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFieldPathRegex(t *testing.T) {
+	re := regexp.MustCompile(fieldPathRegex([]string{"status", "billing.paidUntil"}))
+
+	for path, want := range map[string]bool{
+		"status":                 true,
+		"status.reason":          true,
+		"statusText":             false,
+		"billing":                true,
+		"billing.paidUntil":      true,
+		"billing.paidUntil.date": true,
+		"billing.plan":           false,
+		"billing.paidUntilX":     false,
+		"name":                   false,
+	} {
+		assert.Equal(t, want, re.MatchString(path), path)
+	}
+}
+
+func TestWatchOnlyFieldChanges_Pipeline(t *testing.T) {
+	csw := NewChangeStreamWatcher(nil,
+		WithNamespaceFilter(NamespaceFilter{Allow: []string{"app"}}),
+		WatchOnlyFieldChanges("paidUntil"),
+	)
+
+	pipeline := csw.pipeline()
+	assert.Len(t, pipeline, len(buildPipeline())+2)
+	// the raw updateDescription is matched before the events are reshaped
+	assert.Equal(t, fieldChangeStage([]string{"paidUntil"}), pipeline[1])
+
+	assert.Len(t, NewChangeStreamWatcher(nil).pipeline(), len(buildPipeline()))
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// FileResume is a mongowatch.StreamResume keeping the last resume point in a file, for edge deployments without
+// a local database. Points are written as extended JSON to a temporary file, synced and renamed over the previous
+// one, so a crash leaves either the old or the new point on disk. It is safe for concurrent use within a process;
+// the file must not be shared by several processes.
+type FileResume struct {
+	mu   sync.Mutex
+	path string
+}
+
+var _ mongowatch.StreamResume = (*FileResume)(nil)
+
+// NewFileResume creates a resume store writing to path, the directory is created if missing
+func NewFileResume(path string) (*FileResume, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create resume point directory: %w", err)
+	}
+	// leftovers of a write interrupted by a crash, the point they held was never confirmed
+	_ = os.Remove(path + ".tmp")
+	return &FileResume{path: path}, nil
+}
+
+// Path returns the file holding the resume point
+func (r *FileResume) Path() string {
+	return r.path
+}
+
+// GetResumePoint reads the stored point, mongo.ErrNoDocuments without one like ResumeRepository
+func (r *FileResume) GetResumePoint() (*mongowatch.ChangeStreamResumePoint, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.read()
+}
+
+func (r *FileResume) read() (*mongowatch.ChangeStreamResumePoint, error) {
+	data, err := os.ReadFile(r.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("no resume point stored in %s: %w", r.path, mongo.ErrNoDocuments)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read resume point file: %w", err)
+	}
+	point := &mongowatch.ChangeStreamResumePoint{}
+	if err := bson.UnmarshalExtJSON(data, true, point); err != nil {
+		return nil, fmt.Errorf("failed to decode resume point file %s: %w", r.path, err)
+	}
+	return point, nil
+}
+
+// GetResumeTime returns the timestamp of the stored point
+func (r *FileResume) GetResumeTime() (*primitive.Timestamp, error) {
+	point, err := r.GetResumePoint()
+	if err != nil {
+		return nil, err
+	}
+	return &point.Timestamp, nil
+}
+
+// SaveResumePoint atomically replaces the stored point
+func (r *FileResume) SaveResumePoint(ctx context.Context, ce mongowatch.ChangeStreamResumePoint) error {
+	ce.StoredAt = time.Now()
+	ce.SchemaVersion = ResumePointSchemaVersion
+	data, err := bson.MarshalExtJSONIndent(ce, true, false, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode resume point: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.write(data)
+}
+
+// write replaces the file with data through a synced temporary file and a rename
+func (r *FileResume) write(data []byte) error {
+	tmp := r.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create resume point file: %w", err)
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to write resume point file: %w", err)
+	}
+	if err := os.Rename(tmp, r.path); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to replace resume point file: %w", err)
+	}
+	return r.syncDir()
+}
+
+// syncDir persists the rename, without it a crash may bring the previous file back
+func (r *FileResume) syncDir() error {
+	dir, err := os.Open(filepath.Dir(r.path))
+	if err != nil {
+		return fmt.Errorf("failed to open resume point directory: %w", err)
+	}
+	defer dir.Close()
+	// some platforms, e.g. windows, can't sync directories; the rename is still atomic there
+	if err := dir.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		return fmt.Errorf("failed to sync resume point directory: %w", err)
+	}
+	return nil
+}
+
+// DeleteResumePoint removes the stored point if it has the token, saving replaced older ones already
+func (r *FileResume) DeleteResumePoint(ctx context.Context, token mongowatch.ResumeToken) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	point, err := r.read()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fmt.Sprint(point.ID.TokenData) != fmt.Sprint(token.TokenData) {
+		return nil
+	}
+	if err := os.Remove(r.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete resume point file: %w", err)
+	}
+	return r.syncDir()
+}
+
+// ReplaceResumePoints replaces the stored point
+func (r *FileResume) ReplaceResumePoints(ctx context.Context, ce mongowatch.ChangeStreamResumePoint) error {
+	return r.SaveResumePoint(ctx, ce)
+}
+
+// Describe summarizes the stored point
+func (r *FileResume) Describe(ctx context.Context) (*mongowatch.ResumePointInfo, error) {
+	point, err := r.GetResumePoint()
+	if err != nil {
+		return nil, err
+	}
+	info := point.Describe(time.Now())
+	return &info, nil
+}
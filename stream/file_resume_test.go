@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+func Test_FileResume(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "edge", "resume.json")
+	r, err := NewFileResume(path)
+	require.NoError(t, err)
+	_, err = r.GetResumePoint()
+	assert.ErrorIs(t, err, mongo.ErrNoDocuments)
+
+	first := mongowatch.ChangeStreamResumePoint{ID: mongowatch.ResumeToken{TokenData: "82aa"}, Timestamp: primitive.Timestamp{T: 10, I: 2}}
+	next := mongowatch.ChangeStreamResumePoint{
+		ID:            mongowatch.ResumeToken{TokenData: "82bb"},
+		Timestamp:     primitive.Timestamp{T: 11},
+		OperationType: "update",
+		Epoch:         3,
+		SinkOffset:    "kafka:42",
+	}
+	require.NoError(t, r.SaveResumePoint(ctx, first))
+	require.NoError(t, r.SaveResumePoint(ctx, next))
+	// the watcher deletes the previous point after saving the next one
+	require.NoError(t, r.DeleteResumePoint(ctx, first.ID))
+
+	// a new process reads the point back from disk
+	r, err = NewFileResume(path)
+	require.NoError(t, err)
+	point, err := r.GetResumePoint()
+	require.NoError(t, err)
+	assert.Equal(t, "82bb", point.ID.TokenData)
+	assert.Equal(t, primitive.Timestamp{T: 11}, point.Timestamp)
+	assert.Equal(t, int64(3), point.Epoch)
+	assert.Equal(t, "kafka:42", point.SinkOffset)
+	assert.Equal(t, ResumePointSchemaVersion, point.SchemaVersion)
+	assert.False(t, point.StoredAt.IsZero())
+
+	_, err = os.Stat(path + ".tmp")
+	assert.ErrorIs(t, err, os.ErrNotExist, "temporary file left behind")
+
+	require.NoError(t, r.DeleteResumePoint(ctx, next.ID))
+	_, err = r.Describe(ctx)
+	assert.ErrorIs(t, err, mongo.ErrNoDocuments)
+	require.NoError(t, r.DeleteResumePoint(ctx, next.ID))
+}
+
+func Test_FileResume_InterruptedWrite(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "resume.json")
+	r, err := NewFileResume(path)
+	require.NoError(t, err)
+	require.NoError(t, r.SaveResumePoint(ctx, mongowatch.ChangeStreamResumePoint{ID: mongowatch.ResumeToken{TokenData: "82aa"}}))
+
+	// a crash during the next save leaves a partial temporary file, the stored point is untouched
+	require.NoError(t, os.WriteFile(path+".tmp", []byte(`{"_id": {"_da`), 0o644))
+	r, err = NewFileResume(path)
+	require.NoError(t, err)
+	point, err := r.GetResumePoint()
+	require.NoError(t, err)
+	assert.Equal(t, "82aa", point.ID.TokenData)
+
+	require.NoError(t, os.WriteFile(path, []byte("garbage"), 0o644))
+	_, err = r.GetResumePoint()
+	assert.ErrorContains(t, err, "failed to decode resume point file")
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// FilterReloader holds a NamespaceFilter that can be replaced while the watcher runs.
+// A watcher configured WithFilterReloader picks up a new filter between two events: the
+// cursor is closed after the last event was fully processed and checkpointed, then reopened
+// after its resume token with the new $match stage, so no event is skipped or replayed.
+type FilterReloader struct {
+	mu      sync.Mutex
+	filter  NamespaceFilter
+	changed chan struct{}
+}
+
+// NewFilterReloader creates a reloader starting with the initial filter
+func NewFilterReloader(initial NamespaceFilter) *FilterReloader {
+	return &FilterReloader{filter: initial, changed: make(chan struct{})}
+}
+
+// Set replaces the filter and signals watchers to reopen their cursors
+func (r *FilterReloader) Set(filter NamespaceFilter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.filter = filter
+	close(r.changed)
+	r.changed = make(chan struct{})
+	log.Tracef("namespace filter reloaded: %+v", filter)
+}
+
+// Filter returns the current filter
+func (r *FilterReloader) Filter() NamespaceFilter {
+	f, _ := r.current()
+	return f
+}
+
+// current returns the filter together with a channel closed on its next change
+func (r *FilterReloader) current() (NamespaceFilter, <-chan struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.filter, r.changed
+}
+
+// Poll calls source every interval and applies the returned filter, until ctx is done.
+// Source errors are logged and the current filter is kept.
+func (r *FilterReloader) Poll(ctx context.Context, interval time.Duration, source func(ctx context.Context) (NamespaceFilter, bool, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		filter, changed, err := source(ctx)
+		if err != nil {
+			log.Errorf("failed to reload namespace filter: %v", err)
+			continue
+		}
+		if changed {
+			r.Set(filter)
+		}
+	}
+}
+
+// WatchFile reloads the filter whenever the modification time of the file at path changes,
+// parse turns the file content into a filter, e.g. by unmarshalling YAML
+func (r *FilterReloader) WatchFile(ctx context.Context, path string, interval time.Duration, parse func([]byte) (NamespaceFilter, error)) {
+	var modTime time.Time
+	if info, err := os.Stat(path); err == nil {
+		modTime = info.ModTime()
+	}
+
+	r.Poll(ctx, interval, func(ctx context.Context) (NamespaceFilter, bool, error) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return NamespaceFilter{}, false, fmt.Errorf("failed to stat filter file: %w", err)
+		}
+		if info.ModTime().Equal(modTime) {
+			return NamespaceFilter{}, false, nil
+		}
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return NamespaceFilter{}, false, fmt.Errorf("failed to read filter file: %w", err)
+		}
+		filter, err := parse(raw)
+		if err != nil {
+			return NamespaceFilter{}, false, fmt.Errorf("failed to parse filter file %s: %w", path, err)
+		}
+		modTime = info.ModTime()
+		return filter, true, nil
+	})
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterReloaderSignalsChange(t *testing.T) {
+	r := NewFilterReloader(NamespaceFilter{Allow: []string{"app.users"}})
+	csw := NewChangeStreamWatcher(nil, WithFilterReloader(r))
+	changed := csw.filterChanged()
+
+	r.Set(NamespaceFilter{Deny: []string{"app.tmp_*"}})
+
+	select {
+	case <-changed:
+	default:
+		t.Fatal("reload was not signalled")
+	}
+	assert.Equal(t, []string{"app.tmp_*"}, r.Filter().Deny)
+	assert.Equal(t, r.Filter().Stage(), csw.pipeline()[0])
+
+	// the reload context is what interrupts the waiting cursor
+	ctx, cancel := reloadContext(context.Background(), csw.filterChanged())
+	defer cancel()
+	r.Set(NamespaceFilter{})
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("reload context was not cancelled")
+	}
+	assert.Len(t, csw.pipeline(), len(buildPipeline()))
+}
+
+func TestFilterReloaderWatchFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filter")
+	require.NoError(t, os.WriteFile(path, []byte("app.users"), 0o600))
+
+	r := NewFilterReloader(NamespaceFilter{Allow: []string{"app.users"}})
+	_, changed := r.current()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.WatchFile(ctx, path, 5*time.Millisecond, func(raw []byte) (NamespaceFilter, error) {
+		return NamespaceFilter{Allow: strings.Split(string(raw), ",")}, nil
+	})
+
+	// let the watcher record the initial modification time
+	time.Sleep(20 * time.Millisecond)
+	later := time.Now().Add(time.Second)
+	require.NoError(t, os.WriteFile(path, []byte("app.users,app.orders"), 0o600))
+	require.NoError(t, os.Chtimes(path, later, later))
+
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Fatal("file change was not picked up")
+	}
+	assert.Equal(t, []string{"app.users", "app.orders"}, r.Filter().Allow)
+}
@@ -0,0 +1,180 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// GapKind tells what made a gap suspicious
+type GapKind string
+
+const (
+	// GapClusterTime is a jump between the cluster times of consecutive events, or between the resume point
+	// and the first event after a restart, larger than GapConfig.MaxGap
+	GapClusterTime GapKind = "clusterTime"
+	// GapOplog is a resume point older than the first oplog entry, events in between are gone
+	GapOplog GapKind = "oplog"
+)
+
+// Gap describes a suspicious hole in the sequence of cluster times
+type Gap struct {
+	Kind GapKind `json:"kind"`
+	// From is the cluster time of the last event seen, or of the resume point, To of the next one seen
+	From primitive.Timestamp `json:"from"`
+	To   primitive.Timestamp `json:"to"`
+	// OplogStart is the first oplog entry, only set for GapOplog
+	OplogStart primitive.Timestamp `json:"oplogStart,omitempty"`
+}
+
+// Duration is the wall clock time covered by the gap
+func (g Gap) Duration() time.Duration {
+	return time.Duration(int64(g.To.T)-int64(g.From.T)) * time.Second
+}
+
+// GapConfig configures gap detection
+type GapConfig struct {
+	// MaxGap reports consecutive events further apart, zero disables the check.
+	// Idle collections have legitimate gaps, so it should be well above the expected quiet periods.
+	MaxGap time.Duration
+	// OplogStart returns the cluster time of the first oplog entry, see OplogStart.
+	// When set, resume points are checked against it whenever the stream starts.
+	OplogStart func(ctx context.Context) (primitive.Timestamp, error)
+	// OnGap is called for every gap detected, it must not block
+	OnGap func(ctx context.Context, gap Gap)
+}
+
+// GapDetector tracks the cluster times of dispatched events and reports suspicious gaps,
+// e.g. a restart resuming beyond the oplog, so silent data loss becomes visible.
+// Register it with WithGapDetection.
+type GapDetector struct {
+	cfg GapConfig
+
+	mu   sync.Mutex
+	last primitive.Timestamp
+
+	gaps atomic.Uint64
+}
+
+// NewGapDetector creates a gap detector
+func NewGapDetector(cfg GapConfig) *GapDetector {
+	return &GapDetector{cfg: cfg}
+}
+
+// Gaps counts the gaps detected so far
+func (d *GapDetector) Gaps() uint64 {
+	return d.gaps.Load()
+}
+
+// WithGapDetection checks the resume point against the oplog on every Watch and reports gaps between events
+// to the detector, Stats.Gaps counts them
+func WithGapDetection(detector *GapDetector) ManagerOption {
+	return func(m *Manager) {
+		m.gaps = detector
+		m.middlewares = append(m.middlewares, detector.Middleware())
+	}
+}
+
+// Middleware returns the middleware comparing the cluster time of every event with the previous one
+func (d *GapDetector) Middleware() mongowatch.ChangeEventMiddleware {
+	return func(next mongowatch.ChangeEventDispatcherFunc) mongowatch.ChangeEventDispatcherFunc {
+		return func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+			d.observe(ctx, ce.Timestamp)
+			return next(ctx, ce, err)
+		}
+	}
+}
+
+// observe compares ts with the last cluster time seen, replays after a retry go back in time and aren't gaps
+func (d *GapDetector) observe(ctx context.Context, ts primitive.Timestamp) {
+	d.mu.Lock()
+	from := d.last
+	if from.IsZero() || ts.After(from) {
+		d.last = ts
+	}
+	d.mu.Unlock()
+
+	if d.cfg.MaxGap <= 0 || from.IsZero() || !ts.After(from) {
+		return
+	}
+	gap := Gap{Kind: GapClusterTime, From: from, To: ts}
+	if gap.Duration() > d.cfg.MaxGap {
+		d.report(ctx, gap)
+	}
+}
+
+// start resets the sequence to the resume point the stream starts from and checks it against the oplog
+func (d *GapDetector) start(ctx context.Context, rp *mongowatch.ChangeStreamResumePoint) {
+	var from primitive.Timestamp
+	if rp != nil {
+		from = rp.Timestamp
+	}
+	d.mu.Lock()
+	d.last = from
+	d.mu.Unlock()
+
+	if d.cfg.OplogStart == nil || from.IsZero() {
+		return
+	}
+	first, err := d.cfg.OplogStart(ctx)
+	if err != nil {
+		logger(ctx).Warnf("failed to check resume point against the oplog: %v", err)
+		return
+	}
+	if from.Before(first) {
+		d.report(ctx, Gap{Kind: GapOplog, From: from, To: first, OplogStart: first})
+		// the hole up to the oplog start is reported, the first event is compared with the oplog start
+		d.mu.Lock()
+		d.last = first
+		d.mu.Unlock()
+	}
+}
+
+func (d *GapDetector) report(ctx context.Context, gap Gap) {
+	d.gaps.Add(1)
+	logger(ctx).Warnf("gap detected in change stream (%s): from %d.%d to %d.%d, %v", gap.Kind, gap.From.T, gap.From.I, gap.To.T, gap.To.I, gap.Duration())
+	if d.cfg.OnGap != nil {
+		d.cfg.OnGap(ctx, gap)
+	}
+}
+
+// OplogStart returns a GapConfig.OplogStart reading the first entry of the replica set oplog with client
+func OplogStart(client *mongo.Client) func(ctx context.Context) (primitive.Timestamp, error) {
+	return func(ctx context.Context) (primitive.Timestamp, error) {
+		var first struct {
+			TS primitive.Timestamp `bson:"ts"`
+		}
+		opts := options.FindOne().SetSort(bson.D{{Key: "$natural", Value: 1}}).SetProjection(bson.D{{Key: "ts", Value: 1}})
+		err := client.Database("local").Collection("oplog.rs").FindOne(ctx, bson.D{}, opts).Decode(&first)
+		if err != nil {
+			return primitive.Timestamp{}, fmt.Errorf("failed to read oplog start: %w", err)
+		}
+		return first.TS, nil
+	}
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+func Test_GapDetector(t *testing.T) {
+	var gaps []Gap
+	d := NewGapDetector(GapConfig{
+		MaxGap: time.Minute,
+		OplogStart: func(ctx context.Context) (primitive.Timestamp, error) {
+			return primitive.Timestamp{T: 1000}, nil
+		},
+		OnGap: func(ctx context.Context, gap Gap) { gaps = append(gaps, gap) },
+	})
+	dispatch := d.Middleware()(func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error { return err })
+	event := func(t uint32) mongowatch.ChangeStreamEvent {
+		return mongowatch.ChangeStreamEvent{Timestamp: primitive.Timestamp{T: t}}
+	}
+	ctx := context.Background()
+
+	d.start(ctx, &mongowatch.ChangeStreamResumePoint{Timestamp: primitive.Timestamp{T: 1100}})
+	for _, ts := range []uint32{1110, 1120, 1120, 1115, 1300} {
+		assert.NoError(t, dispatch(ctx, event(ts), nil))
+	}
+	if assert.Len(t, gaps, 1) {
+		assert.Equal(t, Gap{Kind: GapClusterTime, From: primitive.Timestamp{T: 1120}, To: primitive.Timestamp{T: 1300}}, gaps[0])
+		assert.Equal(t, 180*time.Second, gaps[0].Duration())
+	}
+
+	// restarting from a point the oplog no longer covers
+	d.start(ctx, &mongowatch.ChangeStreamResumePoint{Timestamp: primitive.Timestamp{T: 900}})
+	if assert.Len(t, gaps, 2) {
+		assert.Equal(t, GapOplog, gaps[1].Kind)
+		assert.Equal(t, primitive.Timestamp{T: 1000}, gaps[1].OplogStart)
+	}
+	// the first event after the restart isn't reported a second time
+	assert.NoError(t, dispatch(ctx, event(1010), nil))
+	assert.Len(t, gaps, 2)
+	assert.EqualValues(t, 2, d.Gaps())
+
+	// starting without a resume point has nothing to compare with
+	d.start(ctx, nil)
+	assert.NoError(t, dispatch(ctx, event(5000), nil))
+	assert.EqualValues(t, 2, d.Gaps())
+}
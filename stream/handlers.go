@@ -21,8 +21,6 @@ import (
 	"context"
 	"fmt"
 
-	log "github.com/sirupsen/logrus"
-
 	"github.com/mmtracker/mongowatch"
 )
 
@@ -36,7 +34,7 @@ func GetSaveResumePointFunc(streamResumeRepo mongowatch.StreamResume) mongowatch
 		//     cse.Database,
 		//     cse.DocumentKey,
 		// )
-		log.Tracef("saving resume point: %d", cse.Timestamp.T)
+		eventLogf(ctx, "saving resume point: %d", cse.Timestamp.T)
 		point := mongowatch.ChangeStreamResumePoint{
 			ID:            cse.ID,
 			Timestamp:     cse.Timestamp,
@@ -56,16 +54,16 @@ func GetSaveResumePointFunc(streamResumeRepo mongowatch.StreamResume) mongowatch
 func GetDeleteResumePointFunc(resumeTokenRepo mongowatch.StreamResume) mongowatch.ChangeEventDispatcherFunc {
 	return func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
 		if err != nil {
-			log.Errorf("failed to delete resume point: %s", err.Error())
+			logger(ctx).Errorf("failed to delete resume point: %s", err.Error())
 			return err
 		}
 
 		err = resumeTokenRepo.DeleteResumePoint(ctx, ce.ID)
 		if err != nil {
-			log.Errorf("failed to delete resume point ID %v: %v\n", ce.ID.TokenData, err)
+			logger(ctx).Errorf("failed to delete resume point ID %v: %v\n", ce.ID.TokenData, err)
 			return err
 		}
-		log.Tracef("deleted resume point: %d", ce.Timestamp.T)
+		eventLogf(ctx, "deleted resume point: %d", ce.Timestamp.T)
 
 		return nil
 	}
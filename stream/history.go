@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// historyDayLayout is the layout of the day partition field
+const historyDayLayout = "2006-01-02"
+
+// HistoryRecord is a processed event kept in the history, partitioned by the UTC day of its cluster time
+type HistoryRecord struct {
+	ID          primitive.ObjectID           `bson:"_id,omitempty" json:"id"`
+	Day         string                       `bson:"day" json:"day"`
+	DocumentKey string                       `bson:"documentKey" json:"documentKey"`
+	ClusterTime primitive.Timestamp          `bson:"clusterTime" json:"clusterTime"`
+	Event       mongowatch.ChangeStreamEvent `bson:"event" json:"event"`
+	RecordedAt  time.Time                    `bson:"recordedAt" json:"recordedAt"`
+}
+
+// EventHistory keeps processed events to answer what changed and when
+type EventHistory interface {
+	// Record stores a processed event
+	Record(ctx context.Context, ce mongowatch.ChangeStreamEvent) error
+	// EventsFor returns the events of the documentKey with a cluster time in [from, to), oldest first
+	EventsFor(ctx context.Context, documentKey string, from, to time.Time) ([]HistoryRecord, error)
+	// EventsOn returns the events of the day partition containing day, oldest first
+	EventsOn(ctx context.Context, day time.Time) ([]HistoryRecord, error)
+}
+
+// History returns a middleware recording every successfully dispatched event in the history
+func History(history EventHistory) mongowatch.ChangeEventMiddleware {
+	return func(next mongowatch.ChangeEventDispatcherFunc) mongowatch.ChangeEventDispatcherFunc {
+		return func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+			if err = next(ctx, ce, err); err != nil {
+				return err
+			}
+			if rErr := history.Record(ctx, ce); rErr != nil {
+				return fmt.Errorf("failed to record event history: %w", rErr)
+			}
+			return nil
+		}
+	}
+}
+
+// historyDay returns the day partition of a cluster time
+func historyDay(ts primitive.Timestamp) string {
+	return time.Unix(int64(ts.T), 0).UTC().Format(historyDayLayout)
+}
+
+// clusterTimeOf converts a wall clock time into the first cluster time of its second
+func clusterTimeOf(t time.Time) primitive.Timestamp {
+	return primitive.Timestamp{T: uint32(t.Unix())}
+}
+
+// MongoHistory stores the history in a collection partitioned by a day field,
+// records expire retention after they were recorded
+type MongoHistory struct {
+	col       *mongo.Collection
+	retention time.Duration
+}
+
+var _ EventHistory = (*MongoHistory)(nil)
+
+// NewMongoHistory creates a history in col, call EnsureIndexes once to enable the queries and expiry
+func NewMongoHistory(col *mongo.Collection, retention time.Duration) *MongoHistory {
+	return &MongoHistory{col: col, retention: retention}
+}
+
+// EnsureIndexes creates the query indexes and, with a retention, the TTL index removing expired records
+func (h *MongoHistory) EnsureIndexes(ctx context.Context) error {
+	models := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "documentKey", Value: 1}, {Key: "clusterTime", Value: 1}}},
+		{Keys: bson.D{{Key: "day", Value: 1}, {Key: "clusterTime", Value: 1}}},
+	}
+	if h.retention > 0 {
+		models = append(models, mongo.IndexModel{
+			Keys:    bson.D{{Key: "recordedAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(h.retention.Seconds())),
+		})
+	}
+	_, err := h.col.Indexes().CreateMany(ctx, models)
+	if err != nil {
+		return fmt.Errorf("failed to create history indexes: %w", err)
+	}
+	return nil
+}
+
+// Record stores the event in the partition of its cluster time
+func (h *MongoHistory) Record(ctx context.Context, ce mongowatch.ChangeStreamEvent) error {
+	_, err := h.col.InsertOne(ctx, HistoryRecord{
+		Day:         historyDay(ce.Timestamp),
+		DocumentKey: ce.DocumentKey,
+		ClusterTime: ce.Timestamp,
+		Event:       ce,
+		RecordedAt:  time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save history record: %w", err)
+	}
+	return nil
+}
+
+// EventsFor queries the events of documentKey in the time range
+func (h *MongoHistory) EventsFor(ctx context.Context, documentKey string, from, to time.Time) ([]HistoryRecord, error) {
+	return h.find(ctx, bson.M{
+		"documentKey": documentKey,
+		"clusterTime": bson.M{"$gte": clusterTimeOf(from), "$lt": clusterTimeOf(to)},
+	})
+}
+
+// EventsOn queries the events of a single day
+func (h *MongoHistory) EventsOn(ctx context.Context, day time.Time) ([]HistoryRecord, error) {
+	return h.find(ctx, bson.M{"day": day.UTC().Format(historyDayLayout)})
+}
+
+func (h *MongoHistory) find(ctx context.Context, filter bson.M) ([]HistoryRecord, error) {
+	cursor, err := h.col.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "clusterTime", Value: 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query history: %w", err)
+	}
+	var records []HistoryRecord
+	if err = cursor.All(ctx, &records); err != nil {
+		return nil, fmt.Errorf("failed to decode history records: %w", err)
+	}
+	return records, nil
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+type memoryHistory struct {
+	records []HistoryRecord
+}
+
+func (m *memoryHistory) Record(ctx context.Context, ce mongowatch.ChangeStreamEvent) error {
+	m.records = append(m.records, HistoryRecord{Day: historyDay(ce.Timestamp), DocumentKey: ce.DocumentKey, ClusterTime: ce.Timestamp, Event: ce})
+	return nil
+}
+
+func (m *memoryHistory) EventsFor(ctx context.Context, documentKey string, from, to time.Time) ([]HistoryRecord, error) {
+	var records []HistoryRecord
+	for _, r := range m.records {
+		if r.DocumentKey == documentKey && !r.ClusterTime.Before(clusterTimeOf(from)) && r.ClusterTime.Before(clusterTimeOf(to)) {
+			records = append(records, r)
+		}
+	}
+	return records, nil
+}
+
+func (m *memoryHistory) EventsOn(ctx context.Context, day time.Time) ([]HistoryRecord, error) {
+	var records []HistoryRecord
+	for _, r := range m.records {
+		if r.Day == day.UTC().Format(historyDayLayout) {
+			records = append(records, r)
+		}
+	}
+	return records, nil
+}
+
+func TestHistoryRecordsProcessedEvents(t *testing.T) {
+	history := &memoryHistory{}
+	fail := errors.New("handler failed")
+	dispatch := History(history)(func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		if ce.OperationType == "delete" {
+			return fail
+		}
+		return nil
+	})
+
+	day := time.Date(2023, 5, 1, 23, 59, 0, 0, time.UTC)
+	event := func(op string, at time.Time) mongowatch.ChangeStreamEvent {
+		return mongowatch.ChangeStreamEvent{DocumentKey: "a", OperationType: op, Timestamp: primitive.Timestamp{T: uint32(at.Unix())}}
+	}
+	ctx := context.Background()
+	assert.NoError(t, dispatch(ctx, event("insert", day), nil))
+	assert.NoError(t, dispatch(ctx, event("update", day.Add(2*time.Minute)), nil))
+	assert.ErrorIs(t, dispatch(ctx, event("delete", day.Add(3*time.Minute)), nil), fail)
+
+	assert.Len(t, history.records, 2)
+	assert.Equal(t, "2023-05-01", history.records[0].Day)
+	assert.Equal(t, "2023-05-02", history.records[1].Day)
+
+	records, _ := history.EventsFor(ctx, "a", day, day.Add(time.Minute))
+	assert.Len(t, records, 1)
+	records, _ = history.EventsOn(ctx, day.Add(time.Hour))
+	assert.Len(t, records, 1)
+	assert.Equal(t, "update", records[0].Event.OperationType)
+}
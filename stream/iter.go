@@ -0,0 +1,85 @@
+//go:build go1.23
+
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"iter"
+
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// All watches the stream like Watch, yielding every event to the range loop instead of to handlers.
+// An event is handled once the loop body for it returns, so the resume bookkeeping stays the same as for handlers,
+// and breaking out of the loop stops the watcher after the current event.
+// A watcher failure is yielded as the last element with a zero event.
+//
+//	for ev, err := range m.All(ctx) {
+//		if err != nil {
+//			return err
+//		}
+//		...
+//	}
+func (m *Manager) All(ctx context.Context) iter.Seq2[mongowatch.ChangeStreamEvent, error] {
+	return func(yield func(mongowatch.ChangeStreamEvent, error) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		events := make(chan mongowatch.ChangeStreamEvent)
+		handled := make(chan struct{})
+		watchErr := make(chan error, 1)
+		go func() {
+			watchErr <- m.Watch(ctx, options.UpdateLookup, nil, func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+				select {
+				case events <- ce:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				// the watcher moves on once the loop body is done with the event
+				select {
+				case <-handled:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+		}()
+
+		for {
+			select {
+			case ce := <-events:
+				more := yield(ce, nil)
+				handled <- struct{}{}
+				if !more {
+					cancel()
+					<-watchErr
+					return
+				}
+			case err := <-watchErr:
+				if err != nil {
+					yield(mongowatch.ChangeStreamEvent{}, err)
+				}
+				return
+			}
+		}
+	}
+}
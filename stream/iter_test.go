@@ -0,0 +1,91 @@
+//go:build go1.23
+
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// sliceWatcher dispatches a fixed list of events, then fails with err
+type sliceWatcher struct {
+	events []mongowatch.ChangeStreamEvent
+	err    error
+}
+
+func (w sliceWatcher) Start(ctx context.Context, _ options.FullDocument, _ *mongowatch.ChangeStreamResumePoint, _, _ mongowatch.ChangeEventDispatcherFunc, dispatchFuncs ...mongowatch.ChangeEventDispatcherFunc) error {
+	for _, ce := range w.events {
+		if err := dispatchChain(ctx, ce, dispatchFuncs); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return w.err
+}
+
+func iterEvents(n int) []mongowatch.ChangeStreamEvent {
+	events := make([]mongowatch.ChangeStreamEvent, n)
+	for i := range events {
+		events[i] = mongowatch.ChangeStreamEvent{Timestamp: primitive.Timestamp{T: uint32(i + 1)}}
+	}
+	return events
+}
+
+func Test_Manager_All(t *testing.T) {
+	fail := errors.New("stream failed")
+	m := NewManager(emptyResume{}, sliceWatcher{events: iterEvents(3), err: fail}, nil, nil)
+
+	var seen []uint32
+	var last error
+	for ev, err := range m.All(context.Background()) {
+		if err != nil {
+			last = err
+			continue
+		}
+		seen = append(seen, ev.Timestamp.T)
+	}
+
+	assert.Equal(t, []uint32{1, 2, 3}, seen)
+	assert.ErrorIs(t, last, fail)
+}
+
+func Test_Manager_AllBreak(t *testing.T) {
+	m := NewManager(emptyResume{}, sliceWatcher{events: iterEvents(5)}, nil, nil)
+
+	var seen []uint32
+	for ev, err := range m.All(context.Background()) {
+		assert.NoError(t, err)
+		seen = append(seen, ev.Timestamp.T)
+		if len(seen) == 2 {
+			break
+		}
+	}
+
+	assert.Equal(t, []uint32{1, 2}, seen)
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"strings"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// KeyExtractor derives the logical key of an event, ok is false when the event doesn't carry it
+type KeyExtractor func(ce mongowatch.ChangeStreamEvent) (key string, ok bool)
+
+// KeyFields returns a KeyExtractor joining the values of the fields (dotted paths) with "|", e.g. "acme|INV-42"
+// for KeyFields("tenant", "invoiceNo"). The fields are read from the full document, or the pre-image for deletes,
+// so deletes only carry the key when pre-images are enabled, see WithPreImage.
+func KeyFields(paths ...string) KeyExtractor {
+	return func(ce mongowatch.ChangeStreamEvent) (string, bool) {
+		doc := eventDocument(ce)
+		if doc == nil || len(paths) == 0 {
+			return "", false
+		}
+		parts := make([]string, len(paths))
+		for i, path := range paths {
+			v, ok := mongowatch.LookupField(doc, path)
+			if !ok || v == nil {
+				return "", false
+			}
+			parts[i] = documentKeyString(v)
+		}
+		return strings.Join(parts, "|"), true
+	}
+}
+
+// WithKeyExtractor sets the logical key of every event (ChangeStreamEvent.Key) before middlewares and handlers
+// see it, KeyProgress and Sampler then order and partition by it instead of the documentKey.
+// Events the extractor can't derive the key of keep the documentKey as their logical key.
+func WithKeyExtractor(extractor KeyExtractor) ManagerOption {
+	return func(m *Manager) {
+		m.keyExtractor = extractor
+	}
+}
+
+// withKeys sets the logical key of the event and refreshes the event metadata of the context
+func withKeys(next mongowatch.ChangeEventDispatcherFunc, extractor KeyExtractor) mongowatch.ChangeEventDispatcherFunc {
+	return func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		if ce.OperationType == mongowatch.OperationTypeInvalidate {
+			return next(ctx, ce, err)
+		}
+		key, ok := extractor(ce)
+		if !ok {
+			eventLogf(ctx, "no key derived for event %v, using documentKey %s", ce.ID.TokenData, ce.DocumentKey)
+			return next(ctx, ce, err)
+		}
+		ce.Key = key
+		return next(mongowatch.ContextWithEvent(ctx, ce), ce, err)
+	}
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+func TestKeyFields(t *testing.T) {
+	extract := KeyFields("tenant", "invoice.no")
+
+	key, ok := extract(mongowatch.ChangeStreamEvent{
+		OperationType: "update",
+		FullDocument:  primitive.M{"tenant": "acme", "invoice": primitive.M{"no": int32(42)}},
+	})
+	assert.True(t, ok)
+	assert.Equal(t, "acme|42", key)
+
+	key, ok = extract(mongowatch.ChangeStreamEvent{
+		OperationType:            "delete",
+		FullDocumentBeforeChange: primitive.M{"tenant": "acme", "invoice": primitive.M{"no": int32(42)}},
+	})
+	assert.True(t, ok)
+	assert.Equal(t, "acme|42", key)
+
+	_, ok = extract(mongowatch.ChangeStreamEvent{OperationType: "delete", DocumentKey: "d1"})
+	assert.False(t, ok)
+	_, ok = extract(mongowatch.ChangeStreamEvent{OperationType: "insert", FullDocument: primitive.M{"tenant": "acme"}})
+	assert.False(t, ok)
+}
+
+func Test_Manager_KeyExtractor(t *testing.T) {
+	store := memoryKeyProgress{}
+	var keys []string
+	m := NewManager(nil, nil, nil, nil,
+		WithKeyExtractor(KeyFields("tenant", "no")),
+		WithMiddleware(KeyProgress(store)),
+	)
+	dispatch := m.buildDispatcher([]mongowatch.ChangeEventDispatcherFunc{
+		func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+			meta, _ := mongowatch.EventMetaFromContext(ctx)
+			keys = append(keys, ce.LogicalKey()+"/"+meta.Key)
+			return nil
+		},
+	})
+
+	ctx := context.Background()
+	event := func(docKey string, t uint32, doc primitive.M) mongowatch.ChangeStreamEvent {
+		return mongowatch.ChangeStreamEvent{OperationType: "update", DocumentKey: docKey, Timestamp: primitive.Timestamp{T: t}, FullDocument: doc}
+	}
+	assert.NoError(t, dispatch(ctx, event("d1", 10, primitive.M{"tenant": "acme", "no": "7"}), nil))
+	// a different document with the same business key was already processed at a later time
+	assert.NoError(t, dispatch(ctx, event("d2", 9, primitive.M{"tenant": "acme", "no": "7"}), nil))
+	// without the key fields the documentKey is the logical key
+	assert.NoError(t, dispatch(ctx, event("d3", 9, primitive.M{"tenant": "acme"}), nil))
+
+	assert.Equal(t, []string{"acme|7/acme|7", "d3/"}, keys)
+	assert.Equal(t, primitive.Timestamp{T: 10}, store["acme|7"])
+	assert.Equal(t, primitive.Timestamp{T: 9}, store["d3"])
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// KeyProgressStore persists the cluster time of the last processed event per documentKey
+type KeyProgressStore interface {
+	// LastProcessed returns the cluster time of the last processed event of the key, ok is false for unknown keys
+	LastProcessed(ctx context.Context, documentKey string) (ts primitive.Timestamp, ok bool, err error)
+	// MarkProcessed records the event cluster time unless a later one is already stored
+	MarkProcessed(ctx context.Context, documentKey string, ts primitive.Timestamp) error
+}
+
+// KeyProgress returns a middleware that skips events whose documentKey was already processed after
+// the event's cluster time, and records the progress of every successfully dispatched event.
+// Replaying a window (e.g. after Seek) then only reruns handlers for keys that aren't up to date.
+// Events at the stored cluster time are dispatched again: the writes of a transaction share one cluster time,
+// so a second change of the key in the same transaction must not be skipped.
+// Events without a documentKey are always dispatched. With WithKeyExtractor the progress is kept per logical key.
+func KeyProgress(store KeyProgressStore) mongowatch.ChangeEventMiddleware {
+	return func(next mongowatch.ChangeEventDispatcherFunc) mongowatch.ChangeEventDispatcherFunc {
+		return func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+			key := ce.LogicalKey()
+			if key == "" {
+				return next(ctx, ce, err)
+			}
+
+			last, ok, lErr := store.LastProcessed(ctx, key)
+			if lErr != nil {
+				return fmt.Errorf("failed to fetch progress of %s: %w", key, lErr)
+			}
+			if ok && ce.Timestamp.Before(last) {
+				eventLogf(ctx, "skipping event %v, %s is processed up to %v", ce.ID.TokenData, key, last)
+				return err
+			}
+
+			if err = next(ctx, ce, err); err != nil {
+				return err
+			}
+			if mErr := store.MarkProcessed(ctx, key, ce.Timestamp); mErr != nil {
+				return fmt.Errorf("failed to record progress of %s: %w", key, mErr)
+			}
+			return nil
+		}
+	}
+}
+
+// keyProgress is the stored progress of a single documentKey
+type keyProgress struct {
+	DocumentKey string              `bson:"_id"`
+	ClusterTime primitive.Timestamp `bson:"clusterTime"`
+	UpdatedAt   time.Time           `bson:"updatedAt"`
+}
+
+// MongoKeyProgress stores per key progress in a collection, entries expire ttl after their last update
+// so the collection stays bounded by the keys touched recently
+type MongoKeyProgress struct {
+	col *mongo.Collection
+	ttl time.Duration
+}
+
+var _ KeyProgressStore = (*MongoKeyProgress)(nil)
+
+// NewMongoKeyProgress creates a progress store in col, call EnsureIndexes once to enable expiry
+func NewMongoKeyProgress(col *mongo.Collection, ttl time.Duration) *MongoKeyProgress {
+	return &MongoKeyProgress{col: col, ttl: ttl}
+}
+
+// EnsureIndexes creates the TTL index removing expired entries
+func (p *MongoKeyProgress) EnsureIndexes(ctx context.Context) error {
+	_, err := p.col.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "updatedAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(p.ttl.Seconds())),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create key progress TTL index: %w", err)
+	}
+	return nil
+}
+
+// LastProcessed fetches the progress of the key, entries past their TTL count as unknown
+// even before the TTL monitor removed them
+func (p *MongoKeyProgress) LastProcessed(ctx context.Context, documentKey string) (primitive.Timestamp, bool, error) {
+	var progress keyProgress
+	err := p.col.FindOne(ctx, bson.M{"_id": documentKey}).Decode(&progress)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return primitive.Timestamp{}, false, nil
+	}
+	if err != nil {
+		return primitive.Timestamp{}, false, fmt.Errorf("failed to fetch key progress: %w", err)
+	}
+	if p.ttl > 0 && time.Since(progress.UpdatedAt) > p.ttl {
+		return primitive.Timestamp{}, false, nil
+	}
+	return progress.ClusterTime, true, nil
+}
+
+// MarkProcessed advances the progress of the key
+func (p *MongoKeyProgress) MarkProcessed(ctx context.Context, documentKey string, ts primitive.Timestamp) error {
+	_, err := p.col.UpdateOne(ctx,
+		bson.M{"_id": documentKey},
+		bson.M{
+			"$max": bson.M{"clusterTime": ts},
+			"$set": bson.M{"updatedAt": time.Now()},
+		},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save key progress: %w", err)
+	}
+	return nil
+}
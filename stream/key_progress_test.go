@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+type memoryKeyProgress map[string]primitive.Timestamp
+
+func (m memoryKeyProgress) LastProcessed(ctx context.Context, documentKey string) (primitive.Timestamp, bool, error) {
+	ts, ok := m[documentKey]
+	return ts, ok, nil
+}
+
+func (m memoryKeyProgress) MarkProcessed(ctx context.Context, documentKey string, ts primitive.Timestamp) error {
+	if ts.After(m[documentKey]) {
+		m[documentKey] = ts
+	}
+	return nil
+}
+
+func TestKeyProgressSkipsProcessedKeys(t *testing.T) {
+	store := memoryKeyProgress{"a": {T: 10}}
+	var dispatched []string
+	dispatch := KeyProgress(store)(func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		if ce.DocumentKey == "fail" {
+			return errors.New("handler failed")
+		}
+		dispatched = append(dispatched, ce.DocumentKey)
+		return nil
+	})
+
+	event := func(key string, t uint32) mongowatch.ChangeStreamEvent {
+		return mongowatch.ChangeStreamEvent{DocumentKey: key, Timestamp: primitive.Timestamp{T: t}}
+	}
+
+	ctx := context.Background()
+	assert.NoError(t, dispatch(ctx, event("a", 9), nil))
+	assert.NoError(t, dispatch(ctx, event("a", 10), nil))
+	assert.NoError(t, dispatch(ctx, event("a", 11), nil))
+	assert.NoError(t, dispatch(ctx, event("b", 5), nil))
+	assert.NoError(t, dispatch(ctx, event("", 1), nil))
+	assert.Error(t, dispatch(ctx, event("fail", 1), nil))
+
+	// the event at the stored time may be another write of the same transaction
+	assert.Equal(t, []string{"a", "a", "b", ""}, dispatched)
+	assert.Equal(t, primitive.Timestamp{T: 11}, store["a"])
+	assert.Equal(t, primitive.Timestamp{T: 5}, store["b"])
+	// failed events are not marked, so they are retried
+	assert.NotContains(t, store, "fail")
+}
+
+func TestKeyProgressKeepsWritesOfOneTransaction(t *testing.T) {
+	store := memoryKeyProgress{}
+	var dispatched []string
+	dispatch := KeyProgress(store)(func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		dispatched = append(dispatched, ce.OperationType)
+		return nil
+	})
+
+	// both writes of the transaction carry the same cluster time
+	ts := primitive.Timestamp{T: 10, I: 3}
+	ctx := context.Background()
+	assert.NoError(t, dispatch(ctx, mongowatch.ChangeStreamEvent{OperationType: "insert", DocumentKey: "a", Timestamp: ts}, nil))
+	assert.NoError(t, dispatch(ctx, mongowatch.ChangeStreamEvent{OperationType: "update", DocumentKey: "a", Timestamp: ts}, nil))
+
+	assert.Equal(t, []string{"insert", "update"}, dispatched)
+}
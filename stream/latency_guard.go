@@ -0,0 +1,177 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// LatencyGuardConfig configures a LatencyGuard
+type LatencyGuardConfig struct {
+	// Threshold is the average resume point write latency beyond which consumption pauses
+	Threshold time.Duration
+	// Window is the number of recent writes averaged, 5 by default
+	Window int
+	// ProbeInterval is how often the local database is probed while paused, 5 seconds by default
+	ProbeInterval time.Duration
+	// Probe measures the local database while paused, reading the resume point by default
+	Probe func(ctx context.Context) error
+}
+
+// LatencyGuard monitors the write latency of the resume repository and holds back event dispatching while the
+// local database is degraded, rather than racing ahead and failing checkpoint writes mid-stream.
+// Consumption continues once a probe answers within the threshold again. Register it with WithLatencyGuard.
+type LatencyGuard struct {
+	cfg LatencyGuardConfig
+
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+
+	degraded atomic.Bool
+	pauses   atomic.Uint64
+}
+
+// NewLatencyGuard creates a latency guard
+func NewLatencyGuard(cfg LatencyGuardConfig) *LatencyGuard {
+	if cfg.Window <= 0 {
+		cfg.Window = 5
+	}
+	if cfg.ProbeInterval <= 0 {
+		cfg.ProbeInterval = 5 * time.Second
+	}
+	return &LatencyGuard{cfg: cfg}
+}
+
+// WithLatencyGuard measures the processor's resume point writes with the guard and pauses dispatching
+// while they are slow
+func WithLatencyGuard(guard *LatencyGuard) ProcessorOption {
+	return func(dp *DocumentProcessor) {
+		dp.latencyGuard = guard
+	}
+}
+
+// Degraded reports whether the guard is holding back events
+func (g *LatencyGuard) Degraded() bool {
+	return g.degraded.Load()
+}
+
+// Pauses counts how often the guard paused consumption
+func (g *LatencyGuard) Pauses() uint64 {
+	return g.pauses.Load()
+}
+
+// observe records a write latency and switches to degraded once the window average exceeds the threshold
+func (g *LatencyGuard) observe(ctx context.Context, d time.Duration) {
+	g.mu.Lock()
+	if len(g.samples) < g.cfg.Window {
+		g.samples = append(g.samples, d)
+	} else {
+		g.samples[g.next] = d
+		g.next = (g.next + 1) % g.cfg.Window
+	}
+	var sum time.Duration
+	for _, s := range g.samples {
+		sum += s
+	}
+	avg := sum / time.Duration(len(g.samples))
+	g.mu.Unlock()
+
+	if avg > g.cfg.Threshold && g.degraded.CompareAndSwap(false, true) {
+		g.pauses.Add(1)
+		logger(ctx).Warnf("local database degraded, resume point writes take %v on average, pausing consumption", avg)
+	}
+}
+
+// recover probes the local database until it answers within the threshold, it returns early when ctx is done
+func (g *LatencyGuard) recover(ctx context.Context, probe func(ctx context.Context) error) error {
+	ticker := time.NewTicker(g.cfg.ProbeInterval)
+	defer ticker.Stop()
+	for g.degraded.Load() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		started := time.Now()
+		err := probe(ctx)
+		took := time.Since(started)
+		if err != nil || took > g.cfg.Threshold {
+			logger(ctx).Debugf("local database still degraded, probe took %v: %v", took, err)
+			continue
+		}
+		g.mu.Lock()
+		g.samples, g.next = g.samples[:0], 0
+		g.mu.Unlock()
+		if g.degraded.CompareAndSwap(true, false) {
+			logger(ctx).Infof("local database recovered, probe took %v, resuming consumption", took)
+		}
+	}
+	return nil
+}
+
+// Middleware returns the middleware holding back events while the guard is degraded,
+// probing the local database with probe unless LatencyGuardConfig.Probe is set
+func (g *LatencyGuard) Middleware(probe func(ctx context.Context) error) mongowatch.ChangeEventMiddleware {
+	if g.cfg.Probe != nil {
+		probe = g.cfg.Probe
+	}
+	return func(next mongowatch.ChangeEventDispatcherFunc) mongowatch.ChangeEventDispatcherFunc {
+		return func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+			if waitErr := g.recover(ctx, probe); waitErr != nil {
+				return waitErr
+			}
+			return next(ctx, ce, err)
+		}
+	}
+}
+
+// wrap returns the resume repository with its writes measured
+func (g *LatencyGuard) wrap(resume mongowatch.StreamResume) mongowatch.StreamResume {
+	return latencyResume{StreamResume: resume, guard: g}
+}
+
+// latencyResume times the writes of the wrapped repository
+type latencyResume struct {
+	mongowatch.StreamResume
+	guard *LatencyGuard
+}
+
+func (r latencyResume) SaveResumePoint(ctx context.Context, ce mongowatch.ChangeStreamResumePoint) error {
+	defer r.record(ctx, time.Now())
+	return r.StreamResume.SaveResumePoint(ctx, ce)
+}
+
+func (r latencyResume) DeleteResumePoint(ctx context.Context, token mongowatch.ResumeToken) error {
+	defer r.record(ctx, time.Now())
+	return r.StreamResume.DeleteResumePoint(ctx, token)
+}
+
+func (r latencyResume) ReplaceResumePoints(ctx context.Context, ce mongowatch.ChangeStreamResumePoint) error {
+	defer r.record(ctx, time.Now())
+	return r.StreamResume.ReplaceResumePoints(ctx, ce)
+}
+
+func (r latencyResume) record(ctx context.Context, started time.Time) {
+	r.guard.observe(ctx, time.Since(started))
+}
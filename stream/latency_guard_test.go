@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// slowResume delays its writes by the configured latency
+type slowResume struct {
+	MemoryResume
+	latency atomic.Int64
+}
+
+func (r *slowResume) SaveResumePoint(ctx context.Context, ce mongowatch.ChangeStreamResumePoint) error {
+	time.Sleep(time.Duration(r.latency.Load()))
+	return r.MemoryResume.SaveResumePoint(ctx, ce)
+}
+
+func Test_LatencyGuard(t *testing.T) {
+	repo := &slowResume{}
+	var probes atomic.Int32
+	guard := NewLatencyGuard(LatencyGuardConfig{Threshold: 20 * time.Millisecond, Window: 2, ProbeInterval: 5 * time.Millisecond})
+	resume := guard.wrap(repo)
+	probe := func(ctx context.Context) error {
+		if probes.Add(1) < 3 {
+			return errors.New("timeout")
+		}
+		return nil
+	}
+	var dispatched atomic.Int32
+	dispatch := guard.Middleware(probe)(func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		dispatched.Add(1)
+		return err
+	})
+	ctx := context.Background()
+
+	assert.NoError(t, resume.SaveResumePoint(ctx, mongowatch.ChangeStreamResumePoint{}))
+	assert.False(t, guard.Degraded())
+
+	repo.latency.Store(int64(60 * time.Millisecond))
+	assert.NoError(t, resume.SaveResumePoint(ctx, mongowatch.ChangeStreamResumePoint{}))
+	assert.True(t, guard.Degraded())
+	assert.EqualValues(t, 1, guard.Pauses())
+
+	// a canceled dispatch gives up waiting
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.ErrorIs(t, dispatch(canceled, mongowatch.ChangeStreamEvent{}, nil), context.Canceled)
+	assert.Zero(t, dispatched.Load())
+
+	// the event is held back until a probe succeeds
+	assert.NoError(t, dispatch(ctx, mongowatch.ChangeStreamEvent{}, nil))
+	assert.EqualValues(t, 1, dispatched.Load())
+	assert.EqualValues(t, 3, probes.Load())
+	assert.False(t, guard.Degraded())
+}
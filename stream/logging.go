@@ -0,0 +1,40 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// logger returns the standard logger with the fields identifying the watcher of ctx,
+// so log lines of processors sharing a process can be told apart
+func logger(ctx context.Context) *log.Entry {
+	id, ok := mongowatch.WatcherIDFromContext(ctx)
+	if !ok {
+		return log.NewEntry(log.StandardLogger())
+	}
+	return log.WithFields(log.Fields{
+		"watcher":  id.String(),
+		"group":    id.Group,
+		"instance": id.Instance,
+	})
+}
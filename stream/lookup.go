@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// LookupConfig configures a $lookup-style enrichment, mirroring the fields of the aggregation stage
+type LookupConfig struct {
+	// From is the collection of the target DB documents are fetched from
+	From *mongo.Collection
+	// LocalField is the dotted path in fullDocument holding the join value
+	LocalField string
+	// ForeignField is the field matched in From, defaults to "_id"
+	ForeignField string
+	// As is the fullDocument field the fetched document is attached to
+	As string
+	// CacheSize bounds the number of cached lookups, zero disables caching
+	CacheSize int
+	// CacheTTL expires cached lookups, zero keeps them until evicted
+	CacheTTL time.Duration
+}
+
+// Lookup returns a transform attaching the document joined by LocalField to the event's fullDocument.
+// Events without the local field pass through untouched, a missing foreign document is attached as nil.
+func Lookup(cfg LookupConfig) mongowatch.TransformFunc {
+	if cfg.ForeignField == "" {
+		cfg.ForeignField = "_id"
+	}
+	cache := newLRUCache[primitive.M](cfg.CacheSize, cfg.CacheTTL)
+
+	return func(ctx context.Context, ce *mongowatch.ChangeStreamEvent) (bool, error) {
+		if ce.FullDocument == nil {
+			return true, nil
+		}
+		value, ok := mongowatch.LookupField(ce.FullDocument, cfg.LocalField)
+		if !ok {
+			return true, nil
+		}
+
+		key := fmt.Sprint(value)
+		joined, cached := cache.get(key)
+		if !cached {
+			var doc primitive.M
+			err := cfg.From.FindOne(ctx, bson.D{{Key: cfg.ForeignField, Value: value}}).Decode(&doc)
+			if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+				return false, fmt.Errorf("failed to look up %s %v: %w", cfg.From.Name(), value, err)
+			}
+			joined = doc
+			cache.put(key, doc)
+		}
+
+		// copy, the original document is shared with the stored resume point
+		enriched := make(primitive.M, len(ce.FullDocument)+1)
+		for k, v := range ce.FullDocument {
+			enriched[k] = v
+		}
+		if joined == nil {
+			enriched[cfg.As] = nil
+		} else {
+			enriched[cfg.As] = joined
+		}
+		ce.FullDocument = enriched
+
+		return true, nil
+	}
+}
+
+// lruCache is a size bounded least recently used cache with optional expiry
+type lruCache[V any] struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	order *list.List
+	items map[string]*list.Element
+}
+
+type lruEntry[V any] struct {
+	key     string
+	value   V
+	addedAt time.Time
+}
+
+func newLRUCache[V any](size int, ttl time.Duration) *lruCache[V] {
+	return &lruCache[V]{size: size, ttl: ttl, order: list.New(), items: map[string]*list.Element{}}
+}
+
+func (c *lruCache[V]) get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var zero V
+	el, ok := c.items[key]
+	if !ok {
+		return zero, false
+	}
+	entry := el.Value.(*lruEntry[V])
+	if c.ttl > 0 && time.Since(entry.addedAt) > c.ttl {
+		c.order.Remove(el)
+		delete(c.items, key)
+		return zero, false
+	}
+	c.order.MoveToFront(el)
+	return entry.value, true
+}
+
+func (c *lruCache[V]) put(key string, value V) {
+	if c.size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		el.Value = &lruEntry[V]{key: key, value: value, addedAt: time.Now()}
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.order.PushFront(&lruEntry[V]{key: key, value: value, addedAt: time.Now()})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry[V]).key)
+	}
+}
@@ -0,0 +1,47 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func Test_LRUCache(t *testing.T) {
+	cache := newLRUCache[primitive.M](2, 0)
+	cache.put("a", primitive.M{"v": 1})
+	cache.put("b", primitive.M{"v": 2})
+	_, ok := cache.get("a")
+	assert.True(t, ok)
+
+	// b is the least recently used one
+	cache.put("c", primitive.M{"v": 3})
+	_, ok = cache.get("b")
+	assert.False(t, ok)
+	_, ok = cache.get("a")
+	assert.True(t, ok)
+
+	expiring := newLRUCache[primitive.M](2, time.Millisecond)
+	expiring.put("a", nil)
+	time.Sleep(2 * time.Millisecond)
+	_, ok = expiring.get("a")
+	assert.False(t, ok)
+}
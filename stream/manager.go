@@ -21,8 +21,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync"
+	"time"
 
-	log "github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
@@ -35,43 +36,178 @@ type Manager struct {
 	watcher               mongowatch.ChangeStreamWatcher
 	changeEventSaveFunc   mongowatch.ChangeEventDispatcherFunc
 	changeEventDeleteFunc mongowatch.ChangeEventDispatcherFunc
+	middlewares           []mongowatch.ChangeEventMiddleware
+	transforms            []mongowatch.TransformFunc
+	errorAware            []mongowatch.ErrorAwareDispatcher
+	handlerTimeout        time.Duration
+	cancelGrace           time.Duration
+	budget                *eventBudget
+	keyExtractor          KeyExtractor
+	poisonAttempts        int
+	quarantine            QuarantineSink
+	gaps                  *GapDetector
+	sampler               *Sampler
 
-	cancel context.CancelFunc
+	id mongowatch.WatcherID
+
+	// failures tracks consecutive failed attempts of the same event across restarts
+	failures failureTracker
+	stats    managerStats
+	// barrier backs Checkpoint
+	barrier checkpointBarrier
+
+	// mu guards cancel and stopped, stopped remembers a Stop that arrived while no Watch was running
+	mu      sync.Mutex
+	cancel  context.CancelFunc
+	stopped bool
+}
+
+// ManagerOption configures optional Manager behaviour
+type ManagerOption func(*Manager)
+
+// WithManagerID attaches the watcher ID to the context of every hook and handler, and to log lines and stats
+func WithManagerID(id mongowatch.WatcherID) ManagerOption {
+	return func(m *Manager) {
+		m.id = id
+	}
+}
+
+// WithMiddleware wraps the dispatched handlers with middlewares, the first middleware being the outermost one
+func WithMiddleware(middlewares ...mongowatch.ChangeEventMiddleware) ManagerOption {
+	return func(m *Manager) {
+		m.middlewares = append(m.middlewares, middlewares...)
+	}
+}
+
+// WithTransform runs transforms in order on every event before any middleware or handler sees it,
+// transform errors are handled like handler errors
+func WithTransform(transforms ...mongowatch.TransformFunc) ManagerOption {
+	return func(m *Manager) {
+		m.transforms = append(m.transforms, transforms...)
+	}
+}
+
+// WithErrorAwareDispatchers registers cleanup handlers running in order after the dispatch funcs passed to Watch,
+// each receiving the error of the chain so far, see mongowatch.ErrorAwareDispatcher
+func WithErrorAwareDispatchers(handlers ...mongowatch.ErrorAwareDispatcher) ManagerOption {
+	return func(m *Manager) {
+		m.errorAware = append(m.errorAware, handlers...)
+	}
+}
+
+// WithHandlerTimeout bounds every dispatch func invocation with a deadline,
+// a handler running past it fails with ErrHandlerTimeout so the stream can be retried instead of hanging
+func WithHandlerTimeout(timeout time.Duration) ManagerOption {
+	return func(m *Manager) {
+		m.handlerTimeout = timeout
+	}
+}
+
+// DefaultHandlerCancelGrace is how long a handler past its deadline is given to return by default
+const DefaultHandlerCancelGrace = time.Second
+
+// WithHandlerCancelGrace sets how long a handler past its WithHandlerTimeout or WithEventBudget deadline is given to
+// return after its context was cancelled, DefaultHandlerCancelGrace by default. The timeout error is reported only
+// then, so the retry doesn't run alongside the old call. A handler ignoring its context for longer keeps running
+// in the background and may overlap with the retry.
+func WithHandlerCancelGrace(grace time.Duration) ManagerOption {
+	return func(m *Manager) {
+		m.cancelGrace = grace
+	}
+}
+
+// handlerCancelGrace returns the configured cancellation grace or the default
+func (m *Manager) handlerCancelGrace() time.Duration {
+	if m.cancelGrace > 0 {
+		return m.cancelGrace
+	}
+	return DefaultHandlerCancelGrace
 }
 
+// WithPoisonPolicy skips events that failed maxAttempts times in a row, recording them to the quarantine first.
+// Attempts are counted in memory, so they survive StartWithRetry restarts but not process restarts.
+// A nil quarantine skips poison events with an error log only.
+func WithPoisonPolicy(maxAttempts int, quarantine QuarantineSink) ManagerOption {
+	return func(m *Manager) {
+		m.poisonAttempts = maxAttempts
+		m.quarantine = quarantine
+	}
+}
+
+// ErrHandlerTimeout is returned when a dispatch func exceeds the configured handler timeout
+var ErrHandlerTimeout = errors.New("handler timed out")
+
 // NewManager creates a new change stream manager
 func NewManager(
 	resumeRepo mongowatch.StreamResume,
 	watcher mongowatch.ChangeStreamWatcher,
 	changeEventSaveFunc mongowatch.ChangeEventDispatcherFunc,
 	changeEventDeleteFunc mongowatch.ChangeEventDispatcherFunc,
+	opts ...ManagerOption,
 ) *Manager {
-	return &Manager{resumeRepo: resumeRepo, watcher: watcher, changeEventSaveFunc: changeEventSaveFunc, changeEventDeleteFunc: changeEventDeleteFunc}
+	m := &Manager{resumeRepo: resumeRepo, watcher: watcher, changeEventSaveFunc: changeEventSaveFunc, changeEventDeleteFunc: changeEventDeleteFunc}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
 }
 
-// Watch starts the change stream manager
+// Watch starts the change stream manager.
+// Canceling ctx or calling Stop ends it with a nil error, whatever the watcher returned while shutting down.
 func (m *Manager) Watch(ctx context.Context, fullDocumentMode options.FullDocument, rp *mongowatch.ChangeStreamResumePoint, fn ...mongowatch.ChangeEventDispatcherFunc) error {
-	log.Tracef("manager.Watch")
-	ctx, m.cancel = context.WithCancel(ctx)
+	ctx, cancel := context.WithCancel(m.withID(ctx))
+	defer cancel()
+
+	m.mu.Lock()
+	if m.stopped {
+		// Stop was called before the watch started, e.g. while StartWithRetry was backing off
+		m.stopped = false
+		m.mu.Unlock()
+		logger(ctx).Debug("change stream manager stopped before watching")
+		return nil
+	}
+	m.cancel = cancel
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		m.cancel = nil
+		m.mu.Unlock()
+	}()
+
+	logger(ctx).Tracef("manager.Watch")
 	var err error
 	if rp == nil {
 		rp, err = m.resumeRepo.GetResumePoint()
 		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			if ctx.Err() != nil {
+				return nil
+			}
 			return fmt.Errorf("failed to fetch mongo watcher resume token: %w", err)
 		}
 	}
 
+	if m.gaps != nil {
+		m.gaps.start(ctx, rp)
+	}
+
+	saveFunc, deleteFunc := m.barrier.trackSave(m.changeEventSaveFunc, m.changeEventDeleteFunc), m.changeEventDeleteFunc
+	if m.budget != nil {
+		saveFunc, deleteFunc = m.budget.wrap(saveFunc, m.handlerCancelGrace()), m.budget.wrap(deleteFunc, m.handlerCancelGrace())
+	}
+
 	err = m.watcher.Start(
 		ctx,
 		fullDocumentMode,
 		rp,
-		m.changeEventSaveFunc,
-		m.changeEventDeleteFunc,
-		fn...,
+		saveFunc,
+		deleteFunc,
+		m.buildDispatcher(fn),
 	)
 	if err != nil {
-		// enables graceful shutdown
-		if errors.Is(err, context.Canceled) {
+		// enables graceful shutdown, only the cancellation of the stream context is one,
+		// a handler failing with its own canceled context is an error like any other
+		if ctx.Err() != nil {
+			logger(ctx).Debugf("change stream manager stopped: %v", err)
 			return nil
 		}
 		return fmt.Errorf("failed to watch mongo stream: %w", err)
@@ -80,13 +216,218 @@ func (m *Manager) Watch(ctx context.Context, fullDocumentMode options.FullDocume
 	return nil
 }
 
-// Stop stops the change stream manager
+// buildDispatcher chains the dispatch funcs into one and wraps it with the configured middlewares
+func (m *Manager) buildDispatcher(fns []mongowatch.ChangeEventDispatcherFunc) mongowatch.ChangeEventDispatcherFunc {
+	errorAware := make([]mongowatch.ChangeEventDispatcherFunc, len(m.errorAware))
+	for i, handler := range m.errorAware {
+		errorAware[i] = mongowatch.ChangeEventDispatcherFunc(handler)
+	}
+	if m.handlerTimeout > 0 {
+		fns = withTimeouts(fns, m.handlerTimeout, m.handlerCancelGrace())
+		errorAware = withTimeouts(errorAware, m.handlerTimeout, m.handlerCancelGrace())
+	}
+
+	dispatch := func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		if err == nil {
+			err = dispatchChain(ctx, ce, fns)
+		}
+		// error aware handlers always run and see the chain error, this way they can do a cleanup
+		for _, handler := range errorAware {
+			err = handler(ctx, ce, err)
+		}
+		return err
+	}
+
+	for i := len(m.middlewares) - 1; i >= 0; i-- {
+		dispatch = m.middlewares[i](dispatch)
+	}
+	if m.keyExtractor != nil {
+		dispatch = withKeys(dispatch, m.keyExtractor)
+	}
+	if len(m.transforms) > 0 {
+		dispatch = withTransforms(dispatch, m.transforms)
+	}
+	if m.budget != nil {
+		dispatch = m.budget.wrap(dispatch, m.handlerCancelGrace())
+	}
+
+	return m.withProcessingError(dispatch)
+}
+
+// withTransforms applies the transforms to a copy of the event before passing it on
+func withTransforms(next mongowatch.ChangeEventDispatcherFunc, transforms []mongowatch.TransformFunc) mongowatch.ChangeEventDispatcherFunc {
+	return func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		for _, transform := range transforms {
+			keep, tErr := transform(ctx, &ce)
+			if tErr != nil {
+				return fmt.Errorf("failed to transform event: %w", tErr)
+			}
+			if !keep {
+				eventLogf(ctx, "event dropped by transform: %v", ce.ID.TokenData)
+				return err
+			}
+		}
+		return next(ctx, ce, err)
+	}
+}
+
+// dispatchChain calls the funcs in order and stops at the first error
+func dispatchChain(ctx context.Context, ce mongowatch.ChangeStreamEvent, fns []mongowatch.ChangeEventDispatcherFunc) error {
+	for _, fn := range fns {
+		if err := fn(ctx, ce, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func withTimeouts(fns []mongowatch.ChangeEventDispatcherFunc, timeout, grace time.Duration) []mongowatch.ChangeEventDispatcherFunc {
+	wrapped := make([]mongowatch.ChangeEventDispatcherFunc, len(fns))
+	for i, fn := range fns {
+		wrapped[i] = withTimeout(fn, timeout, grace)
+	}
+	return wrapped
+}
+
+// withTimeout runs fn with a deadline, the handler keeps running in the background if it ignores its context
+// past the cancellation grace, but the stream is no longer blocked by it
+func withTimeout(fn mongowatch.ChangeEventDispatcherFunc, timeout, grace time.Duration) mongowatch.ChangeEventDispatcherFunc {
+	return func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		err = callBounded(ctx, fn, ce, err, grace)
+		if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("%w after %s: %w", ErrHandlerTimeout, timeout, err)
+		}
+		return err
+	}
+}
+
+// callBounded runs fn in the background and returns with the context error once ctx is done. It waits up to grace
+// for fn to return first, a retry started right after would otherwise run alongside the old call on the same event.
+func callBounded(ctx context.Context, fn mongowatch.ChangeEventDispatcherFunc, ce mongowatch.ChangeStreamEvent, err error, grace time.Duration) error {
+	done := make(chan error, 1)
+	go func(err error) {
+		done <- fn(ctx, ce, err)
+	}(err)
+
+	select {
+	case err = <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		logger(ctx).Warnf("handler still running %s after its deadline, it may overlap with the retry", grace)
+	}
+	return ctx.Err()
+}
+
+// withProcessingError wraps dispatch errors into mongowatch.ProcessingError carrying the event context
+func (m *Manager) withProcessingError(next mongowatch.ChangeEventDispatcherFunc) mongowatch.ChangeEventDispatcherFunc {
+	return func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		err = next(ctx, ce, err)
+		if err == nil {
+			m.failures.reset()
+			m.stats.recordProcessed(ce.Timestamp)
+			m.barrier.done(ce)
+			return nil
+		}
+		m.stats.failed.Add(1)
+
+		attempt := m.failures.fail(ce.ID)
+		if m.poisonAttempts > 0 && attempt >= m.poisonAttempts {
+			record := QuarantineRecord{
+				QuarantinedAt: time.Now(),
+				Reason:        "poison",
+				Error:         err.Error(),
+				Attempts:      attempt,
+				Event:         ce,
+			}
+			if m.quarantine == nil {
+				logger(ctx).Errorf("skipping poison event %v after %d attempts: %v", ce.ID.TokenData, attempt, err)
+				m.failures.reset()
+				m.barrier.done(ce)
+				return nil
+			}
+			if qErr := m.quarantine.Quarantine(ctx, record); qErr != nil {
+				logger(ctx).Errorf("failed to quarantine poison event %v: %v", ce.ID.TokenData, qErr)
+			} else {
+				logger(ctx).Errorf("quarantined poison event %v after %d attempts: %v", ce.ID.TokenData, attempt, err)
+				m.failures.reset()
+				m.stats.quarantined.Add(1)
+				m.barrier.done(ce)
+				return nil
+			}
+		}
+
+		var processingErr *mongowatch.ProcessingError
+		if errors.As(err, &processingErr) {
+			return err
+		}
+		return mongowatch.NewProcessingError(ce, attempt, err)
+	}
+}
+
+// failureTracker counts consecutive failures of the same event
+type failureTracker struct {
+	mu       sync.Mutex
+	token    string
+	attempts int
+}
+
+// fail registers a failure of the event and returns the attempt number
+func (f *failureTracker) fail(token mongowatch.ResumeToken) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := tokenKey(token)
+	if key != f.token {
+		f.token = key
+		f.attempts = 0
+	}
+	f.attempts++
+	return f.attempts
+}
+
+func (f *failureTracker) reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.token = ""
+	f.attempts = 0
+}
+
+// tokenKey returns a comparable representation of a resume token
+func tokenKey(token mongowatch.ResumeToken) string {
+	return fmt.Sprint(token.TokenData)
+}
+
+// withID attaches the manager's watcher ID to ctx
+func (m *Manager) withID(ctx context.Context) context.Context {
+	if m.id.IsZero() {
+		return ctx
+	}
+	return mongowatch.ContextWithWatcherID(ctx, m.id)
+}
+
+// Stop stops the change stream manager, Watch returns nil then.
+// When no Watch is running, the next one returns right away instead of starting the stream.
 func (m *Manager) Stop() {
+	ctx := m.withID(context.Background())
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if m.cancel == nil {
-		log.Errorf("change stream manager stop called with no cancel")
+		logger(ctx).Trace("change stream manager stop called before watch, the next watch won't start")
+		m.stopped = true
 		return
 	}
 
-	log.Trace("change stream manager stop called")
+	logger(ctx).Trace("change stream manager stop called")
 	m.cancel()
 }
@@ -19,13 +19,17 @@ package stream
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/cenkalti/backoff/v4"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
@@ -34,6 +38,7 @@ import (
 )
 
 func Test_Manager_ProcessesAndDeletesMessages_ExceptLast(t *testing.T) {
+	requireMongo(t)
 	watchManager, streamResumeRepo, watchableCollection, cleanup := buildManager()
 	defer cleanup()
 
@@ -58,7 +63,77 @@ func Test_Manager_ProcessesAndDeletesMessages_ExceptLast(t *testing.T) {
 	assert.Equal(t, fmt.Sprintf("test_%d", eventCount-1), events[0].FullDocument["name"])
 }
 
+func Test_Manager_BatchCheckpoint(t *testing.T) {
+	requireMongo(t)
+	watchableCollection := NewCollection("collection_to_watch", mongoTestsDB)
+	resumeCollection := NewCollection("resume_points", mongoTestsDB)
+	defer db.Truncate(watchableCollection, false)
+	defer db.Truncate(resumeCollection, false)
+
+	streamResumeRepo := NewStreamResumeRepository(resumeCollection)
+	var saves int
+	save := GetSaveResumePointFunc(streamResumeRepo)
+	watchManager := NewManager(
+		streamResumeRepo,
+		NewChangeStreamWatcher(watchableCollection, WithBatchCheckpoint(0)),
+		func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+			saves++
+			return save(ctx, ce, err)
+		},
+		GetDeleteResumePointFunc(streamResumeRepo),
+	)
+
+	const eventCount = 5
+	wg := &sync.WaitGroup{}
+	wg.Add(eventCount)
+
+	insertDocumentsAsync(t, watchableCollection, eventCount, 0)
+	runWatchAsync(watchManager, nil, handlerFunc(wg))
+
+	wg.Wait()
+	// the checkpoint is written once the batch is processed
+	lastName := fmt.Sprintf("test_%d", eventCount-1)
+	assert.Eventually(t, func() bool {
+		events := printResumePoints(streamResumeRepo)
+		return len(events) == 1 && events[0].FullDocument["name"] == lastName
+	}, 5*time.Second, 50*time.Millisecond)
+	watchManager.Stop()
+
+	// a single point for the last event of the last batch
+	cnt, err := streamResumeRepo.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, int(cnt))
+	assert.LessOrEqual(t, saves, eventCount)
+}
+
+func Test_Manager_DeletesSeekPoint(t *testing.T) {
+	requireMongo(t)
+	watchManager, streamResumeRepo, watchableCollection, cleanup := buildManager()
+	defer cleanup()
+
+	ctx := context.Background()
+	seekPoint, err := mongowatch.StartPosition{Timestamp: &primitive.Timestamp{T: uint32(time.Now().Unix())}}.ResumePoint()
+	assert.NoError(t, err)
+	assert.NoError(t, streamResumeRepo.ReplaceResumePoints(ctx, seekPoint))
+
+	const eventCount = 5
+	wg := &sync.WaitGroup{}
+	wg.Add(eventCount)
+	insertDocumentsAsync(t, watchableCollection, eventCount, 0)
+	runWatchAsync(watchManager, nil, handlerFunc(wg))
+
+	wg.Wait()
+	lastName := fmt.Sprintf("test_%d", eventCount-1)
+	// the seek point went away with the first checkpoint, only the last event stays
+	assert.Eventually(t, func() bool {
+		events := printResumePoints(streamResumeRepo)
+		return len(events) == 1 && events[0].FullDocument["name"] == lastName
+	}, 5*time.Second, 50*time.Millisecond)
+	watchManager.Stop()
+}
+
 func Test_Manager_FailsOnError(t *testing.T) {
+	requireMongo(t)
 	watchManager, streamResumeRepo, watchableCollection, cleanup := buildManager()
 	defer cleanup()
 
@@ -93,6 +168,7 @@ func Test_Manager_FailsOnError(t *testing.T) {
 }
 
 func Test_Manager_Resumes(t *testing.T) {
+	requireMongo(t)
 	watchManager, streamResumeRepo, watchableCollection, cleanup := buildManager()
 	defer cleanup()
 
@@ -141,6 +217,7 @@ func Test_Manager_Resumes(t *testing.T) {
 }
 
 func Test_Manager_ResumesWithTimestamp(t *testing.T) {
+	requireMongo(t)
 	watchManager, streamResumeRepo, watchableCollection, cleanup := buildManager()
 	defer cleanup()
 
@@ -187,6 +264,421 @@ func Test_Manager_ResumesWithTimestamp(t *testing.T) {
 	assert.Equal(t, fmt.Sprintf("test_%d", eventCount*2-1), events[0].FullDocument["name"])
 }
 
+func Test_Manager_WrapsProcessingError(t *testing.T) {
+	errHandler := errors.New("handler failed")
+	m := NewManager(nil, nil, nil, nil)
+	dispatch := m.buildDispatcher([]mongowatch.ChangeEventDispatcherFunc{
+		func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+			if ce.DocumentKey == "bad" {
+				return errHandler
+			}
+			return nil
+		},
+	})
+
+	bad := mongowatch.ChangeStreamEvent{
+		ID:            mongowatch.ResumeToken{TokenData: "token_bad"},
+		OperationType: "update",
+		Database:      "app",
+		Collection:    "devices",
+		DocumentKey:   "bad",
+	}
+	for attempt := 1; attempt <= 2; attempt++ {
+		err := dispatch(context.Background(), bad, nil)
+		assert.ErrorIs(t, err, errHandler)
+
+		var processingErr *mongowatch.ProcessingError
+		assert.True(t, errors.As(fmt.Errorf("failed to process event: %w", err), &processingErr))
+		assert.Equal(t, attempt, processingErr.Attempt)
+		assert.Equal(t, bad.ID, processingErr.Token)
+		assert.Equal(t, "devices", processingErr.Collection)
+		assert.Equal(t, "bad", processingErr.DocumentKey)
+	}
+
+	assert.NoError(t, dispatch(context.Background(), mongowatch.ChangeStreamEvent{DocumentKey: "good"}, nil))
+
+	var processingErr *mongowatch.ProcessingError
+	assert.True(t, errors.As(dispatch(context.Background(), bad, nil), &processingErr))
+	assert.Equal(t, 1, processingErr.Attempt)
+}
+
+func Test_Manager_EventBudget(t *testing.T) {
+	quarantine := &quarantineRecorder{}
+	m := NewManager(nil, nil, nil, nil, WithEventBudget(100*time.Millisecond), WithPoisonPolicy(2, quarantine))
+	release := make(chan struct{})
+	defer close(release)
+
+	save := m.budget.wrap(func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		time.Sleep(60 * time.Millisecond)
+		return nil
+	}, m.handlerCancelGrace())
+	dispatch := m.buildDispatcher([]mongowatch.ChangeEventDispatcherFunc{
+		func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+			select {
+			case <-release:
+			case <-time.After(70 * time.Millisecond):
+			}
+			return nil
+		},
+	})
+
+	ce := mongowatch.ChangeStreamEvent{ID: mongowatch.ResumeToken{TokenData: "82aa"}}
+	ctx := mongowatch.ContextWithEvent(context.Background(), ce)
+	// the checkpoint and the handler each fit the budget, together they don't
+	assert.NoError(t, save(ctx, ce, nil))
+	err := dispatch(ctx, ce, nil)
+	assert.ErrorIs(t, err, ErrEventBudgetExceeded)
+	var processingErr *mongowatch.ProcessingError
+	assert.ErrorAs(t, err, &processingErr)
+
+	// the failure policy applies: the redelivered event gets a fresh budget and is quarantined on the second failure
+	assert.NoError(t, save(ctx, ce, nil))
+	assert.NoError(t, dispatch(ctx, ce, nil))
+	assert.Len(t, quarantine.records, 1)
+
+	next := mongowatch.ChangeStreamEvent{ID: mongowatch.ResumeToken{TokenData: "82bb"}}
+	assert.NoError(t, dispatch(mongowatch.ContextWithEvent(context.Background(), next), next, nil))
+}
+
+func Test_Manager_HandlerTimeout(t *testing.T) {
+	m := NewManager(nil, nil, nil, nil, WithHandlerTimeout(10*time.Millisecond), WithHandlerCancelGrace(10*time.Millisecond))
+	release := make(chan struct{})
+	defer close(release)
+
+	dispatch := m.buildDispatcher([]mongowatch.ChangeEventDispatcherFunc{
+		func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+			// a handler ignoring its context
+			<-release
+			return nil
+		},
+	})
+
+	err := dispatch(context.Background(), mongowatch.ChangeStreamEvent{}, nil)
+	assert.ErrorIs(t, err, ErrHandlerTimeout)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func Test_Manager_HandlerTimeout_WaitsForCancelledHandler(t *testing.T) {
+	m := NewManager(nil, nil, nil, nil, WithHandlerTimeout(10*time.Millisecond))
+	var running, overlaps atomic.Int32
+	dispatch := m.buildDispatcher([]mongowatch.ChangeEventDispatcherFunc{
+		func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+			// a handler ignoring its context, but returning within the cancellation grace
+			if running.Add(1) > 1 {
+				overlaps.Add(1)
+			}
+			defer running.Add(-1)
+			time.Sleep(50 * time.Millisecond)
+			return nil
+		},
+	})
+
+	ce := mongowatch.ChangeStreamEvent{ID: mongowatch.ResumeToken{TokenData: "82aa"}}
+	err := dispatch(context.Background(), ce, nil)
+	assert.ErrorIs(t, err, ErrHandlerTimeout)
+	assert.Equal(t, int32(0), running.Load(), "the timeout is reported once the old call returned")
+
+	// the retry of the event
+	assert.ErrorIs(t, dispatch(context.Background(), ce, nil), ErrHandlerTimeout)
+	assert.Equal(t, int32(0), overlaps.Load())
+}
+
+type quarantineRecorder struct {
+	mu      sync.Mutex
+	records []QuarantineRecord
+}
+
+func (q *quarantineRecorder) Quarantine(ctx context.Context, record QuarantineRecord) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.records = append(q.records, record)
+	return nil
+}
+
+func Test_Manager_PoisonPolicy(t *testing.T) {
+	quarantine := &quarantineRecorder{}
+	m := NewManager(nil, nil, nil, nil, WithPoisonPolicy(3, quarantine))
+	dispatch := m.buildDispatcher([]mongowatch.ChangeEventDispatcherFunc{
+		func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+			return errors.New("malformed document")
+		},
+	})
+
+	poison := mongowatch.ChangeStreamEvent{ID: mongowatch.ResumeToken{TokenData: "poison"}}
+	assert.Error(t, dispatch(context.Background(), poison, nil))
+	assert.Error(t, dispatch(context.Background(), poison, nil))
+	// third attempt quarantines the event and lets the stream advance
+	assert.NoError(t, dispatch(context.Background(), poison, nil))
+
+	assert.Len(t, quarantine.records, 1)
+	assert.Equal(t, 3, quarantine.records[0].Attempts)
+	assert.Equal(t, poison.ID, quarantine.records[0].Event.ID)
+
+	// without a sink the poison event is only skipped
+	m = NewManager(nil, nil, nil, nil, WithPoisonPolicy(2, nil))
+	dispatch = m.buildDispatcher([]mongowatch.ChangeEventDispatcherFunc{
+		func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+			return errors.New("malformed document")
+		},
+	})
+	assert.Error(t, dispatch(context.Background(), poison, nil))
+	assert.NoError(t, dispatch(context.Background(), poison, nil))
+}
+
+func Test_Manager_Transforms(t *testing.T) {
+	var dispatched []mongowatch.ChangeStreamEvent
+	m := NewManager(nil, nil, nil, nil, WithTransform(
+		func(ctx context.Context, ce *mongowatch.ChangeStreamEvent) (bool, error) {
+			return ce.DocumentKey != "drop", nil
+		},
+		func(ctx context.Context, ce *mongowatch.ChangeStreamEvent) (bool, error) {
+			if ce.DocumentKey == "fail" {
+				return false, errors.New("lookup failed")
+			}
+			ce.FullDocument = primitive.M{"derived": ce.DocumentKey + "_derived"}
+			return true, nil
+		},
+	))
+	dispatch := m.buildDispatcher([]mongowatch.ChangeEventDispatcherFunc{
+		func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+			dispatched = append(dispatched, ce)
+			return nil
+		},
+	})
+
+	assert.NoError(t, dispatch(context.Background(), mongowatch.ChangeStreamEvent{DocumentKey: "keep"}, nil))
+	assert.NoError(t, dispatch(context.Background(), mongowatch.ChangeStreamEvent{DocumentKey: "drop"}, nil))
+	var processingErr *mongowatch.ProcessingError
+	assert.True(t, errors.As(dispatch(context.Background(), mongowatch.ChangeStreamEvent{DocumentKey: "fail"}, nil), &processingErr))
+
+	assert.Len(t, dispatched, 1)
+	assert.Equal(t, "keep_derived", dispatched[0].FullDocument["derived"])
+}
+
+func Test_Manager_StopsChainOnFirstError(t *testing.T) {
+	errFirst := errors.New("first handler failed")
+	var calls []string
+	var cleanupErr error
+	m := NewManager(nil, nil, nil, nil, WithErrorAwareDispatchers(
+		func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+			calls = append(calls, "cleanup")
+			cleanupErr = err
+			return err
+		},
+	))
+	dispatch := m.buildDispatcher([]mongowatch.ChangeEventDispatcherFunc{
+		func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+			calls = append(calls, "first")
+			return errFirst
+		},
+		func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+			// a handler ignoring err used to run here and swallow the failure
+			calls = append(calls, "second")
+			return nil
+		},
+	})
+
+	err := dispatch(context.Background(), mongowatch.ChangeStreamEvent{}, nil)
+	assert.ErrorIs(t, err, errFirst)
+	assert.Equal(t, []string{"first", "cleanup"}, calls)
+	assert.ErrorIs(t, cleanupErr, errFirst)
+}
+
+func Test_Manager_ErrorAwareDispatcherHandlesFailure(t *testing.T) {
+	var handled []error
+	m := NewManager(nil, nil, nil, nil, WithErrorAwareDispatchers(
+		func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+			handled = append(handled, err)
+			// the failure is recorded elsewhere, let the stream advance
+			return nil
+		},
+	))
+	dispatch := m.buildDispatcher([]mongowatch.ChangeEventDispatcherFunc{
+		func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+			assert.NoError(t, err)
+			if ce.DocumentKey == "bad" {
+				return errors.New("handler failed")
+			}
+			return nil
+		},
+	})
+
+	assert.NoError(t, dispatch(context.Background(), mongowatch.ChangeStreamEvent{DocumentKey: "good"}, nil))
+	assert.NoError(t, dispatch(context.Background(), mongowatch.ChangeStreamEvent{DocumentKey: "bad"}, nil))
+
+	assert.Len(t, handled, 2)
+	assert.NoError(t, handled[0])
+	assert.EqualError(t, handled[1], "handler failed")
+}
+
+func Test_Manager_WatcherID(t *testing.T) {
+	id := mongowatch.NewWatcherID("billing", "pod-1")
+	m := NewManager(nil, nil, nil, nil, WithManagerID(id))
+
+	var seen mongowatch.WatcherID
+	dispatch := m.buildDispatcher([]mongowatch.ChangeEventDispatcherFunc{
+		func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+			seen, _ = mongowatch.WatcherIDFromContext(ctx)
+			return nil
+		},
+	})
+
+	assert.NoError(t, dispatch(m.withID(context.Background()), mongowatch.ChangeStreamEvent{}, nil))
+	assert.Equal(t, id, seen)
+	assert.Equal(t, id, m.Stats().ID)
+	assert.Equal(t, "billing/pod-1", logger(m.withID(context.Background())).Data["watcher"])
+}
+
+func Test_Manager_Tail(t *testing.T) {
+	requireMongo(t)
+	watchManager, streamResumeRepo, watchableCollection, cleanup := buildManager()
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, errc := watchManager.Tail(ctx, 0)
+
+	const eventCount = 3
+	insertDocumentsAsync(t, watchableCollection, eventCount, 0)
+	for i := 0; i < eventCount; i++ {
+		ce := <-events
+		assert.Equal(t, fmt.Sprintf("test_%d", i), ce.FullDocument["name"])
+	}
+	cancel()
+	assert.NoError(t, <-errc)
+
+	// tailing leaves no resume points behind
+	cnt, err := streamResumeRepo.Count()
+	assert.NoError(t, err)
+	assert.Zero(t, cnt)
+}
+
+func Test_Manager_TailUnsupported(t *testing.T) {
+	m := NewManager(nil, nil, nil, nil)
+	events, errc := m.Tail(context.Background(), 0)
+
+	assert.ErrorIs(t, <-errc, ErrTailUnsupported)
+	_, open := <-events
+	assert.False(t, open)
+}
+
+func Test_Manager_StopBeforeWatch(t *testing.T) {
+	w := &stopWatcher{}
+	m := NewManager(emptyResume{}, w, nil, nil)
+
+	m.Stop()
+	assert.NoError(t, m.Watch(context.Background(), options.UpdateLookup, nil))
+	assert.Zero(t, w.started())
+
+	// the pending stop is consumed by the watch it prevented
+	go func() {
+		for w.started() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		m.Stop()
+	}()
+	assert.NoError(t, m.Watch(context.Background(), options.UpdateLookup, nil))
+	assert.Equal(t, 1, w.started())
+}
+
+func Test_Manager_StopIgnoresShutdownErrors(t *testing.T) {
+	w := &stopWatcher{onStop: errors.New("failed to save resume point: client is disconnected")}
+	m := NewManager(emptyResume{}, w, nil, nil)
+
+	go func() {
+		for w.started() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		m.Stop()
+	}()
+	assert.NoError(t, m.Watch(context.Background(), options.UpdateLookup, nil))
+}
+
+func Test_Manager_HandlerCancellationIsAnError(t *testing.T) {
+	// a handler giving up on its own context doesn't mean the stream was stopped
+	m := NewManager(emptyResume{}, &stopWatcher{fail: fmt.Errorf("failed to process event: %w", context.Canceled)}, nil, nil)
+
+	err := m.Watch(context.Background(), options.UpdateLookup, nil)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func Test_DocumentProcessor_StopWhileBackingOff(t *testing.T) {
+	w := &stopWatcher{fail: errors.New("connection reset")}
+	dp := testProcessor(w)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- dp.StartWithRetry(backoff.NewConstantBackOff(50*time.Millisecond), &payloadWatcher{}, options.UpdateLookup)
+	}()
+	for w.started() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	dp.Stop()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("processor restarted after stop")
+	}
+	assert.Equal(t, 1, w.started())
+}
+
+func Test_DocumentProcessor_CancellationNotRetried(t *testing.T) {
+	w := &stopWatcher{fail: fmt.Errorf("failed to process event: %w", context.Canceled)}
+	dp := testProcessor(w)
+
+	err := dp.StartWithRetry(backoff.NewConstantBackOff(time.Millisecond), &payloadWatcher{}, options.UpdateLookup)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 1, w.started())
+}
+
+// emptyResume has no resume point stored
+type emptyResume struct{ mongowatch.StreamResume }
+
+func (emptyResume) GetResumePoint() (*mongowatch.ChangeStreamResumePoint, error) {
+	return nil, mongo.ErrNoDocuments
+}
+
+func (emptyResume) Describe(ctx context.Context) (*mongowatch.ResumePointInfo, error) {
+	return nil, mongo.ErrNoDocuments
+}
+
+// stopWatcher fails with fail right away if set, otherwise it blocks until stopped and returns onStop
+type stopWatcher struct {
+	mu     sync.Mutex
+	starts int
+	fail   error
+	onStop error
+}
+
+func (w *stopWatcher) Start(ctx context.Context, _ options.FullDocument, _ *mongowatch.ChangeStreamResumePoint, _, _ mongowatch.ChangeEventDispatcherFunc, _ ...mongowatch.ChangeEventDispatcherFunc) error {
+	w.mu.Lock()
+	w.starts++
+	w.mu.Unlock()
+	if w.fail != nil {
+		return w.fail
+	}
+	<-ctx.Done()
+	return w.onStop
+}
+
+func (w *stopWatcher) started() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.starts
+}
+
+// testProcessor builds a DocumentProcessor around watcher without touching mongo
+func testProcessor(watcher mongowatch.ChangeStreamWatcher) *DocumentProcessor {
+	return &DocumentProcessor{
+		resumeRepo: emptyResume{},
+		serializer: JSONSerializer{},
+		control:    &processorControl{gate: NewPauseGate()},
+		manager:    NewManager(emptyResume{}, watcher, nil, nil),
+	}
+}
+
 func handlerFunc(wg *sync.WaitGroup) func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
 	return func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
 		wg.Done()
@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// MemoryResume is a mongowatch.StreamResume keeping the last resume point in memory, for tests and short-lived
+// deployments that don't need a local database. It is safe for concurrent use; the point is lost with the process.
+type MemoryResume struct {
+	mu    sync.Mutex
+	point *mongowatch.ChangeStreamResumePoint
+}
+
+var _ mongowatch.StreamResume = (*MemoryResume)(nil)
+
+// NewMemoryResume creates an in-memory resume store, seed is the initial resume point and may be nil
+func NewMemoryResume(seed *mongowatch.ChangeStreamResumePoint) *MemoryResume {
+	r := &MemoryResume{}
+	if seed != nil {
+		point := *seed
+		r.point = &point
+	}
+	return r
+}
+
+// GetResumePoint returns a copy of the stored point, mongo.ErrNoDocuments without one like ResumeRepository
+func (r *MemoryResume) GetResumePoint() (*mongowatch.ChangeStreamResumePoint, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.point == nil {
+		return nil, fmt.Errorf("no resume point stored: %w", mongo.ErrNoDocuments)
+	}
+	point := *r.point
+	return &point, nil
+}
+
+// GetResumeTime returns the timestamp of the stored point
+func (r *MemoryResume) GetResumeTime() (*primitive.Timestamp, error) {
+	point, err := r.GetResumePoint()
+	if err != nil {
+		return nil, err
+	}
+	return &point.Timestamp, nil
+}
+
+// SaveResumePoint replaces the stored point
+func (r *MemoryResume) SaveResumePoint(ctx context.Context, ce mongowatch.ChangeStreamResumePoint) error {
+	ce.StoredAt = time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.point = &ce
+	return nil
+}
+
+// DeleteResumePoint forgets the stored point if it has the token, saving replaced older ones already
+func (r *MemoryResume) DeleteResumePoint(ctx context.Context, token mongowatch.ResumeToken) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.point != nil && fmt.Sprint(r.point.ID.TokenData) == fmt.Sprint(token.TokenData) {
+		r.point = nil
+	}
+	return nil
+}
+
+// ReplaceResumePoints replaces the stored point
+func (r *MemoryResume) ReplaceResumePoints(ctx context.Context, ce mongowatch.ChangeStreamResumePoint) error {
+	return r.SaveResumePoint(ctx, ce)
+}
+
+// Describe summarizes the stored point
+func (r *MemoryResume) Describe(ctx context.Context) (*mongowatch.ResumePointInfo, error) {
+	point, err := r.GetResumePoint()
+	if err != nil {
+		return nil, err
+	}
+	info := point.Describe(time.Now())
+	return &info, nil
+}
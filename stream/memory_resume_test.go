@@ -0,0 +1,71 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+func Test_MemoryResume(t *testing.T) {
+	ctx := context.Background()
+	r := NewMemoryResume(nil)
+	_, err := r.GetResumePoint()
+	assert.ErrorIs(t, err, mongo.ErrNoDocuments)
+
+	seed := &mongowatch.ChangeStreamResumePoint{ID: mongowatch.ResumeToken{TokenData: "82aa"}, Timestamp: primitive.Timestamp{T: 10}}
+	r = NewMemoryResume(seed)
+	seed.Timestamp.T = 99
+	ts, err := r.GetResumeTime()
+	require.NoError(t, err)
+	assert.Equal(t, uint32(10), ts.T, "seed not copied")
+
+	next := mongowatch.ChangeStreamResumePoint{ID: mongowatch.ResumeToken{TokenData: "82bb"}, Timestamp: primitive.Timestamp{T: 11}}
+	require.NoError(t, r.SaveResumePoint(ctx, next))
+	// the watcher deletes the previous point after saving the next one
+	require.NoError(t, r.DeleteResumePoint(ctx, seed.ID))
+	point, err := r.GetResumePoint()
+	require.NoError(t, err)
+	assert.Equal(t, "82bb", point.ID.TokenData)
+	assert.False(t, point.StoredAt.IsZero())
+
+	require.NoError(t, r.DeleteResumePoint(ctx, next.ID))
+	_, err = r.Describe(ctx)
+	assert.ErrorIs(t, err, mongo.ErrNoDocuments)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i uint32) {
+			defer wg.Done()
+			_ = r.ReplaceResumePoints(ctx, mongowatch.ChangeStreamResumePoint{Timestamp: primitive.Timestamp{T: i}})
+			_, _ = r.GetResumePoint()
+		}(uint32(i))
+	}
+	wg.Wait()
+	_, err = r.GetResumePoint()
+	assert.NoError(t, err)
+}
@@ -0,0 +1,213 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+var (
+	// ErrNamespaceRegistered is returned when registering a namespace twice
+	ErrNamespaceRegistered = errors.New("namespace already registered")
+	// ErrMultiManagerStarted is returned when registering after Start
+	ErrMultiManagerStarted = errors.New("multi manager already started")
+	// ErrResumeCollectionIsTarget is returned when resume points would be written into the watched collection
+	ErrResumeCollectionIsTarget = errors.New("resume collection is the watched collection")
+)
+
+// multiResumeSuffix follows the namespace in the resume collection names of a MultiManager
+const multiResumeSuffix = "_resume"
+
+// MultiManager supervises one DocumentProcessor per collection, each with its own resume points, and routes the
+// events of every collection to the CollectionWatcher registered for its "database.collection"
+type MultiManager struct {
+	localDB *mongo.Database
+	opts    []ProcessorOption
+
+	mu      sync.Mutex
+	routes  map[string]*multiRoute
+	started bool
+}
+
+type multiRoute struct {
+	dp      *DocumentProcessor
+	actions mongowatch.CollectionWatcher
+}
+
+// NewMultiManager creates a multi manager storing resume points in localDB, opts apply to every processor.
+// Options holding state, e.g. WithStreamResume or WithWatcher, belong to Register instead.
+func NewMultiManager(localDB *mongo.Database, opts ...ProcessorOption) *MultiManager {
+	return &MultiManager{localDB: localDB, opts: opts, routes: map[string]*multiRoute{}}
+}
+
+// Register adds a processor for the collection of targetDB delivering its events to actions,
+// opts apply after the shared ones. Resume collections are named "<database>.<collection>_resume" with
+// NamespaceResumeNamer unless opts set another namer, a name equal to the watched collection is rejected.
+func (mm *MultiManager) Register(targetDB *mongo.Database, collection string, actions mongowatch.CollectionWatcher, opts ...ProcessorOption) error {
+	ns := targetDB.Name() + "." + collection
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if mm.started {
+		return ErrMultiManagerStarted
+	}
+	if _, ok := mm.routes[ns]; ok {
+		return fmt.Errorf("%w: %s", ErrNamespaceRegistered, ns)
+	}
+
+	all := append([]ProcessorOption{WithResumeNamer(NamespaceResumeNamer, "", "")}, mm.opts...)
+	all = append(all, opts...)
+	dp := NewDataProcessor(targetDB, collection, multiResumeSuffix, mm.localDB, all...)
+	if resume := dp.ResumeCollection(); resume.Name == collection && mm.localDB.Name() == targetDB.Name() {
+		return fmt.Errorf("%w: %s", ErrResumeCollectionIsTarget, ns)
+	}
+	mm.routes[ns] = &multiRoute{dp: dp, actions: actions}
+	return nil
+}
+
+// Namespaces lists the registered namespaces in order
+func (mm *MultiManager) Namespaces() []string {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	namespaces := make([]string, 0, len(mm.routes))
+	for ns := range mm.routes {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// Processor returns the processor of the namespace, e.g. to pause it or serve it with the admin API
+func (mm *MultiManager) Processor(ns string) (*DocumentProcessor, bool) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	route, ok := mm.routes[ns]
+	if !ok {
+		return nil, false
+	}
+	return route.dp, true
+}
+
+// Stats returns the statistics of every processor keyed by namespace
+func (mm *MultiManager) Stats() map[string]ProcessorStats {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	stats := make(map[string]ProcessorStats, len(mm.routes))
+	for ns, route := range mm.routes {
+		stats[ns] = route.dp.Stats()
+	}
+	return stats
+}
+
+// Start runs every processor with StartWithRetry until Stop is called or one of them fails for good, which stops
+// the others. newBackOff is called once per processor, nil uses DefaultRetryPolicy between one second and a minute.
+func (mm *MultiManager) Start(newBackOff func() backoff.BackOff, fullDocumentMode options.FullDocument) error {
+	if newBackOff == nil {
+		newBackOff = func() backoff.BackOff { return DefaultRetryPolicy(time.Second, time.Minute) }
+	}
+
+	mm.mu.Lock()
+	mm.started = true
+	routes := make(map[string]*multiRoute, len(mm.routes))
+	for ns, route := range mm.routes {
+		routes[ns] = route
+	}
+	mm.mu.Unlock()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var failed error
+	for ns, route := range routes {
+		wg.Add(1)
+		go func(ns string, route *multiRoute) {
+			defer wg.Done()
+			err := route.dp.StartWithRetry(newBackOff(), route.actions, fullDocumentMode)
+			if err == nil {
+				return
+			}
+			once.Do(func() {
+				failed = fmt.Errorf("processor for %s failed: %w", ns, err)
+				logger(context.Background()).Errorf("%v, stopping the other processors", failed)
+				mm.Stop()
+			})
+		}(ns, route)
+	}
+	wg.Wait()
+	return failed
+}
+
+// Stop stops every processor
+func (mm *MultiManager) Stop() {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	for _, route := range mm.routes {
+		route.dp.Stop()
+	}
+}
+
+// NamespaceRouter is a CollectionWatcher routing events to the CollectionWatcher of their "database.collection",
+// e.g. for a cluster or database level watcher. Events of other namespaces are skipped.
+type NamespaceRouter map[string]mongowatch.CollectionWatcher
+
+var _ mongowatch.CollectionWatcher = NamespaceRouter(nil)
+
+// Insert routes the insert to the watcher of the namespace
+func (r NamespaceRouter) Insert(ctx context.Context, doc []byte) error {
+	if w, ok := r.watcher(ctx); ok {
+		return w.Insert(ctx, doc)
+	}
+	return nil
+}
+
+// Update routes the update to the watcher of the namespace
+func (r NamespaceRouter) Update(ctx context.Context, doc []byte) error {
+	if w, ok := r.watcher(ctx); ok {
+		return w.Update(ctx, doc)
+	}
+	return nil
+}
+
+// Delete routes the delete to the watcher of the namespace
+func (r NamespaceRouter) Delete(ctx context.Context, doc []byte) error {
+	if w, ok := r.watcher(ctx); ok {
+		return w.Delete(ctx, doc)
+	}
+	return nil
+}
+
+func (r NamespaceRouter) watcher(ctx context.Context) (mongowatch.CollectionWatcher, bool) {
+	meta, ok := mongowatch.EventMetaFromContext(ctx)
+	if !ok {
+		return nil, false
+	}
+	w, ok := r[meta.Database+"."+meta.Collection]
+	if !ok {
+		eventLogf(ctx, "no watcher registered for namespace %s.%s", meta.Database, meta.Collection)
+	}
+	return w, ok
+}
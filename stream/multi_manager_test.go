@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+func Test_MultiManager(t *testing.T) {
+	app := &mongo.Database{}
+	mm := NewMultiManager(nil)
+
+	orders, users := &payloadWatcher{}, &payloadWatcher{}
+	ordersLive := &scriptedLive{dumped: make(chan struct{}), events: []mongowatch.ChangeStreamEvent{
+		{OperationType: "insert", DocumentKey: "o1", FullDocument: primitive.M{"_id": "o1"}},
+	}}
+	usersLive := &scriptedLive{dumped: make(chan struct{}), events: []mongowatch.ChangeStreamEvent{
+		{OperationType: "insert", DocumentKey: "u1", FullDocument: primitive.M{"_id": "u1"}},
+	}}
+	require.NoError(t, mm.Register(app, "orders", orders, WithWatcher(ordersLive), WithStreamResume(NewMemoryResume(nil))))
+	require.NoError(t, mm.Register(app, "users", users, WithWatcher(usersLive), WithStreamResume(NewMemoryResume(nil))))
+	assert.ErrorIs(t, mm.Register(app, "users", users), ErrNamespaceRegistered)
+	assert.Equal(t, []string{".orders", ".users"}, mm.Namespaces())
+
+	done := make(chan error, 1)
+	go func() {
+		done <- mm.Start(func() backoff.BackOff { return &backoff.ZeroBackOff{} }, options.UpdateLookup)
+	}()
+	<-ordersLive.dumped
+	<-usersLive.dumped
+	assert.ErrorIs(t, mm.Register(app, "late", users), ErrMultiManagerStarted)
+
+	mm.Stop()
+	assert.NoError(t, <-done)
+	assert.Equal(t, []string{`{"_id":"o1"}`}, orders.payloads)
+	assert.Equal(t, []string{`{"_id":"u1"}`}, users.payloads)
+	assert.Len(t, mm.Stats(), 2)
+}
+
+func Test_MultiManager_FailureStopsOthers(t *testing.T) {
+	app := &mongo.Database{}
+	mm := NewMultiManager(nil)
+	healthy := &scriptedLive{dumped: make(chan struct{})}
+	require.NoError(t, mm.Register(app, "orders", &payloadWatcher{}, WithWatcher(healthy), WithStreamResume(NewMemoryResume(nil))))
+	require.NoError(t, mm.Register(app, "users", &payloadWatcher{}, WithWatcher(&stopWatcher{fail: ErrResumePointMismatch}),
+		WithStreamResume(NewMemoryResume(nil))))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- mm.Start(nil, options.UpdateLookup)
+	}()
+	select {
+	case err := <-done:
+		assert.True(t, errors.Is(err, ErrResumePointMismatch))
+		assert.ErrorContains(t, err, "processor for .users failed")
+	case <-time.After(2 * time.Second):
+		t.Fatal("failing processor didn't stop the others")
+	}
+}
+
+func Test_NamespaceRouter(t *testing.T) {
+	orders := &payloadWatcher{}
+	router := NamespaceRouter{"shop.orders": orders}
+	ctx := func(db, coll string) context.Context {
+		return mongowatch.ContextWithEvent(context.Background(), mongowatch.ChangeStreamEvent{Database: db, Collection: coll})
+	}
+
+	assert.NoError(t, router.Insert(ctx("shop", "orders"), []byte("a")))
+	assert.NoError(t, router.Delete(ctx("shop", "users"), []byte("b")))
+	assert.NoError(t, router.Update(context.Background(), []byte("c")))
+	assert.Equal(t, []string{"a"}, orders.payloads)
+}
+
+func Test_MultiManager_ResumeCollectionPerNamespace(t *testing.T) {
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://127.0.0.1:1"))
+	require.NoError(t, err)
+	local := client.Database("local")
+	mm := NewMultiManager(local)
+
+	require.NoError(t, mm.Register(client.Database("app1"), "orders", &payloadWatcher{}))
+	require.NoError(t, mm.Register(client.Database("app2"), "orders", &payloadWatcher{}))
+	app1, _ := mm.Processor("app1.orders")
+	app2, _ := mm.Processor("app2.orders")
+	assert.Equal(t, "app1.orders_resume", app1.ResumeCollection().Name)
+	assert.Equal(t, "app2.orders_resume", app2.ResumeCollection().Name)
+
+	// a namer writing the resume points into the watched collection would checkpoint its own checkpoints
+	assert.ErrorIs(t, mm.Register(local, "events", &payloadWatcher{}, WithResumeNamer(func(key ResumeKey) string {
+		return key.Collection
+	}, "", "")), ErrResumeCollectionIsTarget)
+	assert.Equal(t, []string{"app1.orders", "app2.orders"}, mm.Namespaces())
+}
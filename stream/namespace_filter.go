@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// NamespaceFilter limits the namespaces a database- or cluster-level watcher receives events for.
+// Entries have the form "db" (whole database) or "db.collection", and each part is either an exact name
+// or a glob using path.Match syntax, e.g. "app.users", "app.tmp_*", "*.system.*".
+// Deny entries win over allow entries; an empty allow list allows everything.
+type NamespaceFilter struct {
+	Allow []string
+	Deny  []string
+}
+
+// IsEmpty reports whether the filter has no entries
+func (f NamespaceFilter) IsEmpty() bool {
+	return len(f.Allow) == 0 && len(f.Deny) == 0
+}
+
+// Match reports whether the namespace passes the filter on the client side
+func (f NamespaceFilter) Match(db, coll string) bool {
+	for _, entry := range f.Deny {
+		if matchNamespace(entry, db, coll) {
+			return false
+		}
+	}
+	if len(f.Allow) == 0 {
+		return true
+	}
+	for _, entry := range f.Allow {
+		if matchNamespace(entry, db, coll) {
+			return true
+		}
+	}
+	return false
+}
+
+// Stage compiles the filter into a server side $match stage on the change event ns field,
+// so excluded namespaces are dropped before they ever reach the watcher.
+// Events without a namespace (e.g. invalidate) are always let through.
+func (f NamespaceFilter) Stage() bson.D {
+	var conditions bson.A
+	if len(f.Allow) > 0 {
+		allow := bson.A{bson.D{{Key: "ns", Value: bson.D{{Key: "$exists", Value: false}}}}}
+		for _, entry := range f.Allow {
+			allow = append(allow, namespaceCondition(entry))
+		}
+		conditions = append(conditions, bson.D{{Key: "$or", Value: allow}})
+	}
+	if len(f.Deny) > 0 {
+		var deny bson.A
+		for _, entry := range f.Deny {
+			deny = append(deny, namespaceCondition(entry))
+		}
+		conditions = append(conditions, bson.D{{Key: "$nor", Value: deny}})
+	}
+
+	return bson.D{{Key: "$match", Value: bson.D{{Key: "$and", Value: conditions}}}}
+}
+
+// splitNamespace splits a filter entry on the first dot, database names can't contain dots but collection names can
+func splitNamespace(entry string) (string, string) {
+	db, coll, _ := strings.Cut(entry, ".")
+	return db, coll
+}
+
+func matchNamespace(entry, db, coll string) bool {
+	entryDB, entryColl := splitNamespace(entry)
+	if !matchName(entryDB, db) {
+		return false
+	}
+	return entryColl == "" || matchName(entryColl, coll)
+}
+
+func matchName(pattern, name string) bool {
+	if !isGlob(pattern) {
+		return pattern == name
+	}
+	ok, err := path.Match(pattern, name)
+	return err == nil && ok
+}
+
+func namespaceCondition(entry string) bson.D {
+	db, coll := splitNamespace(entry)
+	cond := bson.D{{Key: "ns.db", Value: nameValue(db)}}
+	if coll != "" {
+		cond = append(cond, bson.E{Key: "ns.coll", Value: nameValue(coll)})
+	}
+	return cond
+}
+
+// nameValue returns the exact name or a regex equivalent of the glob for the $match stage
+func nameValue(pattern string) interface{} {
+	if !isGlob(pattern) {
+		return pattern
+	}
+	return primitive.Regex{Pattern: globToRegex(pattern)}
+}
+
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// globToRegex translates path.Match globs into an anchored regular expression
+func globToRegex(glob string) string {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		case '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end < 0 {
+				sb.WriteString(regexp.QuoteMeta(glob[i:]))
+				i = len(glob)
+				continue
+			}
+			// character classes share the same syntax in both
+			sb.WriteString(glob[i : i+end+1])
+			i += end
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	return sb.String()
+}
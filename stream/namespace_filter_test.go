@@ -0,0 +1,65 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func Test_NamespaceFilter_Match(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter NamespaceFilter
+		db     string
+		coll   string
+		want   bool
+	}{
+		{name: "empty filter allows everything", db: "app", coll: "users", want: true},
+		{name: "exact allow", filter: NamespaceFilter{Allow: []string{"app.users"}}, db: "app", coll: "users", want: true},
+		{name: "not allowed", filter: NamespaceFilter{Allow: []string{"app.users"}}, db: "app", coll: "orders", want: false},
+		{name: "whole database allowed", filter: NamespaceFilter{Allow: []string{"app"}}, db: "app", coll: "orders", want: true},
+		{name: "glob allow", filter: NamespaceFilter{Allow: []string{"app.orders_*"}}, db: "app", coll: "orders_eu", want: true},
+		{name: "system collections denied", filter: NamespaceFilter{Deny: []string{"*.system.*"}}, db: "app", coll: "system.profile", want: false},
+		{name: "deny wins over allow", filter: NamespaceFilter{Allow: []string{"app"}, Deny: []string{"app.tmp_?"}}, db: "app", coll: "tmp_1", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.filter.Match(tt.db, tt.coll))
+		})
+	}
+}
+
+func Test_NamespaceFilter_Stage(t *testing.T) {
+	filter := NamespaceFilter{Allow: []string{"app.orders_*"}, Deny: []string{"app.orders_tmp"}}
+
+	want := bson.D{{Key: "$match", Value: bson.D{{Key: "$and", Value: bson.A{
+		bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "ns", Value: bson.D{{Key: "$exists", Value: false}}}},
+			bson.D{{Key: "ns.db", Value: "app"}, {Key: "ns.coll", Value: primitive.Regex{Pattern: "^orders_.*$"}}},
+		}}},
+		bson.D{{Key: "$nor", Value: bson.A{
+			bson.D{{Key: "ns.db", Value: "app"}, {Key: "ns.coll", Value: "orders_tmp"}},
+		}}},
+	}}}}}
+
+	assert.Equal(t, want, filter.Stage())
+}
@@ -0,0 +1,54 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// namespaceOperationTypes are the events dispatched to NamespaceWatchers
+var namespaceOperationTypes = []string{"drop", "rename", "dropDatabase"}
+
+// WithNamespaceEvents passes drop, rename and dropDatabase events on, for CollectionWatchers implementing
+// mongowatch.NamespaceWatcher. Collection watchers see drop and rename of their collection, database and cluster
+// watchers also dropDatabase.
+func WithNamespaceEvents() WatcherOption {
+	return WithOperationTypes(namespaceOperationTypes...)
+}
+
+// dispatchNamespace passes drop, rename and dropDatabase events to the watcher, handled is false for other events
+func dispatchNamespace(ctx context.Context, w mongowatch.NamespaceWatcher, ce mongowatch.ChangeStreamEvent) (handled bool, err error) {
+	ns := mongowatch.Namespace{Database: ce.Database, Collection: ce.Collection}
+	switch ce.OperationType {
+	case "drop":
+		err = w.OnDrop(ctx, ns)
+	case "rename":
+		if ce.To == nil {
+			return true, fmt.Errorf("rename event of %s.%s has no target namespace", ce.Database, ce.Collection)
+		}
+		err = w.OnRename(ctx, ns, *ce.To)
+	case "dropDatabase":
+		err = w.OnDropDatabase(ctx, ce.Database)
+	default:
+		return false, nil
+	}
+	return true, err
+}
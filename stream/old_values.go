@@ -0,0 +1,53 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"github.com/mmtracker/mongowatch"
+)
+
+// WithOldValues copies the pre-image values of the fields, given as dotted paths, into the event's OldValues
+// and drops the rest of fullDocumentBeforeChange of updates and replaces, so handlers comparing old and new values
+// of a few fields don't hold on to whole pre-images. Deletes keep theirs, it is the only copy of the removed document.
+// Fields missing from the pre-image are left out of OldValues.
+func WithOldValues(fields ...string) WatcherOption {
+	return func(csw *ChangeStreamWatcher) {
+		csw.oldValueFields = append(csw.oldValueFields, fields...)
+	}
+}
+
+// captureOldValues moves the selected pre-image fields into OldValues, it runs after redaction
+// so redacted values never end up in OldValues
+func captureOldValues(ce *mongowatch.ChangeStreamEvent, fields []string) {
+	if ce.FullDocumentBeforeChange == nil {
+		return
+	}
+	for _, field := range fields {
+		value, ok := mongowatch.LookupField(ce.FullDocumentBeforeChange, field)
+		if !ok {
+			continue
+		}
+		if ce.OldValues == nil {
+			ce.OldValues = make(map[string]interface{}, len(fields))
+		}
+		ce.OldValues[field] = value
+	}
+	if ce.OperationType == "update" || ce.OperationType == "replace" {
+		ce.FullDocumentBeforeChange = nil
+	}
+}
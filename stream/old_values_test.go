@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestWithOldValues(t *testing.T) {
+	raw, err := bson.Marshal(bson.M{
+		"operationType": "update",
+		"fullDocument":  bson.M{"status": "active", "billing": bson.M{"paidUntil": "2024-01-01"}},
+		"fullDocumentBeforeChange": bson.M{
+			"status":  "trial",
+			"billing": bson.M{"paidUntil": "2023-01-01", "card": "4242"},
+			"notes":   "large",
+		},
+	})
+	require.NoError(t, err)
+
+	csw := NewChangeStreamWatcher(nil,
+		WithRedactor(NewRedactor("salt", RedactRule{Paths: []string{"status"}})),
+		WithOldValues("status", "billing.paidUntil", "missing"),
+	)
+	ce, err := csw.extractChangeEvent(context.Background(), raw)
+	require.NoError(t, err)
+
+	// status is redacted before the old values are taken
+	assert.Equal(t, map[string]interface{}{"billing.paidUntil": "2023-01-01"}, ce.OldValues)
+	assert.Nil(t, ce.FullDocumentBeforeChange)
+	assert.NotNil(t, ce.FullDocument["billing"])
+}
+
+func TestWithOldValues_NoPreImage(t *testing.T) {
+	csw := NewChangeStreamWatcher(nil, WithOldValues("status"))
+	raw, err := bson.Marshal(bson.M{"operationType": "insert", "fullDocument": bson.M{"status": "new"}})
+	require.NoError(t, err)
+
+	ce, err := csw.extractChangeEvent(context.Background(), raw)
+	require.NoError(t, err)
+	assert.Nil(t, ce.OldValues)
+	assert.Equal(t, primitive.M{"status": "new"}, ce.FullDocument)
+}
+
+func TestWithOldValues_KeepsDeletePreImage(t *testing.T) {
+	csw := NewChangeStreamWatcher(nil, WithOldValues("status"))
+	raw, err := bson.Marshal(bson.M{"operationType": "delete", "fullDocumentBeforeChange": bson.M{"status": "gone", "notes": "large"}})
+	require.NoError(t, err)
+
+	ce, err := csw.extractChangeEvent(context.Background(), raw)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"status": "gone"}, ce.OldValues)
+	assert.Equal(t, primitive.M{"status": "gone", "notes": "large"}, ce.FullDocumentBeforeChange)
+}
@@ -0,0 +1,204 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+const (
+	defaultOplogCheckInterval = time.Minute
+	defaultOplogWarnAt        = 0.8
+)
+
+// OplogWindow is the range of cluster times the oplog of the source still holds
+type OplogWindow struct {
+	First primitive.Timestamp `json:"first"`
+	Last  primitive.Timestamp `json:"last"`
+}
+
+// Duration is the wall clock time covered by the oplog
+func (w OplogWindow) Duration() time.Duration {
+	return time.Duration(int64(w.Last.T)-int64(w.First.T)) * time.Second
+}
+
+// ReadOplogWindow returns an OplogWindowConfig.Window reading the first and last entries of the replica set oplog
+func ReadOplogWindow(client *mongo.Client) func(ctx context.Context) (OplogWindow, error) {
+	oplog := client.Database("local").Collection("oplog.rs")
+	read := func(ctx context.Context, order int) (primitive.Timestamp, error) {
+		var entry struct {
+			TS primitive.Timestamp `bson:"ts"`
+		}
+		opts := options.FindOne().SetSort(bson.D{{Key: "$natural", Value: order}}).SetProjection(bson.D{{Key: "ts", Value: 1}})
+		err := oplog.FindOne(ctx, bson.D{}, opts).Decode(&entry)
+		return entry.TS, err
+	}
+	return func(ctx context.Context) (OplogWindow, error) {
+		first, err := read(ctx, 1)
+		if err != nil {
+			return OplogWindow{}, fmt.Errorf("failed to read oplog start: %w", err)
+		}
+		last, err := read(ctx, -1)
+		if err != nil {
+			return OplogWindow{}, fmt.Errorf("failed to read oplog end: %w", err)
+		}
+		return OplogWindow{First: first, Last: last}, nil
+	}
+}
+
+// OplogStatus compares the stored checkpoint with the oplog window
+type OplogStatus struct {
+	Window     OplogWindow         `json:"window"`
+	Checkpoint primitive.Timestamp `json:"checkpoint"`
+	// Headroom is how far the checkpoint is ahead of the oplog start, roughly the time left before the oplog
+	// rolls over it at the current write rate
+	Headroom time.Duration `json:"headroom"`
+	// Used is the share of the window the consumer is behind, 1 or more once the checkpoint fell out of the oplog
+	Used float64 `json:"used"`
+	// Lost is set once the checkpoint is older than the oplog start, resuming fails with ChangeStreamHistoryLost
+	Lost      bool      `json:"lost"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// OplogWindowConfig configures an OplogMonitor
+type OplogWindowConfig struct {
+	// Window reads the oplog window of the source, see ReadOplogWindow
+	Window func(ctx context.Context) (OplogWindow, error)
+	// Checkpoint returns the stored resume point, e.g. StreamResume.GetResumePoint or DocumentProcessor.ResumePoint
+	Checkpoint func() (*mongowatch.ChangeStreamResumePoint, error)
+	// Interval between checks, one minute by default
+	Interval time.Duration
+	// WarnAt is the share of the window the consumer may fall behind before warning, 0.8 by default
+	WarnAt float64
+	// OnWarning is called for every check past WarnAt, it must not block
+	OnWarning func(ctx context.Context, status OplogStatus)
+}
+
+// OplogMonitor periodically compares the age of the checkpoint with the oplog window of the source and warns
+// while the consumer falls behind towards the oplog start, before resuming fails with ChangeStreamHistoryLost
+type OplogMonitor struct {
+	cfg OplogWindowConfig
+
+	mu     sync.Mutex
+	status OplogStatus
+	ok     bool
+}
+
+// NewOplogMonitor creates an oplog monitor
+func NewOplogMonitor(cfg OplogWindowConfig) *OplogMonitor {
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultOplogCheckInterval
+	}
+	if cfg.WarnAt <= 0 {
+		cfg.WarnAt = defaultOplogWarnAt
+	}
+	return &OplogMonitor{cfg: cfg}
+}
+
+// Status returns the result of the last successful check, false before the first one
+func (m *OplogMonitor) Status() (OplogStatus, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status, m.ok
+}
+
+// Check compares the checkpoint with the oplog window once and warns when needed.
+// Without a stored checkpoint, or one without a cluster time, there is nothing to compare and it returns false.
+func (m *OplogMonitor) Check(ctx context.Context) (OplogStatus, bool, error) {
+	point, err := m.cfg.Checkpoint()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return OplogStatus{}, false, nil
+	}
+	if err != nil {
+		return OplogStatus{}, false, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	if point == nil || point.Timestamp.IsZero() {
+		return OplogStatus{}, false, nil
+	}
+	window, err := m.cfg.Window(ctx)
+	if err != nil {
+		return OplogStatus{}, false, err
+	}
+
+	status := oplogStatus(window, point.Timestamp, time.Now())
+	m.mu.Lock()
+	m.status, m.ok = status, true
+	m.mu.Unlock()
+
+	if status.Lost || status.Used >= m.cfg.WarnAt {
+		logger(ctx).Warnf("checkpoint at %d is %.0f%% behind in the oplog window of %s, %s left before it is lost",
+			status.Checkpoint.T, status.Used*100, window.Duration(), status.Headroom)
+		if m.cfg.OnWarning != nil {
+			m.cfg.OnWarning(ctx, status)
+		}
+	}
+	return status, true, nil
+}
+
+// Run checks every interval until ctx is done, failed checks are logged and retried on the next tick
+func (m *OplogMonitor) Run(ctx context.Context) error {
+	ticker := time.NewTicker(m.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		if _, _, err := m.Check(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			logger(ctx).Errorf("failed to check oplog window: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func oplogStatus(window OplogWindow, checkpoint primitive.Timestamp, now time.Time) OplogStatus {
+	status := OplogStatus{
+		Window:     window,
+		Checkpoint: checkpoint,
+		Headroom:   time.Duration(int64(checkpoint.T)-int64(window.First.T)) * time.Second,
+		Lost:       checkpoint.Before(window.First),
+		CheckedAt:  now,
+	}
+	if status.Headroom < 0 {
+		status.Headroom = 0
+	}
+	if span := int64(window.Last.T) - int64(window.First.T); span > 0 {
+		status.Used = float64(int64(window.Last.T)-int64(checkpoint.T)) / float64(span)
+	}
+	if status.Used < 0 {
+		status.Used = 0
+	}
+	if status.Lost && status.Used < 1 {
+		status.Used = 1
+	}
+	return status
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+func Test_OplogMonitor(t *testing.T) {
+	window := OplogWindow{First: primitive.Timestamp{T: 1000}, Last: primitive.Timestamp{T: 2000}}
+	var point *mongowatch.ChangeStreamResumePoint
+	var warnings []OplogStatus
+	monitor := NewOplogMonitor(OplogWindowConfig{
+		Window: func(ctx context.Context) (OplogWindow, error) { return window, nil },
+		Checkpoint: func() (*mongowatch.ChangeStreamResumePoint, error) {
+			if point == nil {
+				return nil, mongo.ErrNoDocuments
+			}
+			return point, nil
+		},
+		OnWarning: func(ctx context.Context, status OplogStatus) { warnings = append(warnings, status) },
+	})
+	ctx := context.Background()
+
+	_, ok, err := monitor.Check(ctx)
+	require.NoError(t, err)
+	assert.False(t, ok, "checked without a checkpoint")
+
+	point = &mongowatch.ChangeStreamResumePoint{Timestamp: primitive.Timestamp{T: 1900}}
+	status, ok, err := monitor.Check(ctx)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.InDelta(t, 0.1, status.Used, 0.001)
+	assert.Equal(t, 900*time.Second, status.Headroom)
+	assert.Empty(t, warnings)
+
+	point.Timestamp = primitive.Timestamp{T: 1150}
+	_, _, err = monitor.Check(ctx)
+	require.NoError(t, err)
+	require.Len(t, warnings, 1)
+	assert.InDelta(t, 0.85, warnings[0].Used, 0.001)
+	assert.False(t, warnings[0].Lost)
+
+	point.Timestamp = primitive.Timestamp{T: 900}
+	_, _, err = monitor.Check(ctx)
+	require.NoError(t, err)
+	require.Len(t, warnings, 2)
+	assert.True(t, warnings[1].Lost)
+	assert.Zero(t, warnings[1].Headroom)
+
+	last, ok := monitor.Status()
+	assert.True(t, ok)
+	assert.Equal(t, warnings[1], last)
+}
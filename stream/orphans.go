@@ -0,0 +1,183 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// OrphanValidator tells whether an event concerns a document of a chunk its shard doesn't own,
+// e.g. left behind by a chunk migration, so its post-image may be a phantom
+type OrphanValidator interface {
+	IsOrphan(ctx context.Context, ce mongowatch.ChangeStreamEvent) (bool, error)
+}
+
+// OrphanValidatorFunc adapts a func to OrphanValidator
+type OrphanValidatorFunc func(ctx context.Context, ce mongowatch.ChangeStreamEvent) (bool, error)
+
+// IsOrphan calls f
+func (f OrphanValidatorFunc) IsOrphan(ctx context.Context, ce mongowatch.ChangeStreamEvent) (bool, error) {
+	return f(ctx, ce)
+}
+
+// OrphanPolicy decides what happens to events of orphaned documents
+type OrphanPolicy int
+
+const (
+	// OrphanDrop skips the event, handlers never see it
+	OrphanDrop OrphanPolicy = iota
+	// OrphanFlag dispatches the event with ChangeStreamEvent.SuspectedOrphan set
+	OrphanFlag
+)
+
+// OrphanFilter returns a middleware checking every insert, update, replace and delete with the validator,
+// dropping or flagging those of orphaned documents according to the policy. Validation failures fail the event
+// so it is retried rather than delivered unchecked.
+func OrphanFilter(validator OrphanValidator, policy OrphanPolicy) mongowatch.ChangeEventMiddleware {
+	return func(next mongowatch.ChangeEventDispatcherFunc) mongowatch.ChangeEventDispatcherFunc {
+		return func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+			switch ce.OperationType {
+			case "insert", "update", "replace", "delete":
+			default:
+				return next(ctx, ce, err)
+			}
+			orphan, vErr := validator.IsOrphan(ctx, ce)
+			if vErr != nil {
+				return fmt.Errorf("failed to check chunk ownership of %s: %w", ce.DocumentKey, vErr)
+			}
+			if !orphan {
+				return next(ctx, ce, err)
+			}
+			if policy == OrphanDrop {
+				eventLogf(ctx, "dropping event %v of orphaned document %s", ce.ID.TokenData, ce.DocumentKey)
+				return err
+			}
+			ce.SuspectedOrphan = true
+			return next(ctx, ce, err)
+		}
+	}
+}
+
+// ErrHashedShardKey is returned by ShardOwnership for collections with a hashed shard key, which it can't range match
+var ErrHashedShardKey = errors.New("hashed shard keys aren't supported")
+
+// ShardOwnership validates events of a watcher reading a single shard against the chunk metadata in the config
+// database: a document whose shard key falls into a chunk owned by another shard is an orphan. Change streams opened
+// through mongos don't need it. The shard key is read from the full document, or the pre-image for deletes, events
+// carrying neither can't be checked and pass. Each check is a query on config.chunks.
+type ShardOwnership struct {
+	config    *mongo.Database
+	namespace string
+	shard     string
+
+	mu     sync.Mutex
+	loaded bool
+	uuid   interface{}
+	key    []string
+}
+
+var _ OrphanValidator = (*ShardOwnership)(nil)
+
+// NewShardOwnership creates a validator for the namespace ("db.collection") watched on shard,
+// client has to be connected through mongos or to the config servers
+func NewShardOwnership(client *mongo.Client, namespace, shard string) *ShardOwnership {
+	return &ShardOwnership{config: client.Database("config"), namespace: namespace, shard: shard}
+}
+
+// load reads the collection uuid and shard key fields once
+func (o *ShardOwnership) load(ctx context.Context) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.loaded {
+		return nil
+	}
+	var coll struct {
+		UUID interface{} `bson:"uuid"`
+		Key  bson.D      `bson:"key"`
+	}
+	err := o.config.Collection("collections").FindOne(ctx, bson.M{"_id": o.namespace}).Decode(&coll)
+	if err != nil {
+		return fmt.Errorf("failed to fetch sharding metadata of %s: %w", o.namespace, err)
+	}
+	key := make([]string, 0, len(coll.Key))
+	for _, field := range coll.Key {
+		if field.Value == "hashed" {
+			return fmt.Errorf("%w: %s", ErrHashedShardKey, o.namespace)
+		}
+		key = append(key, field.Key)
+	}
+	o.uuid, o.key, o.loaded = coll.UUID, key, true
+	return nil
+}
+
+// IsOrphan looks up the chunk of the document's shard key and compares its owner with the watched shard
+func (o *ShardOwnership) IsOrphan(ctx context.Context, ce mongowatch.ChangeStreamEvent) (bool, error) {
+	doc := eventDocument(ce)
+	if doc == nil {
+		return false, nil
+	}
+	if err := o.load(ctx); err != nil {
+		return false, err
+	}
+
+	shardKey, ok := shardKeyOf(doc, o.key)
+	if !ok {
+		return false, nil
+	}
+	// the server compares shard key documents in BSON order, including MinKey and MaxKey bounds
+	filter := bson.D{
+		{Key: "$or", Value: bson.A{bson.D{{Key: "uuid", Value: o.uuid}}, bson.D{{Key: "ns", Value: o.namespace}}}},
+		{Key: "min", Value: bson.D{{Key: "$lte", Value: shardKey}}},
+		{Key: "max", Value: bson.D{{Key: "$gt", Value: shardKey}}},
+	}
+	var chunk struct {
+		Shard string `bson:"shard"`
+	}
+	err := o.config.Collection("chunks").FindOne(ctx, filter, options.FindOne().SetProjection(bson.D{{Key: "shard", Value: 1}})).Decode(&chunk)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// metadata is being refreshed, e.g. during a split, let the event through
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to fetch chunk: %w", err)
+	}
+	return chunk.Shard != o.shard, nil
+}
+
+// shardKeyOf extracts the shard key document, ok is false when a field is missing
+func shardKeyOf(doc primitive.M, fields []string) (bson.D, bool) {
+	key := make(bson.D, 0, len(fields))
+	for _, field := range fields {
+		value, ok := mongowatch.LookupField(doc, field)
+		if !ok {
+			return nil, false
+		}
+		key = append(key, bson.E{Key: field, Value: value})
+	}
+	return key, true
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+func Test_OrphanFilter(t *testing.T) {
+	validator := OrphanValidatorFunc(func(ctx context.Context, ce mongowatch.ChangeStreamEvent) (bool, error) {
+		if ce.DocumentKey == "broken" {
+			return false, errors.New("config server unavailable")
+		}
+		return ce.DocumentKey == "orphan", nil
+	})
+	var seen []mongowatch.ChangeStreamEvent
+	handler := func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		seen = append(seen, ce)
+		return err
+	}
+	ctx := context.Background()
+
+	drop := OrphanFilter(validator, OrphanDrop)(handler)
+	assert.NoError(t, drop(ctx, mongowatch.ChangeStreamEvent{OperationType: "update", DocumentKey: "owned"}, nil))
+	assert.NoError(t, drop(ctx, mongowatch.ChangeStreamEvent{OperationType: "update", DocumentKey: "orphan"}, nil))
+	assert.NoError(t, drop(ctx, mongowatch.ChangeStreamEvent{OperationType: mongowatch.OperationTypeInvalidate, DocumentKey: "orphan"}, nil))
+	assert.Error(t, drop(ctx, mongowatch.ChangeStreamEvent{OperationType: "insert", DocumentKey: "broken"}, nil))
+	if assert.Len(t, seen, 2) {
+		assert.Equal(t, "owned", seen[0].DocumentKey)
+		assert.Equal(t, mongowatch.OperationTypeInvalidate, seen[1].OperationType)
+	}
+
+	seen = nil
+	flag := OrphanFilter(validator, OrphanFlag)(handler)
+	assert.NoError(t, flag(ctx, mongowatch.ChangeStreamEvent{OperationType: "delete", DocumentKey: "orphan"}, nil))
+	if assert.Len(t, seen, 1) {
+		assert.True(t, seen[0].SuspectedOrphan)
+	}
+}
+
+func Test_ShardKeyOf(t *testing.T) {
+	doc := primitive.M{"_id": 1, "tenant": "t1", "owner": primitive.M{"region": "eu"}}
+	key, ok := shardKeyOf(doc, []string{"tenant", "owner.region"})
+	assert.True(t, ok)
+	assert.Equal(t, bson.D{{Key: "tenant", Value: "t1"}, {Key: "owner.region", Value: "eu"}}, key)
+
+	_, ok = shardKeyOf(doc, []string{"missing"})
+	assert.False(t, ok)
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// pageBatchSize bounds the documents held in memory while streaming a collection
+const pageBatchSize = 500
+
+// fetchPage returns up to limit documents of col with an _id greater than after, nil after starts from the first one
+func fetchPage[T any](ctx context.Context, col *mongo.Collection, after interface{}, limit int64) ([]T, error) {
+	filter := bson.D{}
+	if after != nil {
+		filter = bson.D{{Key: "_id", Value: bson.D{{Key: "$gt", Value: after}}}}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(limit)
+	cursor, err := col.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch page: %w", err)
+	}
+
+	var page []T
+	if err = cursor.All(ctx, &page); err != nil {
+		return nil, fmt.Errorf("failed cursor iteration for page: %w", err)
+	}
+	return page, nil
+}
+
+// eachDocument calls fn with the documents of col in _id order, decoding one at a time, until fn fails
+func eachDocument[T any](ctx context.Context, col *mongo.Collection, fn func(T) error) error {
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetBatchSize(pageBatchSize)
+	cursor, err := col.Find(ctx, bson.D{}, opts)
+	if err != nil {
+		return fmt.Errorf("failed to iterate documents: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var doc T
+		if err = cursor.Decode(&doc); err != nil {
+			return fmt.Errorf("failed to decode document: %w", err)
+		}
+		if err = fn(doc); err != nil {
+			return err
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return fmt.Errorf("failed cursor iteration: %w", err)
+	}
+	return nil
+}
+
+// FetchPage returns up to limit resume points ordered by token, starting after the given one or from the first when nil.
+// Pass the token of the last point of a page to get the next one, an empty page is the end.
+func (csr *ResumeRepository) FetchPage(ctx context.Context, after *mongowatch.ResumeToken, limit int64) ([]*mongowatch.ChangeStreamResumePoint, error) {
+	if err := csr.migrate(ctx); err != nil {
+		return nil, err
+	}
+	var from interface{}
+	if after != nil {
+		from = *after
+	}
+	return fetchPage[*mongowatch.ChangeStreamResumePoint](ctx, csr.col, from, limit)
+}
+
+// Each calls fn with every resume point ordered by token without loading them all, it stops at the first error of fn
+func (csr *ResumeRepository) Each(ctx context.Context, fn func(*mongowatch.ChangeStreamResumePoint) error) error {
+	if err := csr.migrate(ctx); err != nil {
+		return err
+	}
+	return eachDocument(ctx, csr.col, fn)
+}
+
+// FetchPage returns up to limit history records in insertion order, starting after the given ID or from the first when zero
+func (h *MongoHistory) FetchPage(ctx context.Context, after primitive.ObjectID, limit int64) ([]HistoryRecord, error) {
+	var from interface{}
+	if !after.IsZero() {
+		from = after
+	}
+	return fetchPage[HistoryRecord](ctx, h.col, from, limit)
+}
+
+// Each calls fn with every history record in insertion order without loading them all, it stops at the first error of fn
+func (h *MongoHistory) Each(ctx context.Context, fn func(HistoryRecord) error) error {
+	return eachDocument(ctx, h.col, fn)
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// PartitionCheckpoint is the resume point of one partition, every partition is a single document
+type PartitionCheckpoint struct {
+	Partition string                             `bson:"_id" json:"partition"`
+	Point     mongowatch.ChangeStreamResumePoint `bson:"point" json:"point"`
+	UpdatedAt time.Time                          `bson:"updatedAt" json:"updatedAt"`
+}
+
+// PartitionedResume tracks one checkpoint per partition of a partitioned consumer in a single collection.
+// Partition returns the StreamResume of one partition, Watermark the point all partitions have reached.
+type PartitionedResume struct {
+	col *mongo.Collection
+}
+
+// NewPartitionedResume creates a partitioned resume repository stored in col
+func NewPartitionedResume(col *mongo.Collection) *PartitionedResume {
+	return &PartitionedResume{col: col}
+}
+
+// Partition returns the resume repository of the named partition
+func (p *PartitionedResume) Partition(name string) *PartitionResume {
+	return &PartitionResume{col: p.col, name: name}
+}
+
+// Partitions returns the checkpoints of all partitions
+func (p *PartitionedResume) Partitions(ctx context.Context) ([]PartitionCheckpoint, error) {
+	cursor, err := p.col.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find partition checkpoints: %w", err)
+	}
+	var checkpoints []PartitionCheckpoint
+	if err = cursor.All(ctx, &checkpoints); err != nil {
+		return nil, fmt.Errorf("failed cursor iteration for partition checkpoints: %w", err)
+	}
+	return checkpoints, nil
+}
+
+// Watermark returns the oldest checkpoint of all partitions, every partition has processed the stream up to it.
+// It fails with mongo.ErrNoDocuments while no partition has a checkpoint.
+func (p *PartitionedResume) Watermark(ctx context.Context) (*mongowatch.ChangeStreamResumePoint, error) {
+	opts := options.FindOne().SetSort(bson.D{{Key: "point.timestamp", Value: 1}})
+	var checkpoint PartitionCheckpoint
+	if err := p.col.FindOne(ctx, bson.D{}, opts).Decode(&checkpoint); err != nil {
+		return nil, fmt.Errorf("failed to find watermark: %w", err)
+	}
+	return &checkpoint.Point, nil
+}
+
+// PartitionResume is the StreamResume of a single partition, every write replaces the partition document atomically
+type PartitionResume struct {
+	col  *mongo.Collection
+	name string
+}
+
+var _ mongowatch.StreamResume = (*PartitionResume)(nil)
+
+// GetResumePoint returns the checkpoint of the partition
+func (r *PartitionResume) GetResumePoint() (*mongowatch.ChangeStreamResumePoint, error) {
+	var checkpoint PartitionCheckpoint
+	err := r.col.FindOne(context.Background(), bson.D{{Key: "_id", Value: r.name}}).Decode(&checkpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find resume point of partition %s: %w", r.name, err)
+	}
+	return &checkpoint.Point, nil
+}
+
+// GetResumeTime returns the timestamp of the partition checkpoint
+func (r *PartitionResume) GetResumeTime() (*primitive.Timestamp, error) {
+	point, err := r.GetResumePoint()
+	if err != nil {
+		return nil, err
+	}
+	return &point.Timestamp, nil
+}
+
+// SaveResumePoint replaces the checkpoint of the partition
+func (r *PartitionResume) SaveResumePoint(ctx context.Context, ce mongowatch.ChangeStreamResumePoint) error {
+	ce.SchemaVersion = ResumePointSchemaVersion
+	ce.StoredAt = time.Now()
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "point", Value: ce},
+		{Key: "updatedAt", Value: ce.StoredAt},
+	}}}
+	_, err := r.col.UpdateOne(ctx, bson.D{{Key: "_id", Value: r.name}}, update, options.Update().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("failed to save resume point of partition %s: %w", r.name, err)
+	}
+	return nil
+}
+
+// DeleteResumePoint is a no-op unless token is still the checkpoint, saving already replaced the previous point
+func (r *PartitionResume) DeleteResumePoint(ctx context.Context, token mongowatch.ResumeToken) error {
+	_, err := r.col.DeleteOne(ctx, bson.D{{Key: "_id", Value: r.name}, {Key: "point._id", Value: token}})
+	if err != nil {
+		return fmt.Errorf("failed to delete resume point of partition %s: %w", r.name, err)
+	}
+	return nil
+}
+
+// ReplaceResumePoints sets the checkpoint of the partition
+func (r *PartitionResume) ReplaceResumePoints(ctx context.Context, ce mongowatch.ChangeStreamResumePoint) error {
+	return r.SaveResumePoint(ctx, ce)
+}
+
+// Describe summarizes the checkpoint of the partition
+func (r *PartitionResume) Describe(ctx context.Context) (*mongowatch.ResumePointInfo, error) {
+	point, err := r.GetResumePoint()
+	if err != nil {
+		return nil, err
+	}
+	info := point.Describe(time.Now())
+	return &info, nil
+}
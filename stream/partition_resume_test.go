@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/mmtracker/mongowatch"
+	"github.com/mmtracker/mongowatch/db"
+)
+
+func Test_PartitionedResume_Watermark(t *testing.T) {
+	requireMongo(t)
+	col := NewCollection("resume_points_partitioned", mongoTestsDB)
+	_ = db.Truncate(col, false)
+
+	ctx := context.Background()
+	repo := NewPartitionedResume(col)
+	_, err := repo.Watermark(ctx)
+	assert.ErrorIs(t, err, mongo.ErrNoDocuments)
+
+	point := func(token string, t uint32) mongowatch.ChangeStreamResumePoint {
+		return mongowatch.ChangeStreamResumePoint{ID: mongowatch.ResumeToken{TokenData: token}, Timestamp: primitive.Timestamp{T: t}}
+	}
+	a, b := repo.Partition("a"), repo.Partition("b")
+	assert.NoError(t, a.SaveResumePoint(ctx, point("a1", 10)))
+	assert.NoError(t, b.SaveResumePoint(ctx, point("b1", 5)))
+	assert.NoError(t, a.SaveResumePoint(ctx, point("a2", 20)))
+	// deleting the previous point of a partition keeps its checkpoint
+	assert.NoError(t, a.DeleteResumePoint(ctx, mongowatch.ResumeToken{TokenData: "a1"}))
+
+	last, err := a.GetResumePoint()
+	assert.NoError(t, err)
+	assert.Equal(t, "a2", last.ID.TokenData)
+
+	watermark, err := repo.Watermark(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "b1", watermark.ID.TokenData)
+
+	assert.NoError(t, b.SaveResumePoint(ctx, point("b2", 30)))
+	watermark, err = repo.Watermark(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "a2", watermark.ID.TokenData)
+
+	checkpoints, err := repo.Partitions(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, checkpoints, 2)
+}
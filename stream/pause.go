@@ -0,0 +1,146 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// PauseGate holds back event dispatching while paused. The change stream stays open, the paused event is
+// dispatched once resumed, so pausing neither skips nor replays events.
+type PauseGate struct {
+	mu      sync.Mutex
+	paused  bool
+	resumed chan struct{}
+	// active counts events past the gate, idle is closed while there are none
+	active int
+	idle   chan struct{}
+}
+
+// NewPauseGate creates an open gate
+func NewPauseGate() *PauseGate {
+	idle := make(chan struct{})
+	close(idle)
+	return &PauseGate{resumed: make(chan struct{}), idle: idle}
+}
+
+// Pause holds back the next event
+func (g *PauseGate) Pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.paused {
+		g.paused = true
+		g.resumed = make(chan struct{})
+		log.Info("event dispatching paused")
+	}
+}
+
+// Resume releases the held back event
+func (g *PauseGate) Resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused {
+		g.paused = false
+		close(g.resumed)
+		log.Info("event dispatching resumed")
+	}
+}
+
+// Paused reports whether the gate is paused
+func (g *PauseGate) Paused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused
+}
+
+// Wait blocks while the gate is paused
+func (g *PauseGate) Wait(ctx context.Context) error {
+	g.mu.Lock()
+	paused, resumed := g.paused, g.resumed
+	g.mu.Unlock()
+	if !paused {
+		return nil
+	}
+
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Drain pauses the gate and waits until the events already past it are dispatched
+func (g *PauseGate) Drain(ctx context.Context) error {
+	g.Pause()
+
+	g.mu.Lock()
+	idle := g.idle
+	g.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// enter lets the event past the gate unless it is paused
+func (g *PauseGate) enter() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused {
+		return false
+	}
+	if g.active == 0 {
+		g.idle = make(chan struct{})
+	}
+	g.active++
+	return true
+}
+
+func (g *PauseGate) leave() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.active--
+	if g.active == 0 {
+		close(g.idle)
+	}
+}
+
+// Middleware returns the middleware to register with WithMiddleware, it should be the outermost one
+func (g *PauseGate) Middleware() mongowatch.ChangeEventMiddleware {
+	return func(next mongowatch.ChangeEventDispatcherFunc) mongowatch.ChangeEventDispatcherFunc {
+		return func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+			// checking and entering happen under one lock, so Drain can't miss an event about to start
+			for !g.enter() {
+				if wErr := g.Wait(ctx); wErr != nil {
+					return wErr
+				}
+			}
+			defer g.leave()
+			return next(ctx, ce, err)
+		}
+	}
+}
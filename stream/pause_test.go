@@ -0,0 +1,63 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+func TestPauseGate(t *testing.T) {
+	gate := NewPauseGate()
+	dispatched := make(chan struct{}, 1)
+	dispatch := gate.Middleware()(func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		dispatched <- struct{}{}
+		return nil
+	})
+
+	assert.NoError(t, dispatch(context.Background(), mongowatch.ChangeStreamEvent{}, nil))
+	<-dispatched
+
+	gate.Pause()
+	assert.True(t, gate.Paused())
+	done := make(chan error, 1)
+	go func() {
+		done <- dispatch(context.Background(), mongowatch.ChangeStreamEvent{}, nil)
+	}()
+
+	select {
+	case <-dispatched:
+		t.Fatal("event dispatched while paused")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	gate.Resume()
+	assert.NoError(t, <-done)
+	<-dispatched
+
+	// a stopped stream isn't held back by a paused gate
+	gate.Pause()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, dispatch(ctx, mongowatch.ChangeStreamEvent{}, nil), context.Canceled)
+}
@@ -0,0 +1,176 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ErrPipelineParity is returned when custom pipeline stages break the events, e.g. project out their documentKey
+var ErrPipelineParity = errors.New("pipeline stages break change events")
+
+// ErrSamplesFiltered is returned by CheckPipeline when the stages filter out every sample event,
+// pass samples matching them to check the events that get through
+var ErrSamplesFiltered = errors.New("pipeline stages filter out every sample event")
+
+// unrecognizedStageCode is the server error of unknown stages, $documents needs MongoDB 5.1
+const unrecognizedStageCode = 40324
+
+// sampleCollection is the collection of sample events of watchers not bound to a collection
+const sampleCollection = "mongowatch_sample"
+
+// changeStreamStages are the stages the server accepts in change stream pipelines
+var changeStreamStages = map[string]bool{
+	"$match": true, "$project": true, "$addFields": true, "$set": true, "$unset": true,
+	"$replaceRoot": true, "$replaceWith": true, "$redact": true,
+}
+
+// requiredEventFields must survive custom stages, the resume token (_id) must also stay unchanged
+var requiredEventFields = []string{"timestamp", "operationType", "documentKey"}
+
+// WithPipelineStages appends custom stages to the change stream pipeline, they see the events reshaped
+// like mongowatch.ChangeStreamEvent. The watcher checks them with CheckPipeline when it starts.
+func WithPipelineStages(stages ...bson.D) WatcherOption {
+	return func(csw *ChangeStreamWatcher) {
+		csw.stages = append(csw.stages, stages...)
+	}
+}
+
+// WithPipelineSamples sets the full documents of the sample events the custom stages are checked with
+func WithPipelineSamples(samples ...bson.M) WatcherOption {
+	return func(csw *ChangeStreamWatcher) {
+		csw.stageSamples = append(csw.stageSamples, samples...)
+	}
+}
+
+// CheckPipeline runs sample insert, update and delete events of col through the watcher pipeline followed by
+// the stages, with $documents (MongoDB 5.1+), and fails with ErrPipelineParity when an event that gets through
+// lost its timestamp, operationType or documentKey or had its resume token changed.
+// Samples are the full documents of the events, a document with just an _id by default.
+func CheckPipeline(ctx context.Context, col *mongo.Collection, stages mongo.Pipeline, samples ...bson.M) error {
+	for i, stage := range stages {
+		if len(stage) != 1 || !changeStreamStages[stage[0].Key] {
+			return fmt.Errorf("stage %d isn't allowed in change streams: %w", i, ErrPipelineParity)
+		}
+	}
+	if len(samples) == 0 {
+		samples = []bson.M{{"_id": primitive.NewObjectID()}}
+	}
+
+	events, tokens := sampleEvents(col, samples)
+	pipeline := append(mongo.Pipeline{{{Key: "$documents", Value: events}}}, buildPipeline()...)
+	cursor, err := col.Database().Aggregate(ctx, append(pipeline, stages...))
+	if err != nil {
+		return fmt.Errorf("failed to run the pipeline on sample events: %w", err)
+	}
+	var results []bson.Raw
+	if err = cursor.All(ctx, &results); err != nil {
+		return fmt.Errorf("failed to read sample events: %w", err)
+	}
+	if len(results) == 0 {
+		return ErrSamplesFiltered
+	}
+
+	for _, result := range results {
+		if err = checkSampleEvent(result, tokens); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sampleEvents builds raw change events of the samples and returns them with their resume tokens
+func sampleEvents(col *mongo.Collection, samples []bson.M) (bson.A, map[string]bool) {
+	events := bson.A{}
+	tokens := map[string]bool{}
+	for i, doc := range samples {
+		id, ok := doc["_id"]
+		if !ok {
+			id = primitive.NewObjectID()
+		}
+		for j, op := range []string{"insert", "update", "delete"} {
+			token := fmt.Sprintf("82%08X%02X", i, j)
+			tokens[token] = true
+			event := bson.M{
+				"_id":           bson.M{"_data": token},
+				"operationType": op,
+				"clusterTime":   primitive.Timestamp{T: 1, I: uint32(i*3 + j + 1)},
+				"ns":            bson.M{"db": col.Database().Name(), "coll": col.Name()},
+				"documentKey":   bson.M{"_id": id},
+			}
+			switch op {
+			case "insert":
+				event["fullDocument"] = doc
+			case "update":
+				event["fullDocument"] = doc
+				event["updateDescription"] = bson.M{"updatedFields": bson.M{}, "removedFields": bson.A{}}
+			}
+			events = append(events, event)
+		}
+	}
+	return events, tokens
+}
+
+func checkSampleEvent(event bson.Raw, tokens map[string]bool) error {
+	token, ok := event.Lookup("_id", "_data").StringValueOK()
+	if !ok || !tokens[token] {
+		return fmt.Errorf("resume token changed to %s: %w", event.Lookup("_id"), ErrPipelineParity)
+	}
+	for _, field := range requiredEventFields {
+		if v, err := event.LookupErr(field); err != nil || v.Type == bson.TypeNull {
+			return fmt.Errorf("%s missing from %s event: %w", field, event.Lookup("operationType"), ErrPipelineParity)
+		}
+	}
+	return nil
+}
+
+// checkStages runs CheckPipeline on the custom stages once, servers without $documents and samples
+// filtered out by the stages only log a warning
+func (csw *ChangeStreamWatcher) checkStages(ctx context.Context) error {
+	if len(csw.stages) == 0 || csw.stagesChecked {
+		return nil
+	}
+	var col *mongo.Collection
+	switch target := csw.target.(type) {
+	case *mongo.Collection:
+		col = target
+	case *mongo.Client:
+		col = target.Database("admin").Collection(sampleCollection)
+	default:
+		return nil
+	}
+
+	err := CheckPipeline(ctx, col, csw.stages, csw.stageSamples...)
+	var serverErr mongo.ServerError
+	switch {
+	case errors.Is(err, ErrSamplesFiltered):
+		logger(ctx).Warnf("pipeline stages of %s not checked: %v", csw.namespace, err)
+	case errors.As(err, &serverErr) && serverErr.HasErrorCode(unrecognizedStageCode):
+		logger(ctx).Warnf("pipeline stages of %s not checked, the server doesn't support $documents: %v", csw.namespace, err)
+	case err != nil:
+		return fmt.Errorf("failed to check the pipeline stages of %s: %w", csw.namespace, err)
+	}
+	csw.stagesChecked = true
+	return nil
+}
@@ -0,0 +1,62 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestPipelineStages(t *testing.T) {
+	stage := bson.D{{Key: "$unset", Value: "fullDocument.secret"}}
+	pipeline := NewChangeStreamWatcher(nil, WithPipelineStages(stage)).pipeline()
+	assert.Len(t, pipeline, len(buildPipeline())+1)
+	assert.Equal(t, stage, pipeline[len(pipeline)-1])
+
+	err := CheckPipeline(context.Background(), nil, mongo.Pipeline{{{Key: "$group", Value: bson.D{{Key: "_id", Value: nil}}}}})
+	assert.True(t, errors.Is(err, ErrPipelineParity))
+}
+
+func TestCheckSampleEvent(t *testing.T) {
+	tokens := map[string]bool{"820000000000": true}
+	event := func(doc bson.D) bson.Raw {
+		raw, err := bson.Marshal(doc)
+		assert.NoError(t, err)
+		return raw
+	}
+	valid := bson.D{
+		{Key: "_id", Value: bson.D{{Key: "_data", Value: "820000000000"}}},
+		{Key: "operationType", Value: "insert"},
+		{Key: "timestamp", Value: 1},
+		{Key: "documentKey", Value: "a"},
+	}
+	assert.NoError(t, checkSampleEvent(event(valid), tokens))
+
+	for name, doc := range map[string]bson.D{
+		"projected out documentKey": valid[:3],
+		"nulled timestamp":          {valid[0], valid[1], {Key: "timestamp", Value: nil}, valid[3]},
+		"replaced resume token":     append(bson.D{{Key: "_id", Value: "a"}}, valid[1:]...),
+	} {
+		assert.True(t, errors.Is(checkSampleEvent(event(doc), tokens), ErrPipelineParity), name)
+	}
+}
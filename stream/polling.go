@@ -0,0 +1,307 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// PollConfig configures a PollingWatcher
+type PollConfig struct {
+	// Filter restricts the polled documents, e.g. to the ones of a tenant
+	Filter bson.M
+	// TimeField is the date field polled on, set on every write of a document, e.g. updatedAt
+	TimeField string
+	// CreatedField tells inserts, whose creation time equals TimeField, from updates;
+	// without it every document is dispatched as an update unless InsertOnly is set
+	CreatedField string
+	// InsertOnly dispatches every document as an insert, for append-only namespaces
+	InsertOnly bool
+	// SoftDelete reports documents marked as deleted, they are dispatched as deletes, see DeletedWhenSet
+	SoftDelete func(doc primitive.M) bool
+	// Interval between polls once the watcher caught up, 5s by default
+	Interval time.Duration
+	// BatchSize bounds the documents fetched by a single poll, 1000 by default
+	BatchSize int32
+	// Lag leaves out documents newer than now - Lag, so writes committed slightly out of order aren't skipped
+	Lag time.Duration
+}
+
+// DeletedWhenSet returns a SoftDelete func reporting documents where field is set to anything but null or false
+func DeletedWhenSet(field string) func(doc primitive.M) bool {
+	return func(doc primitive.M) bool {
+		value, ok := mongowatch.LookupField(doc, field)
+		return ok && value != nil && value != false
+	}
+}
+
+// PollingWatcher feeds documents of namespaces without change streams (views, time series collections...)
+// to the same handlers as a ChangeStreamWatcher by polling on a time field. The high-water mark is the
+// time and _id of the last document, checkpointed as the resume point of every event.
+// Polling only sees the latest state of a document: intermediate writes between polls are merged,
+// hard deletes and writes with a time at or before the high-water mark are never seen.
+type PollingWatcher struct {
+	target pollTarget
+	// database and collection name the polled namespace on events
+	database   string
+	collection string
+	cfg        PollConfig
+}
+
+// pollTarget is what a PollingWatcher queries, a collection, view or time series collection
+type pollTarget interface {
+	Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error)
+}
+
+var _ mongowatch.ChangeStreamWatcher = (*PollingWatcher)(nil)
+
+// NewPollingWatcher creates a watcher polling col
+func NewPollingWatcher(col *mongo.Collection, cfg PollConfig) *PollingWatcher {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 5 * time.Second
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 1000
+	}
+	w := &PollingWatcher{cfg: cfg}
+	if col != nil {
+		w.target, w.database, w.collection = col, col.Database().Name(), col.Name()
+	}
+	return w
+}
+
+// NewWatcher returns a ChangeStreamWatcher for regular collections and a PollingWatcher for namespaces
+// without change streams: time series collections are polled on their time field as inserts, views on
+// poll.TimeField. Pass it to a processor with WithWatcher.
+func NewWatcher(ctx context.Context, col *mongo.Collection, poll PollConfig, opts ...WatcherOption) (mongowatch.ChangeStreamWatcher, error) {
+	specs, err := col.Database().ListCollectionSpecifications(ctx, bson.M{"name": col.Name()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list collections: %w", err)
+	}
+	if len(specs) == 0 {
+		return NewChangeStreamWatcher(col, opts...), nil
+	}
+
+	switch specs[0].Type {
+	case "timeseries":
+		timeField, err := timeSeriesField(specs[0])
+		if err != nil {
+			return nil, err
+		}
+		if poll.TimeField == "" {
+			poll.TimeField = timeField
+		}
+		poll.InsertOnly = true
+	case "view":
+		if poll.TimeField == "" {
+			return nil, fmt.Errorf("%s is a view, polling it requires a time field, see WatchView otherwise", col.Name())
+		}
+	default:
+		return NewChangeStreamWatcher(col, opts...), nil
+	}
+	logger(ctx).Infof("%s is a %s, polling on %s instead of watching it", col.Name(), specs[0].Type, poll.TimeField)
+	return NewPollingWatcher(col, poll), nil
+}
+
+// pollMark is the high-water mark of a polling watcher, stored as the resume token
+type pollMark struct {
+	Time primitive.DateTime `bson:"time"`
+	ID   interface{}        `bson:"id"`
+}
+
+// Start polls the namespace from the resume point on, dispatching every document found
+func (w *PollingWatcher) Start(
+	ctx context.Context,
+	_ options.FullDocument,
+	resumePoint *mongowatch.ChangeStreamResumePoint,
+	saveFunc, deleteFunc mongowatch.ChangeEventDispatcherFunc,
+	dispatchFuncs ...mongowatch.ChangeEventDispatcherFunc,
+) error {
+	var mark *pollMark
+	var previousEvent *mongowatch.ChangeStreamEvent
+	// only the first poll after resuming includes the document of the mark, it may not have been processed
+	inclusive := resumePoint != nil
+	if resumePoint != nil {
+		m, err := decodePollMark(resumePoint.ID)
+		if err != nil {
+			return err
+		}
+		mark = &m
+		previousEvent = &mongowatch.ChangeStreamEvent{ID: resumePoint.ID, Timestamp: resumePoint.Timestamp}
+	}
+
+	for {
+		docs, err := w.poll(ctx, mark, inclusive)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		inclusive = false
+
+		for _, doc := range docs {
+			ce, m, err := w.event(doc)
+			if err != nil {
+				return err
+			}
+			evCtx := mongowatch.ContextWithEvent(ctx, ce)
+			// the document of the resume point may not have been processed, it is dispatched again
+			if resumePoint == nil || !sameToken(ce.ID, resumePoint.ID) {
+				if err = checkpoint(evCtx, saveFunc, deleteFunc, ce, previousEvent); err != nil {
+					return err
+				}
+				previousEvent = &ce
+			}
+			if err = dispatchChain(evCtx, ce, dispatchFuncs); err != nil {
+				return fmt.Errorf("failed to process event: %w", err)
+			}
+			eventLogf(evCtx, "processed polled document: %v", ce.ID.TokenData)
+			mark = &m
+			resumePoint = nil
+		}
+
+		if len(docs) == int(w.cfg.BatchSize) {
+			continue
+		}
+		select {
+		case <-time.After(w.cfg.Interval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// poll fetches the documents after the mark, or from the mark on when inclusive, ordered by time and _id
+func (w *PollingWatcher) poll(ctx context.Context, mark *pollMark, inclusive bool) ([]primitive.M, error) {
+	filter := bson.M{}
+	for k, v := range w.cfg.Filter {
+		filter[k] = v
+	}
+	timeRange := bson.M{}
+	if w.cfg.Lag > 0 {
+		timeRange["$lt"] = time.Now().Add(-w.cfg.Lag)
+	}
+	var conditions bson.A
+	if mark != nil {
+		// documents of the same instant are told apart by _id
+		idOp := "$gt"
+		if inclusive {
+			idOp = "$gte"
+		}
+		timeRange["$gte"] = mark.Time
+		conditions = append(conditions, bson.M{"$or": bson.A{
+			bson.M{w.cfg.TimeField: bson.M{"$gt": mark.Time}},
+			bson.M{"_id": bson.M{idOp: mark.ID}},
+		}})
+	}
+	if len(timeRange) > 0 {
+		conditions = append(conditions, bson.M{w.cfg.TimeField: timeRange})
+	}
+	if len(conditions) > 0 {
+		// the configured filter may use the same top level keys
+		filter = bson.M{"$and": append(conditions, filter)}
+	}
+
+	cursor, err := w.target.Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: w.cfg.TimeField, Value: 1}, {Key: "_id", Value: 1}}).
+		SetLimit(int64(w.cfg.BatchSize)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to poll %s: %w", w.collection, err)
+	}
+	var docs []primitive.M
+	if err = cursor.All(ctx, &docs); err != nil {
+		return nil, fmt.Errorf("failed to read polled documents: %w", err)
+	}
+	return docs, nil
+}
+
+// event wraps a polled document into a change event
+func (w *PollingWatcher) event(doc primitive.M) (mongowatch.ChangeStreamEvent, pollMark, error) {
+	at, ok := doc[w.cfg.TimeField].(primitive.DateTime)
+	if !ok {
+		return mongowatch.ChangeStreamEvent{}, pollMark{}, fmt.Errorf("document %v has no %s time", doc["_id"], w.cfg.TimeField)
+	}
+	mark := pollMark{Time: at, ID: doc["_id"]}
+	ce := mongowatch.ChangeStreamEvent{
+		ID:            mongowatch.ResumeToken{TokenData: mark},
+		Timestamp:     primitive.Timestamp{T: uint32(at.Time().Unix())},
+		OperationType: w.operationType(doc, at),
+		Database:      w.database,
+		Collection:    w.collection,
+		DocumentKey:   documentKeyString(doc["_id"]),
+		FullDocument:  doc,
+	}
+	if ce.OperationType == "delete" {
+		// deletes carry the last state as pre-image, like change stream deletes
+		ce.FullDocument, ce.FullDocumentBeforeChange = nil, doc
+		ce.HasPreImage = true
+	}
+	return ce, mark, nil
+}
+
+func (w *PollingWatcher) operationType(doc primitive.M, at primitive.DateTime) string {
+	switch {
+	case w.cfg.SoftDelete != nil && w.cfg.SoftDelete(doc):
+		return "delete"
+	case w.cfg.InsertOnly:
+		return "insert"
+	case w.cfg.CreatedField != "" && doc[w.cfg.CreatedField] == at:
+		return "insert"
+	}
+	return "update"
+}
+
+// decodePollMark reads the mark back from a resume token, which comes back from storage as a generic document
+func decodePollMark(token mongowatch.ResumeToken) (pollMark, error) {
+	var wrapper struct {
+		Mark pollMark `bson:"mark"`
+	}
+	data, err := bson.Marshal(bson.M{"mark": token.TokenData})
+	if err == nil {
+		err = bson.Unmarshal(data, &wrapper)
+	}
+	if err != nil || wrapper.Mark.ID == nil {
+		return pollMark{}, errors.New("resume point doesn't belong to a polling watcher")
+	}
+	return wrapper.Mark, nil
+}
+
+func sameToken(a, b mongowatch.ResumeToken) bool {
+	ma, errA := decodePollMark(a)
+	mb, errB := decodePollMark(b)
+	return errA == nil && errB == nil && ma.Time == mb.Time && fmt.Sprint(ma.ID) == fmt.Sprint(mb.ID)
+}
+
+// documentKeyString formats an _id the way documentKey is presented on change events
+func documentKeyString(id interface{}) string {
+	if oid, ok := id.(primitive.ObjectID); ok {
+		return oid.Hex()
+	}
+	return fmt.Sprint(id)
+}
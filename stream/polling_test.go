@@ -0,0 +1,232 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+func TestTimeSeriesWatcherEvent(t *testing.T) {
+	// connecting doesn't reach out to the server
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://localhost:27017"))
+	require.NoError(t, err)
+	w := NewTimeSeriesWatcher(client.Database("metrics").Collection("measurements"), PollConfig{TimeField: "ts"})
+	at := primitive.NewDateTimeFromTime(time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC))
+	id := primitive.NewObjectID()
+
+	ce, mark, err := w.event(primitive.M{"_id": id, "ts": at, "value": 3})
+	require.NoError(t, err)
+	assert.Equal(t, pollMark{Time: at, ID: id}, mark)
+	assert.Equal(t, "insert", ce.OperationType)
+	assert.Equal(t, "measurements", ce.Collection)
+	assert.Equal(t, id.Hex(), ce.DocumentKey)
+	assert.Equal(t, uint32(at.Time().Unix()), ce.Timestamp.T)
+
+	_, _, err = w.event(primitive.M{"_id": id})
+	assert.Error(t, err)
+}
+
+func TestPollingWatcherOperationType(t *testing.T) {
+	created := primitive.NewDateTimeFromTime(time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC))
+	updated := primitive.NewDateTimeFromTime(time.Date(2023, 5, 2, 12, 0, 0, 0, time.UTC))
+	w := NewPollingWatcher(nil, PollConfig{TimeField: "updatedAt", CreatedField: "createdAt", SoftDelete: DeletedWhenSet("deletedAt")})
+
+	assert.Equal(t, "insert", w.operationType(primitive.M{"createdAt": created, "updatedAt": created}, created))
+	assert.Equal(t, "update", w.operationType(primitive.M{"createdAt": created, "updatedAt": updated}, updated))
+	assert.Equal(t, "update", w.operationType(primitive.M{"deletedAt": nil}, updated))
+	assert.Equal(t, "delete", w.operationType(primitive.M{"deletedAt": updated}, updated))
+	assert.Equal(t, "update", NewPollingWatcher(nil, PollConfig{TimeField: "updatedAt"}).operationType(primitive.M{}, updated))
+}
+
+func TestPollMarkSurvivesResumeRepository(t *testing.T) {
+	id := primitive.NewObjectID()
+	mark := pollMark{Time: primitive.NewDateTimeFromTime(time.Now().Truncate(time.Millisecond)), ID: id}
+
+	// stored and read back like a resume point, the token loses its type on the way
+	data, err := bson.Marshal(mongowatch.ChangeStreamResumePoint{ID: mongowatch.ResumeToken{TokenData: mark}})
+	require.NoError(t, err)
+	var point mongowatch.ChangeStreamResumePoint
+	require.NoError(t, bson.Unmarshal(data, &point))
+
+	decoded, err := decodePollMark(point.ID)
+	require.NoError(t, err)
+	assert.Equal(t, mark, decoded)
+	assert.True(t, sameToken(point.ID, mongowatch.ResumeToken{TokenData: mark}))
+
+	_, err = decodePollMark(mongowatch.ResumeToken{TokenData: "8264A1"})
+	assert.Error(t, err)
+}
+
+// memoryPollTarget serves Find from documents in memory, evaluating the filter with the client-side $match
+type memoryPollTarget struct {
+	mu        sync.Mutex
+	timeField string
+	docs      []primitive.M
+}
+
+func (m *memoryPollTarget) add(docs ...primitive.M) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.docs = append(m.docs, docs...)
+}
+
+func (m *memoryPollTarget) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	data, err := bson.Marshal(filter)
+	if err != nil {
+		return nil, err
+	}
+	var query bson.D
+	if err = bson.Unmarshal(data, &query); err != nil {
+		return nil, err
+	}
+	match, err := compileFilter(query)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	var found []primitive.M
+	for _, doc := range m.docs {
+		if match(doc) {
+			found = append(found, doc)
+		}
+	}
+	m.mu.Unlock()
+	sort.Slice(found, func(i, j int) bool {
+		if cmp, _ := compareValues(found[i][m.timeField], found[j][m.timeField]); cmp != 0 {
+			return cmp < 0
+		}
+		cmp, _ := compareValues(found[i]["_id"], found[j]["_id"])
+		return cmp < 0
+	})
+	if limit := options.MergeFindOptions(opts...).Limit; limit != nil && int(*limit) < len(found) {
+		found = found[:*limit]
+	}
+
+	results := make([]interface{}, len(found))
+	for i, doc := range found {
+		results[i] = doc
+	}
+	return mongo.NewCursorFromDocuments(results, nil, nil)
+}
+
+// pollRecorder collects the dispatched documents and the checkpoints of a polling watcher
+type pollRecorder struct {
+	mu                         sync.Mutex
+	dispatched, saved, deleted []string
+}
+
+func (r *pollRecorder) record(list *[]string) mongowatch.ChangeEventDispatcherFunc {
+	return func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		*list = append(*list, ce.DocumentKey)
+		return nil
+	}
+}
+
+func (r *pollRecorder) snapshot() (dispatched, saved, deleted []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.dispatched...), append([]string(nil), r.saved...), append([]string(nil), r.deleted...)
+}
+
+func (r *pollRecorder) run(t *testing.T, w *PollingWatcher, resumePoint *mongowatch.ChangeStreamResumePoint) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- w.Start(ctx, options.Off, resumePoint, r.record(&r.saved), r.record(&r.deleted), r.record(&r.dispatched))
+	}()
+	return func() {
+		cancel()
+		assert.NoError(t, <-done)
+	}
+}
+
+func TestPollingWatcherStart(t *testing.T) {
+	at := func(minute int) primitive.DateTime {
+		return primitive.NewDateTimeFromTime(time.Date(2023, 5, 1, 12, minute, 0, 0, time.UTC))
+	}
+	target := &memoryPollTarget{timeField: "ts"}
+	// a and b share an instant, they are told apart by _id
+	target.add(primitive.M{"_id": "a", "ts": at(1)}, primitive.M{"_id": "b", "ts": at(1)}, primitive.M{"_id": "c", "ts": at(2)})
+	w := &PollingWatcher{target: target, cfg: PollConfig{TimeField: "ts", InsertOnly: true, Interval: 5 * time.Millisecond, BatchSize: 1}}
+
+	r := &pollRecorder{}
+	stop := r.run(t, w, nil)
+	// several polls past the last document don't dispatch it again
+	time.Sleep(50 * time.Millisecond)
+	target.add(primitive.M{"_id": "d", "ts": at(3)})
+	assert.Eventually(t, func() bool {
+		dispatched, _, _ := r.snapshot()
+		return len(dispatched) >= 4
+	}, time.Second, 5*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	stop()
+
+	dispatched, saved, deleted := r.snapshot()
+	assert.Equal(t, []string{"a", "b", "c", "d"}, dispatched)
+	assert.Equal(t, []string{"a", "b", "c", "d"}, saved)
+	// the resume point of the last document is kept
+	assert.Equal(t, []string{"a", "b", "c"}, deleted)
+
+	// resuming dispatches the document of the resume point again, once
+	r = &pollRecorder{}
+	point := &mongowatch.ChangeStreamResumePoint{ID: mongowatch.ResumeToken{TokenData: pollMark{Time: at(2), ID: "c"}}}
+	stop = r.run(t, w, point)
+	time.Sleep(50 * time.Millisecond)
+	stop()
+
+	dispatched, saved, deleted = r.snapshot()
+	assert.Equal(t, []string{"c", "d"}, dispatched)
+	assert.Equal(t, []string{"d"}, saved)
+	// the resume point replaced by d
+	assert.Len(t, deleted, 1)
+}
+
+func TestTimeSeriesWatcherStart(t *testing.T) {
+	at := primitive.NewDateTimeFromTime(time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC))
+	target := &memoryPollTarget{timeField: "ts"}
+	target.add(primitive.M{"_id": "m1", "ts": at, "value": 3})
+	w := NewTimeSeriesWatcher(nil, PollConfig{TimeField: "ts", Interval: 5 * time.Millisecond, BatchSize: 1})
+	w.target = target
+
+	r := &pollRecorder{}
+	stop := r.run(t, w, nil)
+	// the single measurement is polled many times over but dispatched and checkpointed once
+	time.Sleep(50 * time.Millisecond)
+	stop()
+
+	dispatched, saved, deleted := r.snapshot()
+	assert.Equal(t, []string{"m1"}, dispatched)
+	assert.Equal(t, []string{"m1"}, saved)
+	assert.Empty(t, deleted)
+}
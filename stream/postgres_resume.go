@@ -0,0 +1,328 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// DefaultPostgresResumeTable is the table PostgresResume keeps resume points in
+const DefaultPostgresResumeTable = "mongowatch_resume_points"
+
+// ErrInvalidPostgresTable is returned when the table given with WithPostgresTable isn't a plain, optionally schema
+// qualified, identifier. It is interpolated into the statements, so it is validated instead of quoted.
+var ErrInvalidPostgresTable = errors.New("invalid resume point table name")
+
+// postgresIdentifier is an unquoted identifier, short enough for the _migrations suffix to fit the 63 byte limit
+var postgresIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,51}$`)
+
+// postgresResumeMigrations create and evolve the resume point table, %[1]s is the table name and %[2]s the table name
+// without its schema, for the objects named after the table.
+// Append new statements, never edit applied ones: the migrations table records how many ran.
+var postgresResumeMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS %[1]s (
+	stream TEXT NOT NULL,
+	token TEXT NOT NULL,
+	cluster_time_t BIGINT NOT NULL,
+	cluster_time_i BIGINT NOT NULL,
+	operation_type TEXT NOT NULL DEFAULT '',
+	epoch BIGINT NOT NULL DEFAULT 0,
+	namespace TEXT NOT NULL DEFAULT '',
+	cluster TEXT NOT NULL DEFAULT '',
+	schema_version INTEGER NOT NULL,
+	sink_offset TEXT NOT NULL DEFAULT '',
+	full_document JSONB,
+	stored_at TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (stream, token)
+)`,
+	`CREATE INDEX IF NOT EXISTS %[2]s_latest ON %[1]s (stream, epoch DESC, cluster_time_t DESC, cluster_time_i DESC)`,
+}
+
+// PostgresResume is a mongowatch.StreamResume keeping resume points in a PostgreSQL table through database/sql,
+// next to the rest of the service state. Several streams share the table, each under its own name.
+// The table is created and migrated on first use, see Migrate.
+type PostgresResume struct {
+	db     *sql.DB
+	table  string
+	stream string
+
+	mu       sync.Mutex
+	migrated bool
+}
+
+var _ mongowatch.StreamResume = (*PostgresResume)(nil)
+
+// PostgresResumeOption configures a PostgresResume
+type PostgresResumeOption func(*PostgresResume)
+
+// WithPostgresTable sets the table of the resume points, DefaultPostgresResumeTable by default
+func WithPostgresTable(table string) PostgresResumeOption {
+	return func(r *PostgresResume) {
+		r.table = table
+	}
+}
+
+// NewPostgresResume creates a resume store for the named stream, db must use a PostgreSQL driver
+func NewPostgresResume(db *sql.DB, stream string, opts ...PostgresResumeOption) *PostgresResume {
+	r := &PostgresResume{db: db, table: DefaultPostgresResumeTable, stream: stream}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Migrations returns the schema statements in order, for services applying migrations with their own tooling
+func (r *PostgresResume) Migrations() []string {
+	name := r.table[strings.LastIndex(r.table, ".")+1:]
+	statements := make([]string, len(postgresResumeMigrations))
+	for i, m := range postgresResumeMigrations {
+		statements[i] = fmt.Sprintf(m, r.table, name)
+	}
+	return statements
+}
+
+// validateTable checks the table is a valid identifier, optionally qualified with a schema
+func (r *PostgresResume) validateTable() error {
+	parts := strings.Split(r.table, ".")
+	if len(parts) > 2 {
+		return fmt.Errorf("%w: %q", ErrInvalidPostgresTable, r.table)
+	}
+	for _, part := range parts {
+		if !postgresIdentifier.MatchString(part) {
+			return fmt.Errorf("%w: %q", ErrInvalidPostgresTable, r.table)
+		}
+	}
+	return nil
+}
+
+// Migrate applies the pending schema migrations, recording them in <table>_migrations.
+// Concurrent callers are serialized by a transaction scoped advisory lock, so every migration runs once.
+func (r *PostgresResume) Migrate(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.migrated {
+		return nil
+	}
+	if err := r.validateTable(); err != nil {
+		return err
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin resume point migration: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// taken before creating the migrations table, concurrent CREATE TABLE IF NOT EXISTS collide on pg_type
+	versions := r.table + "_migrations"
+	if _, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, versions); err != nil {
+		return fmt.Errorf("failed to lock resume point migrations: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS %s (version INTEGER PRIMARY KEY, applied_at TIMESTAMPTZ NOT NULL DEFAULT now())`, versions))
+	if err != nil {
+		return fmt.Errorf("failed to create resume point migrations table: %w", err)
+	}
+	var applied int
+	if err = tx.QueryRowContext(ctx, fmt.Sprintf(`SELECT COALESCE(MAX(version), 0) FROM %s`, versions)).Scan(&applied); err != nil {
+		return fmt.Errorf("failed to read resume point schema version: %w", err)
+	}
+	statements := r.Migrations()
+	for v := applied; v < len(statements); v++ {
+		if _, err = tx.ExecContext(ctx, statements[v]); err != nil {
+			return fmt.Errorf("failed to apply resume point migration %d: %w", v+1, err)
+		}
+		if _, err = tx.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %s (version) VALUES ($1)`, versions), v+1); err != nil {
+			return fmt.Errorf("failed to record resume point migration %d: %w", v+1, err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit resume point migrations: %w", err)
+	}
+	if len(statements) > applied {
+		logger(ctx).Infof("migrated resume point table %s to version %d", r.table, len(statements))
+	}
+
+	r.migrated = true
+	return nil
+}
+
+// postgresColumns are the columns read into a resume point, in the order of scanResumePoint
+const postgresColumns = `token, cluster_time_t, cluster_time_i, operation_type, epoch, namespace, cluster,
+	schema_version, sink_offset, full_document, stored_at`
+
+// GetResumePoint returns the latest point of the stream, mongo.ErrNoDocuments without one like ResumeRepository
+func (r *PostgresResume) GetResumePoint() (*mongowatch.ChangeStreamResumePoint, error) {
+	ctx := context.Background()
+	if err := r.Migrate(ctx); err != nil {
+		return nil, err
+	}
+	// points written by a newer epoch always win, like in ResumeRepository
+	row := r.db.QueryRowContext(ctx, fmt.Sprintf(`SELECT %s FROM %s WHERE stream = $1
+ORDER BY epoch DESC, cluster_time_t DESC, cluster_time_i DESC LIMIT 1`, postgresColumns, r.table), r.stream)
+	point, err := scanResumePoint(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("no resume point stored for %s: %w", r.stream, mongo.ErrNoDocuments)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find resume point: %w", err)
+	}
+	return point, nil
+}
+
+// rowScanner is satisfied by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanResumePoint(row rowScanner) (*mongowatch.ChangeStreamResumePoint, error) {
+	var (
+		point    mongowatch.ChangeStreamResumePoint
+		token    string
+		t, i     int64
+		document sql.NullString
+	)
+	err := row.Scan(&token, &t, &i, &point.OperationType, &point.Epoch, &point.Namespace, &point.Cluster,
+		&point.SchemaVersion, &point.SinkOffset, &document, &point.StoredAt)
+	if err != nil {
+		return nil, err
+	}
+	point.ID = mongowatch.ResumeToken{TokenData: token}
+	point.Timestamp = primitive.Timestamp{T: uint32(t), I: uint32(i)}
+	if document.Valid {
+		if err = bson.UnmarshalExtJSON([]byte(document.String), false, &point.FullDocument); err != nil {
+			return nil, fmt.Errorf("failed to decode resume point document: %w", err)
+		}
+	}
+	return &point, nil
+}
+
+// GetResumeTime returns the timestamp of the latest point
+func (r *PostgresResume) GetResumeTime() (*primitive.Timestamp, error) {
+	point, err := r.GetResumePoint()
+	if err != nil {
+		return nil, err
+	}
+	return &point.Timestamp, nil
+}
+
+// SaveResumePoint stores the point, saving a token again overwrites it
+func (r *PostgresResume) SaveResumePoint(ctx context.Context, ce mongowatch.ChangeStreamResumePoint) error {
+	if err := r.Migrate(ctx); err != nil {
+		return err
+	}
+	return r.save(ctx, r.db, ce)
+}
+
+// execer is satisfied by *sql.DB and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func (r *PostgresResume) save(ctx context.Context, db execer, ce mongowatch.ChangeStreamResumePoint) error {
+	ce.SchemaVersion = ResumePointSchemaVersion
+	ce.StoredAt = time.Now()
+	args, err := resumePointArgs(r.stream, ce)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %s (stream, %s) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+ON CONFLICT (stream, token) DO UPDATE SET cluster_time_t = EXCLUDED.cluster_time_t, cluster_time_i = EXCLUDED.cluster_time_i,
+	operation_type = EXCLUDED.operation_type, epoch = EXCLUDED.epoch, namespace = EXCLUDED.namespace, cluster = EXCLUDED.cluster,
+	schema_version = EXCLUDED.schema_version, sink_offset = EXCLUDED.sink_offset, full_document = EXCLUDED.full_document,
+	stored_at = EXCLUDED.stored_at`, r.table, postgresColumns), args...)
+	if err != nil {
+		return fmt.Errorf("failed to save resume point: %w", err)
+	}
+	return nil
+}
+
+// resumePointArgs returns the values of the stream column and postgresColumns for ce
+func resumePointArgs(stream string, ce mongowatch.ChangeStreamResumePoint) ([]interface{}, error) {
+	var document interface{}
+	if ce.FullDocument != nil {
+		data, err := bson.MarshalExtJSON(ce.FullDocument, false, false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode resume point document: %w", err)
+		}
+		document = string(data)
+	}
+	return []interface{}{
+		stream, fmt.Sprint(ce.ID.TokenData), int64(ce.Timestamp.T), int64(ce.Timestamp.I), ce.OperationType, ce.Epoch,
+		ce.Namespace, ce.Cluster, ce.SchemaVersion, ce.SinkOffset, document, ce.StoredAt,
+	}, nil
+}
+
+// DeleteResumePoint deletes the point with the token
+func (r *PostgresResume) DeleteResumePoint(ctx context.Context, token mongowatch.ResumeToken) error {
+	if err := r.Migrate(ctx); err != nil {
+		return err
+	}
+	_, err := r.db.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %s WHERE stream = $1 AND token = $2`, r.table),
+		r.stream, fmt.Sprint(token.TokenData))
+	if err != nil {
+		return fmt.Errorf("failed to delete resume point: %w", err)
+	}
+	return nil
+}
+
+// ReplaceResumePoints deletes all points of the stream and saves ce as the only one, in one transaction
+func (r *PostgresResume) ReplaceResumePoints(ctx context.Context, ce mongowatch.ChangeStreamResumePoint) error {
+	if err := r.Migrate(ctx); err != nil {
+		return err
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin resume point replacement: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err = tx.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %s WHERE stream = $1`, r.table), r.stream); err != nil {
+		return fmt.Errorf("failed to delete resume points: %w", err)
+	}
+	if err = r.save(ctx, tx, ce); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit resume point replacement: %w", err)
+	}
+	return nil
+}
+
+// Describe summarizes the latest point
+func (r *PostgresResume) Describe(ctx context.Context) (*mongowatch.ResumePointInfo, error) {
+	point, err := r.GetResumePoint()
+	if err != nil {
+		return nil, err
+	}
+	info := point.Describe(time.Now())
+	return &info, nil
+}
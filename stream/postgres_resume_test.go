@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// valuesRow scans the given values the way a driver returns the written columns
+type valuesRow []interface{}
+
+func (v valuesRow) Scan(dest ...interface{}) error {
+	for i, d := range dest {
+		if ns, ok := d.(*sql.NullString); ok {
+			s, valid := v[i].(string)
+			*ns = sql.NullString{String: s, Valid: valid}
+			continue
+		}
+		target := reflect.ValueOf(d).Elem()
+		target.Set(reflect.ValueOf(v[i]).Convert(target.Type()))
+	}
+	return nil
+}
+
+func Test_PostgresResume_Migrations(t *testing.T) {
+	r := NewPostgresResume(nil, "orders", WithPostgresTable("svc.resume"))
+	statements := r.Migrations()
+	require.Len(t, statements, len(postgresResumeMigrations))
+	assert.True(t, strings.HasPrefix(statements[0], "CREATE TABLE IF NOT EXISTS svc.resume ("))
+	assert.Contains(t, statements[1], "EXISTS resume_latest ON svc.resume (")
+
+	assert.Contains(t, NewPostgresResume(nil, "orders").Migrations()[0], DefaultPostgresResumeTable)
+}
+
+func Test_PostgresResume_InvalidTable(t *testing.T) {
+	tests := []struct {
+		table string
+		valid bool
+	}{
+		{table: DefaultPostgresResumeTable, valid: true},
+		{table: "svc.resume", valid: true},
+		{table: "a.b.c"},
+		{table: "resume; DROP TABLE orders"},
+		{table: `"resume"`},
+		{table: "1resume"},
+		{table: ""},
+		{table: strings.Repeat("r", 53)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.table, func(t *testing.T) {
+			err := NewPostgresResume(nil, "orders", WithPostgresTable(tt.table)).validateTable()
+			if tt.valid {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, ErrInvalidPostgresTable)
+			// rejected before the database is used
+			assert.ErrorIs(t, NewPostgresResume(nil, "orders", WithPostgresTable(tt.table)).Migrate(context.Background()), ErrInvalidPostgresTable)
+		})
+	}
+}
+
+func Test_PostgresResume_RowRoundTrip(t *testing.T) {
+	point := mongowatch.ChangeStreamResumePoint{
+		ID:            mongowatch.ResumeToken{TokenData: "82aa"},
+		Timestamp:     primitive.Timestamp{T: 1<<32 - 1, I: 7},
+		FullDocument:  primitive.M{"status": "paid"},
+		OperationType: "update",
+		Epoch:         2,
+		Namespace:     "shop.orders",
+		SchemaVersion: ResumePointSchemaVersion,
+		SinkOffset:    "kafka:42",
+	}
+	args, err := resumePointArgs("orders", point)
+	require.NoError(t, err)
+	assert.Equal(t, "orders", args[0])
+
+	got, err := scanResumePoint(valuesRow(args[1:]))
+	require.NoError(t, err)
+	assert.Equal(t, point.ID, got.ID)
+	assert.Equal(t, point.Timestamp, got.Timestamp)
+	assert.Equal(t, "paid", got.FullDocument["status"])
+	assert.Equal(t, point.Epoch, got.Epoch)
+	assert.Equal(t, point.Namespace, got.Namespace)
+	assert.Equal(t, point.SinkOffset, got.SinkOffset)
+
+	point.FullDocument = nil
+	args, err = resumePointArgs("orders", point)
+	require.NoError(t, err)
+	assert.Nil(t, args[10])
+	got, err = scanResumePoint(valuesRow(args[1:]))
+	require.NoError(t, err)
+	assert.Nil(t, got.FullDocument)
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// defaultPreImageRetry is how long a watcher stays without pre-images after the server failed to provide them
+const defaultPreImageRetry = 5 * time.Minute
+
+// WithPreImageRetry sets how long the watcher runs with options.Off after the server rejected the pre-image mode
+// with NoMatchingDocument, e.g. because pre-images aren't enabled on the collection yet. After that the cursor is
+// reopened with the configured mode again, so enabling pre-images takes effect without a restart. 5 minutes by default.
+func WithPreImageRetry(interval time.Duration) WatcherOption {
+	return func(csw *ChangeStreamWatcher) {
+		csw.preImage.retry = interval
+	}
+}
+
+// WithPreImage sets the pre-image mode of the change stream: options.Required (the default), options.WhenAvailable
+// or options.Off. WhenAvailable suits collections where only some documents have pre-images, e.g. because pre-images
+// were enabled recently; ChangeStreamEvent.HasPreImage tells whether an event carries one.
+func WithPreImage(mode options.FullDocument) WatcherOption {
+	return func(csw *ChangeStreamWatcher) {
+		csw.preImage.configured = mode
+	}
+}
+
+// isPreImageMode tells whether the mode is valid for fullDocumentBeforeChange
+func isPreImageMode(mode options.FullDocument) bool {
+	switch mode {
+	case options.Off, options.WhenAvailable, options.Required:
+		return true
+	}
+	return false
+}
+
+// preImageState tracks the pre-image mode of the watcher and whether it fell back to running without pre-images
+type preImageState struct {
+	retry time.Duration
+
+	mu sync.Mutex
+	// configured is the mode asked for, set with WithPreImage or the mode passed to Start
+	configured options.FullDocument
+	fallbackAt time.Time
+}
+
+// use switches to the mode passed to Start, modes other than pre-image modes (e.g. options.UpdateLookup)
+// keep the one set with WithPreImage
+func (s *preImageState) use(mode options.FullDocument) {
+	if !isPreImageMode(mode) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.configured = mode
+}
+
+// mode returns the pre-image mode to open the next cursor with
+func (s *preImageState) mode() options.FullDocument {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fallbackAt.IsZero() {
+		return s.configured
+	}
+	if time.Since(s.fallbackAt) >= s.retryInterval() {
+		// give the configured mode another try, a failure falls back again
+		s.fallbackAt = time.Time{}
+		return s.configured
+	}
+	return options.Off
+}
+
+// fallback switches to options.Off until the retry interval passed
+func (s *preImageState) fallback() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fallbackAt = time.Now()
+}
+
+// retryTimer fires when a fallen back cursor should be reopened with the configured mode, nil if it isn't fallen back
+func (s *preImageState) retryTimer() <-chan time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fallbackAt.IsZero() {
+		return nil
+	}
+	return time.After(s.retryInterval() - time.Since(s.fallbackAt))
+}
+
+func (s *preImageState) retryInterval() time.Duration {
+	if s.retry <= 0 {
+		return defaultPreImageRetry
+	}
+	return s.retry
+}
+
+// effective returns the pre-image mode of the current cursor
+func (s *preImageState) effective() options.FullDocument {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fallbackAt.IsZero() {
+		return s.configured
+	}
+	return options.Off
+}
+
+// isNoMatchingDocument tells whether the server failed to provide a required pre-image
+func isNoMatchingDocument(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "NoMatchingDocument")
+}
+
+// PreImageMode returns the pre-image mode the cursor currently runs with, options.Off while fallen back
+func (csw *ChangeStreamWatcher) PreImageMode() options.FullDocument {
+	return csw.preImage.effective()
+}
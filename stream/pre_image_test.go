@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func Test_PreImageFallback(t *testing.T) {
+	csw := NewChangeStreamWatcher(nil, WithPreImageRetry(20*time.Millisecond))
+	assert.Equal(t, options.Required, csw.PreImageMode())
+	assert.Nil(t, csw.preImage.retryTimer())
+	assert.Equal(t, options.Required, csw.preImage.mode())
+
+	csw.preImage.fallback()
+	assert.Equal(t, options.Off, csw.PreImageMode())
+	assert.Equal(t, options.Off, csw.preImage.mode())
+
+	select {
+	case <-csw.preImage.retryTimer():
+	case <-time.After(time.Second):
+		t.Fatal("pre-image retry didn't fire")
+	}
+	// the next cursor tries the configured mode again
+	assert.Equal(t, options.Required, csw.preImage.mode())
+	assert.Equal(t, options.Required, csw.PreImageMode())
+	assert.Nil(t, csw.preImage.retryTimer())
+
+	m := NewManager(emptyResume{}, csw, nil, nil)
+	assert.Equal(t, options.Required, m.Stats().FullDocumentBeforeChange)
+}
+
+func Test_PreImageMode(t *testing.T) {
+	csw := NewChangeStreamWatcher(nil, WithPreImage(options.WhenAvailable))
+	assert.Equal(t, options.WhenAvailable, csw.PreImageMode())
+
+	// post-image modes passed to Start keep the configured pre-image mode
+	csw.preImage.use(options.UpdateLookup)
+	assert.Equal(t, options.WhenAvailable, csw.PreImageMode())
+	csw.preImage.use(options.Required)
+	assert.Equal(t, options.Required, csw.preImage.mode())
+
+	for _, tc := range []struct {
+		raw  bson.M
+		want bool
+	}{
+		{raw: bson.M{"operationType": "delete", "fullDocumentBeforeChange": bson.M{"name": "a"}}, want: true},
+		{raw: bson.M{"operationType": "delete"}, want: false},
+	} {
+		raw, err := bson.Marshal(tc.raw)
+		assert.NoError(t, err)
+		ce, err := csw.extractChangeEvent(context.Background(), raw)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.want, ce.HasPreImage)
+	}
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// names of the built-in profiles
+const (
+	ProfileLowLatency     = "low-latency"
+	ProfileHighThroughput = "high-throughput"
+	ProfileAudit          = "audit"
+)
+
+// ErrUnknownProfile is returned by LookupProfile for names no profile is registered under
+var ErrUnknownProfile = errors.New("unknown profile")
+
+// Profile bundles the checkpoint policy, batching, timeouts and per-event logging of a processing style,
+// so many processors behave the same without copying option lists. Zero fields keep the defaults.
+// Processors dispatch events one at a time in stream order whatever the profile.
+type Profile struct {
+	Name string
+	// BatchCheckpoint saves one resume point per batch of at most BatchMaxEvents, see WithBatchCheckpoint
+	BatchCheckpoint bool
+	BatchMaxEvents  int
+	// BatchSize and MaxAwaitTime tune the cursor, see WithBatchSize and WithMaxAwaitTime
+	BatchSize    int32
+	MaxAwaitTime time.Duration
+	// PreImage is the pre-image mode, see WithPreImage
+	PreImage options.FullDocument
+	// HandlerTimeout bounds every handler call, see WithHandlerTimeout
+	HandlerTimeout time.Duration
+	// EventLog samples the per-event log lines, see WithEventLogging
+	EventLog *EventLogConfig
+}
+
+// Options returns the processor options of the profile, options passed after them take precedence
+func (p Profile) Options() []ProcessorOption {
+	var watcherOpts []WatcherOption
+	if p.BatchCheckpoint {
+		watcherOpts = append(watcherOpts, WithBatchCheckpoint(p.BatchMaxEvents))
+	}
+	if p.BatchSize > 0 {
+		watcherOpts = append(watcherOpts, WithBatchSize(p.BatchSize))
+	}
+	if p.MaxAwaitTime > 0 {
+		watcherOpts = append(watcherOpts, WithMaxAwaitTime(p.MaxAwaitTime))
+	}
+	if p.PreImage != "" {
+		watcherOpts = append(watcherOpts, WithPreImage(p.PreImage))
+	}
+	if p.EventLog != nil {
+		watcherOpts = append(watcherOpts, WithEventLogging(*p.EventLog))
+	}
+
+	var opts []ProcessorOption
+	if len(watcherOpts) > 0 {
+		opts = append(opts, WithWatcherOptions(watcherOpts...))
+	}
+	if p.HandlerTimeout > 0 {
+		opts = append(opts, WithManagerOptions(WithHandlerTimeout(p.HandlerTimeout)))
+	}
+	return opts
+}
+
+// WithProfile applies the options of the profile, pass it before options overriding single settings
+func WithProfile(p Profile) ProcessorOption {
+	return func(dp *DocumentProcessor) {
+		for _, opt := range p.Options() {
+			opt(dp)
+		}
+	}
+}
+
+var (
+	profilesMu sync.RWMutex
+	profiles   = map[string]Profile{
+		// events reach handlers as soon as possible, checkpointing each of them
+		ProfileLowLatency: {
+			Name:         ProfileLowLatency,
+			BatchSize:    100,
+			MaxAwaitTime: 100 * time.Millisecond,
+			EventLog:     &EventLogConfig{Slow: time.Second, Failed: true},
+		},
+		// large batches with a checkpoint per batch, failures replay at most a batch
+		ProfileHighThroughput: {
+			Name:            ProfileHighThroughput,
+			BatchCheckpoint: true,
+			BatchMaxEvents:  1000,
+			BatchSize:       1000,
+			MaxAwaitTime:    time.Second,
+			EventLog:        &EventLogConfig{Slow: 10 * time.Second, Failed: true},
+		},
+		// every event checkpointed and logged with its pre-image required
+		ProfileAudit: {
+			Name:     ProfileAudit,
+			PreImage: options.Required,
+			EventLog: &EventLogConfig{Level: log.InfoLevel, EveryN: 1, Failed: true},
+		},
+	}
+)
+
+// RegisterProfile adds or replaces a named profile, e.g. one standardized across a team's processors
+func RegisterProfile(p Profile) {
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+	profiles[p.Name] = p
+}
+
+// LookupProfile returns the profile registered under name
+func LookupProfile(name string) (Profile, error) {
+	profilesMu.RLock()
+	defer profilesMu.RUnlock()
+	p, ok := profiles[name]
+	if !ok {
+		return Profile{}, fmt.Errorf("%w %q, known profiles: %v", ErrUnknownProfile, name, profileNames())
+	}
+	return p, nil
+}
+
+// ProfileNames lists the registered profiles
+func ProfileNames() []string {
+	profilesMu.RLock()
+	defer profilesMu.RUnlock()
+	return profileNames()
+}
+
+func profileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
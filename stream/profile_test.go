@@ -0,0 +1,53 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func Test_Profiles(t *testing.T) {
+	p, err := LookupProfile(ProfileHighThroughput)
+	assert.NoError(t, err)
+	dp := &DocumentProcessor{}
+	WithProfile(p)(dp)
+	WithWatcherOptions(WithBatchSize(50))(dp)
+	csw := NewChangeStreamWatcher(nil, dp.watcherOpts...)
+	assert.True(t, csw.batchCheckpoint)
+	assert.Equal(t, 1000, csw.batchMaxEvents)
+	assert.Equal(t, time.Second, csw.maxAwaitTime)
+	// options after the profile override it
+	assert.EqualValues(t, 50, csw.batchSize)
+	assert.NotNil(t, csw.eventLog)
+
+	RegisterProfile(Profile{Name: "team-default", PreImage: options.WhenAvailable, HandlerTimeout: time.Minute})
+	p, err = LookupProfile("team-default")
+	assert.NoError(t, err)
+	dp = &DocumentProcessor{}
+	WithProfile(p)(dp)
+	assert.Equal(t, options.WhenAvailable, NewChangeStreamWatcher(nil, dp.watcherOpts...).PreImageMode())
+	assert.Equal(t, time.Minute, NewManager(nil, nil, nil, nil, dp.managerOpts...).handlerTimeout)
+	assert.Contains(t, ProfileNames(), "team-default")
+
+	_, err = LookupProfile("fast")
+	assert.ErrorIs(t, err, ErrUnknownProfile)
+}
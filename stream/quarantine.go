@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// QuarantineRecord is the audit record of an event that was set aside instead of being processed
+type QuarantineRecord struct {
+	ID            primitive.ObjectID           `bson:"_id,omitempty" json:"id,omitempty"`
+	QuarantinedAt time.Time                    `bson:"quarantinedAt" json:"quarantinedAt"`
+	Reason        string                       `bson:"reason" json:"reason"`
+	Error         string                       `bson:"error" json:"error"`
+	Attempts      int                          `bson:"attempts" json:"attempts"`
+	Event         mongowatch.ChangeStreamEvent `bson:"event" json:"event"`
+}
+
+// QuarantineSink stores quarantined events
+type QuarantineSink interface {
+	Quarantine(ctx context.Context, record QuarantineRecord) error
+}
+
+// QuarantineBrowser lists quarantined events, newest first
+type QuarantineBrowser interface {
+	ListQuarantined(ctx context.Context, offset, limit int64) ([]QuarantineRecord, error)
+}
+
+// MongoQuarantine stores quarantined events in a collection
+type MongoQuarantine struct {
+	col *mongo.Collection
+}
+
+var _ QuarantineSink = (*MongoQuarantine)(nil)
+var _ QuarantineBrowser = (*MongoQuarantine)(nil)
+
+// NewMongoQuarantine creates a quarantine stored in col
+func NewMongoQuarantine(col *mongo.Collection) *MongoQuarantine {
+	return &MongoQuarantine{col: col}
+}
+
+// Quarantine inserts the record
+func (q *MongoQuarantine) Quarantine(ctx context.Context, record QuarantineRecord) error {
+	if _, err := q.col.InsertOne(ctx, record); err != nil {
+		return fmt.Errorf("failed to quarantine event: %w", err)
+	}
+	return nil
+}
+
+// CountQuarantined returns the number of quarantined events
+func (q *MongoQuarantine) CountQuarantined(ctx context.Context) (int64, error) {
+	n, err := q.col.CountDocuments(ctx, bson.M{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count quarantined events: %w", err)
+	}
+	return n, nil
+}
+
+// ListQuarantined returns a page of quarantined events, newest first
+func (q *MongoQuarantine) ListQuarantined(ctx context.Context, offset, limit int64) ([]QuarantineRecord, error) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "quarantinedAt", Value: -1}}).
+		SetSkip(offset).
+		SetLimit(limit)
+	cursor, err := q.col.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list quarantined events: %w", err)
+	}
+	records := []QuarantineRecord{}
+	if err = cursor.All(ctx, &records); err != nil {
+		return nil, fmt.Errorf("failed to decode quarantined events: %w", err)
+	}
+	return records, nil
+}
@@ -0,0 +1,281 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// OpCounts counts changes by operation type, insert, update and delete
+type OpCounts map[string]int64
+
+// oplogOps maps oplog entry ops to change stream operation types, replaces are updates in the oplog
+var oplogOps = map[string]string{"i": "insert", "u": "update", "d": "delete"}
+
+// CountFunc counts the changes with a cluster time in [from, to)
+type CountFunc func(ctx context.Context, from, to primitive.Timestamp) (OpCounts, error)
+
+// OplogCounter counts the inserts, updates and deletes of the namespace ("db.collection") in the oplog,
+// including those applied by transactions. Windows must still be covered by the oplog.
+func OplogCounter(client *mongo.Client, namespace string) CountFunc {
+	return func(ctx context.Context, from, to primitive.Timestamp) (OpCounts, error) {
+		pipeline := mongo.Pipeline{
+			{{Key: "$match", Value: bson.D{
+				{Key: "ts", Value: bson.D{{Key: "$gte", Value: from}, {Key: "$lt", Value: to}}},
+				{Key: "$or", Value: bson.A{
+					bson.D{{Key: "ns", Value: namespace}},
+					bson.D{{Key: "op", Value: "c"}, {Key: "o.applyOps.ns", Value: namespace}},
+				}},
+			}}},
+			// transactions carry their operations in a single applyOps command entry
+			{{Key: "$project", Value: bson.D{{Key: "entries", Value: bson.D{{Key: "$cond", Value: bson.A{
+				bson.D{{Key: "$eq", Value: bson.A{"$op", "c"}}},
+				"$o.applyOps",
+				bson.A{bson.D{{Key: "op", Value: "$op"}, {Key: "ns", Value: "$ns"}}},
+			}}}}}}},
+			{{Key: "$unwind", Value: "$entries"}},
+			{{Key: "$match", Value: bson.D{
+				{Key: "entries.ns", Value: namespace},
+				{Key: "entries.op", Value: bson.D{{Key: "$in", Value: bson.A{"i", "u", "d"}}}},
+			}}},
+			{{Key: "$group", Value: bson.D{{Key: "_id", Value: "$entries.op"}, {Key: "n", Value: bson.D{{Key: "$sum", Value: 1}}}}}},
+		}
+		cursor, err := client.Database("local").Collection("oplog.rs").Aggregate(ctx, pipeline)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count oplog entries: %w", err)
+		}
+		var groups []struct {
+			Op string `bson:"_id"`
+			N  int64  `bson:"n"`
+		}
+		if err = cursor.All(ctx, &groups); err != nil {
+			return nil, fmt.Errorf("failed cursor iteration for oplog counts: %w", err)
+		}
+		counts := OpCounts{}
+		for _, g := range groups {
+			counts[oplogOps[g.Op]] += g.N
+		}
+		return counts, nil
+	}
+}
+
+// DeliveryCounter counts the events processed by a consumer per cluster time bucket, in memory.
+// Redeliveries after a restart are counted again, so consumers may show more events than the source.
+type DeliveryCounter struct {
+	resolution uint32
+	retention  int
+
+	mu      sync.Mutex
+	buckets map[uint32]OpCounts
+}
+
+// NewDeliveryCounter creates a counter with buckets of resolution, keeping the last retention of them.
+// Reconciliation windows should be aligned to the resolution.
+func NewDeliveryCounter(resolution time.Duration, retention int) *DeliveryCounter {
+	seconds := uint32(resolution / time.Second)
+	if seconds == 0 {
+		seconds = 1
+	}
+	return &DeliveryCounter{resolution: seconds, retention: retention, buckets: map[uint32]OpCounts{}}
+}
+
+// Middleware returns the middleware counting the events the handlers processed without an error
+func (c *DeliveryCounter) Middleware() mongowatch.ChangeEventMiddleware {
+	return func(next mongowatch.ChangeEventDispatcherFunc) mongowatch.ChangeEventDispatcherFunc {
+		return func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+			if err = next(ctx, ce, err); err == nil {
+				c.record(ce)
+			}
+			return err
+		}
+	}
+}
+
+func (c *DeliveryCounter) record(ce mongowatch.ChangeStreamEvent) {
+	op := ce.OperationType
+	switch op {
+	case "insert", "update", "delete":
+	case "replace":
+		op = "update"
+	default:
+		return
+	}
+	bucket := ce.Timestamp.T - ce.Timestamp.T%c.resolution
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts, ok := c.buckets[bucket]
+	if !ok {
+		counts = OpCounts{}
+		c.buckets[bucket] = counts
+		c.evict()
+	}
+	counts[op]++
+}
+
+// evict drops the oldest buckets beyond the retention
+func (c *DeliveryCounter) evict() {
+	if c.retention <= 0 || len(c.buckets) <= c.retention {
+		return
+	}
+	keys := make([]uint32, 0, len(c.buckets))
+	for k := range c.buckets {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	for _, k := range keys[:len(keys)-c.retention] {
+		delete(c.buckets, k)
+	}
+}
+
+// Count sums the buckets starting in [from, to), it is a CountFunc
+func (c *DeliveryCounter) Count(ctx context.Context, from, to primitive.Timestamp) (OpCounts, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := OpCounts{}
+	for bucket, bc := range c.buckets {
+		if bucket < from.T || bucket >= to.T {
+			continue
+		}
+		for op, n := range bc {
+			counts[op] += n
+		}
+	}
+	return counts, nil
+}
+
+// ReconcileReport compares the changes of a window in the source with the events the consumer processed
+type ReconcileReport struct {
+	From     primitive.Timestamp `json:"from"`
+	To       primitive.Timestamp `json:"to"`
+	Source   OpCounts            `json:"source"`
+	Consumer OpCounts            `json:"consumer"`
+	// Missing counts changes of the source the consumer didn't process, Extra events it processed more than once
+	Missing OpCounts `json:"missing,omitempty"`
+	Extra   OpCounts `json:"extra,omitempty"`
+}
+
+// OK tells whether every change was processed exactly once
+func (r ReconcileReport) OK() bool {
+	return len(r.Missing) == 0 && len(r.Extra) == 0
+}
+
+// ReconcileConfig configures a Reconciler
+type ReconcileConfig struct {
+	// Source counts the changes in the source, e.g. OplogCounter; Consumer the processed events, e.g. DeliveryCounter.Count
+	Source   CountFunc
+	Consumer CountFunc
+	// Window is the span compared per run, Delay how far behind now a window has to end,
+	// leaving the consumer time to process it
+	Window time.Duration
+	Delay  time.Duration
+	// OnReport is called with every report, discrepancies are logged as well
+	OnReport func(ctx context.Context, report ReconcileReport)
+}
+
+// Reconciler periodically compares source and consumer counts, a cheap ongoing check that no change got lost
+type Reconciler struct {
+	cfg ReconcileConfig
+}
+
+// NewReconciler creates a reconciler, Window defaults to a minute and Delay to the window
+func NewReconciler(cfg ReconcileConfig) *Reconciler {
+	if cfg.Window <= 0 {
+		cfg.Window = time.Minute
+	}
+	if cfg.Delay <= 0 {
+		cfg.Delay = cfg.Window
+	}
+	return &Reconciler{cfg: cfg}
+}
+
+// Reconcile compares the counts of the window [from, to)
+func (r *Reconciler) Reconcile(ctx context.Context, from, to primitive.Timestamp) (ReconcileReport, error) {
+	report := ReconcileReport{From: from, To: to}
+	var err error
+	if report.Source, err = r.cfg.Source(ctx, from, to); err != nil {
+		return report, fmt.Errorf("failed to count source changes: %w", err)
+	}
+	if report.Consumer, err = r.cfg.Consumer(ctx, from, to); err != nil {
+		return report, fmt.Errorf("failed to count consumer events: %w", err)
+	}
+
+	for _, op := range []string{"insert", "update", "delete"} {
+		switch diff := report.Source[op] - report.Consumer[op]; {
+		case diff > 0:
+			if report.Missing == nil {
+				report.Missing = OpCounts{}
+			}
+			report.Missing[op] = diff
+		case diff < 0:
+			if report.Extra == nil {
+				report.Extra = OpCounts{}
+			}
+			report.Extra[op] = -diff
+		}
+	}
+	return report, nil
+}
+
+// Run reconciles consecutive windows until ctx is done, starting with the one ending Delay before now
+func (r *Reconciler) Run(ctx context.Context) error {
+	window := uint32(r.cfg.Window / time.Second)
+	if window == 0 {
+		window = 1
+	}
+	end := uint32(time.Now().Add(-r.cfg.Delay).Unix())
+	end -= end % window
+
+	ticker := time.NewTicker(r.cfg.Window)
+	defer ticker.Stop()
+	for {
+		for uint32(time.Now().Add(-r.cfg.Delay).Unix()) >= end+window {
+			from, to := primitive.Timestamp{T: end}, primitive.Timestamp{T: end + window}
+			report, err := r.Reconcile(ctx, from, to)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				logger(ctx).Errorf("failed to reconcile window %d-%d: %v", from.T, to.T, err)
+				break
+			}
+			if !report.OK() {
+				logger(ctx).Warnf("delivery discrepancy in window %d-%d: missing %v, extra %v", from.T, to.T, report.Missing, report.Extra)
+			}
+			if r.cfg.OnReport != nil {
+				r.cfg.OnReport(ctx, report)
+			}
+			end += window
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+func Test_DeliveryCounter(t *testing.T) {
+	c := NewDeliveryCounter(time.Minute, 2)
+	failing := true
+	dispatch := c.Middleware()(func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		if ce.DocumentKey == "poison" && failing {
+			return errors.New("handler failed")
+		}
+		return nil
+	})
+	event := func(op string, ts uint32, key string) mongowatch.ChangeStreamEvent {
+		return mongowatch.ChangeStreamEvent{OperationType: op, DocumentKey: key, Timestamp: primitive.Timestamp{T: ts}}
+	}
+	ctx := context.Background()
+
+	assert.NoError(t, dispatch(ctx, event("insert", 60, "a"), nil))
+	assert.NoError(t, dispatch(ctx, event("replace", 61, "a"), nil))
+	assert.Error(t, dispatch(ctx, event("delete", 62, "poison"), nil))
+	failing = false
+	assert.NoError(t, dispatch(ctx, event("delete", 62, "poison"), nil))
+	assert.NoError(t, dispatch(ctx, event("invalidate", 63, ""), nil))
+	assert.NoError(t, dispatch(ctx, event("insert", 130, "b"), nil))
+
+	counts, err := c.Count(ctx, primitive.Timestamp{T: 60}, primitive.Timestamp{T: 120})
+	assert.NoError(t, err)
+	assert.Equal(t, OpCounts{"insert": 1, "update": 1, "delete": 1}, counts)
+
+	// the oldest bucket is evicted beyond the retention
+	assert.NoError(t, dispatch(ctx, event("insert", 200, "c"), nil))
+	counts, _ = c.Count(ctx, primitive.Timestamp{T: 0}, primitive.Timestamp{T: 300})
+	assert.Equal(t, OpCounts{"insert": 2}, counts)
+}
+
+func Test_Reconciler(t *testing.T) {
+	source := func(ctx context.Context, from, to primitive.Timestamp) (OpCounts, error) {
+		return OpCounts{"insert": 3, "update": 2}, nil
+	}
+	consumer := func(ctx context.Context, from, to primitive.Timestamp) (OpCounts, error) {
+		return OpCounts{"insert": 3, "update": 1, "delete": 1}, nil
+	}
+	r := NewReconciler(ReconcileConfig{Source: source, Consumer: consumer})
+
+	report, err := r.Reconcile(context.Background(), primitive.Timestamp{T: 60}, primitive.Timestamp{T: 120})
+	assert.NoError(t, err)
+	assert.False(t, report.OK())
+	assert.Equal(t, OpCounts{"update": 1}, report.Missing)
+	assert.Equal(t, OpCounts{"delete": 1}, report.Extra)
+
+	r = NewReconciler(ReconcileConfig{Source: source, Consumer: source})
+	report, err = r.Reconcile(context.Background(), primitive.Timestamp{T: 60}, primitive.Timestamp{T: 120})
+	assert.NoError(t, err)
+	assert.True(t, report.OK())
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// RedactAction tells what happens to a sensitive field
+type RedactAction int
+
+const (
+	// RedactRemove drops the field
+	RedactRemove RedactAction = iota
+	// RedactHash replaces the value with a salted SHA-256 hex digest, keeping it joinable but unreadable
+	RedactHash
+)
+
+// RedactRule selects sensitive fields by exact dotted path or by a regex matched against the dotted path
+type RedactRule struct {
+	Paths   []string
+	Pattern *regexp.Regexp
+	Action  RedactAction
+}
+
+func (r RedactRule) matches(path string) bool {
+	for _, p := range r.Paths {
+		if p == path {
+			return true
+		}
+	}
+	return r.Pattern != nil && r.Pattern.MatchString(path)
+}
+
+// Redactor removes or masks sensitive fields of change events.
+// It is applied by the watcher right after an event is extracted, so redacted values never reach
+// handlers, logs, resume points or sinks.
+type Redactor struct {
+	rules []RedactRule
+	salt  []byte
+}
+
+// NewRedactor creates a redactor, salt is mixed into hashed values
+func NewRedactor(salt string, rules ...RedactRule) *Redactor {
+	return &Redactor{rules: rules, salt: []byte(salt)}
+}
+
+// Redact masks the documents and update description of the event in place
+func (r *Redactor) Redact(ce *mongowatch.ChangeStreamEvent) {
+	r.redactDoc("", ce.FullDocument)
+	r.redactDoc("", ce.FullDocumentBeforeChange)
+	r.redactDoc("", ce.UpdateDescription.UpdatedFields)
+
+	// removed fields only carry names, drop the names of removed sensitive fields too
+	if removed, ok := ce.UpdateDescription.RemovedFields.(primitive.A); ok {
+		kept := primitive.A{}
+		for _, field := range removed {
+			if name, ok := field.(string); ok && r.rule(name) != nil && r.rule(name).Action == RedactRemove {
+				continue
+			}
+			kept = append(kept, field)
+		}
+		ce.UpdateDescription.RemovedFields = kept
+	}
+}
+
+func (r *Redactor) rule(path string) *RedactRule {
+	for i := range r.rules {
+		if r.rules[i].matches(path) {
+			return &r.rules[i]
+		}
+	}
+	return nil
+}
+
+func (r *Redactor) redactDoc(prefix string, doc map[string]interface{}) {
+	for key, value := range doc {
+		path := key
+		if prefix != "" {
+			path = prefix + "." + key
+		}
+
+		if rule := r.rule(path); rule != nil {
+			if rule.Action == RedactHash {
+				doc[key] = r.hash(value)
+			} else {
+				delete(doc, key)
+			}
+			continue
+		}
+		r.redactValue(path, value)
+	}
+}
+
+func (r *Redactor) redactValue(path string, value interface{}) {
+	switch v := value.(type) {
+	case primitive.M:
+		r.redactDoc(path, v)
+	case map[string]interface{}:
+		r.redactDoc(path, v)
+	case primitive.A:
+		// array elements share the path of the array
+		for _, item := range v {
+			r.redactValue(path, item)
+		}
+	}
+}
+
+func (r *Redactor) hash(value interface{}) string {
+	h := sha256.New()
+	h.Write(r.salt)
+	h.Write([]byte(fmt.Sprint(value)))
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+func Test_Redactor_Redact(t *testing.T) {
+	redactor := NewRedactor("salt",
+		RedactRule{Paths: []string{"owner.phone"}, Action: RedactRemove},
+		RedactRule{Pattern: regexp.MustCompile(`(^|\.)email$`), Action: RedactHash},
+	)
+
+	ce := mongowatch.ChangeStreamEvent{
+		FullDocument: primitive.M{
+			"name":  "tracker",
+			"owner": primitive.M{"phone": "+370", "email": "john@example.com"},
+		},
+		FullDocumentBeforeChange: primitive.M{"contacts": primitive.A{primitive.M{"email": "jane@example.com"}}},
+	}
+	ce.UpdateDescription.UpdatedFields = map[string]interface{}{"owner.phone": "+371", "owner.email": "john@example.com"}
+	ce.UpdateDescription.RemovedFields = primitive.A{"owner.phone", "name"}
+
+	redactor.Redact(&ce)
+
+	owner := ce.FullDocument["owner"].(primitive.M)
+	assert.NotContains(t, owner, "phone")
+	assert.Len(t, owner["email"], 64)
+	assert.Equal(t, "tracker", ce.FullDocument["name"])
+	assert.Equal(t, owner["email"], ce.UpdateDescription.UpdatedFields["owner.email"])
+	assert.NotContains(t, ce.UpdateDescription.UpdatedFields, "owner.phone")
+	assert.Equal(t, primitive.A{"name"}, ce.UpdateDescription.RemovedFields)
+
+	contact := ce.FullDocumentBeforeChange["contacts"].(primitive.A)[0].(primitive.M)
+	assert.NotEqual(t, "jane@example.com", contact["email"])
+}
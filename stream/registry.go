@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// ConsumerInfo is the registry document of a running processor
+type ConsumerInfo struct {
+	ID          string                 `bson:"_id" json:"id"`
+	Group       string                 `bson:"group" json:"group"`
+	Target      string                 `bson:"target" json:"target"`
+	Host        string                 `bson:"host" json:"host"`
+	PID         int                    `bson:"pid" json:"pid"`
+	StartedAt   time.Time              `bson:"startedAt" json:"startedAt"`
+	HeartbeatAt time.Time              `bson:"heartbeatAt" json:"heartbeatAt"`
+	Token       mongowatch.ResumeToken `bson:"token" json:"token"`
+	Timestamp   primitive.Timestamp    `bson:"timestamp" json:"timestamp"`
+}
+
+// ConsumerRegistry keeps track of the processors running across a fleet in a local DB collection
+type ConsumerRegistry struct {
+	col *mongo.Collection
+}
+
+// NewConsumerRegistry creates a registry stored in col
+func NewConsumerRegistry(col *mongo.Collection) *ConsumerRegistry {
+	return &ConsumerRegistry{col: col}
+}
+
+// NewConsumer describes this process consuming target (usually "db.collection") as part of group
+func (r *ConsumerRegistry) NewConsumer(group, target string) *Consumer {
+	host, _ := os.Hostname()
+	pid := os.Getpid()
+	return &Consumer{
+		registry: r,
+		info: ConsumerInfo{
+			ID:        fmt.Sprintf("%s/%s/%d/%s", group, host, pid, primitive.NewObjectID().Hex()),
+			Group:     group,
+			Target:    target,
+			Host:      host,
+			PID:       pid,
+			StartedAt: time.Now(),
+		},
+	}
+}
+
+// ListConsumers returns the registered consumers ordered by group, consumers whose heartbeat is older
+// than staleAfter are left out, a zero staleAfter lists all of them
+func (r *ConsumerRegistry) ListConsumers(ctx context.Context, staleAfter time.Duration) ([]ConsumerInfo, error) {
+	filter := bson.D{}
+	if staleAfter > 0 {
+		filter = bson.D{{Key: "heartbeatAt", Value: bson.D{{Key: "$gte", Value: time.Now().Add(-staleAfter)}}}}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "group", Value: 1}, {Key: "startedAt", Value: 1}})
+
+	cursor, err := r.col.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list consumers: %w", err)
+	}
+
+	var consumers []ConsumerInfo
+	if err = cursor.All(ctx, &consumers); err != nil {
+		return nil, fmt.Errorf("failed cursor iteration for consumers: %w", err)
+	}
+	return consumers, nil
+}
+
+// Consumer is a registry entry of this process
+type Consumer struct {
+	registry *ConsumerRegistry
+
+	mu   sync.Mutex
+	info ConsumerInfo
+}
+
+// Info returns the current registry document
+func (c *Consumer) Info() ConsumerInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.info
+}
+
+// Middleware records the token of every dispatched event, register it with WithMiddleware
+func (c *Consumer) Middleware() mongowatch.ChangeEventMiddleware {
+	return func(next mongowatch.ChangeEventDispatcherFunc) mongowatch.ChangeEventDispatcherFunc {
+		return func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+			err = next(ctx, ce, err)
+			if err == nil {
+				c.mu.Lock()
+				c.info.Token = ce.ID
+				c.info.Timestamp = ce.Timestamp
+				c.mu.Unlock()
+			}
+			return err
+		}
+	}
+}
+
+// Heartbeat writes the registry document every interval until ctx is done, then removes it
+func (c *Consumer) Heartbeat(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.save(ctx); err != nil && ctx.Err() == nil {
+			log.Errorf("failed to save consumer heartbeat: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			c.unregister()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Consumer) save(ctx context.Context) error {
+	c.mu.Lock()
+	c.info.HeartbeatAt = time.Now()
+	info := c.info
+	c.mu.Unlock()
+
+	filter := bson.D{{Key: "_id", Value: info.ID}}
+	_, err := c.registry.col.ReplaceOne(ctx, filter, info, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (c *Consumer) unregister() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := c.registry.col.DeleteOne(ctx, bson.D{{Key: "_id", Value: c.info.ID}}); err != nil {
+		log.Errorf("failed to unregister consumer %s: %v", c.info.ID, err)
+	}
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+	"github.com/mmtracker/mongowatch/db"
+)
+
+func Test_ConsumerRegistry_NewConsumer(t *testing.T) {
+	registry := NewConsumerRegistry(nil)
+	tests := []struct {
+		name   string
+		group  string
+		target string
+	}{
+		{name: "first", group: "billing", target: "app.orders"},
+		{name: "same names", group: "billing", target: "app.orders"},
+		{name: "other target", group: "billing", target: "app.users"},
+		{name: "no group", group: "", target: "app.orders"},
+	}
+
+	ids := map[string]string{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := registry.NewConsumer(tt.group, tt.target).Info()
+			assert.Equal(t, tt.group, info.Group)
+			assert.Equal(t, tt.target, info.Target)
+			assert.NotZero(t, info.PID)
+			// consumers with duplicate names still get their own registry document
+			prev, dup := ids[info.ID]
+			assert.False(t, dup, "ID %s reused by %s", info.ID, prev)
+			ids[info.ID] = tt.name
+		})
+	}
+}
+
+func Test_Consumer_Middleware(t *testing.T) {
+	consumer := NewConsumerRegistry(nil).NewConsumer("billing", "app.orders")
+	tests := []struct {
+		name      string
+		token     string
+		err       error
+		wantToken string
+	}{
+		{name: "processed", token: "a", wantToken: "a"},
+		{name: "failed event keeps the last token", token: "b", err: errors.New("boom"), wantToken: "a"},
+		{name: "next processed", token: "c", wantToken: "c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dispatch := consumer.Middleware()(func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+				return tt.err
+			})
+			ce := mongowatch.ChangeStreamEvent{ID: mongowatch.ResumeToken{TokenData: tt.token}, Timestamp: primitive.Timestamp{T: 1}}
+			assert.Equal(t, tt.err, dispatch(context.Background(), ce, nil))
+			assert.Equal(t, tt.wantToken, consumer.Info().Token.TokenData)
+		})
+	}
+}
+
+func Test_ConsumerRegistry_ListConsumers(t *testing.T) {
+	requireMongo(t)
+	col := NewCollection("consumer_registry", mongoTestsDB)
+	_ = db.Truncate(col, false)
+	defer db.Truncate(col, false)
+	registry := NewConsumerRegistry(col)
+
+	ctx := context.Background()
+	consumers, err := registry.ListConsumers(ctx, 0)
+	require.NoError(t, err)
+	assert.Empty(t, consumers, "nothing registered yet")
+
+	live := []*Consumer{registry.NewConsumer("billing", "app.orders"), registry.NewConsumer("billing", "app.orders"), registry.NewConsumer("audit", "app.users")}
+	for _, c := range live {
+		require.NoError(t, c.save(ctx))
+	}
+	stale := registry.NewConsumer("billing", "app.orders")
+	require.NoError(t, stale.save(ctx))
+	_, err = col.UpdateByID(ctx, stale.Info().ID, bson.M{"$set": bson.M{"heartbeatAt": time.Now().Add(-time.Hour)}})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		staleAfter time.Duration
+		wantGroups []string
+	}{
+		{name: "all", staleAfter: 0, wantGroups: []string{"audit", "billing", "billing", "billing"}},
+		{name: "live only", staleAfter: time.Minute, wantGroups: []string{"audit", "billing", "billing"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			consumers, err := registry.ListConsumers(ctx, tt.staleAfter)
+			require.NoError(t, err)
+			var groups []string
+			for _, c := range consumers {
+				groups = append(groups, c.Group)
+			}
+			assert.Equal(t, tt.wantGroups, groups)
+		})
+	}
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// ResumeKey identifies the stream a resume collection belongs to
+type ResumeKey struct {
+	// URI is the connection string of the target cluster, only its hosts are used
+	URI        string `json:"uri"`
+	Database   string `json:"database"`
+	Collection string `json:"collection"`
+	// Group is the consumer group, e.g. the group of the processor ID
+	Group string `json:"group"`
+	// Suffix is the resume suffix passed to NewDataProcessor
+	Suffix string `json:"suffix"`
+}
+
+// ResumeNamer maps a stream to the name of its resume collection in the local database
+type ResumeNamer func(key ResumeKey) string
+
+// SuffixResumeNamer is the default naming: the target collection name followed by the resume suffix
+func SuffixResumeNamer(key ResumeKey) string {
+	return key.Collection + key.Suffix
+}
+
+// NamespaceResumeNamer names resume collections after the whole namespace, "<database>.<collection>" followed by
+// the resume suffix; database names can't contain dots, so namespaces never share a name
+func NamespaceResumeNamer(key ResumeKey) string {
+	return key.Database + "." + key.Collection + key.Suffix
+}
+
+// HashedResumeNamer names resume collections prefix followed by a hash of the whole key, so processors of
+// different clusters, databases or groups sharing one local database never share a resume collection
+func HashedResumeNamer(prefix string) ResumeNamer {
+	return func(key ResumeKey) string {
+		sum := sha256.Sum256([]byte(strings.Join([]string{
+			clusterHosts(key.URI), key.Database, key.Collection, key.Group, key.Suffix,
+		}, "\x00")))
+		return prefix + hex.EncodeToString(sum[:8])
+	}
+}
+
+// clusterHosts reduces a connection string to its sorted hosts, so credentials and options don't change the hash
+func clusterHosts(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" {
+		return uri
+	}
+	hosts := strings.Split(strings.ToLower(u.Host), ",")
+	sort.Strings(hosts)
+	return u.Scheme + "://" + strings.Join(hosts, ",")
+}
+
+// ResumeCollectionInfo tells which stream a resume collection belongs to
+type ResumeCollectionInfo struct {
+	Name string    `json:"name"`
+	Key  ResumeKey `json:"key"`
+}
+
+// WithResumeNamer names the resume collection with namer, uri and group complete the key next to the target
+// database, collection and resume suffix, see HashedResumeNamer
+func WithResumeNamer(namer ResumeNamer, uri, group string) ProcessorOption {
+	return func(dp *DocumentProcessor) {
+		dp.resumeNamer = namer
+		dp.resumeCollection.Key.URI = uri
+		dp.resumeCollection.Key.Group = group
+	}
+}
+
+// ResumeCollection returns the name of the resume collection and the key it was derived from
+func (dp DocumentProcessor) ResumeCollection() ResumeCollectionInfo {
+	return dp.resumeCollection
+}
@@ -0,0 +1,45 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ResumeNamer(t *testing.T) {
+	key := ResumeKey{URI: "mongodb://a:27017,b:27017", Database: "shop", Collection: "orders", Group: "billing", Suffix: "_resume"}
+	assert.Equal(t, "orders_resume", SuffixResumeNamer(key))
+
+	namer := HashedResumeNamer("resume_")
+	name := namer(key)
+	assert.Regexp(t, `^resume_[0-9a-f]{16}$`, name)
+
+	// credentials, options and host order don't identify the cluster
+	same := key
+	same.URI = "mongodb://user:secret@B:27017,a:27017/?replicaSet=rs0"
+	assert.Equal(t, name, namer(same))
+
+	other := key
+	other.URI = "mongodb://c:27017"
+	assert.NotEqual(t, name, namer(other))
+	other = key
+	other.Group = "audit"
+	assert.NotEqual(t, name, namer(other))
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// ResumePointSchemaVersion is the version of the resume point documents written by this release
+const ResumePointSchemaVersion = 1
+
+// resumePointMigrations upgrade a resume point from the version of their index to the next one,
+// append one and bump ResumePointSchemaVersion whenever the stored fields change meaning
+var resumePointMigrations = []func(rp *mongowatch.ChangeStreamResumePoint, target ResumeTarget){
+	// 0 -> 1: points written before versioning don't know their stream, the current target adopts them
+	func(rp *mongowatch.ChangeStreamResumePoint, target ResumeTarget) {
+		if rp.Namespace == "" {
+			rp.Namespace = target.Namespace
+		}
+		if rp.Cluster == "" {
+			rp.Cluster = target.Cluster
+		}
+	},
+}
+
+// upgradeResumePoint runs the migrations from the version of rp up to the current one, it reports whether rp changed
+func upgradeResumePoint(rp *mongowatch.ChangeStreamResumePoint, target ResumeTarget) bool {
+	if rp.SchemaVersion >= ResumePointSchemaVersion {
+		return false
+	}
+	for v := rp.SchemaVersion; v < ResumePointSchemaVersion; v++ {
+		resumePointMigrations[v](rp, target)
+	}
+	rp.SchemaVersion = ResumePointSchemaVersion
+	return true
+}
+
+// migrate upgrades the stored resume points written by older releases in place, once per repository
+func (csr *ResumeRepository) migrate(ctx context.Context) error {
+	if csr.migrated.Load() {
+		return nil
+	}
+
+	// documents without a version match too
+	outdated := bson.D{{Key: "schemaVersion", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$gte", Value: ResumePointSchemaVersion}}}}}}
+	cursor, err := csr.col.Find(ctx, outdated)
+	if err != nil {
+		return fmt.Errorf("failed to find outdated resume points: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var migrated int
+	for cursor.Next(ctx) {
+		var rp mongowatch.ChangeStreamResumePoint
+		if err = cursor.Decode(&rp); err != nil {
+			return fmt.Errorf("failed to decode outdated resume point: %w", err)
+		}
+		if !upgradeResumePoint(&rp, csr.target) {
+			continue
+		}
+		// a concurrent writer may have replaced the point meanwhile, only outdated documents are overwritten
+		filter := append(bson.D{{Key: "_id", Value: rp.ID}}, outdated...)
+		if _, err = csr.col.ReplaceOne(ctx, filter, rp); err != nil {
+			return fmt.Errorf("failed to migrate resume point: %w", err)
+		}
+		migrated++
+	}
+	if err = cursor.Err(); err != nil {
+		return fmt.Errorf("failed cursor iteration for outdated resume points: %w", err)
+	}
+	if migrated > 0 {
+		logger(ctx).Infof("migrated %d resume points to schema version %d", migrated, ResumePointSchemaVersion)
+	}
+
+	csr.migrated.Store(true)
+	return nil
+}
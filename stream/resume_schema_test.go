@@ -0,0 +1,42 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+func Test_ResumeSchema_Upgrade(t *testing.T) {
+	assert.Len(t, resumePointMigrations, ResumePointSchemaVersion, "every version needs a migration from the previous one")
+
+	target := ResumeTarget{Namespace: "shop.orders", Cluster: "rs0"}
+	legacy := mongowatch.ChangeStreamResumePoint{ID: mongowatch.ResumeToken{TokenData: "a"}, OperationType: "insert"}
+	assert.True(t, upgradeResumePoint(&legacy, target))
+	assert.Equal(t, ResumePointSchemaVersion, legacy.SchemaVersion)
+	assert.Equal(t, "shop.orders", legacy.Namespace)
+	assert.Equal(t, "rs0", legacy.Cluster)
+	assert.Equal(t, "insert", legacy.OperationType)
+
+	// current points are left alone
+	assert.False(t, upgradeResumePoint(&legacy, ResumeTarget{Namespace: "shop.invoices"}))
+	assert.Equal(t, "shop.orders", legacy.Namespace)
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// ErrResumePointMismatch is returned when the stored resume point was written for another namespace or cluster,
+// e.g. a processor pointed at a different collection still finding the checkpoint of the old one
+var ErrResumePointMismatch = errors.New("resume point belongs to a different stream")
+
+// ResumeTarget identifies the stream resume points are written for
+type ResumeTarget struct {
+	// Namespace is the watched "database.collection"
+	Namespace string
+	// Cluster is a hint identifying the cluster, e.g. the replica set name, empty skips the cluster check
+	Cluster string
+}
+
+// stamp tags the resume point with the target
+func (t ResumeTarget) stamp(rp *mongowatch.ChangeStreamResumePoint) {
+	rp.Namespace = t.Namespace
+	rp.Cluster = t.Cluster
+}
+
+// check fails with ErrResumePointMismatch if the resume point was written for another target,
+// points written before the target was stored are accepted
+func (t ResumeTarget) check(rp *mongowatch.ChangeStreamResumePoint) error {
+	if rp.Namespace != "" && t.Namespace != "" && rp.Namespace != t.Namespace {
+		return fmt.Errorf("%w: stored for namespace %s, configured %s", ErrResumePointMismatch, rp.Namespace, t.Namespace)
+	}
+	if rp.Cluster != "" && t.Cluster != "" && rp.Cluster != t.Cluster {
+		return fmt.Errorf("%w: stored for cluster %s, configured %s", ErrResumePointMismatch, rp.Cluster, t.Cluster)
+	}
+	return nil
+}
+
+// ClusterHint returns the replica set name of the deployment database belongs to, to be used as ResumeTarget.Cluster.
+// Standalone servers and mongos have none and return an empty hint.
+func ClusterHint(ctx context.Context, database *mongo.Database) (string, error) {
+	var hello struct {
+		SetName string `bson:"setName"`
+	}
+	err := database.RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+	if err != nil {
+		return "", fmt.Errorf("failed to run hello: %w", err)
+	}
+	return hello.SetName, nil
+}
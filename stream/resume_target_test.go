@@ -0,0 +1,55 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+func Test_ResumeTarget_Check(t *testing.T) {
+	target := ResumeTarget{Namespace: "shop.orders", Cluster: "rs0"}
+
+	tests := []struct {
+		name     string
+		point    mongowatch.ChangeStreamResumePoint
+		mismatch bool
+	}{
+		{name: "same target", point: mongowatch.ChangeStreamResumePoint{Namespace: "shop.orders", Cluster: "rs0"}},
+		{name: "legacy point", point: mongowatch.ChangeStreamResumePoint{}},
+		{name: "no cluster stored", point: mongowatch.ChangeStreamResumePoint{Namespace: "shop.orders"}},
+		{name: "other collection", point: mongowatch.ChangeStreamResumePoint{Namespace: "shop.invoices", Cluster: "rs0"}, mismatch: true},
+		{name: "other cluster", point: mongowatch.ChangeStreamResumePoint{Namespace: "shop.orders", Cluster: "rs1"}, mismatch: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := target.check(&tt.point)
+			if tt.mismatch {
+				assert.ErrorIs(t, err, ErrResumePointMismatch)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+
+	// without a configured cluster only the namespace is compared
+	assert.NoError(t, ResumeTarget{Namespace: "shop.orders"}.check(&mongowatch.ChangeStreamResumePoint{Namespace: "shop.orders", Cluster: "rs1"}))
+}
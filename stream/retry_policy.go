@@ -0,0 +1,218 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// ErrorClass groups errors a processor fails with by how they should be retried
+type ErrorClass string
+
+const (
+	// ErrorClassNetwork covers connection errors and timeouts, usually brief
+	ErrorClassNetwork ErrorClass = "network"
+	// ErrorClassElection covers replica set state changes, e.g. a stepped down primary; elections take seconds
+	ErrorClassElection ErrorClass = "election"
+	// ErrorClassHandler covers handler failures, usually an overloaded or unavailable downstream
+	ErrorClassHandler ErrorClass = "handler"
+	// ErrorClassOther is everything else
+	ErrorClassOther ErrorClass = "other"
+)
+
+// electionCodes are server error codes of replica set state changes
+var electionCodes = []int{
+	91,    // ShutdownInProgress
+	189,   // PrimarySteppedDown
+	10107, // NotWritablePrimary
+	11600, // InterruptedAtShutdown
+	11602, // InterruptedDueToReplStateChange
+	13435, // NotPrimaryNoSecondaryOk
+	13436, // NotPrimaryOrSecondary
+}
+
+// ClassifyError returns the class of an error returned by DocumentProcessor.Start
+func ClassifyError(err error) ErrorClass {
+	var processingErr *mongowatch.ProcessingError
+	if errors.As(err, &processingErr) {
+		return ErrorClassHandler
+	}
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) {
+		for _, code := range electionCodes {
+			if serverErr.HasErrorCode(code) {
+				return ErrorClassElection
+			}
+		}
+	}
+	var selectionErr topology.ServerSelectionError
+	if errors.As(err, &selectionErr) {
+		// no primary to select while the replica set elects one
+		return ErrorClassElection
+	}
+	var netErr net.Error
+	if mongo.IsNetworkError(err) || mongo.IsTimeout(err) || errors.As(err, &netErr) {
+		return ErrorClassNetwork
+	}
+	return ErrorClassOther
+}
+
+// DecorrelatedJitter is a backoff.BackOff waiting a random time between Base and three times the previous wait,
+// capped at Max. Processors restarting after a shared incident spread out instead of retrying in lockstep.
+type DecorrelatedJitter struct {
+	Base time.Duration
+	Max  time.Duration
+
+	mu   sync.Mutex
+	prev time.Duration
+	rand *rand.Rand
+}
+
+var _ backoff.BackOff = (*DecorrelatedJitter)(nil)
+
+// NewDecorrelatedJitter creates a decorrelated jitter backoff
+func NewDecorrelatedJitter(base, max time.Duration) *DecorrelatedJitter {
+	return &DecorrelatedJitter{Base: base, Max: max, rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// NextBackOff implements backoff.BackOff
+func (j *DecorrelatedJitter) NextBackOff() time.Duration {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.rand == nil {
+		j.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	prev := j.prev
+	if prev < j.Base {
+		prev = j.Base
+	}
+	next := j.Base
+	if upper := 3 * prev; upper > j.Base {
+		next += time.Duration(j.rand.Int63n(int64(upper - j.Base)))
+	}
+	if next > j.Max {
+		next = j.Max
+	}
+	j.prev = next
+	return next
+}
+
+// Reset implements backoff.BackOff
+func (j *DecorrelatedJitter) Reset() {
+	j.mu.Lock()
+	j.prev = 0
+	j.mu.Unlock()
+}
+
+// errorObserver is implemented by backoffs choosing the next wait by the error of the failed attempt,
+// StartWithRetry reports every error to them before asking for the next wait
+type errorObserver interface {
+	Observe(err error)
+}
+
+// RetryPolicy is a backoff.BackOff using a separate curve per error class, pass it to StartWithRetry.
+// Each curve keeps growing while failures of its class repeat and starts over when another class interrupts.
+type RetryPolicy struct {
+	// MaxElapsedTime stops retrying once exceeded since the last Reset, zero retries forever
+	MaxElapsedTime time.Duration
+
+	mu       sync.Mutex
+	classes  map[ErrorClass]backoff.BackOff
+	fallback backoff.BackOff
+	current  ErrorClass
+	started  time.Time
+}
+
+var _ backoff.BackOff = (*RetryPolicy)(nil)
+
+// NewRetryPolicy creates a retry policy, errors of classes without a curve use fallback
+func NewRetryPolicy(fallback backoff.BackOff, classes map[ErrorClass]backoff.BackOff) *RetryPolicy {
+	return &RetryPolicy{classes: classes, fallback: fallback, current: ErrorClassOther, started: time.Now()}
+}
+
+// DefaultRetryPolicy returns decorrelated jitter curves between base and max: network errors start at base,
+// elections wait at least two seconds since a new primary isn't elected sooner, and handler errors start at
+// four times base to give an overloaded downstream room
+func DefaultRetryPolicy(base, max time.Duration) *RetryPolicy {
+	electionBase := base
+	if electionBase < 2*time.Second {
+		electionBase = 2 * time.Second
+	}
+	handlerBase := 4 * base
+	if electionBase > max {
+		electionBase = max
+	}
+	if handlerBase > max {
+		handlerBase = max
+	}
+	return NewRetryPolicy(NewDecorrelatedJitter(base, max), map[ErrorClass]backoff.BackOff{
+		ErrorClassNetwork:  NewDecorrelatedJitter(base, max),
+		ErrorClassElection: NewDecorrelatedJitter(electionBase, max),
+		ErrorClassHandler:  NewDecorrelatedJitter(handlerBase, max),
+	})
+}
+
+// Observe selects the curve for the error of the last attempt
+func (p *RetryPolicy) Observe(err error) {
+	class := ClassifyError(err)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if class != p.current {
+		p.current = class
+		p.curve().Reset()
+	}
+}
+
+// NextBackOff implements backoff.BackOff
+func (p *RetryPolicy) NextBackOff() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.MaxElapsedTime > 0 && time.Since(p.started) > p.MaxElapsedTime {
+		return backoff.Stop
+	}
+	return p.curve().NextBackOff()
+}
+
+// Reset implements backoff.BackOff
+func (p *RetryPolicy) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.started = time.Now()
+	p.fallback.Reset()
+	for _, curve := range p.classes {
+		curve.Reset()
+	}
+}
+
+func (p *RetryPolicy) curve() backoff.BackOff {
+	if curve, ok := p.classes[p.current]; ok {
+		return curve
+	}
+	return p.fallback
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+func Test_ClassifyError(t *testing.T) {
+	handler := mongowatch.NewProcessingError(mongowatch.ChangeStreamEvent{}, 1, errors.New("downstream unavailable"))
+	stepDown := mongo.CommandError{Code: 189, Name: "PrimarySteppedDown"}
+	network := &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}
+
+	assert.Equal(t, ErrorClassHandler, ClassifyError(fmt.Errorf("failed to watch change stream: %w", handler)))
+	assert.Equal(t, ErrorClassElection, ClassifyError(fmt.Errorf("failed to watch: %w", stepDown)))
+	assert.Equal(t, ErrorClassElection, ClassifyError(topology.ServerSelectionError{Wrapped: errors.New("no primary")}))
+	assert.Equal(t, ErrorClassNetwork, ClassifyError(fmt.Errorf("failed to watch: %w", network)))
+	assert.Equal(t, ErrorClassOther, ClassifyError(errors.New("boom")))
+}
+
+func Test_DecorrelatedJitter(t *testing.T) {
+	j := NewDecorrelatedJitter(100*time.Millisecond, time.Second)
+	var maxSeen time.Duration
+	for i := 0; i < 100; i++ {
+		d := j.NextBackOff()
+		assert.GreaterOrEqual(t, d, 100*time.Millisecond)
+		assert.LessOrEqual(t, d, time.Second)
+		if d > maxSeen {
+			maxSeen = d
+		}
+	}
+	assert.Greater(t, maxSeen, 300*time.Millisecond, "waits didn't grow")
+
+	j.Reset()
+	assert.Less(t, j.NextBackOff(), 300*time.Millisecond)
+}
+
+func Test_RetryPolicy(t *testing.T) {
+	network := backoff.NewConstantBackOff(time.Second)
+	election := backoff.NewConstantBackOff(5 * time.Second)
+	p := NewRetryPolicy(backoff.NewConstantBackOff(time.Minute), map[ErrorClass]backoff.BackOff{
+		ErrorClassNetwork:  network,
+		ErrorClassElection: election,
+	})
+
+	p.Observe(&net.OpError{Op: "dial", Err: errors.New("refused")})
+	assert.Equal(t, time.Second, p.NextBackOff())
+	p.Observe(mongo.CommandError{Code: 10107})
+	assert.Equal(t, 5*time.Second, p.NextBackOff())
+	p.Observe(errors.New("boom"))
+	assert.Equal(t, time.Minute, p.NextBackOff())
+
+	p.MaxElapsedTime = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	assert.Equal(t, backoff.Stop, p.NextBackOff())
+	p.MaxElapsedTime = time.Hour
+	p.Reset()
+	assert.Equal(t, time.Minute, p.NextBackOff())
+}
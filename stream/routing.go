@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// knownOperationTypes are the change event types of the server versions mongowatch supports
+var knownOperationTypes = map[string]bool{
+	"insert": true, "update": true, "replace": true, "delete": true, "invalidate": true,
+	"drop": true, "rename": true, "dropDatabase": true,
+	// expanded events
+	"create": true, "createIndexes": true, "dropIndexes": true, "modify": true,
+	"shardCollection": true, "reshardCollection": true, "refineCollectionShardKey": true,
+}
+
+// OperationHandlers routes events to a handler per operation type, for consumers that only care about some of them.
+// Pass it to Start like any CollectionWatcher; operation types beyond insert, update and delete (e.g. replace, drop,
+// rename) also need WithOperationTypes on the watcher.
+//
+//	dp.Start(stream.OperationHandlers{"delete": onDelete}, options.UpdateLookup)
+type OperationHandlers map[string]func(ctx context.Context, doc []byte) error
+
+var (
+	_ mongowatch.CollectionWatcher = OperationHandlers(nil)
+	_ mongowatch.OperationRouter   = OperationHandlers(nil)
+)
+
+// Handler returns the handler of the operation type
+func (h OperationHandlers) Handler(operationType string) (func(ctx context.Context, doc []byte) error, bool) {
+	handler, ok := h[operationType]
+	return handler, ok
+}
+
+// Insert calls the insert handler if there is one
+func (h OperationHandlers) Insert(ctx context.Context, doc []byte) error {
+	return h.call(ctx, "insert", doc)
+}
+
+// Update calls the update handler if there is one
+func (h OperationHandlers) Update(ctx context.Context, doc []byte) error {
+	return h.call(ctx, "update", doc)
+}
+
+// Delete calls the delete handler if there is one
+func (h OperationHandlers) Delete(ctx context.Context, doc []byte) error {
+	return h.call(ctx, "delete", doc)
+}
+
+func (h OperationHandlers) call(ctx context.Context, operationType string, doc []byte) error {
+	if handler, ok := h[operationType]; ok {
+		return handler(ctx, doc)
+	}
+	return nil
+}
+
+// route dispatches the event to the handler of its operation type. Events without a document
+// (drop, rename...) pass their namespace as the document.
+func (dp DocumentProcessor) route(ctx context.Context, router mongowatch.OperationRouter, ce mongowatch.ChangeStreamEvent) error {
+	handler, ok := router.Handler(ce.OperationType)
+	if !ok {
+		if dp.strict && !knownOperationTypes[ce.OperationType] {
+			return fmt.Errorf("%w: %s", ErrUnhandledOperation, ce.OperationType)
+		}
+		eventLogf(ctx, "no handler for event: %d: %s", ce.Timestamp.T, ce.OperationType)
+		return nil
+	}
+
+	doc := eventDocument(ce)
+	if doc == nil {
+		doc = primitive.M{"db": ce.Database, "coll": ce.Collection}
+	}
+	payload, err := dp.serialize(ce, doc)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s event document: %w", ce.OperationType, err)
+	}
+	return handler(ctx, payload)
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+func TestOperationHandlers(t *testing.T) {
+	dp := DocumentProcessor{serializer: JSONSerializer{}}
+	got := map[string]string{}
+	record := func(op string) func(ctx context.Context, doc []byte) error {
+		return func(ctx context.Context, doc []byte) error {
+			got[op] = string(doc)
+			return nil
+		}
+	}
+	dispatch := dp.dispatcher(OperationHandlers{
+		"delete":  record("delete"),
+		"replace": record("replace"),
+		"drop":    record("drop"),
+	})
+
+	ctx := context.Background()
+	for _, ce := range []mongowatch.ChangeStreamEvent{
+		{OperationType: "insert", FullDocument: primitive.M{"n": 1}},
+		{OperationType: "delete", FullDocumentBeforeChange: primitive.M{"n": 2}},
+		{OperationType: "replace", FullDocument: primitive.M{"n": 3}},
+		{OperationType: "drop", Database: "app", Collection: "users"},
+	} {
+		assert.NoError(t, dispatch(ctx, ce, nil))
+	}
+
+	assert.Equal(t, map[string]string{
+		"delete":  `{"n":2}`,
+		"replace": `{"n":3}`,
+		"drop":    `{"coll":"users","db":"app"}`,
+	}, got)
+}
+
+func TestWithOperationTypes(t *testing.T) {
+	pipeline := NewChangeStreamWatcher(nil, WithOperationTypes("replace", "drop")).pipeline()
+
+	match := pipeline[0][0].Value.(bson.D)[0].Value.(bson.A)
+	assert.Len(t, match, 6)
+	assert.Equal(t, bson.D{{Key: "operationType", Value: "drop"}}, match[5])
+}
+
+func TestStrictOperations(t *testing.T) {
+	ctx := context.Background()
+	lenient := DocumentProcessor{serializer: JSONSerializer{}}
+	strict := DocumentProcessor{serializer: JSONSerializer{}}
+	WithStrictOperations()(&strict)
+	replace := mongowatch.ChangeStreamEvent{OperationType: "replace", FullDocument: primitive.M{"n": 1}}
+
+	assert.NoError(t, lenient.dispatcher(&payloadWatcher{})(ctx, replace, nil))
+	assert.ErrorIs(t, strict.dispatcher(&payloadWatcher{})(ctx, replace, nil), ErrUnhandledOperation)
+	assert.NoError(t, strict.dispatcher(&payloadWatcher{})(ctx, mongowatch.ChangeStreamEvent{OperationType: "invalidate"}, nil))
+
+	// routed processors only fail on operation types nobody knows about
+	handlers := OperationHandlers{}
+	assert.NoError(t, strict.dispatcher(handlers)(ctx, replace, nil))
+	assert.ErrorIs(t, strict.dispatcher(handlers)(ctx, mongowatch.ChangeStreamEvent{OperationType: "reshape"}, nil), ErrUnhandledOperation)
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// exit codes returned by Run
+const (
+	// ExitOK the processor stopped on its own or drained within the grace period
+	ExitOK = 0
+	// ExitError the processor stopped with an error
+	ExitError = 1
+	// ExitForced the grace period passed or a second signal arrived before the processor stopped
+	ExitForced = 2
+)
+
+// RunConfig configures Run
+type RunConfig struct {
+	// GracePeriod bounds draining the event in flight and stopping the stream, 30s by default
+	GracePeriod time.Duration
+	// Signals trigger the shutdown, SIGINT and SIGTERM by default
+	Signals []os.Signal
+}
+
+// Drainer is a processor that can be drained and stopped, implemented by DocumentProcessor
+type Drainer interface {
+	Drain(ctx context.Context) error
+	Stop()
+}
+
+// Run runs start, typically a DocumentProcessor Start or StartWithRetry call, until it returns or a shutdown signal
+// arrives. On a signal the processor is drained, so the event in flight finishes and no new one is dispatched,
+// then stopped, all within the grace period. A second signal forces the shutdown.
+// The result is an exit code for os.Exit, e.g. os.Exit(stream.Run(dp, start, stream.RunConfig{})).
+func Run(p Drainer, start func() error, cfg RunConfig) int {
+	if cfg.GracePeriod <= 0 {
+		cfg.GracePeriod = 30 * time.Second
+	}
+	if len(cfg.Signals) == 0 {
+		cfg.Signals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	}
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, cfg.Signals...)
+	defer signal.Stop(signals)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- start()
+	}()
+
+	select {
+	case err := <-done:
+		return exitCode(err)
+	case sig := <-signals:
+		log.Infof("received %s, draining processor within %s", sig, cfg.GracePeriod)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.GracePeriod)
+	defer cancel()
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- p.Drain(ctx)
+	}()
+
+	select {
+	case err := <-drained:
+		if err != nil {
+			log.Errorf("failed to drain processor: %v", err)
+		}
+	case err := <-done:
+		// the stream ended while draining
+		return exitCode(err)
+	case sig := <-signals:
+		log.Errorf("received %s while draining, forcing shutdown", sig)
+		p.Stop()
+		return ExitForced
+	}
+
+	p.Stop()
+
+	select {
+	case err := <-done:
+		if ctx.Err() != nil {
+			return ExitForced
+		}
+		return exitCode(err)
+	case <-ctx.Done():
+		log.Errorf("processor did not stop within %s", cfg.GracePeriod)
+		return ExitForced
+	case sig := <-signals:
+		log.Errorf("received %s while stopping, forcing shutdown", sig)
+		return ExitForced
+	}
+}
+
+func exitCode(err error) int {
+	if err != nil {
+		log.Errorf("processor stopped: %v", err)
+		return ExitError
+	}
+	log.Info("processor stopped")
+	return ExitOK
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// gateProcessor dispatches slow events through a pause gate until stopped
+type gateProcessor struct {
+	gate      *PauseGate
+	stop      chan struct{}
+	started   chan struct{}
+	completed int
+}
+
+func (p *gateProcessor) Drain(ctx context.Context) error { return p.gate.Drain(ctx) }
+func (p *gateProcessor) Stop()                           { close(p.stop) }
+
+func (p *gateProcessor) start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-p.stop
+		cancel()
+	}()
+
+	dispatch := p.gate.Middleware()(func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		select {
+		case p.started <- struct{}{}:
+		default:
+		}
+		// the event in flight finishes although a shutdown was requested meanwhile
+		time.Sleep(30 * time.Millisecond)
+		p.completed++
+		return nil
+	})
+	for {
+		if err := dispatch(ctx, mongowatch.ChangeStreamEvent{}, nil); err != nil {
+			if errors.Is(err, context.Canceled) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func TestRunDrainsOnSignal(t *testing.T) {
+	p := &gateProcessor{gate: NewPauseGate(), stop: make(chan struct{}), started: make(chan struct{}, 1)}
+	go func() {
+		<-p.started
+		_ = syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+	}()
+
+	code := Run(p, p.start, RunConfig{GracePeriod: time.Second, Signals: []os.Signal{syscall.SIGUSR1}})
+	assert.Equal(t, ExitOK, code)
+	assert.GreaterOrEqual(t, p.completed, 1)
+}
+
+func TestRunExitCodes(t *testing.T) {
+	p := &gateProcessor{gate: NewPauseGate(), stop: make(chan struct{})}
+	assert.Equal(t, ExitError, Run(p, func() error { return errors.New("boom") }, RunConfig{Signals: []os.Signal{syscall.SIGUSR1}}))
+	assert.Equal(t, ExitOK, Run(p, func() error { return nil }, RunConfig{Signals: []os.Signal{syscall.SIGUSR1}}))
+
+	// a processor ignoring Stop exceeds the grace period
+	stuck := &gateProcessor{gate: NewPauseGate(), stop: make(chan struct{})}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		_ = syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+	}()
+	block := make(chan struct{})
+	defer close(block)
+	code := Run(stuck, func() error { <-block; return nil }, RunConfig{GracePeriod: 50 * time.Millisecond, Signals: []os.Signal{syscall.SIGUSR1}})
+	assert.Equal(t, ExitForced, code)
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// sampleKeys bounds the memory used by per key sampling, the counter of the least recently seen key is evicted
+// first and that key's next event is kept as if it was its first
+const sampleKeys = 4096
+
+// SamplerConfig configures event sampling, set either Rate or EveryN
+type SamplerConfig struct {
+	// Rate keeps each event with the given probability (0..1)
+	Rate float64
+	// EveryN keeps every Nth event of each logical key, the documentKey unless WithKeyExtractor is set
+	EveryN int
+}
+
+// SamplingStats counts sampling decisions
+type SamplingStats struct {
+	Kept    uint64 `json:"kept"`
+	Dropped uint64 `json:"dropped"`
+}
+
+// Sampler drops a share of events before they are dispatched.
+// It is meant for consumers feeding dashboards and metrics which don't need every event.
+// Invalidate events are never dropped.
+type Sampler struct {
+	cfg SamplerConfig
+
+	mu       sync.Mutex
+	counters *lruCache[uint32]
+	random   *rand.Rand
+
+	kept    atomic.Uint64
+	dropped atomic.Uint64
+}
+
+// NewSampler creates a sampler
+func NewSampler(cfg SamplerConfig) *Sampler {
+	return &Sampler{cfg: cfg, counters: newLRUCache[uint32](sampleKeys, 0), random: rand.New(rand.NewSource(rand.Int63()))}
+}
+
+// Stats returns the sampling decisions made so far
+func (s *Sampler) Stats() SamplingStats {
+	return SamplingStats{Kept: s.kept.Load(), Dropped: s.dropped.Load()}
+}
+
+// WithSampling drops events as decided by the sampler before they are dispatched, Stats.Sampled counts the decisions
+func WithSampling(sampler *Sampler) ManagerOption {
+	return func(m *Manager) {
+		m.sampler = sampler
+		m.middlewares = append(m.middlewares, sampler.Middleware())
+	}
+}
+
+// Middleware returns the middleware to register with WithMiddleware, prefer WithSampling which also reports
+// the decisions in Stats
+func (s *Sampler) Middleware() mongowatch.ChangeEventMiddleware {
+	return func(next mongowatch.ChangeEventDispatcherFunc) mongowatch.ChangeEventDispatcherFunc {
+		return func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+			if ce.OperationType != mongowatch.OperationTypeInvalidate && !s.keep(ce) {
+				s.dropped.Add(1)
+				return err
+			}
+			s.kept.Add(1)
+			return next(ctx, ce, err)
+		}
+	}
+}
+
+func (s *Sampler) keep(ce mongowatch.ChangeStreamEvent) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cfg.EveryN > 1 {
+		key := ce.LogicalKey()
+		n, _ := s.counters.get(key)
+		n++
+		s.counters.put(key, n)
+		return n%uint32(s.cfg.EveryN) == 1
+	}
+	if s.cfg.Rate > 0 && s.cfg.Rate < 1 {
+		return s.random.Float64() < s.cfg.Rate
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+func Test_Sampler_EveryN(t *testing.T) {
+	sampler := NewSampler(SamplerConfig{EveryN: 3})
+	dispatched := map[string]int{}
+	dispatch := sampler.Middleware()(func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		dispatched[ce.DocumentKey]++
+		return nil
+	})
+
+	for i := 0; i < 6; i++ {
+		for _, key := range []string{"a", "b"} {
+			assert.NoError(t, dispatch(context.Background(), mongowatch.ChangeStreamEvent{DocumentKey: key, OperationType: "update"}, nil))
+		}
+	}
+	assert.NoError(t, dispatch(context.Background(), mongowatch.ChangeStreamEvent{OperationType: mongowatch.OperationTypeInvalidate}, nil))
+
+	assert.Equal(t, 2, dispatched["a"])
+	assert.Equal(t, 2, dispatched["b"])
+	assert.Equal(t, 1, dispatched[""])
+	assert.Equal(t, SamplingStats{Kept: 5, Dropped: 8}, sampler.Stats())
+}
+
+func Test_Sampler_EveryN_CountsKeysSeparately(t *testing.T) {
+	sampler := NewSampler(SamplerConfig{EveryN: 2})
+	dispatch := sampler.Middleware()(func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		return nil
+	})
+	send := func(key string) {
+		assert.NoError(t, dispatch(context.Background(), mongowatch.ChangeStreamEvent{DocumentKey: key, OperationType: "update"}, nil))
+	}
+
+	// the first event of every key is kept, however many keys there are
+	for i := 0; i < sampleKeys; i++ {
+		send(fmt.Sprintf("key-%d", i))
+	}
+	assert.Equal(t, SamplingStats{Kept: sampleKeys}, sampler.Stats())
+
+	send("key-1")
+	assert.Equal(t, uint64(1), sampler.Stats().Dropped)
+	// one more key evicts the least recently seen counter, key-0 starts over
+	send("key-new")
+	send("key-0")
+	assert.Equal(t, SamplingStats{Kept: sampleKeys + 2, Dropped: 1}, sampler.Stats())
+}
+
+func Test_Manager_Sampling(t *testing.T) {
+	m := NewManager(nil, nil, nil, nil, WithSampling(NewSampler(SamplerConfig{EveryN: 2})))
+	var dispatched int
+	dispatch := m.buildDispatcher([]mongowatch.ChangeEventDispatcherFunc{
+		func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+			dispatched++
+			return nil
+		},
+	})
+
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, dispatch(context.Background(), mongowatch.ChangeStreamEvent{DocumentKey: "a", OperationType: "update"}, nil))
+	}
+	assert.Equal(t, 2, dispatched)
+	assert.Equal(t, SamplingStats{Kept: 2, Dropped: 2}, m.Stats().Sampled)
+}
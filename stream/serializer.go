@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"encoding/json"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// SerializerFunc adapts a plain function (e.g. a msgpack or protobuf codec) to the mongowatch.Serializer interface
+type SerializerFunc func(doc primitive.M) ([]byte, error)
+
+// Serialize calls f(doc)
+func (f SerializerFunc) Serialize(doc primitive.M) ([]byte, error) {
+	return f(doc)
+}
+
+// JSONSerializer marshals documents with encoding/json, this is the default
+type JSONSerializer struct{}
+
+// Serialize marshals doc to plain JSON
+func (JSONSerializer) Serialize(doc primitive.M) ([]byte, error) {
+	return json.Marshal(doc)
+}
+
+// ExtendedJSONSerializer marshals documents to MongoDB Extended JSON, preserving BSON types such as ObjectID and dates
+type ExtendedJSONSerializer struct {
+	// Canonical selects canonical mode instead of relaxed mode
+	Canonical bool
+}
+
+// Serialize marshals doc to Extended JSON
+func (s ExtendedJSONSerializer) Serialize(doc primitive.M) ([]byte, error) {
+	return bson.MarshalExtJSON(doc, s.Canonical, false)
+}
+
+// BSONSerializer marshals documents to raw BSON
+type BSONSerializer struct{}
+
+// Serialize marshals doc to BSON
+func (BSONSerializer) Serialize(doc primitive.M) ([]byte, error) {
+	return bson.Marshal(doc)
+}
+
+var (
+	_ mongowatch.Serializer = SerializerFunc(nil)
+	_ mongowatch.Serializer = JSONSerializer{}
+	_ mongowatch.Serializer = ExtendedJSONSerializer{}
+	_ mongowatch.Serializer = BSONSerializer{}
+)
@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+func Test_Serializers(t *testing.T) {
+	id, _ := primitive.ObjectIDFromHex("64a7f0c2e1b2c3d4e5f60718")
+	doc := primitive.M{"_id": id, "name": "test"}
+
+	tests := []struct {
+		name       string
+		serializer mongowatch.Serializer
+		want       string
+	}{
+		{
+			name:       "json",
+			serializer: JSONSerializer{},
+			want:       `{"_id":"64a7f0c2e1b2c3d4e5f60718","name":"test"}`,
+		},
+		{
+			name:       "extended json",
+			serializer: ExtendedJSONSerializer{},
+			want:       `{"_id":{"$oid":"64a7f0c2e1b2c3d4e5f60718"},"name":"test"}`,
+		},
+		{
+			name: "user codec",
+			serializer: SerializerFunc(func(doc primitive.M) ([]byte, error) {
+				return []byte(`"` + doc["name"].(string) + `"`), nil
+			}),
+			want: `"test"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.serializer.Serialize(doc)
+			assert.NoError(t, err)
+			assert.JSONEq(t, tt.want, string(got))
+		})
+	}
+
+	raw, err := BSONSerializer{}.Serialize(doc)
+	assert.NoError(t, err)
+	var decoded primitive.M
+	assert.NoError(t, bson.Unmarshal(raw, &decoded))
+	assert.Equal(t, doc, decoded)
+}
@@ -0,0 +1,348 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+const spillSegmentExt = ".seg"
+
+// ErrSpillFull is returned when an event doesn't fit into the spill buffer anymore
+var ErrSpillFull = errors.New("spill buffer is full")
+
+// SpillConfig configures a SpillBuffer
+type SpillConfig struct {
+	// Dir holds the segment files, it is created if missing
+	Dir string
+	// MaxBytes bounds the pending events on disk, 1GiB by default
+	MaxBytes int64
+	// SegmentBytes is the size after which a new segment file is started, 64MiB by default
+	SegmentBytes int64
+	// RetryInterval is the pause between replay attempts while the handler keeps failing, 1s by default
+	RetryInterval time.Duration
+	// Spillable tells handler errors caused by a downstream outage, nil spills on every error
+	Spillable func(error) bool
+}
+
+// SpillBuffer is a disk backed queue in front of a handler. While the handler fails, events are appended
+// to segment files instead and the stream keeps advancing, so a long downstream outage doesn't outlast
+// the oplog window. Run replays the spilled events in order once the handler recovers; until the buffer
+// is empty, new events are spilled behind them. Only when the buffer is full does the stream fail.
+type SpillBuffer struct {
+	cfg     SpillConfig
+	handler mongowatch.ChangeEventDispatcherFunc
+
+	mu       sync.Mutex
+	segments []uint64
+	// writer appends to the last segment
+	writer    *os.File
+	writeSize int64
+	// readOffset is the position of the oldest pending event in the first segment
+	readOffset int64
+	pending    int64
+	notify     chan struct{}
+}
+
+// NewSpillBuffer opens the buffer in cfg.Dir, picking up the events spilled before a restart
+func NewSpillBuffer(cfg SpillConfig, handler mongowatch.ChangeEventDispatcherFunc) (*SpillBuffer, error) {
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = 1 << 30
+	}
+	if cfg.SegmentBytes <= 0 {
+		cfg.SegmentBytes = 64 << 20
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = time.Second
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create spill dir: %w", err)
+	}
+
+	sb := &SpillBuffer{cfg: cfg, handler: handler, notify: make(chan struct{}, 1)}
+	if err := sb.load(); err != nil {
+		return nil, err
+	}
+	return sb, nil
+}
+
+// load finds the segments and the read position left by a previous run
+func (sb *SpillBuffer) load() error {
+	entries, err := os.ReadDir(sb.cfg.Dir)
+	if err != nil {
+		return fmt.Errorf("failed to read spill dir: %w", err)
+	}
+	for _, entry := range entries {
+		id, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), spillSegmentExt), 10, 64)
+		if err != nil || !strings.HasSuffix(entry.Name(), spillSegmentExt) {
+			continue
+		}
+		sb.segments = append(sb.segments, id)
+	}
+	sort.Slice(sb.segments, func(i, j int) bool { return sb.segments[i] < sb.segments[j] })
+
+	// a missing or unreadable cursor replays the first segment from the start
+	if data, err := os.ReadFile(sb.cursorPath()); err == nil {
+		var id uint64
+		var offset int64
+		if _, err := fmt.Sscanf(string(data), "%d %d", &id, &offset); err == nil && len(sb.segments) > 0 && sb.segments[0] == id {
+			sb.readOffset = offset
+		}
+	}
+
+	for i, id := range sb.segments {
+		info, err := os.Stat(sb.segmentPath(id))
+		if err != nil {
+			return fmt.Errorf("failed to stat spill segment: %w", err)
+		}
+		sb.pending += info.Size()
+		if i == len(sb.segments)-1 {
+			sb.writeSize = info.Size()
+		}
+	}
+	sb.pending -= sb.readOffset
+
+	if len(sb.segments) > 0 {
+		sb.writer, err = os.OpenFile(sb.segmentPath(sb.segments[len(sb.segments)-1]), os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to open spill segment: %w", err)
+		}
+	}
+	return nil
+}
+
+// Dispatch hands the event to the handler, or spills it when the handler fails or older events are still pending
+func (sb *SpillBuffer) Dispatch(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+	if err != nil {
+		return err
+	}
+	if sb.Pending() == 0 {
+		err = sb.handler(ctx, ce, nil)
+		if err == nil || (sb.cfg.Spillable != nil && !sb.cfg.Spillable(err)) {
+			return err
+		}
+		logger(ctx).Warnf("handler failed, spilling events to disk until it recovers: %v", err)
+	}
+
+	if spillErr := sb.append(ce); spillErr != nil {
+		if err != nil {
+			return fmt.Errorf("failed to spill event after handler error %v: %w", err, spillErr)
+		}
+		return fmt.Errorf("failed to spill event: %w", spillErr)
+	}
+	return nil
+}
+
+// Run replays the spilled events to the handler until ctx is done, retrying the oldest event while it fails
+func (sb *SpillBuffer) Run(ctx context.Context) error {
+	for {
+		ce, size, ok, err := sb.peek()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			select {
+			case <-sb.notify:
+				continue
+			case <-ctx.Done():
+				return nil
+			}
+		}
+
+		err = sb.handler(mongowatch.ContextWithEvent(ctx, ce), ce, nil)
+		if err != nil {
+			logger(ctx).Debugf("replaying spilled event %v failed, retrying in %s: %v", ce.ID.TokenData, sb.cfg.RetryInterval, err)
+			select {
+			case <-time.After(sb.cfg.RetryInterval):
+				continue
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		if err = sb.ack(size); err != nil {
+			return err
+		}
+	}
+}
+
+// Pending returns the size in bytes of the events waiting to be replayed
+func (sb *SpillBuffer) Pending() int64 {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.pending
+}
+
+// Close closes the segment being written, pending events are replayed after reopening the buffer
+func (sb *SpillBuffer) Close() error {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.writer == nil {
+		return nil
+	}
+	err := sb.writer.Close()
+	sb.writer = nil
+	return err
+}
+
+func (sb *SpillBuffer) append(ce mongowatch.ChangeStreamEvent) error {
+	// bson documents start with their length, which frames the records in a segment
+	data, err := bson.Marshal(ce)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+	size := int64(len(data))
+
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.pending+size > sb.cfg.MaxBytes {
+		return ErrSpillFull
+	}
+	if sb.writer == nil || sb.writeSize+size > sb.cfg.SegmentBytes {
+		if err = sb.roll(); err != nil {
+			return err
+		}
+	}
+	if _, err = sb.writer.Write(data); err != nil {
+		return fmt.Errorf("failed to write spill segment: %w", err)
+	}
+	// the stream moves past the event once it is spilled, so it has to be on disk by then
+	if err = sb.writer.Sync(); err != nil {
+		return fmt.Errorf("failed to sync spill segment: %w", err)
+	}
+	sb.writeSize += size
+	sb.pending += size
+
+	select {
+	case sb.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// roll starts a new segment
+func (sb *SpillBuffer) roll() error {
+	if sb.writer != nil {
+		if err := sb.writer.Close(); err != nil {
+			return fmt.Errorf("failed to close spill segment: %w", err)
+		}
+	}
+	var id uint64 = 1
+	if len(sb.segments) > 0 {
+		id = sb.segments[len(sb.segments)-1] + 1
+	}
+	writer, err := os.OpenFile(sb.segmentPath(id), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create spill segment: %w", err)
+	}
+	sb.writer, sb.writeSize = writer, 0
+	sb.segments = append(sb.segments, id)
+	return nil
+}
+
+// peek reads the oldest pending event
+func (sb *SpillBuffer) peek() (mongowatch.ChangeStreamEvent, int64, bool, error) {
+	var ce mongowatch.ChangeStreamEvent
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.pending == 0 {
+		return ce, 0, false, nil
+	}
+
+	f, err := os.Open(sb.segmentPath(sb.segments[0]))
+	if err != nil {
+		return ce, 0, false, fmt.Errorf("failed to open spill segment: %w", err)
+	}
+	defer f.Close()
+
+	var length [4]byte
+	if _, err = f.ReadAt(length[:], sb.readOffset); err != nil {
+		return ce, 0, false, fmt.Errorf("failed to read spilled event: %w", err)
+	}
+	data := make([]byte, binary.LittleEndian.Uint32(length[:]))
+	if _, err = f.ReadAt(data, sb.readOffset); err != nil && !errors.Is(err, io.EOF) {
+		return ce, 0, false, fmt.Errorf("failed to read spilled event: %w", err)
+	}
+	if err = bson.Unmarshal(data, &ce); err != nil {
+		return ce, 0, false, fmt.Errorf("failed to unmarshal spilled event: %w", err)
+	}
+	return ce, int64(len(data)), true, nil
+}
+
+// ack drops the oldest pending event, removing its segment once it is fully replayed
+func (sb *SpillBuffer) ack(size int64) error {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	sb.readOffset += size
+	sb.pending -= size
+
+	head := sb.segments[0]
+	info, err := os.Stat(sb.segmentPath(head))
+	if err != nil {
+		return fmt.Errorf("failed to stat spill segment: %w", err)
+	}
+	if sb.readOffset >= info.Size() {
+		if len(sb.segments) == 1 && sb.writer != nil {
+			// the segment being written is done too, the next spill starts a new one
+			if err = sb.writer.Close(); err != nil {
+				return fmt.Errorf("failed to close spill segment: %w", err)
+			}
+			sb.writer = nil
+		}
+		if err = os.Remove(sb.segmentPath(head)); err != nil {
+			return fmt.Errorf("failed to remove spill segment: %w", err)
+		}
+		sb.segments = sb.segments[1:]
+		sb.readOffset = 0
+		if len(sb.segments) == 0 {
+			// segment IDs start over, a stale cursor must not apply to them
+			if err = os.Remove(sb.cursorPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("failed to remove spill cursor: %w", err)
+			}
+			return nil
+		}
+	}
+
+	cursor := fmt.Sprintf("%d %d", sb.segments[0], sb.readOffset)
+	if err = os.WriteFile(sb.cursorPath(), []byte(cursor), 0o644); err != nil {
+		return fmt.Errorf("failed to save spill cursor: %w", err)
+	}
+	return nil
+}
+
+func (sb *SpillBuffer) segmentPath(id uint64) string {
+	return filepath.Join(sb.cfg.Dir, fmt.Sprintf("%016d%s", id, spillSegmentExt))
+}
+
+func (sb *SpillBuffer) cursorPath() string {
+	return filepath.Join(sb.cfg.Dir, "cursor")
+}
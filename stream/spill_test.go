@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// flakyDownstream records events and fails while down
+type flakyDownstream struct {
+	mu   sync.Mutex
+	down bool
+	seen []uint32
+}
+
+func (d *flakyDownstream) handle(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.down {
+		return errors.New("downstream unavailable")
+	}
+	d.seen = append(d.seen, ce.Timestamp.T)
+	return nil
+}
+
+func (d *flakyDownstream) setDown(down bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.down = down
+}
+
+func (d *flakyDownstream) received() []uint32 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]uint32(nil), d.seen...)
+}
+
+func spillEvent(t uint32) mongowatch.ChangeStreamEvent {
+	return mongowatch.ChangeStreamEvent{
+		ID:           mongowatch.ResumeToken{TokenData: "token"},
+		Timestamp:    primitive.Timestamp{T: t},
+		FullDocument: primitive.M{"n": int32(t)},
+	}
+}
+
+func TestSpillBufferReplaysInOrder(t *testing.T) {
+	downstream := &flakyDownstream{}
+	sb, err := NewSpillBuffer(SpillConfig{Dir: t.TempDir(), SegmentBytes: 200, RetryInterval: 10 * time.Millisecond}, downstream.handle)
+	require.NoError(t, err)
+	defer sb.Close()
+	ctx := context.Background()
+
+	require.NoError(t, sb.Dispatch(ctx, spillEvent(1), nil))
+	downstream.setDown(true)
+	for i := uint32(2); i <= 6; i++ {
+		require.NoError(t, sb.Dispatch(ctx, spillEvent(i), nil))
+	}
+	assert.Positive(t, sb.Pending())
+	downstream.setDown(false)
+	// pending events go first, newer ones queue up behind them
+	require.NoError(t, sb.Dispatch(ctx, spillEvent(7), nil))
+	assert.Equal(t, []uint32{1}, downstream.received())
+
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() { done <- sb.Run(runCtx) }()
+
+	assert.Eventually(t, func() bool { return sb.Pending() == 0 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, []uint32{1, 2, 3, 4, 5, 6, 7}, downstream.received())
+	cancel()
+	assert.NoError(t, <-done)
+
+	// once drained the handler is called directly again
+	require.NoError(t, sb.Dispatch(ctx, spillEvent(8), nil))
+	assert.Equal(t, []uint32{1, 2, 3, 4, 5, 6, 7, 8}, downstream.received())
+}
+
+func TestSpillBufferSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	downstream := &flakyDownstream{down: true}
+	sb, err := NewSpillBuffer(SpillConfig{Dir: dir, SegmentBytes: 200}, downstream.handle)
+	require.NoError(t, err)
+	for i := uint32(1); i <= 4; i++ {
+		require.NoError(t, sb.Dispatch(context.Background(), spillEvent(i), nil))
+	}
+	// replay the first event before the restart
+	downstream.setDown(false)
+	_, size, ok, err := sb.peek()
+	require.True(t, ok)
+	require.NoError(t, err)
+	require.NoError(t, sb.ack(size))
+	pending := sb.Pending()
+	require.NoError(t, sb.Close())
+
+	reopened, err := NewSpillBuffer(SpillConfig{Dir: dir, SegmentBytes: 200}, downstream.handle)
+	require.NoError(t, err)
+	defer reopened.Close()
+	assert.Equal(t, pending, reopened.Pending())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go reopened.Run(ctx)
+	assert.Eventually(t, func() bool { return reopened.Pending() == 0 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, []uint32{2, 3, 4}, downstream.received())
+}
+
+func TestSpillBufferBounded(t *testing.T) {
+	downstream := &flakyDownstream{down: true}
+	sb, err := NewSpillBuffer(SpillConfig{Dir: t.TempDir(), MaxBytes: 150}, downstream.handle)
+	require.NoError(t, err)
+	defer sb.Close()
+
+	var err2 error
+	for i := uint32(1); i <= 10 && err2 == nil; i++ {
+		err2 = sb.Dispatch(context.Background(), spillEvent(i), nil)
+	}
+	assert.ErrorIs(t, err2, ErrSpillFull)
+	assert.LessOrEqual(t, sb.Pending(), int64(150))
+}
+
+func TestSpillBufferSpillable(t *testing.T) {
+	fatal := errors.New("bad event")
+	sb, err := NewSpillBuffer(SpillConfig{Dir: t.TempDir(), Spillable: func(err error) bool { return !errors.Is(err, fatal) }},
+		func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error { return fatal })
+	require.NoError(t, err)
+	defer sb.Close()
+
+	assert.ErrorIs(t, sb.Dispatch(context.Background(), spillEvent(1), nil), fatal)
+	assert.Zero(t, sb.Pending())
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// ErrInvalidStartPosition is returned by StartFrom when the server can't resume from the given position,
+// e.g. the token belongs to another stream or fell off the oplog
+var ErrInvalidStartPosition = errors.New("invalid start position")
+
+// startValidationTimeout bounds the round trip validating a start position
+const startValidationTimeout = 30 * time.Second
+
+// positionValidator is implemented by watchers able to check a resume point against the server before starting
+type positionValidator interface {
+	ValidatePosition(ctx context.Context, point mongowatch.ChangeStreamResumePoint) error
+}
+
+// ValidatePosition opens and closes a change stream at the resume point, failing with ErrInvalidStartPosition
+// when the server rejects it, so a bad position is reported before any resume point is overwritten
+func (csw *ChangeStreamWatcher) ValidatePosition(ctx context.Context, point mongowatch.ChangeStreamResumePoint) error {
+	cursor, err := csw.getWatchCursor(ctx, csw.fullDocument, &point)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidStartPosition, err)
+	}
+	defer cursor.Close(context.Background())
+	// tokens of events the stream doesn't match are only reported with the first batch
+	if !cursor.TryNext(ctx) && cursor.Err() != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidStartPosition, cursor.Err())
+	}
+	return nil
+}
+
+// StartFrom starts the doc processor at an explicit position instead of the stored resume point,
+// e.g. a token committed by an external offset store or chosen by an orchestrator. The position is
+// validated against the server first when the watcher supports it; once valid it replaces the stored
+// resume points like Seek does, so retries and restarts continue from there.
+func (dp DocumentProcessor) StartFrom(pos mongowatch.StartPosition, actions mongowatch.CollectionWatcher, fullDocumentMode options.FullDocument) error {
+	point, err := pos.ResumePoint()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidStartPosition, err)
+	}
+
+	ctx := dp.manager.withID(context.Background())
+	if v, ok := dp.watcher.(positionValidator); ok {
+		vctx, cancel := context.WithTimeout(ctx, startValidationTimeout)
+		err = v.ValidatePosition(vctx, point)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to validate start position: %w", err)
+		}
+	}
+	if _, err = dp.applySeek(ctx, pos); err != nil {
+		return err
+	}
+	logger(ctx).Infof("starting data processor from position: %v", point.ID.TokenData)
+	return dp.Start(actions, fullDocumentMode)
+}
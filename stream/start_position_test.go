@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+var errWatcherStopped = errors.New("stopped")
+
+// validatingWatcher rejects the tokens in invalid and records the resume point it was started from
+type validatingWatcher struct {
+	mu      sync.Mutex
+	invalid string
+	started *mongowatch.ChangeStreamResumePoint
+}
+
+func (w *validatingWatcher) ValidatePosition(ctx context.Context, point mongowatch.ChangeStreamResumePoint) error {
+	if point.ID.TokenData == w.invalid {
+		return ErrInvalidStartPosition
+	}
+	return nil
+}
+
+func (w *validatingWatcher) Start(ctx context.Context, _ options.FullDocument, point *mongowatch.ChangeStreamResumePoint, _, _ mongowatch.ChangeEventDispatcherFunc, _ ...mongowatch.ChangeEventDispatcherFunc) error {
+	w.mu.Lock()
+	w.started = point
+	w.mu.Unlock()
+	return errWatcherStopped
+}
+
+func Test_DocumentProcessor_StartFrom(t *testing.T) {
+	w := &validatingWatcher{invalid: "lost"}
+	resume := NewMemoryResume(nil)
+	dp := &DocumentProcessor{
+		resumeRepo: resume,
+		serializer: JSONSerializer{},
+		control:    &processorControl{gate: NewPauseGate()},
+		watcher:    w,
+		manager:    NewManager(resume, w, nil, nil),
+	}
+
+	err := dp.StartFrom(mongowatch.StartPosition{Token: &mongowatch.ResumeToken{TokenData: "lost"}}, &payloadWatcher{}, options.Off)
+	assert.ErrorIs(t, err, ErrInvalidStartPosition)
+	assert.Nil(t, w.started, "watcher started from a rejected position")
+	_, err = resume.GetResumePoint()
+	assert.Error(t, err, "rejected position was stored")
+
+	err = dp.StartFrom(mongowatch.StartPosition{Token: &mongowatch.ResumeToken{TokenData: "82aa"}}, &payloadWatcher{}, options.Off)
+	assert.ErrorIs(t, err, errWatcherStopped)
+	if assert.NotNil(t, w.started) {
+		assert.Equal(t, "82aa", w.started.ID.TokenData)
+	}
+
+	err = dp.StartFrom(mongowatch.StartPosition{}, &payloadWatcher{}, options.Off)
+	assert.ErrorIs(t, err, ErrInvalidStartPosition)
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// Stats describes the events handled by a Manager
+type Stats struct {
+	// ID identifies the watcher, set with WithManagerID
+	ID mongowatch.WatcherID `json:"id"`
+	// Processed counts successfully dispatched events, Failed failed dispatch attempts
+	Processed uint64 `json:"processed"`
+	Failed    uint64 `json:"failed"`
+	// Quarantined counts poison events set aside by WithPoisonPolicy
+	Quarantined uint64 `json:"quarantined"`
+	// Gaps counts suspicious cluster time gaps found by WithGapDetection
+	Gaps uint64 `json:"gaps"`
+	// Sampled counts the events kept and dropped by WithSampling
+	Sampled SamplingStats `json:"sampled"`
+	// LastClusterTime is the cluster time of the last processed event, LastProcessedAt when it was processed
+	LastClusterTime primitive.Timestamp `json:"lastClusterTime"`
+	LastProcessedAt time.Time           `json:"lastProcessedAt"`
+	// Cursor is empty unless the watcher collects cursor statistics
+	Cursor CursorStats `json:"cursor"`
+	// FullDocumentBeforeChange is the pre-image mode the watcher currently runs with, options.Off after falling
+	// back, see WithPreImageRetry; empty unless the watcher reports it
+	FullDocumentBeforeChange options.FullDocument `json:"fullDocumentBeforeChange,omitempty"`
+}
+
+// ProcessorStats describes a DocumentProcessor
+type ProcessorStats struct {
+	Stats
+	Running bool `json:"running"`
+	Paused  bool `json:"paused"`
+	// Degraded is set while WithLatencyGuard holds back events because of a slow local database
+	Degraded bool `json:"degraded"`
+	// Restarts counts failed starts retried by StartWithRetry
+	Restarts uint64 `json:"restarts"`
+}
+
+// managerStats is the concurrency safe accumulator behind Stats
+type managerStats struct {
+	processed   atomic.Uint64
+	failed      atomic.Uint64
+	quarantined atomic.Uint64
+
+	mu              sync.Mutex
+	lastClusterTime primitive.Timestamp
+	lastProcessedAt time.Time
+}
+
+func (s *managerStats) recordProcessed(ts primitive.Timestamp) {
+	s.processed.Add(1)
+	s.mu.Lock()
+	s.lastClusterTime = ts
+	s.lastProcessedAt = time.Now()
+	s.mu.Unlock()
+}
+
+// Stats returns the event counters of the manager
+func (m *Manager) Stats() Stats {
+	m.stats.mu.Lock()
+	defer m.stats.mu.Unlock()
+
+	cursor, _ := m.CursorStats()
+	var preImage options.FullDocument
+	if w, ok := m.watcher.(interface{ PreImageMode() options.FullDocument }); ok {
+		preImage = w.PreImageMode()
+	}
+	var gaps uint64
+	if m.gaps != nil {
+		gaps = m.gaps.Gaps()
+	}
+	var sampled SamplingStats
+	if m.sampler != nil {
+		sampled = m.sampler.Stats()
+	}
+	return Stats{
+		ID:              m.id,
+		Processed:       m.stats.processed.Load(),
+		Failed:          m.stats.failed.Load(),
+		Quarantined:     m.stats.quarantined.Load(),
+		Gaps:            gaps,
+		Sampled:         sampled,
+		LastClusterTime: m.stats.lastClusterTime,
+		LastProcessedAt: m.stats.lastProcessedAt,
+		Cursor:          cursor,
+
+		FullDocumentBeforeChange: preImage,
+	}
+}
+
+// Stats returns the processor state and event counters
+func (dp DocumentProcessor) Stats() ProcessorStats {
+	dp.control.mu.Lock()
+	running := dp.control.running
+	dp.control.mu.Unlock()
+
+	stats := ProcessorStats{Stats: dp.manager.Stats(), Running: running, Paused: dp.control.gate.Paused(), Restarts: dp.control.restarts.Load()}
+	if dp.latencyGuard != nil {
+		stats.Degraded = dp.latencyGuard.Degraded()
+	}
+	return stats
+}
@@ -0,0 +1,157 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// StepJournal records which steps of a multi-step handler completed for an event
+type StepJournal interface {
+	// CompletedSteps returns the names of the steps completed for the event
+	CompletedSteps(ctx context.Context, eventID string) ([]string, error)
+	// CompleteStep records a completed step of the event
+	CompleteStep(ctx context.Context, eventID, step string) error
+}
+
+// ErrNoEventID is returned by StepHandler for events without a resume token to journal their steps under
+var ErrNoEventID = errors.New("event has no ID to journal steps under")
+
+// Step is a named side effect of a multi-step handler, names must be unique within the handler
+type Step struct {
+	Name string
+	Run  func(ctx context.Context, ce mongowatch.ChangeStreamEvent) error
+}
+
+// StepHandler runs the steps in order, journaling each completed one. When an event is dispatched again
+// after a failure or crash, steps already completed for it are skipped, so only the failed step and the
+// ones after it repeat their side effects. Journals are kept after all steps completed, the last saved event
+// is dispatched again after a restart; the journal has to expire them, see MongoStepJournal.
+func StepHandler(journal StepJournal, steps ...Step) mongowatch.ChangeEventDispatcherFunc {
+	return func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		if err != nil {
+			return err
+		}
+		eventID := mongowatch.MetaOf(ce).EventID
+		if eventID == "" {
+			return ErrNoEventID
+		}
+		completed, err := journal.CompletedSteps(ctx, eventID)
+		if err != nil {
+			return fmt.Errorf("failed to fetch completed steps: %w", err)
+		}
+		done := make(map[string]bool, len(completed))
+		for _, name := range completed {
+			done[name] = true
+		}
+
+		for _, step := range steps {
+			if done[step.Name] {
+				eventLogf(ctx, "skipping completed step %s of event %s", step.Name, eventID)
+				continue
+			}
+			if err = step.Run(ctx, ce); err != nil {
+				return fmt.Errorf("failed to run step %s: %w", step.Name, err)
+			}
+			if err = journal.CompleteStep(ctx, eventID, step.Name); err != nil {
+				return fmt.Errorf("failed to journal step %s: %w", step.Name, err)
+			}
+		}
+		return nil
+	}
+}
+
+// stepJournalEntry is the stored journal of a single event
+type stepJournalEntry struct {
+	EventID   string    `bson:"_id"`
+	Steps     []string  `bson:"steps"`
+	UpdatedAt time.Time `bson:"updatedAt"`
+}
+
+// MongoStepJournal keeps step journals in a collection, usually next to the resume points in the local DB.
+// Journals expire ttl after their last step, pick a ttl well beyond the time a restart takes.
+type MongoStepJournal struct {
+	col *mongo.Collection
+	ttl time.Duration
+}
+
+var _ StepJournal = (*MongoStepJournal)(nil)
+
+// NewMongoStepJournal creates a journal in col, call EnsureIndexes once to enable expiry
+func NewMongoStepJournal(col *mongo.Collection, ttl time.Duration) *MongoStepJournal {
+	return &MongoStepJournal{col: col, ttl: ttl}
+}
+
+// EnsureIndexes creates the TTL index removing abandoned journals
+func (j *MongoStepJournal) EnsureIndexes(ctx context.Context) error {
+	_, err := j.col.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "updatedAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(j.ttl.Seconds())),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create step journal TTL index: %w", err)
+	}
+	return nil
+}
+
+// CompletedSteps fetches the journal of the event
+func (j *MongoStepJournal) CompletedSteps(ctx context.Context, eventID string) ([]string, error) {
+	var entry stepJournalEntry
+	err := j.col.FindOne(ctx, bson.M{"_id": eventID}).Decode(&entry)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch step journal: %w", err)
+	}
+	return entry.Steps, nil
+}
+
+// CompleteStep adds the step to the journal of the event
+func (j *MongoStepJournal) CompleteStep(ctx context.Context, eventID, step string) error {
+	_, err := j.col.UpdateOne(ctx,
+		bson.M{"_id": eventID},
+		bson.M{
+			"$addToSet": bson.M{"steps": step},
+			"$set":      bson.M{"updatedAt": time.Now()},
+		},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save step journal: %w", err)
+	}
+	return nil
+}
+
+// Forget deletes the journal of the event, e.g. to run its steps again on purpose
+func (j *MongoStepJournal) Forget(ctx context.Context, eventID string) error {
+	_, err := j.col.DeleteOne(ctx, bson.M{"_id": eventID})
+	if err != nil {
+		return fmt.Errorf("failed to delete step journal: %w", err)
+	}
+	return nil
+}
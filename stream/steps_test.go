@@ -0,0 +1,73 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+type memoryStepJournal map[string][]string
+
+func (m memoryStepJournal) CompletedSteps(ctx context.Context, eventID string) ([]string, error) {
+	return m[eventID], nil
+}
+
+func (m memoryStepJournal) CompleteStep(ctx context.Context, eventID, step string) error {
+	m[eventID] = append(m[eventID], step)
+	return nil
+}
+
+func TestStepHandlerResumesAtFailedStep(t *testing.T) {
+	journal := memoryStepJournal{}
+	runs := map[string]int{}
+	failInvoice := true
+	step := func(name string) Step {
+		return Step{Name: name, Run: func(ctx context.Context, ce mongowatch.ChangeStreamEvent) error {
+			runs[name]++
+			if name == "invoice" && failInvoice {
+				return errors.New("billing unavailable")
+			}
+			return nil
+		}}
+	}
+	handler := StepHandler(journal, step("charge"), step("invoice"), step("email"))
+	ce := mongowatch.ChangeStreamEvent{ID: mongowatch.ResumeToken{TokenData: "t1"}}
+
+	err := handler(context.Background(), ce, nil)
+	assert.ErrorContains(t, err, "invoice")
+	assert.Equal(t, []string{"charge"}, journal["t1"])
+
+	// the redelivered event continues at the failed step
+	failInvoice = false
+	assert.NoError(t, handler(context.Background(), ce, nil))
+	assert.Equal(t, map[string]int{"charge": 1, "invoice": 2, "email": 1}, runs)
+
+	// the last saved event is dispatched again after a restart, its steps don't repeat
+	assert.NoError(t, handler(context.Background(), ce, nil))
+	assert.Equal(t, map[string]int{"charge": 1, "invoice": 2, "email": 1}, runs)
+	assert.Equal(t, []string{"charge", "invoice", "email"}, journal["t1"])
+
+	// events without a token would share a journal
+	assert.ErrorIs(t, handler(context.Background(), mongowatch.ChangeStreamEvent{}, nil), ErrNoEventID)
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// ErrTailUnsupported is returned by Manager.Tail when its watcher can't tail
+var ErrTailUnsupported = errors.New("watcher doesn't support tailing")
+
+// Tail streams the events happening from now on to the returned channel, without saving or deleting
+// resume points, for tooling and consumers that don't need to pick up where they left off.
+// Both channels are closed when ctx is done, the stream is invalidated or fails; a failure is sent on the
+// error channel first. Slow readers hold back the stream once buffer events are queued.
+func (csw *ChangeStreamWatcher) Tail(ctx context.Context, buffer int) (<-chan mongowatch.ChangeStreamEvent, <-chan error) {
+	events := make(chan mongowatch.ChangeStreamEvent, buffer)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(events)
+		defer close(errc)
+		if err := csw.tail(ctx, events); err != nil && ctx.Err() == nil {
+			errc <- err
+		}
+	}()
+	return events, errc
+}
+
+func (csw *ChangeStreamWatcher) tail(ctx context.Context, events chan<- mongowatch.ChangeStreamEvent) error {
+	cursor, err := csw.getWatchCursor(ctx, csw.fullDocument, nil)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	for csw.next(ctx, cursor) {
+		ce, err := csw.extractChangeEvent(ctx, cursor.Current)
+		if err != nil {
+			return fmt.Errorf("failed to extract change event: %w", err)
+		}
+		select {
+		case events <- ce:
+		case <-ctx.Done():
+			return nil
+		}
+		// without a resume point there is nothing to restart from
+		if ce.OperationType == mongowatch.OperationTypeInvalidate {
+			return nil
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return fmt.Errorf("failed to tail change stream: %w", err)
+	}
+	return nil
+}
+
+// Tail streams events of the manager's watcher without resume bookkeeping, transforms and handlers,
+// see ChangeStreamWatcher.Tail. It fails with ErrTailUnsupported when the watcher can't tail.
+func (m *Manager) Tail(ctx context.Context, buffer int) (<-chan mongowatch.ChangeStreamEvent, <-chan error) {
+	w, ok := m.watcher.(interface {
+		Tail(ctx context.Context, buffer int) (<-chan mongowatch.ChangeStreamEvent, <-chan error)
+	})
+	if !ok {
+		events := make(chan mongowatch.ChangeStreamEvent)
+		errc := make(chan error, 1)
+		errc <- ErrTailUnsupported
+		close(events)
+		close(errc)
+		return events, errc
+	}
+	return w.Tail(m.withID(ctx), buffer)
+}
@@ -0,0 +1,322 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// tenantStreamPartition is the partition holding the checkpoint of the shared stream
+const tenantStreamPartition = "_stream"
+
+// defaultTenantAttempts is the MaxAttempts of tenants unless configured
+const defaultTenantAttempts = 10
+
+// TenantConfig configures a TenantFanOut
+type TenantConfig struct {
+	// Field is the path of the tenant ID in the full document, or the pre-image of deletes;
+	// events without it belong to the tenant named DefaultTenant
+	Field string
+	// Buffer bounds the queued events per tenant, 1000 by default; events overflowing a full queue are quarantined
+	// right away, so a stuck tenant never holds back the stream
+	Buffer int
+	// MaxAttempts quarantines an event of a tenant after that many failed attempts, 10 by default;
+	// a negative value retries until it succeeds, the queue of the tenant then overflows into the quarantine
+	MaxAttempts int
+	// RetryInterval is the pause between attempts of a failing event, 1s by default
+	RetryInterval time.Duration
+	// Quarantine returns the dead letter queue of a tenant; without it quarantined events are logged and skipped
+	Quarantine func(tenant string) QuarantineSink
+}
+
+// DefaultTenant is the tenant of events without a tenant ID
+const DefaultTenant = "_default"
+
+// TenantFanOut dispatches the events of one stream to a queue per tenant, each processed in order by its own
+// goroutine with its own checkpoint and dead letter queue, so a tenant failing to process its events doesn't stall
+// the others. The shared stream checkpoint only moves past events every tenant has processed, after a restart
+// tenants skip the events older than their own checkpoint.
+//
+// Install Middleware as the innermost middleware of the processor and pass StreamResume WithStreamResume.
+type TenantFanOut struct {
+	resume *PartitionedResume
+	cfg    TenantConfig
+
+	// ctx outlives the stream contexts, workers keep processing queued events while the stream restarts
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	tenants map[string]chan *tenantEvent
+	// pending are the unprocessed events in stream order, the stream checkpoint is the event before the first of them;
+	// processed events leave the list right away, so it is bounded by the tenant queues
+	pending *list.List
+	// last is the last event queued, seq counts them
+	last     mongowatch.ChangeStreamResumePoint
+	seq      uint64
+	advanced uint64
+
+	saveMu sync.Mutex
+	saved  uint64
+}
+
+// tenantEvent is a queued event with the rest of the dispatch chain
+type tenantEvent struct {
+	ce   mongowatch.ChangeStreamEvent
+	next mongowatch.ChangeEventDispatcherFunc
+	seq  uint64
+	// prev is the event queued before this one, the stream checkpoint while this one is the first pending
+	prev mongowatch.ChangeStreamResumePoint
+	elem *list.Element
+}
+
+// NewTenantFanOut creates a fan-out keeping the stream and tenant checkpoints in resume, call Close when done
+func NewTenantFanOut(resume *PartitionedResume, cfg TenantConfig) *TenantFanOut {
+	if cfg.Buffer <= 0 {
+		cfg.Buffer = 1000
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = time.Second
+	}
+	if cfg.MaxAttempts == 0 {
+		cfg.MaxAttempts = defaultTenantAttempts
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &TenantFanOut{
+		resume:  resume,
+		cfg:     cfg,
+		ctx:     ctx,
+		cancel:  cancel,
+		tenants: make(map[string]chan *tenantEvent),
+		pending: list.New(),
+	}
+}
+
+// Middleware queues every event for its tenant, the handlers after it run on the goroutine of the tenant
+func (f *TenantFanOut) Middleware() mongowatch.ChangeEventMiddleware {
+	return func(next mongowatch.ChangeEventDispatcherFunc) mongowatch.ChangeEventDispatcherFunc {
+		return func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+			if err != nil {
+				return err
+			}
+			return f.enqueue(ctx, ce, next)
+		}
+	}
+}
+
+// StreamResume returns the resume repository of the shared stream, it only stores what every tenant processed
+func (f *TenantFanOut) StreamResume() mongowatch.StreamResume {
+	return tenantStreamResume{f.resume.Partition(tenantStreamPartition)}
+}
+
+// Close stops the tenant goroutines, queued events are processed again after the next start
+func (f *TenantFanOut) Close() {
+	f.cancel()
+	f.wg.Wait()
+}
+
+func (f *TenantFanOut) enqueue(ctx context.Context, ce mongowatch.ChangeStreamEvent, next mongowatch.ChangeEventDispatcherFunc) error {
+	tenant := f.tenantOf(ce)
+	if f.ctx.Err() != nil {
+		return fmt.Errorf("failed to queue event for tenant %s: fan-out closed", tenant)
+	}
+
+	f.mu.Lock()
+	queue, ok := f.tenants[tenant]
+	if !ok {
+		queue = make(chan *tenantEvent, f.cfg.Buffer)
+		f.tenants[tenant] = queue
+		f.wg.Add(1)
+		go f.work(tenant, queue)
+	}
+	// only the stream goroutine sends, the queue can't fill up between the check and the send
+	full := len(queue) == cap(queue)
+	f.mu.Unlock()
+
+	if full {
+		logger(ctx).Warnf("queue of tenant %s is full, quarantining event %v", tenant, ce.ID.TokenData)
+		if !f.quarantine(ctx, tenant, ce, fmt.Sprintf("queue of tenant %s full", tenant), nil, 0) {
+			return fmt.Errorf("failed to quarantine event overflowing the queue of tenant %s", tenant)
+		}
+	}
+
+	f.mu.Lock()
+	f.seq++
+	ev := &tenantEvent{ce: ce, next: next, seq: f.seq, prev: f.last}
+	f.last = mongowatch.ChangeStreamResumePoint{ID: ce.ID, Timestamp: ce.Timestamp, OperationType: ce.OperationType}
+	ev.elem = f.pending.PushBack(ev)
+	if !full {
+		queue <- ev
+	}
+	f.mu.Unlock()
+
+	if full {
+		f.complete(ctx, ev)
+		return nil
+	}
+	eventLogf(ctx, "queued event for tenant %s: %s", tenant, ce.ID)
+	return nil
+}
+
+// tenantOf reads the tenant ID of the event
+func (f *TenantFanOut) tenantOf(ce mongowatch.ChangeStreamEvent) string {
+	for _, doc := range []primitive.M{ce.FullDocument, ce.FullDocumentBeforeChange} {
+		if value, ok := mongowatch.LookupField(doc, f.cfg.Field); ok && value != nil {
+			return fmt.Sprint(value)
+		}
+	}
+	return DefaultTenant
+}
+
+// work processes the queue of a tenant in order
+func (f *TenantFanOut) work(tenant string, queue chan *tenantEvent) {
+	defer f.wg.Done()
+	ctx := f.ctx
+	resume := f.resume.Partition(tenant)
+
+	var checkpoint primitive.Timestamp
+	if point, err := resume.GetResumePoint(); err == nil {
+		checkpoint = point.Timestamp
+	}
+
+	for {
+		var ev *tenantEvent
+		select {
+		case <-ctx.Done():
+			return
+		case ev = <-queue:
+		}
+
+		evCtx := mongowatch.ContextWithEvent(ctx, ev.ce)
+		// events the tenant processed before the stream restarted from an older checkpoint
+		if !ev.ce.Timestamp.Before(checkpoint) {
+			if !f.process(evCtx, tenant, ev) {
+				return
+			}
+			point := mongowatch.ChangeStreamResumePoint{ID: ev.ce.ID, Timestamp: ev.ce.Timestamp, OperationType: ev.ce.OperationType}
+			if err := resume.SaveResumePoint(evCtx, point); err != nil {
+				logger(evCtx).Errorf("failed to save checkpoint of tenant %s: %v", tenant, err)
+			}
+			checkpoint = ev.ce.Timestamp
+		}
+		f.complete(evCtx, ev)
+	}
+}
+
+// process runs the event through the rest of the chain until it succeeds or is quarantined,
+// it returns false if the fan-out was closed meanwhile
+func (f *TenantFanOut) process(ctx context.Context, tenant string, ev *tenantEvent) bool {
+	for attempt := 1; ; attempt++ {
+		err := ev.next(ctx, ev.ce, nil)
+		if err == nil {
+			return true
+		}
+		logger(ctx).Errorf("failed to process event of tenant %s, attempt %d: %v", tenant, attempt, err)
+
+		if f.cfg.MaxAttempts > 0 && attempt >= f.cfg.MaxAttempts &&
+			f.quarantine(ctx, tenant, ev.ce, fmt.Sprintf("tenant %s failed %d times", tenant, attempt), err, attempt) {
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(f.cfg.RetryInterval):
+		}
+	}
+}
+
+// quarantine hands the event to the dead letter queue of the tenant, or logs it without one;
+// it returns false if the dead letter queue failed
+func (f *TenantFanOut) quarantine(ctx context.Context, tenant string, ce mongowatch.ChangeStreamEvent, reason string, err error, attempts int) bool {
+	if f.cfg.Quarantine == nil {
+		logger(ctx).Errorf("skipping event %v of tenant %s: %s: %v", ce.ID.TokenData, tenant, reason, err)
+		return true
+	}
+	record := QuarantineRecord{
+		QuarantinedAt: time.Now(),
+		Reason:        reason,
+		Attempts:      attempts,
+		Event:         ce,
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	if qErr := f.cfg.Quarantine(tenant).Quarantine(ctx, record); qErr != nil {
+		logger(ctx).Errorf("failed to quarantine event of tenant %s: %v", tenant, qErr)
+		return false
+	}
+	return true
+}
+
+// complete marks the event processed and moves the stream checkpoint up to the first pending event
+func (f *TenantFanOut) complete(ctx context.Context, ev *tenantEvent) {
+	f.mu.Lock()
+	f.pending.Remove(ev.elem)
+	seq, point := f.seq, f.last
+	if front := f.pending.Front(); front != nil {
+		first := front.Value.(*tenantEvent)
+		seq, point = first.seq-1, first.prev
+	}
+	if seq <= f.advanced {
+		f.mu.Unlock()
+		return
+	}
+	f.advanced = seq
+	f.mu.Unlock()
+
+	f.saveMu.Lock()
+	defer f.saveMu.Unlock()
+	// a later advance was saved meanwhile
+	if seq <= f.saved {
+		return
+	}
+	if err := f.resume.Partition(tenantStreamPartition).SaveResumePoint(ctx, point); err != nil {
+		logger(ctx).Errorf("failed to save stream checkpoint: %v", err)
+		return
+	}
+	f.saved = seq
+}
+
+// tenantStreamResume is the StreamResume of the stream feeding a TenantFanOut,
+// the manager's writes are ignored since the fan-out stores the checkpoint once tenants processed the events
+type tenantStreamResume struct {
+	*PartitionResume
+}
+
+func (r tenantStreamResume) SaveResumePoint(ctx context.Context, ce mongowatch.ChangeStreamResumePoint) error {
+	return nil
+}
+
+func (r tenantStreamResume) DeleteResumePoint(ctx context.Context, token mongowatch.ResumeToken) error {
+	return nil
+}
+
+// ReplaceResumePoints moves the stream checkpoint, e.g. when seeking; tenants still skip events older than their own
+func (r tenantStreamResume) ReplaceResumePoints(ctx context.Context, ce mongowatch.ChangeStreamResumePoint) error {
+	return r.PartitionResume.SaveResumePoint(ctx, ce)
+}
@@ -0,0 +1,200 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mmtracker/mongowatch"
+	"github.com/mmtracker/mongowatch/db"
+)
+
+func Test_TenantFanOut_IsolatesTenants(t *testing.T) {
+	requireMongo(t)
+	col := NewCollection("resume_points_tenants", mongoTestsDB)
+	_ = db.Truncate(col, false)
+
+	var mu sync.Mutex
+	processed := map[string][]uint32{}
+	brokenUntil := make(chan struct{})
+	handler := func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		tenant := ce.FullDocument["tenant"].(string)
+		if tenant == "a" {
+			select {
+			case <-brokenUntil:
+			default:
+				return errors.New("tenant a downstream is down")
+			}
+		}
+		mu.Lock()
+		processed[tenant] = append(processed[tenant], ce.Timestamp.T)
+		mu.Unlock()
+		return nil
+	}
+	count := func(tenant string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(processed[tenant])
+	}
+
+	fanOut := NewTenantFanOut(NewPartitionedResume(col), TenantConfig{Field: "tenant", MaxAttempts: -1, RetryInterval: 10 * time.Millisecond})
+	defer fanOut.Close()
+	dispatch := fanOut.Middleware()(handler)
+
+	ctx := context.Background()
+	event := func(ts uint32, tenant string) mongowatch.ChangeStreamEvent {
+		return mongowatch.ChangeStreamEvent{
+			ID:           mongowatch.ResumeToken{TokenData: ts},
+			Timestamp:    primitive.Timestamp{T: ts},
+			FullDocument: primitive.M{"tenant": tenant},
+		}
+	}
+	assert.NoError(t, dispatch(ctx, event(1, "b"), nil))
+	assert.NoError(t, dispatch(ctx, event(2, "a"), nil))
+	assert.NoError(t, dispatch(ctx, event(3, "b"), nil))
+
+	// tenant b keeps going while a is failing
+	assert.Eventually(t, func() bool { return count("b") == 2 }, time.Second, 5*time.Millisecond)
+	assert.Zero(t, count("a"))
+
+	// the stream checkpoint stays before the pending event of tenant a
+	point, err := fanOut.StreamResume().GetResumePoint()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1), point.Timestamp.T)
+
+	close(brokenUntil)
+	assert.Eventually(t, func() bool { return count("a") == 1 }, time.Second, 5*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		point, err = fanOut.StreamResume().GetResumePoint()
+		return err == nil && point.Timestamp.T == 3
+	}, time.Second, 5*time.Millisecond)
+}
+
+func Test_TenantFanOut_Quarantine(t *testing.T) {
+	requireMongo(t)
+	col := NewCollection("resume_points_tenants_dlq", mongoTestsDB)
+	_ = db.Truncate(col, false)
+
+	var mu sync.Mutex
+	dlq := map[string]*quarantineRecorder{}
+	fanOut := NewTenantFanOut(NewPartitionedResume(col), TenantConfig{
+		Field:         "tenant",
+		MaxAttempts:   2,
+		RetryInterval: time.Millisecond,
+		Quarantine: func(tenant string) QuarantineSink {
+			mu.Lock()
+			defer mu.Unlock()
+			if dlq[tenant] == nil {
+				dlq[tenant] = &quarantineRecorder{}
+			}
+			return dlq[tenant]
+		},
+	})
+	defer fanOut.Close()
+	dispatch := fanOut.Middleware()(func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		return errors.New("poison")
+	})
+
+	ce := mongowatch.ChangeStreamEvent{ID: mongowatch.ResumeToken{TokenData: "x"}, Timestamp: primitive.Timestamp{T: 1}, FullDocument: primitive.M{"tenant": "a"}}
+	assert.NoError(t, dispatch(context.Background(), ce, nil))
+	assert.Eventually(t, func() bool {
+		point, err := fanOut.StreamResume().GetResumePoint()
+		return err == nil && point.Timestamp.T == 1
+	}, time.Second, 5*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, dlq["a"].records, 1)
+	assert.Equal(t, 2, dlq["a"].records[0].Attempts)
+}
+
+// unreachableCollection fails every operation quickly, for tests whose checkpoints don't matter
+func unreachableCollection(t *testing.T, name string) *mongo.Collection {
+	client, err := mongo.Connect(context.Background(), options.Client().
+		ApplyURI("mongodb://127.0.0.1:1").
+		SetServerSelectionTimeout(10*time.Millisecond))
+	require.NoError(t, err)
+	return client.Database("unreachable").Collection(name)
+}
+
+func Test_TenantFanOut_FullQueueDoesNotStallStream(t *testing.T) {
+	stuck := make(chan struct{})
+	var mu sync.Mutex
+	processed := 0
+	dlq := &quarantineRecorder{}
+	fanOut := NewTenantFanOut(NewPartitionedResume(unreachableCollection(t, "tenants")), TenantConfig{
+		Field:       "tenant",
+		Buffer:      2,
+		MaxAttempts: -1,
+		Quarantine:  func(tenant string) QuarantineSink { return dlq },
+	})
+	defer fanOut.Close()
+	// the stuck handler has to return before Close can
+	defer close(stuck)
+	dispatch := fanOut.Middleware()(func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		if ce.FullDocument["tenant"] == "a" {
+			<-stuck
+		}
+		mu.Lock()
+		processed++
+		mu.Unlock()
+		return nil
+	})
+
+	event := func(ts uint32, tenant string) mongowatch.ChangeStreamEvent {
+		return mongowatch.ChangeStreamEvent{ID: mongowatch.ResumeToken{TokenData: ts}, Timestamp: primitive.Timestamp{T: ts}, FullDocument: primitive.M{"tenant": tenant}}
+	}
+	// the stream never blocks on a full queue
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	// a's head is stuck in its handler, the queue holds two more, the rest overflows
+	for ts := uint32(1); ts <= 5; ts++ {
+		require.NoError(t, dispatch(ctx, event(ts, "a"), nil))
+	}
+	for ts := uint32(6); ts <= 1000; ts++ {
+		require.NoError(t, dispatch(ctx, event(ts, "b"), nil))
+	}
+
+	// every event of b is processed or, overflowing its small queue, quarantined
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		dlq.mu.Lock()
+		defer dlq.mu.Unlock()
+		return processed+len(dlq.records)-2 == 995
+	}, 5*time.Second, 5*time.Millisecond)
+	dlq.mu.Lock()
+	assert.Equal(t, "queue of tenant a full", dlq.records[0].Reason)
+	dlq.mu.Unlock()
+	// processed events of b don't pile up behind the stuck head of a
+	assert.Eventually(t, func() bool {
+		fanOut.mu.Lock()
+		defer fanOut.mu.Unlock()
+		return fanOut.pending.Len() <= 3
+	}, time.Second, 5*time.Millisecond)
+}
@@ -18,16 +18,37 @@
 package stream
 
 import (
+	"context"
+	"log"
+	"os"
 	"testing"
 
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-var mongoTestsDB = &mongo.Database{}
+// testURIEnv names the replica set the Mongo-backed tests run against, e.g. the one of docker compose
+const testURIEnv = "MONGOWATCH_TEST_URI"
 
-// If developing locally you should probably run mongo containers using docker compose.
-// This way it will not attempt to start containers each time integrity test is being run.
+var mongoTestsDB *mongo.Database
+
+// If developing locally you should probably run mongo containers using docker compose and point MONGOWATCH_TEST_URI
+// at them. Without it only the tests that don't need a database run.
 func TestMain(m *testing.M) {
-	// TODO: start mongo container or connect to existing DB
-	// test.SetupMongoTestMain(m, "../..", mongoTestsDB)
+	if uri := os.Getenv(testURIEnv); uri != "" {
+		client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
+		if err != nil {
+			log.Fatalf("failed to connect to %s: %v", testURIEnv, err)
+		}
+		mongoTestsDB = client.Database("mongowatch_test")
+	}
+	os.Exit(m.Run())
+}
+
+// requireMongo skips tests that need a database when none is configured
+func requireMongo(t testing.TB) {
+	t.Helper()
+	if mongoTestsDB == nil {
+		t.Skipf("%s not set", testURIEnv)
+	}
 }
@@ -0,0 +1,132 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// TenantThrottleConfig configures per tenant rate budgets
+type TenantThrottleConfig struct {
+	// TenantField is the dotted document path holding the tenant ID, e.g. "accountId"
+	TenantField string
+	// DefaultRate is the events per second budget of tenants without an entry in Rates, zero means unlimited
+	DefaultRate float64
+	// Rates overrides the budget per tenant ID
+	Rates map[string]float64
+	// Burst is the number of events a tenant may dispatch at once before being throttled, defaults to 1
+	Burst int
+}
+
+// TenantThrottle returns a middleware that delays the events of tenants exceeding their rate budget.
+// Events without a tenant field are never throttled.
+// The budget caps how much of the handler capacity a single tenant's bulk import can take,
+// so the downstream stays responsive for everyone else.
+func TenantThrottle(cfg TenantThrottleConfig) mongowatch.ChangeEventMiddleware {
+	if cfg.Burst <= 0 {
+		cfg.Burst = 1
+	}
+	throttle := &tenantThrottle{cfg: cfg, buckets: map[string]*tokenBucket{}}
+
+	return func(next mongowatch.ChangeEventDispatcherFunc) mongowatch.ChangeEventDispatcherFunc {
+		return func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+			tenant, ok := mongowatch.LookupField(eventDocument(ce), cfg.TenantField)
+			if ok {
+				if waitErr := throttle.wait(ctx, fmt.Sprint(tenant)); waitErr != nil {
+					return waitErr
+				}
+			}
+			return next(ctx, ce, err)
+		}
+	}
+}
+
+type tenantThrottle struct {
+	cfg TenantThrottleConfig
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func (t *tenantThrottle) wait(ctx context.Context, tenant string) error {
+	t.mu.Lock()
+	bucket, ok := t.buckets[tenant]
+	if !ok {
+		rate, ok := t.cfg.Rates[tenant]
+		if !ok {
+			rate = t.cfg.DefaultRate
+		}
+		bucket = newTokenBucket(rate, t.cfg.Burst)
+		t.buckets[tenant] = bucket
+	}
+	t.mu.Unlock()
+
+	delay := bucket.reserve(time.Now())
+	if delay <= 0 {
+		return nil
+	}
+
+	logger(ctx).Tracef("throttling tenant %s for %s", tenant, delay)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// tokenBucket is a minimal token bucket rate limiter, a zero rate never limits
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// reserve takes a token and returns how long the caller has to wait before using it
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
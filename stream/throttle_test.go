@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+func Test_TokenBucket_Reserve(t *testing.T) {
+	now := time.Now()
+	bucket := newTokenBucket(10, 2)
+
+	assert.Zero(t, bucket.reserve(now))
+	assert.Zero(t, bucket.reserve(now))
+	assert.Equal(t, 100*time.Millisecond, bucket.reserve(now))
+	// refilled after a second
+	assert.Zero(t, bucket.reserve(now.Add(time.Second)))
+}
+
+func Test_TenantThrottle_OnlyDelaysBusyTenant(t *testing.T) {
+	dispatch := TenantThrottle(TenantThrottleConfig{
+		TenantField: "tenant",
+		Rates:       map[string]float64{"bulk": 1},
+	})(func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		return nil
+	})
+
+	event := func(tenant string) mongowatch.ChangeStreamEvent {
+		return mongowatch.ChangeStreamEvent{FullDocument: primitive.M{"tenant": tenant}}
+	}
+
+	assert.NoError(t, dispatch(context.Background(), event("bulk"), nil))
+	started := time.Now()
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, dispatch(context.Background(), event("other"), nil))
+	}
+	assert.Less(t, time.Since(started), 100*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, dispatch(ctx, event("bulk"), nil), context.DeadlineExceeded)
+}
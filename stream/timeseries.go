@@ -0,0 +1,58 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// NewTimeSeriesWatcher creates a watcher polling the measurements inserted into a time series collection,
+// which has no change stream, on cfg.TimeField (see TimeSeriesInfo); every measurement is dispatched as an insert
+func NewTimeSeriesWatcher(col *mongo.Collection, cfg PollConfig) *PollingWatcher {
+	cfg.InsertOnly = true
+	return NewPollingWatcher(col, cfg)
+}
+
+// TimeSeriesInfo tells whether the collection is a time series collection and returns its time field
+func TimeSeriesInfo(ctx context.Context, db *mongo.Database, name string) (timeField string, ok bool, err error) {
+	specs, err := db.ListCollectionSpecifications(ctx, bson.M{"name": name})
+	if err != nil {
+		return "", false, fmt.Errorf("failed to list collections: %w", err)
+	}
+	if len(specs) == 0 || specs[0].Type != "timeseries" {
+		return "", false, nil
+	}
+	timeField, err = timeSeriesField(specs[0])
+	return timeField, err == nil, err
+}
+
+func timeSeriesField(spec *mongo.CollectionSpecification) (string, error) {
+	var opts struct {
+		TimeSeries struct {
+			TimeField string `bson:"timeField"`
+		} `bson:"timeseries"`
+	}
+	if err := bson.Unmarshal(spec.Options, &opts); err != nil {
+		return "", fmt.Errorf("failed to decode time series options: %w", err)
+	}
+	return opts.TimeSeries.TimeField, nil
+}
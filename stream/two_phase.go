@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// WithTwoPhaseCommit advances the resume point only after the sink confirmed the events before it, for
+// CollectionWatchers implementing mongowatch.CommitWatcher. Events are checkpointed per batch of at most maxEvents
+// (see WithBatchCheckpoint), every checkpoint commits the sink first and stores the returned offset with the
+// resume point (ChangeStreamResumePoint.SinkOffset) for reconciling both systems. When the stream stops before a
+// checkpoint, the sink aborts the staged events and they are replayed on the next start.
+// It needs the change stream watcher, custom watchers set WithWatcher checkpoint on their own terms.
+func WithTwoPhaseCommit(maxEvents int) ProcessorOption {
+	return func(dp *DocumentProcessor) {
+		dp.twoPhase = &twoPhaseCommit{}
+		dp.watcherOpts = append(dp.watcherOpts, WithBatchCheckpoint(maxEvents))
+	}
+}
+
+// twoPhaseCommit commits the sink before saving each resume point
+type twoPhaseCommit struct {
+	mongowatch.StreamResume
+
+	mu   sync.Mutex
+	sink mongowatch.CommitWatcher
+}
+
+// use makes the CollectionWatcher passed to Start the committed sink, watchers without Commit aren't committed
+func (c *twoPhaseCommit) use(actions mongowatch.CollectionWatcher) {
+	sink, _ := actions.(mongowatch.CommitWatcher)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sink = sink
+}
+
+func (c *twoPhaseCommit) current() mongowatch.CommitWatcher {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sink
+}
+
+// SaveResumePoint commits the sink and stores its offset with the point
+func (c *twoPhaseCommit) SaveResumePoint(ctx context.Context, point mongowatch.ChangeStreamResumePoint) error {
+	if sink := c.current(); sink != nil {
+		offset, err := sink.Commit(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to commit sink: %w", err)
+		}
+		point.SinkOffset = offset
+		eventLogf(ctx, "sink committed at offset %s", offset)
+	}
+	return c.StreamResume.SaveResumePoint(ctx, point)
+}
+
+// abort drops the events staged since the last checkpoint, they are replayed on the next start
+func (c *twoPhaseCommit) abort(ctx context.Context) {
+	sink := c.current()
+	if sink == nil {
+		return
+	}
+	if err := sink.Abort(ctx); err != nil {
+		logger(ctx).Errorf("failed to abort staged sink events: %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// stagingSink stages inserted documents until they are committed
+type stagingSink struct {
+	staged    []string
+	committed []string
+	aborts    int
+}
+
+func (s *stagingSink) Insert(ctx context.Context, doc []byte) error {
+	s.staged = append(s.staged, string(doc))
+	return nil
+}
+func (s *stagingSink) Update(ctx context.Context, doc []byte) error { return nil }
+func (s *stagingSink) Delete(ctx context.Context, doc []byte) error { return nil }
+
+func (s *stagingSink) Commit(ctx context.Context) (string, error) {
+	s.committed = append(s.committed, s.staged...)
+	s.staged = nil
+	return fmt.Sprintf("offset-%d", len(s.committed)), nil
+}
+
+func (s *stagingSink) Abort(ctx context.Context) error {
+	s.aborts++
+	s.staged = nil
+	return nil
+}
+
+// batchWatcher dispatches events and checkpoints after every other one, like WithBatchCheckpoint, then fails
+type batchWatcher struct {
+	events []mongowatch.ChangeStreamEvent
+}
+
+func (w *batchWatcher) Start(ctx context.Context, _ options.FullDocument, _ *mongowatch.ChangeStreamResumePoint, saveFunc, _ mongowatch.ChangeEventDispatcherFunc, dispatchFuncs ...mongowatch.ChangeEventDispatcherFunc) error {
+	for i, ce := range w.events {
+		if err := dispatchChain(ctx, ce, dispatchFuncs); err != nil {
+			return err
+		}
+		if i%2 == 1 {
+			if err := saveFunc(ctx, ce, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return errors.New("connection reset")
+}
+
+func Test_DocumentProcessor_TwoPhaseCommit(t *testing.T) {
+	event := func(n int) mongowatch.ChangeStreamEvent {
+		return mongowatch.ChangeStreamEvent{
+			ID:            mongowatch.ResumeToken{TokenData: fmt.Sprint(n)},
+			OperationType: "insert",
+			FullDocument:  primitive.M{"n": n},
+		}
+	}
+	w := &batchWatcher{events: []mongowatch.ChangeStreamEvent{event(1), event(2), event(3)}}
+	dp := &DocumentProcessor{serializer: JSONSerializer{}, control: &processorControl{gate: NewPauseGate()}, watcher: w}
+	WithTwoPhaseCommit(2)(dp)
+	dp.twoPhase.StreamResume = NewMemoryResume(nil)
+	dp.resumeRepo = dp.twoPhase
+	dp.manager = NewManager(dp.resumeRepo, w, GetSaveResumePointFunc(dp.resumeRepo), nil)
+
+	sink := &stagingSink{}
+	assert.Error(t, dp.Start(sink, options.Off))
+
+	assert.Equal(t, []string{`{"n":1}`, `{"n":2}`}, sink.committed)
+	assert.Empty(t, sink.staged, "events after the checkpoint weren't aborted")
+	assert.Equal(t, 1, sink.aborts)
+
+	point, err := dp.resumeRepo.GetResumePoint()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "2", point.ID.TokenData)
+		assert.Equal(t, "offset-2", point.SinkOffset)
+	}
+}
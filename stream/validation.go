@@ -0,0 +1,298 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// Violation describes a single way a document breaks its schema
+type Violation struct {
+	Path    string `bson:"path" json:"path"`
+	Message string `bson:"message" json:"message"`
+}
+
+func (v Violation) String() string {
+	if v.Path == "" {
+		return v.Message
+	}
+	return v.Path + ": " + v.Message
+}
+
+// ValidationError is returned for documents with violations when no quarantine is configured
+type ValidationError struct {
+	Violations []Violation
+}
+
+func (e *ValidationError) Error() string {
+	parts := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		parts[i] = v.String()
+	}
+	return "document failed validation: " + strings.Join(parts, "; ")
+}
+
+// Validator checks documents before they are dispatched
+type Validator interface {
+	Validate(doc primitive.M) []Violation
+}
+
+// ValidatorFunc adapts a function to the Validator interface
+type ValidatorFunc func(doc primitive.M) []Violation
+
+// Validate calls f(doc)
+func (f ValidatorFunc) Validate(doc primitive.M) []Violation {
+	return f(doc)
+}
+
+// Validate returns a middleware running validator against the fullDocument of insert, update and replace events.
+// Invalid events are recorded to quarantine with their violations and skipped,
+// without a quarantine a *ValidationError goes through the standard error handling instead.
+func Validate(validator Validator, quarantine QuarantineSink) mongowatch.ChangeEventMiddleware {
+	return func(next mongowatch.ChangeEventDispatcherFunc) mongowatch.ChangeEventDispatcherFunc {
+		return func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+			if ce.FullDocument == nil {
+				return next(ctx, ce, err)
+			}
+
+			violations := validator.Validate(ce.FullDocument)
+			if len(violations) == 0 {
+				return next(ctx, ce, err)
+			}
+
+			validationErr := &ValidationError{Violations: violations}
+			if quarantine == nil {
+				return validationErr
+			}
+
+			record := QuarantineRecord{
+				QuarantinedAt: time.Now(),
+				Reason:        "invalid",
+				Error:         validationErr.Error(),
+				Attempts:      1,
+				Event:         ce,
+			}
+			if qErr := quarantine.Quarantine(ctx, record); qErr != nil {
+				return fmt.Errorf("%w (quarantine failed: %v)", validationErr, qErr)
+			}
+			logger(ctx).Errorf("quarantined invalid event %v: %v", ce.ID.TokenData, validationErr)
+			return err
+		}
+	}
+}
+
+// Schema is the subset of JSON Schema supported by SchemaValidator:
+// type, required, properties, additionalProperties, items, enum, minimum, maximum, minLength, maxLength and pattern
+type Schema struct {
+	Type                 string             `json:"type,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// SchemaValidator validates documents against a JSON Schema
+type SchemaValidator struct {
+	schema *Schema
+}
+
+var _ Validator = (*SchemaValidator)(nil)
+
+// NewSchemaValidator parses a JSON Schema document
+func NewSchemaValidator(schemaJSON []byte) (*SchemaValidator, error) {
+	var schema Schema
+	if err := json.Unmarshal(schemaJSON, &schema); err != nil {
+		return nil, fmt.Errorf("failed to parse schema: %w", err)
+	}
+	if err := schema.compile(); err != nil {
+		return nil, err
+	}
+	return &SchemaValidator{schema: &schema}, nil
+}
+
+// Validate returns all schema violations of doc
+func (v *SchemaValidator) Validate(doc primitive.M) []Violation {
+	return v.schema.validate("", map[string]interface{}(doc))
+}
+
+func (s *Schema) compile() error {
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid schema pattern %q: %w", s.Pattern, err)
+		}
+		s.pattern = re
+	}
+	for _, prop := range s.Properties {
+		if err := prop.compile(); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.compile()
+	}
+	return nil
+}
+
+func (s *Schema) validate(path string, value interface{}) []Violation {
+	violation := func(format string, args ...interface{}) []Violation {
+		return []Violation{{Path: path, Message: fmt.Sprintf(format, args...)}}
+	}
+
+	if s.Type != "" && !matchesType(s.Type, value) {
+		return violation("expected %s, got %T", s.Type, value)
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		for _, allowed := range s.Enum {
+			if fmt.Sprint(allowed) == fmt.Sprint(value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return violation("value %v is not one of %v", value, s.Enum)
+		}
+	}
+
+	var violations []Violation
+	if n, ok := number(value); ok {
+		if s.Minimum != nil && n < *s.Minimum {
+			violations = append(violations, violation("%v is less than minimum %v", n, *s.Minimum)...)
+		}
+		if s.Maximum != nil && n > *s.Maximum {
+			violations = append(violations, violation("%v is greater than maximum %v", n, *s.Maximum)...)
+		}
+	}
+
+	if str, ok := value.(string); ok {
+		if s.MinLength != nil && len(str) < *s.MinLength {
+			violations = append(violations, violation("length %d is shorter than %d", len(str), *s.MinLength)...)
+		}
+		if s.MaxLength != nil && len(str) > *s.MaxLength {
+			violations = append(violations, violation("length %d is longer than %d", len(str), *s.MaxLength)...)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(str) {
+			violations = append(violations, violation("does not match pattern %s", s.Pattern)...)
+		}
+	}
+
+	if obj, ok := mongowatch.AsDocument(value); ok {
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				violations = append(violations, Violation{Path: joinPath(path, name), Message: "is required"})
+			}
+		}
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		// keep violations in a stable order
+		sort.Strings(names)
+		for _, name := range names {
+			item := obj[name]
+			prop, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					violations = append(violations, Violation{Path: joinPath(path, name), Message: "is not allowed"})
+				}
+				continue
+			}
+			violations = append(violations, prop.validate(joinPath(path, name), item)...)
+		}
+	}
+
+	if arr, ok := value.(primitive.A); ok && s.Items != nil {
+		for i, item := range arr {
+			violations = append(violations, s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item)...)
+		}
+	}
+
+	return violations
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func number(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+func matchesType(typ string, value interface{}) bool {
+	switch typ {
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := number(value)
+		return ok
+	case "integer":
+		switch value.(type) {
+		case int32, int64, int:
+			return true
+		}
+		f, ok := value.(float64)
+		return ok && f == float64(int64(f))
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "object":
+		_, ok := mongowatch.AsDocument(value)
+		return ok
+	case "array":
+		_, ok := value.(primitive.A)
+		return ok
+	case "null":
+		return value == nil
+	}
+	// BSON specific types such as ObjectID or dates are not described by JSON Schema types
+	return true
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+const deviceSchema = `{
+	"type": "object",
+	"required": ["name", "status"],
+	"properties": {
+		"name": {"type": "string", "minLength": 1},
+		"status": {"enum": ["active", "inactive"]},
+		"battery": {"type": "integer", "minimum": 0, "maximum": 100}
+	}
+}`
+
+func Test_SchemaValidator(t *testing.T) {
+	validator, err := NewSchemaValidator([]byte(deviceSchema))
+	assert.NoError(t, err)
+
+	assert.Empty(t, validator.Validate(primitive.M{"name": "tracker", "status": "active", "battery": int32(50)}))
+	assert.Equal(t, []Violation{
+		{Path: "status", Message: "is required"},
+		{Path: "battery", Message: "150 is greater than maximum 100"},
+		{Path: "name", Message: "length 0 is shorter than 1"},
+	}, validator.Validate(primitive.M{"name": "", "battery": int32(150)}))
+}
+
+func Test_Validate_QuarantinesInvalidEvents(t *testing.T) {
+	validator, err := NewSchemaValidator([]byte(deviceSchema))
+	assert.NoError(t, err)
+
+	dispatched := 0
+	next := func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+		dispatched++
+		return nil
+	}
+	invalid := mongowatch.ChangeStreamEvent{OperationType: "insert", FullDocument: primitive.M{"name": "tracker"}}
+
+	quarantine := &quarantineRecorder{}
+	assert.NoError(t, Validate(validator, quarantine)(next)(context.Background(), invalid, nil))
+	assert.Equal(t, 0, dispatched)
+	assert.Len(t, quarantine.records, 1)
+	assert.Equal(t, "invalid", quarantine.records[0].Reason)
+
+	var validationErr *ValidationError
+	err = Validate(validator, nil)(next)(context.Background(), invalid, nil)
+	assert.True(t, errors.As(err, &validationErr))
+	assert.Equal(t, "status", validationErr.Violations[0].Path)
+}
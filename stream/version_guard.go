@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Fields written by the versioned apply helpers
+const (
+	// VersionField holds the version of the event a document was last written by, see mongowatch.VersionOf
+	VersionField = "_version"
+	// TombstoneField marks documents removed by DeleteVersioned
+	TombstoneField = "_deleted"
+)
+
+// versionTimestamp stores versions as BSON timestamps, Mongo compares them natively and they don't overflow int64
+func versionTimestamp(version uint64) primitive.Timestamp {
+	return primitive.Timestamp{T: uint32(version >> 32), I: uint32(version)}
+}
+
+// olderFilter matches the document with the given _id if it was written by version or an older one
+func olderFilter(id interface{}, version uint64) bson.D {
+	return bson.D{
+		{Key: "_id", Value: id},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: VersionField, Value: bson.D{{Key: "$lte", Value: versionTimestamp(version)}}}},
+			bson.D{{Key: VersionField, Value: bson.D{{Key: "$exists", Value: false}}}},
+		}},
+	}
+}
+
+// ReplaceVersioned writes doc as the document with the given _id unless the stored one comes from a newer event.
+// Retried or reordered events then never overwrite newer state; it reports whether doc was written.
+// Equal versions are applied, so several writes of one transaction and redeliveries of an event go through.
+func ReplaceVersioned(ctx context.Context, col *mongo.Collection, id interface{}, doc primitive.M, version uint64) (bool, error) {
+	replacement := make(primitive.M, len(doc)+1)
+	for k, v := range doc {
+		replacement[k] = v
+	}
+	replacement["_id"] = id
+	replacement[VersionField] = versionTimestamp(version)
+	return applyVersioned(ctx, col, id, replacement, version)
+}
+
+// DeleteVersioned replaces the document with the given _id by a tombstone unless the stored one comes from a newer
+// event. The tombstone keeps the version, so a late insert or update of the deleted document is rejected;
+// readers skip documents with TombstoneField set and a TTL index may expire them.
+func DeleteVersioned(ctx context.Context, col *mongo.Collection, id interface{}, version uint64) (bool, error) {
+	tombstone := primitive.M{"_id": id, VersionField: versionTimestamp(version), TombstoneField: true}
+	return applyVersioned(ctx, col, id, tombstone, version)
+}
+
+func applyVersioned(ctx context.Context, col *mongo.Collection, id interface{}, replacement primitive.M, version uint64) (bool, error) {
+	res, err := col.ReplaceOne(ctx, olderFilter(id, version), replacement, options.Replace().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		// the document exists with a newer version, the upsert collided with it
+		eventLogf(ctx, "skipping stale write of %v: version %d", id, version)
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to write versioned document: %w", err)
+	}
+	return res.MatchedCount > 0 || res.UpsertedCount > 0, nil
+}
@@ -0,0 +1,47 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+func Test_VersionTimestamp(t *testing.T) {
+	ts := primitive.Timestamp{T: 1700000000, I: 42}
+	assert.Equal(t, ts, versionTimestamp(mongowatch.VersionOf(ts)))
+	assert.Equal(t, primitive.Timestamp{T: 1<<32 - 1, I: 1}, versionTimestamp(mongowatch.VersionOf(primitive.Timestamp{T: 1<<32 - 1, I: 1})))
+}
+
+func Test_OlderFilter(t *testing.T) {
+	version := mongowatch.VersionOf(primitive.Timestamp{T: 10, I: 2})
+	filter := olderFilter("d1", version)
+
+	assert.Equal(t, bson.D{
+		{Key: "_id", Value: "d1"},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: VersionField, Value: bson.D{{Key: "$lte", Value: primitive.Timestamp{T: 10, I: 2}}}}},
+			bson.D{{Key: VersionField, Value: bson.D{{Key: "$exists", Value: false}}}},
+		}},
+	}, filter)
+}
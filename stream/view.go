@@ -0,0 +1,162 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// maxViewDepth is the server limit of views defined on views
+const maxViewDepth = 20
+
+// ErrNotAView is returned by ResolveView for namespaces that aren't views
+var ErrNotAView = errors.New("not a view")
+
+// View is a view resolved to the collection it reads from
+type View struct {
+	Name string
+	// Source is the collection the view reads from, views on views resolve to the underlying collection
+	Source string
+	// Pipeline is the pipeline of the view, preceded by the pipelines of the views it is defined on
+	Pipeline []bson.D
+}
+
+// ResolveView looks the view up with listCollections and follows it, through views defined on views,
+// down to the collection it reads from
+func ResolveView(ctx context.Context, db *mongo.Database, name string) (View, error) {
+	view := View{Name: name, Source: name}
+	for depth := 0; ; depth++ {
+		specs, err := db.ListCollectionSpecifications(ctx, bson.M{"name": view.Source})
+		if err != nil {
+			return View{}, fmt.Errorf("failed to list collections: %w", err)
+		}
+		if len(specs) == 0 || specs[0].Type != "view" {
+			if depth == 0 {
+				return View{}, fmt.Errorf("%s: %w", name, ErrNotAView)
+			}
+			return view, nil
+		}
+		if depth == maxViewDepth {
+			return View{}, fmt.Errorf("%s is defined on more than %d views", name, maxViewDepth)
+		}
+
+		var opts struct {
+			ViewOn   string   `bson:"viewOn"`
+			Pipeline []bson.D `bson:"pipeline"`
+		}
+		if err := bson.Unmarshal(specs[0].Options, &opts); err != nil {
+			return View{}, fmt.Errorf("failed to decode view options of %s: %w", view.Source, err)
+		}
+		view.Source = opts.ViewOn
+		view.Pipeline = append(opts.Pipeline, view.Pipeline...)
+	}
+}
+
+// WatchView resolves the view and watches the collection it reads from. Register the returned transform,
+// e.g. WithManagerOptions(WithTransform(transform)), to shape the events into those of the view, see ViewTransform.
+// Pass the watcher to a processor with WithWatcher.
+func WatchView(ctx context.Context, db *mongo.Database, name string, opts ...WatcherOption) (*ChangeStreamWatcher, mongowatch.TransformFunc, error) {
+	view, err := ResolveView(ctx, db, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	transform, err := ViewTransform(view.Pipeline)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to apply the pipeline of view %s: %w", name, err)
+	}
+	logger(ctx).Infof("%s is a view, watching %s and applying its %d stages", name, view.Source, len(view.Pipeline))
+	return NewChangeStreamWatcher(db.Collection(view.Source), opts...), transform, nil
+}
+
+// ViewTransform returns a transform applying the view pipeline client-side to the documents of events.
+// Documents entering the view are dispatched as inserts, leaving it as deletes, events of documents outside
+// of it are dropped. Pre-images tell whether an update enters the view, without them updates of matching
+// documents keep their operation type and updates of other documents become deletes.
+// Updates need the full document (updateLookup). Only document-wise stages are supported, see compilePipeline,
+// views using others fail here rather than diverge at runtime.
+func ViewTransform(pipeline []bson.D) (mongowatch.TransformFunc, error) {
+	stages, err := compilePipeline(pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ctx context.Context, ce *mongowatch.ChangeStreamEvent) (bool, error) {
+		var before primitive.M
+		wasIn := false
+		if ce.FullDocumentBeforeChange != nil {
+			before, wasIn = applyStages(stages, ce.FullDocumentBeforeChange)
+		}
+
+		switch ce.OperationType {
+		case "delete":
+			if ce.FullDocumentBeforeChange != nil && !wasIn {
+				return false, nil
+			}
+			ce.FullDocumentBeforeChange = before
+			return true, nil
+		case "insert", "replace", "update":
+		default:
+			return true, nil
+		}
+
+		if ce.FullDocument == nil {
+			return false, fmt.Errorf("%s of %s has no full document to apply the view to", ce.OperationType, ce.DocumentKey)
+		}
+		after, inView := applyStages(stages, ce.FullDocument)
+		known := ce.FullDocumentBeforeChange != nil || ce.OperationType == "insert"
+
+		switch {
+		case inView && known && !wasIn:
+			ce.OperationType = "insert"
+			ce.UpdateDescription.UpdatedFields, ce.UpdateDescription.RemovedFields = nil, nil
+		case inView:
+			ce.UpdateDescription.UpdatedFields = viewUpdatedFields(ce.UpdateDescription.UpdatedFields, after)
+		case known && !wasIn:
+			return false, nil
+		default:
+			eventLogf(ctx, "%s left the view, dispatching %s as delete", ce.DocumentKey, ce.OperationType)
+			ce.OperationType = "delete"
+			ce.UpdateDescription.UpdatedFields, ce.UpdateDescription.RemovedFields = nil, nil
+			after = nil
+		}
+		ce.FullDocument, ce.FullDocumentBeforeChange = after, before
+		return true, nil
+	}, nil
+}
+
+// viewUpdatedFields keeps the updated fields still present in the view document, so projected out fields don't leak
+func viewUpdatedFields(updated map[string]interface{}, doc primitive.M) map[string]interface{} {
+	if updated == nil {
+		return nil
+	}
+	out := make(map[string]interface{}, len(updated))
+	for path, v := range updated {
+		if _, ok := mongowatch.LookupField(doc, path); ok {
+			out[path] = v
+		}
+	}
+	return out
+}
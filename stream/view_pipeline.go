@@ -0,0 +1,457 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// docStage is a pipeline stage applied to a single document, keep is false when the stage filters it out
+type docStage func(doc primitive.M) (out primitive.M, keep bool)
+
+// compilePipeline turns the stages into funcs evaluated client-side. Only the document-wise stages
+// are supported: $match with query operators (no $expr), $project with inclusions or exclusions,
+// $addFields / $set with literals and field references, and $unset. Other stages fail.
+func compilePipeline(pipeline []bson.D) ([]docStage, error) {
+	stages := make([]docStage, 0, len(pipeline))
+	for i, stage := range pipeline {
+		if len(stage) != 1 {
+			return nil, fmt.Errorf("stage %d: expected a single operator, got %d", i, len(stage))
+		}
+		var compiled docStage
+		var err error
+		switch stage[0].Key {
+		case "$match":
+			compiled, err = compileMatchStage(stage[0].Value)
+		case "$project":
+			compiled, err = compileProjectStage(stage[0].Value)
+		case "$addFields", "$set":
+			compiled, err = compileSetStage(stage[0].Value)
+		case "$unset":
+			compiled, err = compileUnsetStage(stage[0].Value)
+		default:
+			err = fmt.Errorf("%s can't be applied to single documents", stage[0].Key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("stage %d: %w", i, err)
+		}
+		stages = append(stages, compiled)
+	}
+	return stages, nil
+}
+
+// applyStages runs the document through the stages, the input document isn't modified
+func applyStages(stages []docStage, doc primitive.M) (primitive.M, bool) {
+	out := doc
+	for _, stage := range stages {
+		var keep bool
+		if out, keep = stage(out); !keep {
+			return nil, false
+		}
+	}
+	return out, true
+}
+
+type matcher func(doc primitive.M) bool
+
+func compileMatchStage(value interface{}) (docStage, error) {
+	filter, ok := value.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("$match expects a document, got %T", value)
+	}
+	match, err := compileFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	return func(doc primitive.M) (primitive.M, bool) {
+		return doc, match(doc)
+	}, nil
+}
+
+func compileFilter(filter bson.D) (matcher, error) {
+	matchers := make([]matcher, 0, len(filter))
+	for _, e := range filter {
+		var m matcher
+		var err error
+		switch e.Key {
+		case "$and", "$or", "$nor":
+			m, err = compileLogical(e.Key, e.Value)
+		default:
+			if strings.HasPrefix(e.Key, "$") {
+				return nil, fmt.Errorf("%s isn't supported in client-side $match", e.Key)
+			}
+			m, err = compileField(e.Key, e.Value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	return func(doc primitive.M) bool {
+		for _, m := range matchers {
+			if !m(doc) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func compileLogical(op string, value interface{}) (matcher, error) {
+	clauses, ok := value.(bson.A)
+	if !ok || len(clauses) == 0 {
+		return nil, fmt.Errorf("%s expects a non-empty array", op)
+	}
+	matchers := make([]matcher, len(clauses))
+	for i, clause := range clauses {
+		filter, ok := clause.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("%s expects documents, got %T", op, clause)
+		}
+		m, err := compileFilter(filter)
+		if err != nil {
+			return nil, err
+		}
+		matchers[i] = m
+	}
+	return func(doc primitive.M) bool {
+		for _, m := range matchers {
+			matched := m(doc)
+			if op == "$and" && !matched {
+				return false
+			}
+			if op != "$and" && matched {
+				return op == "$or"
+			}
+		}
+		return op != "$or"
+	}, nil
+}
+
+func compileField(path string, value interface{}) (matcher, error) {
+	ops, isOps := value.(bson.D)
+	if !isOps || len(ops) == 0 || !strings.HasPrefix(ops[0].Key, "$") {
+		return func(doc primitive.M) bool {
+			v, ok := mongowatch.LookupField(doc, path)
+			return ok && anyValue(v, func(v interface{}) bool { return valuesEqual(v, value) })
+		}, nil
+	}
+
+	matchers := make([]func(v interface{}, exists bool) bool, 0, len(ops))
+	for _, op := range ops {
+		operand := op.Value
+		switch op.Key {
+		case "$eq":
+			matchers = append(matchers, func(v interface{}, exists bool) bool {
+				return exists && anyValue(v, func(v interface{}) bool { return valuesEqual(v, operand) })
+			})
+		case "$ne":
+			matchers = append(matchers, func(v interface{}, exists bool) bool {
+				return !exists || !anyValue(v, func(v interface{}) bool { return valuesEqual(v, operand) })
+			})
+		case "$gt", "$gte", "$lt", "$lte":
+			accept := comparisonAccepts(op.Key)
+			matchers = append(matchers, func(v interface{}, exists bool) bool {
+				return exists && anyValue(v, func(v interface{}) bool {
+					cmp, ok := compareValues(v, operand)
+					return ok && accept(cmp)
+				})
+			})
+		case "$in", "$nin":
+			candidates, ok := operand.(bson.A)
+			if !ok {
+				return nil, fmt.Errorf("%s of %s expects an array", op.Key, path)
+			}
+			in := op.Key == "$in"
+			matchers = append(matchers, func(v interface{}, exists bool) bool {
+				found := exists && anyValue(v, func(v interface{}) bool {
+					for _, c := range candidates {
+						if valuesEqual(v, c) {
+							return true
+						}
+					}
+					return false
+				})
+				return found == in
+			})
+		case "$exists":
+			want, ok := operand.(bool)
+			if !ok {
+				return nil, fmt.Errorf("$exists of %s expects a boolean", path)
+			}
+			matchers = append(matchers, func(_ interface{}, exists bool) bool { return exists == want })
+		default:
+			return nil, fmt.Errorf("%s of %s isn't supported in client-side $match", op.Key, path)
+		}
+	}
+	return func(doc primitive.M) bool {
+		v, exists := mongowatch.LookupField(doc, path)
+		for _, m := range matchers {
+			if !m(v, exists) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func comparisonAccepts(op string) func(cmp int) bool {
+	switch op {
+	case "$gt":
+		return func(cmp int) bool { return cmp > 0 }
+	case "$gte":
+		return func(cmp int) bool { return cmp >= 0 }
+	case "$lt":
+		return func(cmp int) bool { return cmp < 0 }
+	default:
+		return func(cmp int) bool { return cmp <= 0 }
+	}
+}
+
+// anyValue applies fn to the value, or to each of its elements for arrays, the way queries match arrays
+func anyValue(v interface{}, fn func(v interface{}) bool) bool {
+	if fn(v) {
+		return true
+	}
+	if arr, ok := v.(primitive.A); ok {
+		for _, e := range arr {
+			if fn(e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func valuesEqual(a, b interface{}) bool {
+	if cmp, ok := compareValues(a, b); ok {
+		return cmp == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// compareValues orders values of the same BSON type, ok is false for values that aren't comparable,
+// which never match range operators, like the type bracketing of queries
+func compareValues(a, b interface{}) (int, bool) {
+	if x, ok := number(a); ok {
+		if y, ok := number(b); ok {
+			return compareOrdered(x, y), true
+		}
+		return 0, false
+	}
+	switch x := a.(type) {
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	case primitive.DateTime:
+		if y, ok := dateTime(b); ok {
+			return compareOrdered(int64(x), int64(y)), true
+		}
+	case time.Time:
+		if y, ok := dateTime(b); ok {
+			return compareOrdered(int64(primitive.NewDateTimeFromTime(x)), int64(y)), true
+		}
+	case primitive.ObjectID:
+		if y, ok := b.(primitive.ObjectID); ok {
+			return bytes.Compare(x[:], y[:]), true
+		}
+	case bool:
+		if y, ok := b.(bool); ok && x == y {
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+func dateTime(v interface{}) (primitive.DateTime, bool) {
+	switch t := v.(type) {
+	case primitive.DateTime:
+		return t, true
+	case time.Time:
+		return primitive.NewDateTimeFromTime(t), true
+	}
+	return 0, false
+}
+
+func compareOrdered[T int64 | float64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compileProjectStage(value interface{}) (docStage, error) {
+	spec, ok := value.(bson.D)
+	if !ok || len(spec) == 0 {
+		return nil, fmt.Errorf("$project expects a non-empty document")
+	}
+	include, exclude := []string{}, []string{}
+	keepID := true
+	for _, e := range spec {
+		on, ok := projectionFlag(e.Value)
+		if !ok {
+			return nil, fmt.Errorf("$project of %s: only inclusions and exclusions are supported", e.Key)
+		}
+		switch {
+		case e.Key == "_id":
+			keepID = on
+		case on:
+			include = append(include, e.Key)
+		default:
+			exclude = append(exclude, e.Key)
+		}
+	}
+	if len(include) > 0 && len(exclude) > 0 {
+		return nil, fmt.Errorf("$project can't mix inclusions and exclusions")
+	}
+
+	return func(doc primitive.M) (primitive.M, bool) {
+		if len(include) == 0 {
+			out := copyDocument(doc)
+			for _, path := range exclude {
+				unsetField(out, path)
+			}
+			if !keepID {
+				delete(out, "_id")
+			}
+			return out, true
+		}
+		out := primitive.M{}
+		if id, ok := doc["_id"]; ok && keepID {
+			out["_id"] = id
+		}
+		for _, path := range include {
+			if v, ok := mongowatch.LookupField(doc, path); ok {
+				setField(out, path, v)
+			}
+		}
+		return out, true
+	}, nil
+}
+
+func projectionFlag(v interface{}) (bool, bool) {
+	if b, ok := v.(bool); ok {
+		return b, true
+	}
+	if n, ok := number(v); ok {
+		return n != 0, true
+	}
+	return false, false
+}
+
+func compileSetStage(value interface{}) (docStage, error) {
+	spec, ok := value.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("$addFields expects a document, got %T", value)
+	}
+	for _, e := range spec {
+		if expr, ok := e.Value.(bson.D); ok && len(expr) > 0 && strings.HasPrefix(expr[0].Key, "$") {
+			return nil, fmt.Errorf("$addFields of %s: expression %s isn't supported", e.Key, expr[0].Key)
+		}
+	}
+	return func(doc primitive.M) (primitive.M, bool) {
+		out := copyDocument(doc)
+		for _, e := range spec {
+			if ref, ok := e.Value.(string); ok && strings.HasPrefix(ref, "$") {
+				if v, found := mongowatch.LookupField(doc, ref[1:]); found {
+					setField(out, e.Key, v)
+				} else {
+					unsetField(out, e.Key)
+				}
+				continue
+			}
+			setField(out, e.Key, e.Value)
+		}
+		return out, true
+	}, nil
+}
+
+func compileUnsetStage(value interface{}) (docStage, error) {
+	var paths []string
+	switch v := value.(type) {
+	case string:
+		paths = []string{v}
+	case bson.A:
+		for _, p := range v {
+			path, ok := p.(string)
+			if !ok {
+				return nil, fmt.Errorf("$unset expects field names, got %T", p)
+			}
+			paths = append(paths, path)
+		}
+	default:
+		return nil, fmt.Errorf("$unset expects a field name or an array of them, got %T", value)
+	}
+	return func(doc primitive.M) (primitive.M, bool) {
+		out := copyDocument(doc)
+		for _, path := range paths {
+			unsetField(out, path)
+		}
+		return out, true
+	}, nil
+}
+
+// copyDocument copies the documents along the way, so set and unset don't modify shared nested documents
+func copyDocument(doc primitive.M) primitive.M {
+	out := make(primitive.M, len(doc))
+	for k, v := range doc {
+		if nested, ok := mongowatch.AsDocument(v); ok {
+			v = copyDocument(nested)
+		}
+		out[k] = v
+	}
+	return out
+}
+
+func setField(doc primitive.M, path string, value interface{}) {
+	parts := strings.Split(path, ".")
+	for _, key := range parts[:len(parts)-1] {
+		nested, ok := doc[key].(primitive.M)
+		if !ok {
+			nested = primitive.M{}
+			doc[key] = nested
+		}
+		doc = nested
+	}
+	doc[parts[len(parts)-1]] = value
+}
+
+func unsetField(doc primitive.M, path string) {
+	parts := strings.Split(path, ".")
+	for _, key := range parts[:len(parts)-1] {
+		nested, ok := doc[key].(primitive.M)
+		if !ok {
+			return
+		}
+		doc = nested
+	}
+	delete(doc, parts[len(parts)-1])
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+func TestViewTransform(t *testing.T) {
+	transform, err := ViewTransform([]bson.D{
+		{{Key: "$match", Value: bson.D{
+			{Key: "status", Value: "active"},
+			{Key: "$or", Value: bson.A{
+				bson.D{{Key: "plan.seats", Value: bson.D{{Key: "$gte", Value: int32(5)}}}},
+				bson.D{{Key: "tags", Value: "vip"}},
+			}},
+		}}},
+		{{Key: "$project", Value: bson.D{{Key: "status", Value: 1}, {Key: "plan.seats", Value: 1}, {Key: "tags", Value: 1}}}},
+		{{Key: "$set", Value: bson.D{{Key: "seats", Value: "$plan.seats"}, {Key: "view", Value: "active"}}}},
+	})
+	require.NoError(t, err)
+
+	active := primitive.M{"_id": "a", "status": "active", "plan": primitive.M{"seats": int64(10)}, "secret": "x"}
+	vip := primitive.M{"_id": "a", "status": "active", "plan": primitive.M{"seats": 1.0}, "tags": primitive.A{"vip"}}
+	inactive := primitive.M{"_id": "a", "status": "inactive", "plan": primitive.M{"seats": int64(10)}}
+
+	apply := func(ce mongowatch.ChangeStreamEvent) (mongowatch.ChangeStreamEvent, bool) {
+		keep, err := transform(context.Background(), &ce)
+		require.NoError(t, err)
+		return ce, keep
+	}
+
+	ce, keep := apply(mongowatch.ChangeStreamEvent{OperationType: "insert", DocumentKey: "a", FullDocument: active})
+	assert.True(t, keep)
+	assert.Equal(t, primitive.M{"_id": "a", "status": "active", "plan": primitive.M{"seats": int64(10)}, "seats": int64(10), "view": "active"}, ce.FullDocument)
+	assert.Equal(t, "x", active["secret"], "the source document is left untouched")
+
+	_, keep = apply(mongowatch.ChangeStreamEvent{OperationType: "insert", DocumentKey: "a", FullDocument: inactive})
+	assert.False(t, keep)
+
+	// entering the view
+	ce, keep = apply(mongowatch.ChangeStreamEvent{OperationType: "update", DocumentKey: "a", FullDocument: vip, FullDocumentBeforeChange: inactive})
+	assert.True(t, keep)
+	assert.Equal(t, "insert", ce.OperationType)
+
+	// staying in the view, projected out fields don't leak
+	update := mongowatch.ChangeStreamEvent{OperationType: "update", DocumentKey: "a", FullDocument: active, FullDocumentBeforeChange: vip}
+	update.UpdateDescription.UpdatedFields = map[string]interface{}{"plan.seats": int64(10), "secret": "x"}
+	ce, keep = apply(update)
+	assert.True(t, keep)
+	assert.Equal(t, "update", ce.OperationType)
+	assert.Equal(t, map[string]interface{}{"plan.seats": int64(10)}, ce.UpdateDescription.UpdatedFields)
+
+	// leaving the view, with and without a pre-image
+	for _, before := range []primitive.M{active, nil} {
+		ce, keep = apply(mongowatch.ChangeStreamEvent{OperationType: "update", DocumentKey: "a", FullDocument: inactive, FullDocumentBeforeChange: before})
+		assert.True(t, keep)
+		assert.Equal(t, "delete", ce.OperationType)
+		assert.Nil(t, ce.FullDocument)
+	}
+
+	// outside of the view
+	_, keep = apply(mongowatch.ChangeStreamEvent{OperationType: "update", DocumentKey: "a", FullDocument: inactive, FullDocumentBeforeChange: inactive})
+	assert.False(t, keep)
+	_, keep = apply(mongowatch.ChangeStreamEvent{OperationType: "delete", DocumentKey: "a", FullDocumentBeforeChange: inactive})
+	assert.False(t, keep)
+	_, keep = apply(mongowatch.ChangeStreamEvent{OperationType: "delete", DocumentKey: "a"})
+	assert.True(t, keep)
+
+	_, err = transform(context.Background(), &mongowatch.ChangeStreamEvent{OperationType: "update", DocumentKey: "a"})
+	assert.Error(t, err)
+}
+
+func TestViewTransformUnsupportedStages(t *testing.T) {
+	for _, stage := range []bson.D{
+		{{Key: "$group", Value: bson.D{{Key: "_id", Value: "$status"}}}},
+		{{Key: "$match", Value: bson.D{{Key: "$expr", Value: bson.D{{Key: "$gt", Value: bson.A{"$a", "$b"}}}}}}},
+		{{Key: "$project", Value: bson.D{{Key: "total", Value: bson.D{{Key: "$sum", Value: "$items"}}}}}},
+		{{Key: "$project", Value: bson.D{{Key: "a", Value: 1}, {Key: "b", Value: 0}}}},
+	} {
+		_, err := ViewTransform([]bson.D{stage})
+		assert.Error(t, err, stage)
+	}
+}
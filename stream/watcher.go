@@ -21,9 +21,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"strings"
+	"time"
 
-	log "github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -34,20 +33,155 @@ import (
 
 // NewCollection returns a new collection
 func NewCollection(col string, mongoInstance *mongo.Database) *mongo.Collection {
+	journal := false
 	collection := mongoInstance.Collection(col,
-		options.Collection().SetWriteConcern(writeconcern.New(writeconcern.W(1), writeconcern.J(false))),
+		options.Collection().SetWriteConcern(&writeconcern.WriteConcern{W: 1, Journal: &journal}),
 	)
 	return collection
 }
 
 // ChangeStreamWatcher watches a mongo change stream for change events and reacts to those events.
 type ChangeStreamWatcher struct {
-	col *mongo.Collection
+	target watchTarget
+	// namespace describes the target in logs, "db.collection", "db" or "*" for the whole cluster
+	namespace string
+	nsFilter  NamespaceFilter
+	reloader  *FilterReloader
+	redactor  *Redactor
+	// fullDocument is the post-image mode of update events
+	fullDocument options.FullDocument
+	// batchCheckpoint saves one resume point per cursor batch instead of one per event
+	batchCheckpoint bool
+	batchMaxEvents  int
+	maxAwaitTime    time.Duration
+	batchSize       int32
+	getMoreLimit    *tokenBucket
+	eventLog        *eventLog
+	// watchFields limits update events to those touching the fields
+	watchFields []string
+	// operationTypes are passed on top of insert, update, delete and invalidate
+	operationTypes []string
+	// oldValueFields are copied from the pre-image into OldValues, replacing it
+	oldValueFields []string
+	// preImage is the pre-image mode, tracking falling back to options.Off
+	preImage preImageState
+	// stages are custom stages appended to the pipeline, checked once on start
+	stages        mongo.Pipeline
+	stageSamples  []bson.M
+	stagesChecked bool
+
+	stats cursorStats
 }
 
+// WatcherOption configures optional ChangeStreamWatcher behaviour
+type WatcherOption func(*ChangeStreamWatcher)
+
+// WithNamespaceFilter excludes namespaces from the stream with a server side $match on ns
+func WithNamespaceFilter(filter NamespaceFilter) WatcherOption {
+	return func(csw *ChangeStreamWatcher) {
+		csw.nsFilter = filter
+	}
+}
+
+// WithFilterReloader takes the namespace filter from the reloader, replacing WithNamespaceFilter.
+// Reloaded filters are applied between events by reopening the cursor after the last processed event.
+func WithFilterReloader(reloader *FilterReloader) WatcherOption {
+	return func(csw *ChangeStreamWatcher) {
+		csw.reloader = reloader
+	}
+}
+
+// WithRedactor masks sensitive fields of every event before it is logged, saved as a resume point or dispatched
+func WithRedactor(redactor *Redactor) WatcherOption {
+	return func(csw *ChangeStreamWatcher) {
+		csw.redactor = redactor
+	}
+}
+
+// WithFullDocument sets how update events carry the full document, options.UpdateLookup by default.
+// options.Default skips the lookup, leaving only the update description on update events.
+func WithFullDocument(mode options.FullDocument) WatcherOption {
+	return func(csw *ChangeStreamWatcher) {
+		csw.fullDocument = mode
+	}
+}
+
+// WithBatchCheckpoint dispatches every event buffered in the current cursor batch before saving a single
+// resume point for the last of them, instead of saving one before each event. A failure replays the events
+// since the last checkpoint, maxEvents > 0 bounds that window, otherwise it is the cursor batch size.
+func WithBatchCheckpoint(maxEvents int) WatcherOption {
+	return func(csw *ChangeStreamWatcher) {
+		csw.batchCheckpoint = true
+		csw.batchMaxEvents = maxEvents
+	}
+}
+
+// WithMaxAwaitTime sets how long the server waits for new events before answering a getMore with an empty batch,
+// CursorStats.EmptyAwaits shows how often that happens
+func WithMaxAwaitTime(d time.Duration) WatcherOption {
+	return func(csw *ChangeStreamWatcher) {
+		csw.maxAwaitTime = d
+	}
+}
+
+// WithOperationTypes passes events of more operation types, e.g. replace, drop or rename, to the handlers.
+// Collection level streams end with an invalidate event after drop and rename.
+func WithOperationTypes(operationTypes ...string) WatcherOption {
+	return func(csw *ChangeStreamWatcher) {
+		csw.operationTypes = append(csw.operationTypes, operationTypes...)
+	}
+}
+
+// WithBatchSize sets the number of events the server returns per batch
+func WithBatchSize(size int32) WatcherOption {
+	return func(csw *ChangeStreamWatcher) {
+		csw.batchSize = size
+	}
+}
+
+// WithGetMoreRate caps how often the watcher asks the server for the next batch, allowing burst round trips
+// at once, so many consumers of a cluster don't keep it busy with awaitData getMores during busy periods.
+// Combined with WithBatchSize it bounds the events per second the watcher receives.
+func WithGetMoreRate(perSecond float64, burst int) WatcherOption {
+	return func(csw *ChangeStreamWatcher) {
+		if burst <= 0 {
+			burst = 1
+		}
+		csw.getMoreLimit = newTokenBucket(perSecond, burst)
+	}
+}
+
+// watchTarget is what a change stream is opened on: a collection, a database or the whole cluster
+type watchTarget interface {
+	Watch(ctx context.Context, pipeline interface{}, opts ...*options.ChangeStreamOptions) (*mongo.ChangeStream, error)
+}
+
+// ClusterNamespace is the namespace of cluster-level watchers, use it as ResumeTarget.Namespace of their resume points
+const ClusterNamespace = "*"
+
 // NewChangeStreamWatcher builds a new mongo watcher instance
-func NewChangeStreamWatcher(col *mongo.Collection) *ChangeStreamWatcher {
-	return &ChangeStreamWatcher{col: col}
+func NewChangeStreamWatcher(col *mongo.Collection, opts ...WatcherOption) *ChangeStreamWatcher {
+	var namespace string
+	if col != nil {
+		namespace = col.Database().Name() + "." + col.Name()
+	}
+	return newChangeStreamWatcher(col, namespace, opts)
+}
+
+// NewClusterWatcher watches every database of the deployment client is connected to with client.Watch.
+// Narrow the stream down with WithNamespaceFilter, events tell their namespace in Database and Collection.
+// Collections need pre-images enabled for the default options.Required mode, otherwise use WithPreImage.
+func NewClusterWatcher(client *mongo.Client, opts ...WatcherOption) *ChangeStreamWatcher {
+	return newChangeStreamWatcher(client, ClusterNamespace, opts)
+}
+
+func newChangeStreamWatcher(target watchTarget, namespace string, opts []WatcherOption) *ChangeStreamWatcher {
+	csw := &ChangeStreamWatcher{target: target, namespace: namespace, fullDocument: options.UpdateLookup}
+	csw.preImage.configured = options.Required
+	for _, opt := range opts {
+		opt(csw)
+	}
+	return csw
 }
 
 var _ mongowatch.ChangeStreamWatcher = (*ChangeStreamWatcher)(nil)
@@ -67,12 +201,19 @@ func (csw *ChangeStreamWatcher) Start(
 
 func (csw *ChangeStreamWatcher) startWatcher(ctx context.Context, fullDocumentMode options.FullDocument, resumePoint *mongowatch.ChangeStreamResumePoint, saveFunc mongowatch.ChangeEventDispatcherFunc, deleteFunc mongowatch.ChangeEventDispatcherFunc, dispatchFuncs []mongowatch.ChangeEventDispatcherFunc) error {
 	// we start a loop here to be able to restart the watcher on invalidate events
+	csw.preImage.use(fullDocumentMode)
+	if err := csw.checkStages(ctx); err != nil {
+		return err
+	}
+	reload := csw.filterChanged()
 	watchCursor, err := csw.getWatchCursor(ctx, fullDocumentMode, resumePoint)
 	if err != nil {
 		return err
 	}
 	err = csw.watchChangeStream(
 		ctx,
+		fullDocumentMode,
+		reload,
 		resumePoint,
 		saveFunc,
 		deleteFunc,
@@ -81,7 +222,7 @@ func (csw *ChangeStreamWatcher) startWatcher(ctx context.Context, fullDocumentMo
 	)
 	if err != nil {
 		if errors.Is(err, ErrInvalidate) {
-			log.Tracef("received 'invalidate' event, restarting watcher")
+			logger(ctx).Tracef("received 'invalidate' event, restarting watcher")
 			// time.Sleep(10000 * time.Millisecond)
 			// continue
 		}
@@ -93,58 +234,117 @@ func (csw *ChangeStreamWatcher) startWatcher(ctx context.Context, fullDocumentMo
 
 func (csw *ChangeStreamWatcher) getWatchCursor(ctx context.Context, fullDocumentMode options.FullDocument, resumePoint *mongowatch.ChangeStreamResumePoint) (*mongo.ChangeStream, error) {
 	opts := options.ChangeStream()
-	opts.SetFullDocument(options.UpdateLookup)
-	opts.SetFullDocumentBeforeChange(options.Required)
+	opts.SetFullDocument(csw.fullDocument)
+	opts.SetFullDocumentBeforeChange(csw.preImage.mode())
+	if csw.maxAwaitTime > 0 {
+		opts.SetMaxAwaitTime(csw.maxAwaitTime)
+	}
+	if csw.batchSize > 0 {
+		opts.SetBatchSize(csw.batchSize)
+	}
 
 	// when recovering from an invalidate event we need to start from the next event
 	if resumePoint != nil {
-		log.Tracef("starting watcher from resume point for op: %s", resumePoint.OperationType)
+		logger(ctx).Tracef("starting watcher from resume point for op: %s", resumePoint.OperationType)
 		if resumePoint.OperationType == mongowatch.OperationTypeInvalidate {
-			log.Tracef("starting watcher after resume point because of invalidate event: %s", resumePoint.ID)
+			logger(ctx).Tracef("starting watcher after resume point because of invalidate event: %s", resumePoint.ID)
 			opts.SetStartAfter(resumePoint.ID)
+		} else if resumePoint.Timestamp.IsZero() {
+			// points set by seeking to a token carry no timestamp
+			logger(ctx).Tracef("starting watcher after resume token: %v", resumePoint.ID.TokenData)
+			opts.SetResumeAfter(resumePoint.ID)
 		} else {
-			log.Tracef("starting watcher from timestamp: %d in mode: %s", resumePoint.Timestamp, fullDocumentMode)
+			logger(ctx).Tracef("starting watcher from timestamp: %d in mode: %s", resumePoint.Timestamp, fullDocumentMode)
 			opts.SetStartAtOperationTime(&resumePoint.Timestamp)
 		}
 	} else {
-		log.Tracef("starting watcher without timestamp")
+		logger(ctx).Tracef("starting watcher without timestamp")
 	}
 
-	watchCursor, err := csw.col.Watch(ctx, buildPipeline(), opts)
+	watchCursor, err := csw.target.Watch(ctx, csw.pipeline(), opts)
 	if err != nil {
-		if strings.Contains(err.Error(), "NoMatchingDocument") {
-			log.Errorf("NoMatchingDocument, falling back to fullDocumentMode options.Off: %s", err.Error())
+		if isNoMatchingDocument(err) {
+			logger(ctx).Errorf("NoMatchingDocument, falling back to fullDocumentMode options.Off for %v: %s", csw.preImage.retryInterval(), err.Error())
+			csw.preImage.fallback()
 			opts.SetFullDocumentBeforeChange(options.Off)
-			watchCursor, err = csw.col.Watch(ctx, buildPipeline(), opts)
+			watchCursor, err = csw.target.Watch(ctx, csw.pipeline(), opts)
 			if err != nil {
-				return nil, fmt.Errorf("failed to watch collection: %w", err)
+				return nil, fmt.Errorf("failed to watch %s: %w", csw.namespace, err)
 			}
 		} else {
-			return nil, fmt.Errorf("failed to watch collection: %w", err)
+			return nil, fmt.Errorf("failed to watch %s: %w", csw.namespace, err)
 		}
 	}
 
-	log.Tracef("getWatchCursor: watch cursor: %+v", watchCursor.ResumeToken())
+	logger(ctx).Tracef("getWatchCursor: watch cursor: %+v", watchCursor.ResumeToken())
 
 	return watchCursor, nil
 }
 
 var ErrInvalidate = fmt.Errorf("received 'invalidate' event")
 
-func (csw *ChangeStreamWatcher) watchChangeStream(ctx context.Context, resumeToken *mongowatch.ChangeStreamResumePoint, saveFunc mongowatch.ChangeEventDispatcherFunc, deleteFunc mongowatch.ChangeEventDispatcherFunc, watchCursor *mongo.ChangeStream, dispatchFuncs []mongowatch.ChangeEventDispatcherFunc) error {
-	defer watchCursor.Close(ctx)
+func (csw *ChangeStreamWatcher) watchChangeStream(ctx context.Context, fullDocumentMode options.FullDocument, reload <-chan struct{}, resumeToken *mongowatch.ChangeStreamResumePoint, saveFunc mongowatch.ChangeEventDispatcherFunc, deleteFunc mongowatch.ChangeEventDispatcherFunc, watchCursor *mongo.ChangeStream, dispatchFuncs []mongowatch.ChangeEventDispatcherFunc) (err error) {
+	// the cursor is replaced when the namespace filter is reloaded
+	defer func() {
+		if watchCursor != nil {
+			watchCursor.Close(ctx)
+		}
+	}()
 
-	log.Trace("mongo stream watcher launched, waiting for change events...")
+	logger(ctx).Trace("mongo stream watcher launched, waiting for change events...")
 
 	var previousEvent *mongowatch.ChangeStreamEvent
-	// wait for the next change stream data to become available
-	for watchCursor.Next(ctx) {
-		// log.Tracef("received change event: %+v", watchCursor.Current)
-		changeEvent, err := csw.extractChangeEvent(watchCursor.Current)
+	// a point set by seeking isn't replaced by the checkpoints, it is deleted once the first one is saved
+	var seekPoint *mongowatch.ChangeStreamResumePoint
+	if resumeToken != nil && resumeToken.IsSeek() {
+		seekPoint = resumeToken
+	}
+	// started is set once the first event was received, uncommitted counts events dispatched since the last checkpoint
+	var started bool
+	var uncommitted int
+	// only waiting for the next event is interrupted by a filter reload,
+	// by then the previous event is saved and processed
+	cursorCtx, stopCursor := csw.cursorContext(ctx, reload)
+	defer func() { stopCursor() }()
+	// the trace of the event in flight is flushed once the next one is awaited or the watcher returns
+	var pending *eventTrace
+	defer func() { pending.finish(err) }()
+
+	for {
+		pending.finish(nil)
+		pending = nil
+		if !csw.next(cursorCtx, watchCursor) {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if cursorCtx.Err() == nil {
+				if !isNoMatchingDocument(watchCursor.Err()) {
+					return nil
+				}
+				// an event lacks its pre-image, continue without them until the retry interval passed
+				logger(ctx).Errorf("NoMatchingDocument, falling back to fullDocumentMode options.Off for %v: %v", csw.preImage.retryInterval(), watchCursor.Err())
+				csw.preImage.fallback()
+			}
+			stopCursor()
+			// take the channel before the pipeline so a reload in between isn't missed
+			reload = csw.filterChanged()
+			watchCursor, err = csw.reopenCursor(ctx, fullDocumentMode, watchCursor, previousEvent, resumeToken)
+			if err != nil {
+				return err
+			}
+			cursorCtx, stopCursor = csw.cursorContext(ctx, reload)
+			continue
+		}
+
+		changeEvent, err := csw.extractChangeEvent(ctx, watchCursor.Current)
 		if err != nil {
 			return fmt.Errorf("failed to extract change event: %w", err)
 		}
-		// log.Tracef("extracted change event: %+v", changeEvent)
+		// handlers get the event metadata with the context,
+		// per event log lines go through the event trace, which may sample them
+		evCtx, trace := csw.traceEvent(mongowatch.ContextWithEvent(ctx, changeEvent), changeEvent)
+		pending = trace
+		eventLogf(evCtx, "unmarshalled change event: %+v", changeEvent)
 
 		// attempting to do the following here will fail
 		// if changeEvent.OperationType == mongowatch.OperationTypeInvalidate return ErrInvalidate
@@ -155,24 +355,21 @@ func (csw *ChangeStreamWatcher) watchChangeStream(ctx context.Context, resumeTok
 		// when we resume we already have the last event stored
 		// so all we need to do is process
 		// we will leave the deletion to the next event, so we have a point to resume from
-		if previousEvent == nil && resumeToken != nil {
-			log.Tracef("resuming watcher with no previous event: %+v", changeEvent)
-			for _, dispatchFunc := range dispatchFuncs {
-				// we pass the previous error to the next handler
-				// this way the last handler can do a cleanup
-				err = dispatchFunc(ctx, changeEvent, err)
-			}
+		first := !started
+		started = true
+		if first && resumeToken != nil {
+			eventLogf(evCtx, "resuming watcher with no previous event: %+v", changeEvent)
+			err = dispatchChain(evCtx, changeEvent, dispatchFuncs)
 			if err != nil {
 				return fmt.Errorf("failed to process first event: %w", err)
 			}
-			log.Tracef("resumed watcher from no event: %s", changeEvent.ID)
+			eventLogf(evCtx, "resumed watcher from no event: %s", changeEvent.ID)
 
 			// watchCursor was started with an invalidate event
 			// we need to return the error to restart the watcher
 			if changeEvent.OperationType == mongowatch.OperationTypeInvalidate {
-				log.Tracef("received 'invalidate' event for: %s", changeEvent.Collection)
-				log.Tracef("returning error to restart the watcher and resume the next event from: %s", changeEvent.ID)
-
+				logger(evCtx).Tracef("received 'invalidate' event for: %s", changeEvent.Collection)
+				logger(evCtx).Tracef("returning error to restart the watcher and resume the next event from: %s", changeEvent.ID)
 				return ErrInvalidate
 			}
 
@@ -181,84 +378,225 @@ func (csw *ChangeStreamWatcher) watchChangeStream(ctx context.Context, resumeTok
 			continue
 		}
 
-		// save event
-		err = saveFunc(ctx, changeEvent, nil)
-		if err != nil {
-			return fmt.Errorf("failed to save event: %w", err)
-		}
+		if csw.batchCheckpoint {
+			err = dispatchChain(evCtx, changeEvent, dispatchFuncs)
+			if err != nil {
+				return fmt.Errorf("failed to process event: %w", err)
+			}
+			uncommitted++
 
-		log.Tracef("saved event: %s", changeEvent.ID)
+			invalidate := changeEvent.OperationType == mongowatch.OperationTypeInvalidate
+			batchDone := watchCursor.RemainingBatchLength() == 0 || (csw.batchMaxEvents > 0 && uncommitted >= csw.batchMaxEvents)
+			if !invalidate && !batchDone {
+				continue
+			}
 
-		// the very first run (before we have events stored) will have previousEvent nil
-		if previousEvent != nil {
-			// we saved the current event and keep it for resumption
-			// we delete the previous event since we don't have to return to it
-			err = deleteFunc(ctx, *previousEvent, nil)
+			// the whole batch is processed, its last event becomes the resume point
+			err = checkpoint(evCtx, saveFunc, deleteFunc, changeEvent, previousEvent)
 			if err != nil {
-				return fmt.Errorf("failed to delete event: %w", err)
+				return err
+			}
+			if err = deleteSeekPoint(evCtx, deleteFunc, &seekPoint); err != nil {
+				return err
+			}
+			eventLogf(evCtx, "checkpointed batch of %d events at: %s", uncommitted, changeEvent.ID)
+			uncommitted = 0
+
+			if invalidate {
+				logger(evCtx).Tracef("returning error to restart the watcher and resume the next event from: %s", changeEvent.ID)
+				return ErrInvalidate
 			}
-			log.Tracef("deleted event: %s", previousEvent.ID)
+			previousEvent = &changeEvent
+			continue
+		}
+
+		err = checkpoint(evCtx, saveFunc, deleteFunc, changeEvent, previousEvent)
+		if err != nil {
+			return err
+		}
+		if err = deleteSeekPoint(evCtx, deleteFunc, &seekPoint); err != nil {
+			return err
 		}
 
 		// once the current event is stored and the previous event is deleted
 		// we can continue processing the current event since even if it fails we can resume from here
-		for _, dispatchFunc := range dispatchFuncs {
-			// we pass the previous error to the next handler
-			// this way the last handler can do a cleanup
-			err = dispatchFunc(ctx, changeEvent, err)
-		}
+		// dispatching stops at the first failing func, cleanup belongs in a Manager error aware dispatcher
+		err = dispatchChain(evCtx, changeEvent, dispatchFuncs)
 		if err != nil {
 			return fmt.Errorf("failed to process event: %w", err)
 		}
 
-		log.Tracef("processed event: %s", changeEvent.ID)
+		eventLogf(evCtx, "processed event: %s", changeEvent.ID)
 
 		// 2nd case
 		if changeEvent.OperationType == mongowatch.OperationTypeInvalidate {
-			log.Tracef("received 'invalidate' event for: %s", changeEvent.Collection)
-			log.Tracef("returning error to restart the watcher and resume the next event from: %s", changeEvent.ID)
+			logger(evCtx).Tracef("received 'invalidate' event for: %s", changeEvent.Collection)
+			logger(evCtx).Tracef("returning error to restart the watcher and resume the next event from: %s", changeEvent.ID)
 			return ErrInvalidate
 		}
 
 		previousEvent = &changeEvent
 	}
+}
+
+// checkpoint saves the event as the resume point and deletes the previous one
+func checkpoint(ctx context.Context, saveFunc, deleteFunc mongowatch.ChangeEventDispatcherFunc, changeEvent mongowatch.ChangeStreamEvent, previousEvent *mongowatch.ChangeStreamEvent) error {
+	// save event
+	err := saveFunc(ctx, changeEvent, nil)
+	if err != nil {
+		return fmt.Errorf("failed to save event: %w", err)
+	}
+
+	logger(ctx).Tracef("saved event: %s", changeEvent.ID)
+
+	// the very first run (before we have events stored) will have previousEvent nil
+	if previousEvent != nil {
+		// we saved the current event and keep it for resumption
+		// we delete the previous event since we don't have to return to it
+		err = deleteFunc(ctx, *previousEvent, nil)
+		if err != nil {
+			return fmt.Errorf("failed to delete event: %w", err)
+		}
+		logger(ctx).Tracef("deleted event: %s", previousEvent.ID)
+	}
 
 	return nil
 }
 
+// deleteSeekPoint deletes the point the watcher was seeked to, if any, and clears it
+func deleteSeekPoint(ctx context.Context, deleteFunc mongowatch.ChangeEventDispatcherFunc, seekPoint **mongowatch.ChangeStreamResumePoint) error {
+	if *seekPoint == nil {
+		return nil
+	}
+	err := deleteFunc(ctx, mongowatch.ChangeStreamEvent{ID: (*seekPoint).ID}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete seek point: %w", err)
+	}
+	logger(ctx).Tracef("deleted seek point: %v", (*seekPoint).ID.TokenData)
+	*seekPoint = nil
+	return nil
+}
+
+// filterChanged returns a channel closed on the next filter reload, nil without a reloader
+func (csw *ChangeStreamWatcher) filterChanged() <-chan struct{} {
+	if csw.reloader == nil {
+		return nil
+	}
+	_, changed := csw.reloader.current()
+	return changed
+}
+
+// cursorContext derives the context of a cursor, cancelled on a filter reload or when pre-images should be retried
+func (csw *ChangeStreamWatcher) cursorContext(ctx context.Context, reload <-chan struct{}) (context.Context, context.CancelFunc) {
+	cursorCtx, cancel := reloadContext(ctx, reload)
+	if retry := csw.preImage.retryTimer(); retry != nil {
+		go func() {
+			select {
+			case <-retry:
+				cancel()
+			case <-cursorCtx.Done():
+			}
+		}()
+	}
+	return cursorCtx, cancel
+}
+
+// reloadContext derives a context cancelled once reload is closed
+func reloadContext(ctx context.Context, reload <-chan struct{}) (context.Context, context.CancelFunc) {
+	cursorCtx, cancel := context.WithCancel(ctx)
+	if reload != nil {
+		go func() {
+			select {
+			case <-reload:
+				cancel()
+			case <-cursorCtx.Done():
+			}
+		}()
+	}
+	return cursorCtx, cancel
+}
+
+// reopenCursor replaces the cursor with one built from the current pipeline,
+// resuming after the last event the old cursor returned
+func (csw *ChangeStreamWatcher) reopenCursor(ctx context.Context, fullDocumentMode options.FullDocument, watchCursor *mongo.ChangeStream, previousEvent *mongowatch.ChangeStreamEvent, resumePoint *mongowatch.ChangeStreamResumePoint) (*mongo.ChangeStream, error) {
+	rp := resumePoint
+	if raw := watchCursor.ResumeToken(); raw != nil {
+		var token mongowatch.ResumeToken
+		if err := bson.Unmarshal(raw, &token); err != nil {
+			return nil, fmt.Errorf("failed to decode cursor resume token: %w", err)
+		}
+		rp = &mongowatch.ChangeStreamResumePoint{ID: token}
+	} else if previousEvent != nil {
+		rp = &mongowatch.ChangeStreamResumePoint{ID: previousEvent.ID}
+	}
+	_ = watchCursor.Close(ctx)
+
+	logger(ctx).Tracef("namespace filter or pre-image mode changed, reopening watch cursor")
+	return csw.getWatchCursor(ctx, fullDocumentMode, rp)
+}
+
 // extractChangeEvent transforms the raw data received from the MongoDB change stream to the ChangeStreamEvent type.
-func (csw *ChangeStreamWatcher) extractChangeEvent(rawChange bson.Raw) (mongowatch.ChangeStreamEvent, error) {
+func (csw *ChangeStreamWatcher) extractChangeEvent(ctx context.Context, rawChange bson.Raw) (mongowatch.ChangeStreamEvent, error) {
 	// log.Tracef("received change event: %s", rawChange)
 	var ce mongowatch.ChangeStreamEvent
 	err := bson.Unmarshal(rawChange, &ce)
 	if err != nil {
 		return ce, fmt.Errorf("failed to unmarshal change event: %w", err)
 	}
-	log.Tracef("unmarshalled change event: %+v", ce)
+	if csw.redactor != nil {
+		csw.redactor.Redact(&ce)
+	}
+	ce.HasPreImage = ce.FullDocumentBeforeChange != nil
+	if len(csw.oldValueFields) > 0 {
+		captureOldValues(&ce, csw.oldValueFields)
+	}
 
 	return ce, nil
 }
 
+// pipeline builds the change stream pipeline including the configured namespace and field filters and custom stages
+func (csw *ChangeStreamWatcher) pipeline() mongo.Pipeline {
+	filter := csw.nsFilter
+	if csw.reloader != nil {
+		filter = csw.reloader.Filter()
+	}
+	var pipeline mongo.Pipeline
+	if !filter.IsEmpty() {
+		pipeline = append(pipeline, filter.Stage())
+	}
+	if len(csw.watchFields) > 0 {
+		pipeline = append(pipeline, fieldChangeStage(csw.watchFields))
+	}
+	pipeline = append(pipeline, buildPipeline(csw.operationTypes...)...)
+	return append(pipeline, csw.stages...)
+}
+
 // buildPipeline builds a MongoDB aggregation pipeline to reshape the change stream data received from MongoDB in
 // the format of our change events. See mongowatch.ChangeStreamEvent.
-func buildPipeline() mongo.Pipeline {
+// Operation types other than insert, update, delete and invalidate are only passed when listed in extraOps.
+func buildPipeline(extraOps ...string) mongo.Pipeline {
+	operationTypes := bson.A{
+		// TODO: as far as I can tell these are ignored for some reason
+		bson.D{{Key: "operationType", Value: "insert"}},
+		bson.D{{Key: "operationType", Value: "update"}},
+		bson.D{{Key: "operationType", Value: "delete"}},
+		// invalidate is received when the watched collection is dropped or renamed
+		// https://www.mongodb.com/docs/manual/reference/change-events/#invalidate-event
+		// we should probably restart the watcher on it
+		bson.D{{Key: "operationType", Value: "invalidate"}},
+	}
+	for _, op := range extraOps {
+		operationTypes = append(operationTypes, bson.D{{Key: "operationType", Value: op}})
+	}
+
 	pipeline := mongo.Pipeline{
 		bson.D{
 			{
 				Key: "$match",
 				Value: bson.D{
 					{
-						Key: "$or",
-						Value: bson.A{
-							// TODO: as far as I can tell these are ignored for some reason
-							bson.D{{Key: "operationType", Value: "insert"}},
-							bson.D{{Key: "operationType", Value: "update"}},
-							bson.D{{Key: "operationType", Value: "delete"}},
-							// invalidate is received when the watched collection is dropped or renamed
-							// https://www.mongodb.com/docs/manual/reference/change-events/#invalidate-event
-							// we should probably restart the watcher on it
-							bson.D{{Key: "operationType", Value: "invalidate"}},
-						},
+						Key:   "$or",
+						Value: operationTypes,
 					},
 				},
 			},
@@ -284,6 +622,7 @@ func buildPipeline() mongo.Pipeline {
 					{Key: "fullDocument", Value: 1},
 					{Key: "fullDocumentBeforeChange", Value: 1},
 					{Key: "updateDescription", Value: 1},
+					{Key: "to", Value: 1},
 				},
 			},
 		},
@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stream
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mmtracker/mongowatch"
+	"github.com/mmtracker/mongowatch/db"
+)
+
+func Test_NewClusterWatcher(t *testing.T) {
+	filter := NamespaceFilter{Allow: []string{"orders", "billing.invoices"}}
+	csw := NewClusterWatcher(&mongo.Client{}, WithNamespaceFilter(filter))
+
+	assert.Equal(t, ClusterNamespace, csw.namespace)
+	pipeline := csw.pipeline()
+	require.NotEmpty(t, pipeline)
+	assert.Equal(t, filter.Stage(), pipeline[0])
+}
+
+func Test_ClusterWatcher(t *testing.T) {
+	requireMongo(t)
+	client := mongoTestsDB.Client()
+	orders := NewCollection("orders", client.Database("cluster_orders"))
+	audit := NewCollection("entries", client.Database("cluster_audit"))
+	resumeCol := NewCollection("cluster_resume", mongoTestsDB)
+	for _, col := range []*mongo.Collection{orders, audit, resumeCol} {
+		_ = db.Truncate(col, false)
+	}
+
+	repo := NewStreamResumeRepository(resumeCol)
+	repo.SetTarget(ResumeTarget{Namespace: ClusterNamespace})
+	watcher := NewClusterWatcher(client, WithPreImage(options.Off), WithNamespaceFilter(NamespaceFilter{Allow: []string{"cluster_*"}}))
+	m := NewManager(repo, watcher, GetSaveResumePointFunc(repo), GetDeleteResumePointFunc(repo))
+
+	var mu sync.Mutex
+	var namespaces []string
+	done := make(chan error, 1)
+	go func() {
+		done <- m.Watch(context.Background(), options.Off, nil, func(ctx context.Context, ce mongowatch.ChangeStreamEvent, err error) error {
+			mu.Lock()
+			namespaces = append(namespaces, ce.Database+"."+ce.Collection)
+			mu.Unlock()
+			return nil
+		})
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	ctx := context.Background()
+	_, err := orders.InsertOne(ctx, bson.M{"_id": primitive.NewObjectID()})
+	require.NoError(t, err)
+	_, err = audit.InsertOne(ctx, bson.M{"_id": primitive.NewObjectID()})
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(namespaces) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	m.Stop()
+	<-done
+
+	assert.ElementsMatch(t, []string{"cluster_orders.orders", "cluster_audit.entries"}, namespaces)
+	point, err := repo.GetResumePoint()
+	require.NoError(t, err)
+	assert.Equal(t, ClusterNamespace, point.Namespace)
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mongowatch
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TypedCallbacks are CollectionWatcher callbacks taking the decoded document, nil callbacks skip their operation
+type TypedCallbacks[T any] struct {
+	Insert func(ctx context.Context, doc T) error
+	Update func(ctx context.Context, doc T) error
+	Delete func(ctx context.Context, doc T) error
+}
+
+// TypedCollectionWatcher adapts typed callbacks to CollectionWatcher, decoding documents into T with the BSON codec:
+// fields map by their bson tags, so `bson:"_id"` takes the document key without wrapper structs, and BSON types
+// such as ObjectID and dates decode into their Go types. As a DocumentWatcher it gets the documents of the processor
+// directly; with envelopes the payload must be raw BSON, see stream.BSONSerializer.
+// Deletes without a pre-image decode into the zero T, the key is in EventMetaFromContext.
+type TypedCollectionWatcher[T any] struct {
+	callbacks TypedCallbacks[T]
+}
+
+// NewTypedCollectionWatcher creates a CollectionWatcher calling the typed callbacks
+func NewTypedCollectionWatcher[T any](callbacks TypedCallbacks[T]) *TypedCollectionWatcher[T] {
+	return &TypedCollectionWatcher[T]{callbacks: callbacks}
+}
+
+// Insert decodes the inserted document
+func (w *TypedCollectionWatcher[T]) Insert(ctx context.Context, doc []byte) error {
+	return w.call(ctx, "insert", doc, w.callbacks.Insert)
+}
+
+// Update decodes the updated document
+func (w *TypedCollectionWatcher[T]) Update(ctx context.Context, doc []byte) error {
+	return w.call(ctx, "update", doc, w.callbacks.Update)
+}
+
+// Delete decodes the deleted document
+func (w *TypedCollectionWatcher[T]) Delete(ctx context.Context, doc []byte) error {
+	return w.call(ctx, "delete", doc, w.callbacks.Delete)
+}
+
+// InsertDocument decodes the inserted document
+func (w *TypedCollectionWatcher[T]) InsertDocument(ctx context.Context, doc primitive.M) error {
+	return w.callDocument(ctx, "insert", doc, w.callbacks.Insert)
+}
+
+// UpdateDocument decodes the updated document
+func (w *TypedCollectionWatcher[T]) UpdateDocument(ctx context.Context, doc primitive.M) error {
+	return w.callDocument(ctx, "update", doc, w.callbacks.Update)
+}
+
+// DeleteDocument decodes the deleted document
+func (w *TypedCollectionWatcher[T]) DeleteDocument(ctx context.Context, doc primitive.M) error {
+	return w.callDocument(ctx, "delete", doc, w.callbacks.Delete)
+}
+
+func (w *TypedCollectionWatcher[T]) callDocument(ctx context.Context, op string, doc primitive.M, fn func(context.Context, T) error) error {
+	if fn == nil {
+		return nil
+	}
+	var v T
+	if doc != nil {
+		raw, err := bson.Marshal(doc)
+		if err != nil {
+			return fmt.Errorf("failed to encode %s document: %w", op, err)
+		}
+		if err = bson.Unmarshal(raw, &v); err != nil {
+			return fmt.Errorf("failed to decode %s document: %w", op, err)
+		}
+	}
+	return fn(ctx, v)
+}
+
+func (w *TypedCollectionWatcher[T]) call(ctx context.Context, op string, doc []byte, fn func(context.Context, T) error) error {
+	if fn == nil {
+		return nil
+	}
+	v, err := DecodeBSON[T](doc)
+	if err != nil {
+		return fmt.Errorf("failed to decode %s document: %w", op, err)
+	}
+	return fn(ctx, v)
+}
+
+// DecodeBSON decodes a raw BSON document into T, an empty payload gives the zero T
+func DecodeBSON[T any](doc []byte) (T, error) {
+	var v T
+	if len(doc) == 0 {
+		return v, nil
+	}
+	if err := bson.Unmarshal(doc, &v); err != nil {
+		return v, fmt.Errorf("document is not raw BSON, is the processor using stream.BSONSerializer: %w", err)
+	}
+	return v, nil
+}
+
+var (
+	_ CollectionWatcher = (*TypedCollectionWatcher[struct{}])(nil)
+	_ DocumentWatcher   = (*TypedCollectionWatcher[struct{}])(nil)
+)
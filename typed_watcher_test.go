@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mongowatch
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type typedDevice struct {
+	ID       primitive.ObjectID `bson:"_id"`
+	Name     string             `bson:"name"`
+	SeenAt   time.Time          `bson:"seenAt"`
+	Firmware struct {
+		Version string `bson:"version"`
+	} `bson:"firmware"`
+}
+
+func TestTypedCollectionWatcher(t *testing.T) {
+	ctx := context.Background()
+	id := primitive.NewObjectID()
+	seen := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	doc, err := bson.Marshal(primitive.M{
+		"_id":      id,
+		"name":     "tracker",
+		"seenAt":   primitive.NewDateTimeFromTime(seen),
+		"firmware": primitive.M{"version": "1.2.0"},
+	})
+	require.NoError(t, err)
+
+	var inserted, deleted []typedDevice
+	w := NewTypedCollectionWatcher(TypedCallbacks[typedDevice]{
+		Insert: func(ctx context.Context, d typedDevice) error {
+			inserted = append(inserted, d)
+			return nil
+		},
+		Delete: func(ctx context.Context, d typedDevice) error {
+			deleted = append(deleted, d)
+			return nil
+		},
+	})
+
+	require.NoError(t, w.Insert(ctx, doc))
+	require.Len(t, inserted, 1)
+	assert.Equal(t, id, inserted[0].ID)
+	assert.Equal(t, "tracker", inserted[0].Name)
+	assert.True(t, seen.Equal(inserted[0].SeenAt))
+	assert.Equal(t, "1.2.0", inserted[0].Firmware.Version)
+
+	// no Update callback, updates are skipped
+	assert.NoError(t, w.Update(ctx, doc))
+
+	// deletes without a pre-image serialize an empty document
+	empty, err := bson.Marshal(primitive.M(nil))
+	require.NoError(t, err)
+	require.NoError(t, w.Delete(ctx, empty))
+	assert.Equal(t, []typedDevice{{}}, deleted)
+
+	err = w.Insert(ctx, []byte(`{"name":"tracker"}`))
+	assert.ErrorContains(t, err, "BSONSerializer")
+}
+
+func TestTypedCollectionWatcher_Documents(t *testing.T) {
+	var got []typedDevice
+	record := func(ctx context.Context, d typedDevice) error {
+		got = append(got, d)
+		return nil
+	}
+	w := NewTypedCollectionWatcher(TypedCallbacks[typedDevice]{Update: record, Delete: record})
+
+	id := primitive.NewObjectID()
+	require.NoError(t, w.UpdateDocument(context.Background(), primitive.M{"_id": id, "firmware": primitive.M{"version": "2.0.0"}}))
+	require.NoError(t, w.DeleteDocument(context.Background(), nil))
+	assert.NoError(t, w.InsertDocument(context.Background(), primitive.M{"_id": id}))
+
+	require.Len(t, got, 2)
+	assert.Equal(t, id, got[0].ID)
+	assert.Equal(t, "2.0.0", got[0].Firmware.Version)
+	assert.Equal(t, typedDevice{}, got[1])
+}
@@ -0,0 +1,45 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mongowatch
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// VersionOf packs a cluster time into a number growing with every event of the cluster, so stores that can't
+// compare timestamps (e.g. external versioning in search indexes, conditional SQL writes) can order events.
+// Events of one transaction share their cluster time and therefore their version.
+func VersionOf(ts primitive.Timestamp) uint64 {
+	return uint64(ts.T)<<32 | uint64(ts.I)
+}
+
+// Version returns the version of the event, see VersionOf
+func (ce ChangeStreamEvent) Version() uint64 {
+	return VersionOf(ce.Timestamp)
+}
+
+// VersionFromContext returns the version of the event being dispatched with the context
+func VersionFromContext(ctx context.Context) (uint64, bool) {
+	meta, ok := EventMetaFromContext(ctx)
+	if !ok || meta.ClusterTime.IsZero() {
+		return 0, false
+	}
+	return VersionOf(meta.ClusterTime), true
+}
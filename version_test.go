@@ -0,0 +1,49 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mongowatch
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestVersionOf(t *testing.T) {
+	older := primitive.Timestamp{T: 1700000000, I: 7}
+	sameSecond := primitive.Timestamp{T: 1700000000, I: 8}
+	later := primitive.Timestamp{T: 1700000001, I: 1}
+
+	assert.Less(t, VersionOf(older), VersionOf(sameSecond))
+	assert.Less(t, VersionOf(sameSecond), VersionOf(later))
+	assert.Equal(t, VersionOf(later), ChangeStreamEvent{Timestamp: later}.Version())
+}
+
+func TestVersionFromContext(t *testing.T) {
+	_, ok := VersionFromContext(context.Background())
+	assert.False(t, ok)
+
+	ce := ChangeStreamEvent{Timestamp: primitive.Timestamp{T: 10, I: 2}}
+	v, ok := VersionFromContext(ContextWithEvent(context.Background(), ce))
+	assert.True(t, ok)
+	assert.Equal(t, uint64(10)<<32|2, v)
+
+	_, ok = VersionFromContext(ContextWithEvent(context.Background(), ChangeStreamEvent{}))
+	assert.False(t, ok, "events without a cluster time have no version")
+}
@@ -0,0 +1,228 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package wasm runs sandboxed WebAssembly transform plugins, so operators can change event filtering and
+// mapping by swapping a .wasm file instead of recompiling the consumer.
+//
+// A plugin module exports its memory and two functions, and optionally a third:
+//
+//	alloc(size i32) i32                 returns a buffer the host writes the event into
+//	transform(ptr i32, size i32) i64    inspects the event and returns the decision
+//	reset()                             frees everything alloc and transform handed out
+//
+// reset is called once the host read the result of a transform. Without it the module instance is dropped after
+// every call and the next one runs on a fresh instance, so memory never grows across events either way.
+//
+// The event is passed as relaxed extended JSON of mongowatch.ChangeStreamEvent. transform returns
+// Keep (-1) to dispatch the event unchanged, Drop (0) to skip it, or ptr<<32|size of an extended JSON
+// document in its memory which replaces the event. Plugins get no filesystem, network or environment
+// access; WASI is provided for toolchains that need it.
+package wasm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// transform results with a special meaning
+const (
+	Keep int64 = -1
+	Drop int64 = 0
+)
+
+// Config limits the resources of a plugin
+type Config struct {
+	// Timeout bounds a single transform call, 100ms by default
+	Timeout time.Duration
+	// MemoryLimitPages caps the plugin memory in 64KiB pages, 256 (16MiB) by default
+	MemoryLimitPages uint32
+}
+
+// Plugin is a loaded transform plugin, calls are serialized since a module instance isn't concurrency safe
+type Plugin struct {
+	name     string
+	cfg      Config
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+
+	mu  sync.Mutex
+	mod api.Module
+}
+
+// LoadFile loads the plugin at path
+func LoadFile(ctx context.Context, path string, cfg Config) (*Plugin, error) {
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read plugin: %w", err)
+	}
+	return Load(ctx, path, code, cfg)
+}
+
+// Load compiles the plugin code, name is used in logs and errors
+func Load(ctx context.Context, name string, code []byte, cfg Config) (*Plugin, error) {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 100 * time.Millisecond
+	}
+	if cfg.MemoryLimitPages == 0 {
+		cfg.MemoryLimitPages = 256
+	}
+
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithCloseOnContextDone(true).
+		WithMemoryLimitPages(cfg.MemoryLimitPages))
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, runtime); err != nil {
+		_ = runtime.Close(ctx)
+		return nil, fmt.Errorf("failed to instantiate WASI: %w", err)
+	}
+
+	compiled, err := runtime.CompileModule(ctx, code)
+	if err != nil {
+		_ = runtime.Close(ctx)
+		return nil, fmt.Errorf("failed to compile plugin %s: %w", name, err)
+	}
+	if _, ok := compiled.ExportedMemories()["memory"]; !ok {
+		_ = runtime.Close(ctx)
+		return nil, fmt.Errorf("plugin %s does not export memory", name)
+	}
+	for _, export := range []string{"alloc", "transform"} {
+		if _, ok := compiled.ExportedFunctions()[export]; !ok {
+			_ = runtime.Close(ctx)
+			return nil, fmt.Errorf("plugin %s does not export %s", name, export)
+		}
+	}
+
+	p := &Plugin{name: name, cfg: cfg, runtime: runtime, compiled: compiled}
+	if _, err = p.instance(ctx); err != nil {
+		_ = runtime.Close(ctx)
+		return nil, err
+	}
+	return p, nil
+}
+
+// Close releases the plugin runtime
+func (p *Plugin) Close(ctx context.Context) error {
+	return p.runtime.Close(ctx)
+}
+
+// instance returns the module instance, replacing one closed by a timed out call
+func (p *Plugin) instance(ctx context.Context) (api.Module, error) {
+	if p.mod != nil && !p.mod.IsClosed() {
+		return p.mod, nil
+	}
+	// reactor modules initialize in _initialize, a missing start function is skipped
+	mod, err := p.runtime.InstantiateModule(ctx, p.compiled, wazero.NewModuleConfig().
+		WithName("").
+		WithStartFunctions("_initialize"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to instantiate plugin %s: %w", p.name, err)
+	}
+	p.mod = mod
+	return mod, nil
+}
+
+// Transform is a mongowatch.TransformFunc running the plugin on the event
+func (p *Plugin) Transform(ctx context.Context, ce *mongowatch.ChangeStreamEvent) (bool, error) {
+	in, err := bson.MarshalExtJSON(ce, false, false)
+	if err != nil {
+		return false, fmt.Errorf("failed to encode event for plugin %s: %w", p.name, err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
+	defer cancel()
+
+	mod, err := p.instance(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer p.release(ctx, mod)
+
+	result, err := p.call(ctx, mod, in)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return false, fmt.Errorf("plugin %s timed out after %s: %w", p.name, p.cfg.Timeout, err)
+		}
+		return false, fmt.Errorf("plugin %s failed: %w", p.name, err)
+	}
+
+	switch result {
+	case Keep:
+		return true, nil
+	case Drop:
+		log.Tracef("event %v dropped by plugin %s", ce.ID.TokenData, p.name)
+		return false, nil
+	}
+
+	ptr, size := uint32(uint64(result)>>32), uint32(result)
+	out, ok := mod.Memory().Read(ptr, size)
+	if !ok {
+		return false, fmt.Errorf("plugin %s returned out of range result %d:%d", p.name, ptr, size)
+	}
+	var replaced mongowatch.ChangeStreamEvent
+	if err = bson.UnmarshalExtJSON(out, false, &replaced); err != nil {
+		return false, fmt.Errorf("failed to decode event returned by plugin %s: %w", p.name, err)
+	}
+	*ce = replaced
+	return true, nil
+}
+
+// release frees the buffers of the last call by calling reset, without it or when it fails the instance is closed
+// and replaced on the next call
+func (p *Plugin) release(ctx context.Context, mod api.Module) {
+	if mod.IsClosed() {
+		return
+	}
+	if reset := mod.ExportedFunction("reset"); reset != nil {
+		_, err := reset.Call(ctx)
+		if err == nil {
+			return
+		}
+		log.Warnf("plugin %s failed to reset, replacing its instance: %v", p.name, err)
+	}
+	_ = mod.Close(ctx)
+}
+
+func (p *Plugin) call(ctx context.Context, mod api.Module, in []byte) (int64, error) {
+	res, err := mod.ExportedFunction("alloc").Call(ctx, uint64(len(in)))
+	if err != nil {
+		return 0, fmt.Errorf("alloc: %w", err)
+	}
+	ptr := uint32(res[0])
+	if !mod.Memory().Write(ptr, in) {
+		return 0, fmt.Errorf("alloc returned out of range buffer %d", ptr)
+	}
+
+	res, err = mod.ExportedFunction("transform").Call(ctx, uint64(ptr), uint64(len(in)))
+	if err != nil {
+		return 0, fmt.Errorf("transform: %w", err)
+	}
+	return int64(res[0]), nil
+}
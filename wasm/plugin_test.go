@@ -0,0 +1,210 @@
+/*
+ * Copyright (c) 2023. Monimoto Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package wasm
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mmtracker/mongowatch"
+)
+
+// testModule assembles a plugin whose transform runs body, data is placed at memory offset 0
+// and alloc always hands out offset 1024
+func testModule(body []byte, data []byte) []byte {
+	section := func(id byte, content ...byte) []byte {
+		return append(append([]byte{id}, uleb(uint64(len(content)))...), content...)
+	}
+	name := func(s string) []byte {
+		return append(uleb(uint64(len(s))), s...)
+	}
+	code := func(instructions ...byte) []byte {
+		fn := append([]byte{0x00}, instructions...)
+		return append(uleb(uint64(len(fn))), fn...)
+	}
+
+	module := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+	// (i32) -> i32 and (i32, i32) -> i64
+	module = append(module, section(1, 0x02, 0x60, 0x01, 0x7f, 0x01, 0x7f, 0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7e)...)
+	module = append(module, section(3, 0x02, 0x00, 0x01)...)
+	module = append(module, section(5, 0x01, 0x00, 0x01)...)
+
+	exports := []byte{0x03}
+	exports = append(append(exports, name("memory")...), 0x02, 0x00)
+	exports = append(append(exports, name("alloc")...), 0x00, 0x00)
+	exports = append(append(exports, name("transform")...), 0x00, 0x01)
+	module = append(module, section(7, exports...)...)
+
+	codes := []byte{0x02}
+	codes = append(codes, code(0x41, 0x80, 0x08, 0x0b)...)
+	codes = append(codes, code(append(body, 0x0b)...)...)
+	module = append(module, section(10, codes...)...)
+
+	if data != nil {
+		segment := []byte{0x01, 0x00, 0x41, 0x00, 0x0b}
+		segment = append(append(segment, uleb(uint64(len(data)))...), data...)
+		module = append(module, section(11, segment...)...)
+	}
+	return module
+}
+
+// bumpModule assembles a plugin keeping every event, its alloc bumps a pointer and never reuses memory,
+// with reset the pointer is rewound to 0
+func bumpModule(withReset bool) []byte {
+	section := func(id byte, content ...byte) []byte {
+		return append(append([]byte{id}, uleb(uint64(len(content)))...), content...)
+	}
+	name := func(s string) []byte {
+		return append(uleb(uint64(len(s))), s...)
+	}
+	code := func(instructions ...byte) []byte {
+		fn := append([]byte{0x00}, append(instructions, 0x0b)...)
+		return append(uleb(uint64(len(fn))), fn...)
+	}
+
+	module := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+	// (i32) -> i32, (i32, i32) -> i64 and () -> ()
+	module = append(module, section(1, 0x03, 0x60, 0x01, 0x7f, 0x01, 0x7f, 0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7e, 0x60, 0x00, 0x00)...)
+	functions := []byte{0x02, 0x00, 0x01}
+	if withReset {
+		functions = []byte{0x03, 0x00, 0x01, 0x02}
+	}
+	module = append(module, section(3, functions...)...)
+	module = append(module, section(5, 0x01, 0x00, 0x01)...)
+	// mutable i32 global holding the next free offset
+	module = append(module, section(6, 0x01, 0x7f, 0x01, 0x41, 0x00, 0x0b)...)
+
+	exports := []byte{functions[0] + 1}
+	exports = append(append(exports, name("memory")...), 0x02, 0x00)
+	exports = append(append(exports, name("alloc")...), 0x00, 0x00)
+	exports = append(append(exports, name("transform")...), 0x00, 0x01)
+	if withReset {
+		exports = append(append(exports, name("reset")...), 0x00, 0x02)
+	}
+	module = append(module, section(7, exports...)...)
+
+	codes := []byte{functions[0]}
+	// return the pointer and advance it by size
+	codes = append(codes, code(0x23, 0x00, 0x23, 0x00, 0x20, 0x00, 0x6a, 0x24, 0x00)...)
+	codes = append(codes, code(returnConst(Keep)...)...)
+	if withReset {
+		codes = append(codes, code(0x41, 0x00, 0x24, 0x00)...)
+	}
+	return append(module, section(10, codes...)...)
+}
+
+func uleb(v uint64) []byte {
+	var out []byte
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 {
+			return append(out, b)
+		}
+		out = append(out, b|0x80)
+	}
+}
+
+// returns i64.const v, v must fit a 2 byte signed LEB128
+func returnConst(v int64) []byte {
+	if v >= -64 && v < 64 {
+		return []byte{0x42, byte(v) & 0x7f}
+	}
+	return []byte{0x42, byte(v&0x7f) | 0x80, byte(v>>7) & 0x7f}
+}
+
+func TestPluginKeepAndDrop(t *testing.T) {
+	ctx := context.Background()
+	ce := mongowatch.ChangeStreamEvent{OperationType: "insert", DocumentKey: "a"}
+
+	keep, err := Load(ctx, "keep", testModule(returnConst(Keep), nil), Config{})
+	require.NoError(t, err)
+	defer keep.Close(ctx)
+	ok, err := keep.Transform(ctx, &ce)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "a", ce.DocumentKey)
+
+	drop, err := Load(ctx, "drop", testModule(returnConst(Drop), nil), Config{})
+	require.NoError(t, err)
+	defer drop.Close(ctx)
+	ok, err = drop.Transform(ctx, &ce)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestPluginReplacesEvent(t *testing.T) {
+	ctx := context.Background()
+	replacement := []byte(`{"operationType":"update","documentKey":"b","fullDocument":{"masked":true}}`)
+	// the replacement lives at offset 0, so the result is just its size
+	plugin, err := Load(ctx, "rewrite", testModule(returnConst(int64(len(replacement))), replacement), Config{})
+	require.NoError(t, err)
+	defer plugin.Close(ctx)
+
+	ce := mongowatch.ChangeStreamEvent{OperationType: "insert", DocumentKey: "a", FullDocument: primitive.M{"secret": "x"}}
+	ok, err := plugin.Transform(ctx, &ce)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "update", ce.OperationType)
+	assert.Equal(t, "b", ce.DocumentKey)
+	assert.Equal(t, primitive.M{"masked": true}, ce.FullDocument)
+}
+
+func TestPluginTimeout(t *testing.T) {
+	ctx := context.Background()
+	// loop forever, then return 0 to satisfy the validator
+	spin := []byte{0x03, 0x40, 0x0c, 0x00, 0x0b, 0x42, 0x00}
+	plugin, err := Load(ctx, "spin", testModule(spin, nil), Config{Timeout: 20 * time.Millisecond})
+	require.NoError(t, err)
+	defer plugin.Close(ctx)
+
+	ce := mongowatch.ChangeStreamEvent{}
+	_, err = plugin.Transform(ctx, &ce)
+	assert.ErrorContains(t, err, "timed out")
+
+	// the closed instance is replaced on the next call
+	_, err = plugin.Transform(ctx, &ce)
+	assert.ErrorContains(t, err, "timed out")
+}
+
+func TestPluginRequiresExports(t *testing.T) {
+	_, err := Load(context.Background(), "empty", []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}, Config{})
+	assert.ErrorContains(t, err, "does not export")
+}
+
+func TestPluginMemoryDoesNotGrow(t *testing.T) {
+	ctx := context.Background()
+	ce := mongowatch.ChangeStreamEvent{OperationType: "insert", DocumentKey: "a", FullDocument: primitive.M{"payload": string(make([]byte, 1024))}}
+
+	for _, withReset := range []bool{true, false} {
+		// a single 64KiB page holds about 60 of these events
+		plugin, err := Load(ctx, "bump", bumpModule(withReset), Config{MemoryLimitPages: 1})
+		require.NoError(t, err)
+		for i := 0; i < 500; i++ {
+			ok, err := plugin.Transform(ctx, &ce)
+			require.NoError(t, err, "event %d, reset exported: %v", i, withReset)
+			assert.True(t, ok)
+		}
+		assert.NoError(t, plugin.Close(ctx))
+	}
+}